@@ -0,0 +1,828 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"a4/common"
+)
+
+// ======= WIRE TYPES =======
+
+// AdminArgs mirrors the Trader's admin credential
+type AdminArgs struct {
+	Token  string
+	Enable bool
+}
+
+// Wire types shared with Traders and Sellers
+type (
+	ShutdownArgs = common.ShutdownArgs
+	Request      = common.Request
+	Leaderboard  = common.Leaderboard
+)
+
+// StatusArgs mirrors the Seller's status request
+type StatusArgs struct {
+	Token string
+}
+
+// TraderState mirrors the fields of the Trader's admin state that a4ctl shows
+type TraderState struct {
+	ID        int
+	IsLeader  bool
+	PeerUp    bool
+	Inventory map[string]int
+	Adopted   map[string]int
+	Handback  map[string]int
+	Processed int
+	Abandoned int
+	Repeated  int
+
+	InFlight    int
+	Overloaded  int
+	Summaries   int
+	Summarized  int
+	Federated   int
+	TimedOut    int
+	Alerts      map[string]int
+	StaleConns  int
+	HistoryLen  int
+	MemoryBytes int
+	MemoryLimit int
+
+	ReadOnlyLocal int
+	Offloaded     int
+	ReplicaReads  int
+
+	FailoverPolicy  string
+	FailoverPending bool
+
+	Term      int64
+	Draining  bool
+	ReplQueue int
+	Forwards  int
+	PollQueue int
+	Streams   int
+
+	Members  int
+	LeaderID int
+
+	PeerAccepted int
+
+	ForwardsWaiting int
+	Working         int
+	WorkWaiting     int
+	Expired         int
+
+	WorkerLimit    int
+	WorkerScalings int
+
+	AcceptQueue  int
+	AsyncWorkers int
+
+	CachePending int
+
+	QueryHits   int
+	QueryMisses int
+	QuerySeq    uint64
+
+	Pool common.PoolStats
+
+	Fairness FairnessReport
+}
+
+// PostStats mirrors the service one post got from a Trader
+type PostStats struct {
+	Post       int
+	Received   int
+	Deposits   int
+	Purchases  int
+	Rate       float64
+	AvgLatency time.Duration
+	MaxLatency time.Duration
+}
+
+// FairnessReport mirrors a Trader's per-post service and fairness index
+type FairnessReport struct {
+	Posts    []PostStats
+	Fairness float64
+}
+
+// SellerStatus mirrors the Seller's status report
+type SellerStatus struct {
+	ID         int
+	Trader     string
+	LeaderTerm int64
+	Stopping   bool
+	Pending    []Request
+	Succeeded  int
+	Failed     int
+	Abandoned  int
+	Delivered  map[string]int
+	Spoiled    map[string]int
+
+	ReadsToLeader  int
+	ReadsOffloaded int
+
+	Connections int
+	Reconnects  int
+
+	LocalOnly     bool
+	LocalWaiting  int
+	LocalRecorded int
+
+	DirectSold    int
+	DirectPending int
+}
+
+// HistoryArgs mirrors the Buyer's spend report query
+type HistoryArgs struct {
+	Token string
+	Item  string
+	Limit int
+}
+
+// Purchase mirrors one purchase of a Buyer's ledger
+type Purchase struct {
+	RequestID int
+	Item      string
+	Quantity  int
+	Post      int
+	Seller    int
+	Outcome   string
+	Price     float64
+	Rule      string
+	Reason    string
+	Attempts  int
+	Latency   time.Duration
+	At        time.Time
+}
+
+// ItemSpend mirrors what a Buyer bought of one item
+type ItemSpend struct {
+	Item      string
+	Purchases int
+	Quantity  int
+	Spent     float64
+}
+
+// PurchaseHistory mirrors the Buyer's spend report
+type PurchaseHistory struct {
+	BuyerID    int
+	Bought     int
+	OutOfStock int
+	Rejected   int
+	Failed     int
+	Spent      float64
+	AvgLatency time.Duration
+	Items      []ItemSpend
+	Purchases  []Purchase
+}
+
+// NodeStatus mirrors one node of a Trader's cluster view
+type NodeStatus struct {
+	Role    string
+	ID      int
+	Address string
+	Post    int
+	Leader  bool
+	Term    int64
+	Domain  string
+	Health  string
+	Self    bool
+}
+
+// LinkStatus mirrors a link of a Trader's cluster view
+type LinkStatus struct {
+	From, To string
+	Kind     string
+	Up       bool
+	Note     string
+}
+
+// ClusterStatus mirrors a Trader's view of the cluster topology
+type ClusterStatus struct {
+	Reporter int
+	Time     time.Time
+	Nodes    []NodeStatus
+	Links    []LinkStatus
+}
+
+// JobArgs mirrors the Trader's request to run a job
+type JobArgs struct {
+	Token string
+	Name  string
+}
+
+// JobStatus mirrors one of a Trader's scheduled jobs
+type JobStatus struct {
+	Name      string
+	Interval  time.Duration
+	Runs      int
+	Failures  int
+	Running   bool
+	LastStart time.Time
+	LastTook  time.Duration
+	AvgTook   time.Duration
+	LastError string
+	NextRun   time.Time
+}
+
+// CompletedRequest mirrors a Trader's record of a completed request
+type CompletedRequest struct {
+	Time      time.Time
+	SellerID  int
+	BuyerID   int
+	RequestID int
+	Post      int
+	Item      string
+	Quantity  int
+	Status    string
+	Price     float64
+	Rule      string
+}
+
+// TransactionQuery mirrors the Trader's history filter
+type TransactionQuery struct {
+	Token    string
+	SellerID int
+	BuyerID  int
+	Item     string
+	Status   string
+	Limit    int
+}
+
+// TransactionList mirrors the Trader's answer to a TransactionQuery
+type TransactionList struct {
+	Records []CompletedRequest
+	Seq     uint64
+	Cached  bool
+}
+
+// PriceQuery mirrors the Trader's price history request
+type PriceQuery struct {
+	Token string
+	Item  string
+	Limit int
+}
+
+// PricePoint mirrors one purchase in a price history
+type PricePoint struct {
+	Time      time.Time
+	BuyerID   int
+	Quantity  int
+	Price     float64
+	UnitPrice float64
+	Rule      string
+}
+
+// PriceHistory mirrors the Trader's price history of an item
+type PriceHistory struct {
+	Item      string
+	ListPrice float64
+	Points    []PricePoint
+	Min       float64
+	Avg       float64
+	Max       float64
+	Seq       uint64
+	Cached    bool
+}
+
+// SettlementsArgs mirrors the federation gateway's settlements request
+type SettlementsArgs struct {
+	Token string
+	Limit int
+}
+
+// Settlement mirrors a purchase the federation gateway forwarded between clusters
+type Settlement struct {
+	Time        time.Time
+	Status      string
+	Origin      string
+	Destination string
+	BuyerID     int
+	RequestID   int
+	Item        string
+	Quantity    int
+	Price       float64
+}
+
+// SettlementsReply mirrors the federation gateway's balances and latest settlements
+type SettlementsReply struct {
+	Balances    map[string]float64
+	Outcomes    map[string]int
+	InDoubt     int
+	Settlements []Settlement
+}
+
+// ======= COMMANDS =======
+
+// Ctl holds the options shared by every command
+type Ctl struct {
+	Token   string
+	JSON    bool
+	Timeout time.Duration
+}
+
+// command is one a4ctl subcommand; args are the arguments after the node address
+type command struct {
+	usage string
+	run   func(c *Ctl, addr string, args []string) error
+}
+
+var commands = map[string]command{
+	"status":   {"status <trader>", (*Ctl).status},
+	"cluster":  {"cluster <trader>", (*Ctl).cluster},
+	"seller":   {"seller <seller>", (*Ctl).seller},
+	"buyer":    {"buyer <buyer> [item=<item>] [limit=<n>]", (*Ctl).buyer},
+	"failover": {"failover <trader>", (*Ctl).failover},
+	"drain":    {"drain <trader> [on|off]", (*Ctl).drain},
+	"shutdown": {"shutdown <trader|seller> [graceful|immediate]", (*Ctl).shutdown},
+	"jobs":     {"jobs <trader>", (*Ctl).jobs},
+	"run-job":  {"run-job <trader> <job>", (*Ctl).runJob},
+
+	"transactions": {"transactions <trader> [seller=<id>] [buyer=<id>] [item=<item>] [status=<status>] [limit=<n>]", (*Ctl).transactions},
+	"prices":       {"prices <trader> <item> [limit=<n>]", (*Ctl).prices},
+	"settlements":  {"settlements <gateway> [limit=<n>]", (*Ctl).settlements},
+	"leaderboard":  {"leaderboard <trader> [top=<n>]", (*Ctl).leaderboard},
+}
+
+// call invokes an RPC on the node at addr, giving up after the timeout
+func (c *Ctl) call(addr, method string, args, reply interface{}) error {
+	return common.Call(addr, method, args, reply, c.Timeout)
+}
+
+// show prints a reply as JSON when -json is set, or with the given printer otherwise
+func (c *Ctl) show(v interface{}, print func()) error {
+	if c.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	print()
+	return nil
+}
+
+// formatStock renders stock as "apples=10 pears=3", or "-" if empty
+func formatStock(stock map[string]int) string {
+	if len(stock) == 0 {
+		return "-"
+	}
+	var parts []string
+	for item, qty := range stock {
+		parts = append(parts, fmt.Sprintf("%s=%d", item, qty))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+// status dumps a Trader's role, term and queue depths
+func (c *Ctl) status(addr string, _ []string) error {
+	var st TraderState
+	if err := c.call(addr, "Trader.State", &AdminArgs{Token: c.Token}, &st); err != nil {
+		return err
+	}
+	return c.show(&st, func() {
+		role := "backup"
+		if st.IsLeader {
+			role = "leader"
+		}
+		fmt.Printf("Trader %d at %s: %s, term %d\n", st.ID, addr, role, st.Term)
+		fmt.Printf("  peer up:      %v\n", st.PeerUp)
+		fmt.Printf("  timeouts:     %d outgoing calls abandoned at their deadline, %d stale peer connections replaced\n",
+			st.TimedOut, st.StaleConns)
+		fmt.Printf("  conn pool:    %d open, %d dialed, %d calls reused a connection, %d closed idle or evicted\n",
+			st.Pool.Open, st.Pool.Dials, st.Pool.Reuses, st.Pool.Evictions)
+		if st.Members > 0 {
+			fmt.Printf("  election:     Bully over %d Traders, leader Trader %d\n", st.Members, st.LeaderID)
+		}
+		fmt.Printf("  failover:     %s (pending approval: %v)\n", st.FailoverPolicy, st.FailoverPending)
+		fmt.Printf("  draining:     %v\n", st.Draining)
+		fmt.Printf("  in flight:    %d requests, %d forwarded to the peer, %d refused as overloaded\n", st.InFlight, st.Forwards, st.Overloaded)
+		if st.Summaries > 0 {
+			fmt.Printf("  summaries:    %d summary deposits netting %d deposits Sellers held back during overload\n", st.Summaries, st.Summarized)
+		}
+		if len(st.Alerts) > 0 {
+			fmt.Printf("  ALERTS:       %s (see the ALERT lines in the Trader's log)\n", formatStock(st.Alerts))
+		}
+		if st.Federated > 0 {
+			fmt.Printf("  federated:    %d purchases filled by other clusters through the gateway\n", st.Federated)
+		}
+		fmt.Printf("  scheduling:   %d processing, %d waiting to process, %d waiting to forward, %d expired\n",
+			st.Working, st.WorkWaiting, st.ForwardsWaiting, st.Expired)
+		fmt.Printf("  workers:      limit %d (0 for unlimited), resized %d times\n", st.WorkerLimit, st.WorkerScalings)
+		fmt.Printf("  queues:       replication %d, poll %d, warehouse cache %d, accepted %d (%d dispatchers)\n",
+			st.ReplQueue, st.PollQueue, st.CachePending, st.AcceptQueue, st.AsyncWorkers)
+		fmt.Printf("  peer log:     %d requests accepted by the peer and not settled\n", st.PeerAccepted)
+		fmt.Printf("  streams:      %d Sellers reading a response stream\n", st.Streams)
+		fmt.Printf("  reads:        %d served locally, %d delegated to the backup, %d split reads from the replica\n",
+			st.ReadOnlyLocal, st.Offloaded, st.ReplicaReads)
+		fmt.Printf("  processed:    %d (abandoned %d, retries answered from the dedup table %d), history %d\n",
+			st.Processed, st.Abandoned, st.Repeated, st.HistoryLen)
+		fmt.Printf("  queries:      %d answered from the cache, %d scanned the history (sequence %d)\n",
+			st.QueryHits, st.QueryMisses, st.QuerySeq)
+		if len(st.Fairness.Posts) > 0 {
+			fmt.Printf("  fairness:     %.3f across %d posts\n", st.Fairness.Fairness, len(st.Fairness.Posts))
+			for _, ps := range st.Fairness.Posts {
+				fmt.Printf("    post %-3d    %d received, %d deposits, %d purchases, %.2f/s, latency avg %v max %v\n",
+					ps.Post, ps.Received, ps.Deposits, ps.Purchases, ps.Rate, ps.AvgLatency.Round(time.Microsecond), ps.MaxLatency.Round(time.Microsecond))
+			}
+		}
+		if st.MemoryLimit > 0 {
+			fmt.Printf("  memory:       %d of %d bytes\n", st.MemoryBytes, st.MemoryLimit)
+		} else {
+			fmt.Printf("  memory:       %d bytes\n", st.MemoryBytes)
+		}
+		fmt.Printf("  inventory:    %s\n", formatStock(st.Inventory))
+		fmt.Printf("  adopted:      %s\n", formatStock(st.Adopted))
+		fmt.Printf("  handback:     %s\n", formatStock(st.Handback))
+	})
+}
+
+// cluster dumps a Trader's view of the nodes and links of the cluster
+func (c *Ctl) cluster(addr string, _ []string) error {
+	var cs ClusterStatus
+	if err := c.call(addr, "Trader.ClusterStatus", &AdminArgs{Token: c.Token}, &cs); err != nil {
+		return err
+	}
+	return c.show(&cs, func() {
+		fmt.Printf("Cluster as seen by Trader %d at %s\n", cs.Reporter, cs.Time.Format(time.RFC3339))
+		fmt.Printf("%-7s %-4s %-22s %-5s %-7s %-5s %s\n", "ROLE", "ID", "ADDRESS", "POST", "LEADER", "TERM", "HEALTH")
+		for _, n := range cs.Nodes {
+			fmt.Printf("%-7s %-4d %-22s %-5d %-7v %-5d %s\n", n.Role, n.ID, n.Address, n.Post, n.Leader, n.Term, n.Health)
+		}
+		for _, l := range cs.Links {
+			state := "up"
+			if !l.Up {
+				state = "down"
+			}
+			fmt.Printf("  %s -> %s (%s): %s %s\n", l.From, l.To, l.Kind, state, l.Note)
+		}
+	})
+}
+
+// seller dumps a Seller's Trader and pending requests
+func (c *Ctl) seller(addr string, _ []string) error {
+	var st SellerStatus
+	if err := c.call(addr, "Seller.Status", &StatusArgs{Token: c.Token}, &st); err != nil {
+		return err
+	}
+	return c.show(&st, func() {
+		fmt.Printf("Seller %d at %s: Trader %s, term %d\n", st.ID, addr, st.Trader, st.LeaderTerm)
+		fmt.Printf("  stopping:     %v\n", st.Stopping)
+		fmt.Printf("  requests:     %d succeeded, %d failed, %d abandoned, %d pending\n", st.Succeeded, st.Failed, st.Abandoned, len(st.Pending))
+		fmt.Printf("  delivered:    %s\n", formatStock(st.Delivered))
+		fmt.Printf("  spoiled:      %s\n", formatStock(st.Spoiled))
+		fmt.Printf("  dry runs:     %d to the leader, %d to other Traders\n", st.ReadsToLeader, st.ReadsOffloaded)
+		fmt.Printf("  connections:  %d to Traders, %d dropped and redialed\n", st.Connections, st.Reconnects)
+		if st.LocalOnly || st.LocalRecorded > 0 {
+			fmt.Printf("  local only:   %v (%d deposits waiting for a summary, %d recorded locally in all)\n", st.LocalOnly, st.LocalWaiting, st.LocalRecorded)
+		}
+		if st.DirectSold > 0 || st.DirectPending > 0 {
+			fmt.Printf("  direct:       %d trades sold to Buyers, %d not yet reported to a Trader\n", st.DirectSold, st.DirectPending)
+		}
+		for _, req := range st.Pending {
+			fmt.Printf("  pending #%d: %d %s for post %d\n", req.RequestID, req.Quantity, req.Item, req.Post)
+		}
+	})
+}
+
+// buyer prints a Buyer's spend report: what it bought and paid, the purchases that did
+// not go through and the latest purchases
+func (c *Ctl) buyer(addr string, args []string) error {
+	filters, err := parseFilters(args, "item", "limit")
+	if err != nil {
+		return err
+	}
+	q := HistoryArgs{Token: c.Token, Item: filters["item"]}
+	if q.Limit, err = atoi(filters, "limit"); err != nil {
+		return err
+	}
+	var hist PurchaseHistory
+	if err := c.call(addr, "Buyer.GetHistory", &q, &hist); err != nil {
+		return err
+	}
+	return c.show(&hist, func() {
+		fmt.Printf("Buyer %d at %s: spent %.2f\n", hist.BuyerID, addr, hist.Spent)
+		fmt.Printf("  purchases:    %d bought, %d out of stock, %d rejected, %d failed\n", hist.Bought, hist.OutOfStock, hist.Rejected, hist.Failed)
+		fmt.Printf("  latency:      %v on average\n", hist.AvgLatency.Round(time.Microsecond))
+		for _, it := range hist.Items {
+			fmt.Printf("  %-12s  %d purchases, %d bought, spent %.2f\n", it.Item+":", it.Purchases, it.Quantity, it.Spent)
+		}
+		if len(hist.Purchases) > 0 {
+			fmt.Printf("%-20s %-14s %-5s %-8s %-5s %-13s %-8s %-8s %-10s %s\n", "TIME", "REQUEST", "POST", "ITEM", "QTY", "OUTCOME", "PRICE", "ATTEMPTS", "LATENCY", "VIA")
+		}
+		for _, p := range hist.Purchases {
+			price := "-"
+			if p.Outcome == "bought" {
+				price = fmt.Sprintf("%.2f", p.Price)
+			}
+			via := "trader"
+			if p.Rule == "direct" {
+				via = "direct"
+			}
+			if p.Seller != 0 {
+				via = fmt.Sprintf("seller-%d", p.Seller)
+			}
+			fmt.Printf("%-20s %-14d %-5d %-8s %-5d %-13s %-8s %-8d %-10v %s\n", p.At.Format("2006-01-02 15:04:05"), p.RequestID,
+				p.Post, p.Item, p.Quantity, p.Outcome, price, p.Attempts, p.Latency.Round(time.Microsecond), via)
+		}
+	})
+}
+
+// failover approves a takeover held back by the standby or read-only policy
+func (c *Ctl) failover(addr string, _ []string) error {
+	var reply string
+	if err := c.call(addr, "Trader.ApproveFailover", &AdminArgs{Token: c.Token}, &reply); err != nil {
+		return err
+	}
+	fmt.Println(reply)
+	return nil
+}
+
+// drain turns a Trader's drain mode on (the default) or off
+func (c *Ctl) drain(addr string, args []string) error {
+	enable := true
+	if len(args) > 0 {
+		switch args[0] {
+		case "on":
+		case "off":
+			enable = false
+		default:
+			return fmt.Errorf("drain takes on or off, not %q", args[0])
+		}
+	}
+	var reply string
+	if err := c.call(addr, "Trader.Drain", &AdminArgs{Token: c.Token, Enable: enable}, &reply); err != nil {
+		return err
+	}
+	fmt.Println(reply)
+	return nil
+}
+
+// shutdown stops a Trader or, if the node has no Trader service, a Seller
+func (c *Ctl) shutdown(addr string, args []string) error {
+	sa := &ShutdownArgs{Token: c.Token, Mode: "graceful"}
+	if len(args) > 0 {
+		sa.Mode = args[0]
+	}
+	var reply string
+	err := c.call(addr, "Trader.Shutdown", sa, &reply)
+	if err != nil && strings.Contains(err.Error(), "can't find service") {
+		err = c.call(addr, "Seller.Shutdown", sa, &reply)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(reply)
+	return nil
+}
+
+// jobs lists a Trader's scheduled jobs with their metrics
+func (c *Ctl) jobs(addr string, _ []string) error {
+	var jobs []JobStatus
+	if err := c.call(addr, "Trader.Jobs", &AdminArgs{Token: c.Token}, &jobs); err != nil {
+		return err
+	}
+	return c.show(jobs, func() {
+		fmt.Printf("%-14s %-9s %-6s %-6s %-12s %-12s %-9s %s\n", "JOB", "INTERVAL", "RUNS", "FAILS", "LAST TOOK", "AVG TOOK", "NEXT IN", "LAST ERROR")
+		for _, j := range jobs {
+			interval, next := "on demand", "-"
+			if j.Interval > 0 {
+				interval = j.Interval.String()
+				next = time.Until(j.NextRun).Round(time.Second).String()
+			}
+			if j.Running {
+				next = "running"
+			}
+			fmt.Printf("%-14s %-9s %-6d %-6d %-12s %-12s %-9s %s\n", j.Name, interval, j.Runs, j.Failures,
+				j.LastTook.Round(time.Microsecond), j.AvgTook.Round(time.Microsecond), next, j.LastError)
+		}
+	})
+}
+
+// runJob triggers one of a Trader's scheduled jobs now
+func (c *Ctl) runJob(addr string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("run-job needs the name of a job (see a4ctl jobs)")
+	}
+	var reply string
+	if err := c.call(addr, "Trader.RunJob", &JobArgs{Token: c.Token, Name: args[0]}, &reply); err != nil {
+		return err
+	}
+	fmt.Println(reply)
+	return nil
+}
+
+// parseFilters reads key=value arguments, allowing only the given keys
+func parseFilters(args []string, keys ...string) (map[string]string, error) {
+	filters := make(map[string]string)
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected <key>=<value>, got %q", arg)
+		}
+		known := false
+		for _, k := range keys {
+			known = known || k == key
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown filter %q (expected one of %s)", key, strings.Join(keys, ", "))
+		}
+		filters[key] = value
+	}
+	return filters, nil
+}
+
+// atoi parses a numeric filter, treating a missing one as 0
+func atoi(filters map[string]string, key string) (int, error) {
+	if filters[key] == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(filters[key])
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number, got %q", key, filters[key])
+	}
+	return n, nil
+}
+
+// transactions lists a Trader's completed requests, newest first
+func (c *Ctl) transactions(addr string, args []string) error {
+	filters, err := parseFilters(args, "seller", "buyer", "item", "status", "limit")
+	if err != nil {
+		return err
+	}
+	q := TransactionQuery{Token: c.Token, Item: filters["item"], Status: filters["status"]}
+	if q.SellerID, err = atoi(filters, "seller"); err != nil {
+		return err
+	}
+	if q.BuyerID, err = atoi(filters, "buyer"); err != nil {
+		return err
+	}
+	if q.Limit, err = atoi(filters, "limit"); err != nil {
+		return err
+	}
+	var list TransactionList
+	if err := c.call(addr, "Trader.Transactions", &q, &list); err != nil {
+		return err
+	}
+	return c.show(list, func() {
+		fmt.Printf("%-20s %-10s %-14s %-5s %-8s %-5s %-16s %s\n", "TIME", "CLIENT", "REQUEST", "POST", "ITEM", "QTY", "STATUS", "PRICE")
+		for _, r := range list.Records {
+			client, price := fmt.Sprintf("seller %d", r.SellerID), "-"
+			if r.BuyerID != 0 {
+				client, price = fmt.Sprintf("buyer %d", r.BuyerID), fmt.Sprintf("%.2f", r.Price)
+			}
+			fmt.Printf("%-20s %-10s %-14d %-5d %-8s %-5d %-16s %s\n", r.Time.Format("2006-01-02 15:04:05"), client,
+				r.RequestID, r.Post, r.Item, r.Quantity, r.Status, price)
+		}
+		fmt.Printf("%d records at history sequence %d (cached: %v)\n", len(list.Records), list.Seq, list.Cached)
+	})
+}
+
+// prices shows what Buyers recently paid for an item on a Trader
+func (c *Ctl) prices(addr string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("prices needs an item")
+	}
+	filters, err := parseFilters(args[1:], "limit")
+	if err != nil {
+		return err
+	}
+	q := PriceQuery{Token: c.Token, Item: args[0]}
+	if q.Limit, err = atoi(filters, "limit"); err != nil {
+		return err
+	}
+	var hist PriceHistory
+	if err := c.call(addr, "Trader.PriceHistory", &q, &hist); err != nil {
+		return err
+	}
+	return c.show(hist, func() {
+		fmt.Printf("%s: list price %.2f, %d purchases\n", hist.Item, hist.ListPrice, len(hist.Points))
+		if len(hist.Points) > 0 {
+			fmt.Printf("  unit price:   min %.2f, avg %.2f, max %.2f\n", hist.Min, hist.Avg, hist.Max)
+		}
+		for _, p := range hist.Points {
+			rule := p.Rule
+			if rule == "" {
+				rule = "-"
+			}
+			fmt.Printf("  %s  buyer %-4d %4d x %.2f = %.2f (rule %s)\n", p.Time.Format("15:04:05"), p.BuyerID,
+				p.Quantity, p.UnitPrice, p.Price, rule)
+		}
+		fmt.Printf("  history sequence %d (cached: %v)\n", hist.Seq, hist.Cached)
+	})
+}
+
+// leaderboard ranks the items and Sellers of a Trader by cumulative sales
+func (c *Ctl) leaderboard(addr string, args []string) error {
+	filters, err := parseFilters(args, "top")
+	if err != nil {
+		return err
+	}
+	top, err := atoi(filters, "top")
+	if err != nil {
+		return err
+	}
+	var lb Leaderboard
+	if err := c.call(addr, "Trader.GetLeaderboard", top, &lb); err != nil {
+		return err
+	}
+	return c.show(lb, func() {
+		fmt.Printf("Trader %d: %d units sold by Sellers\n", lb.TraderID, lb.Total)
+		for _, is := range lb.Items {
+			fmt.Printf("  %-8s %6d  led by seller %d (%.0f%%)\n", is.Item, is.Quantity, is.Leader, 100*is.Share)
+		}
+		for i, s := range lb.Sellers {
+			fmt.Printf("  %2d. seller %-4d %6d (%.0f%%)  %s\n", i+1, s.SellerID, s.Quantity, 100*s.Share, formatStock(s.Items))
+		}
+	})
+}
+
+// usage prints the commands and flags
+// settlements shows what the federated clusters owe each other, and the latest purchases
+// the gateway forwarded between them
+func (c *Ctl) settlements(addr string, args []string) error {
+	filters, err := parseFilters(args, "limit")
+	if err != nil {
+		return err
+	}
+	q := SettlementsArgs{Token: c.Token, Limit: 20}
+	if _, ok := filters["limit"]; ok {
+		if q.Limit, err = atoi(filters, "limit"); err != nil {
+			return err
+		}
+	}
+	var reply SettlementsReply
+	if err := c.call(addr, "Gateway.Settlements", &q, &reply); err != nil {
+		return err
+	}
+	return c.show(reply, func() {
+		var clusters []string
+		for name := range reply.Balances {
+			clusters = append(clusters, name)
+		}
+		sort.Strings(clusters)
+		fmt.Printf("Federation gateway at %s: %d purchased, %d in doubt, %d unfilled since it started\n", addr,
+			reply.Outcomes["Purchased"], reply.InDoubt, reply.Outcomes["OutOfStock"])
+		for _, name := range clusters {
+			fmt.Printf("  %-12s %+10.2f\n", name, reply.Balances[name])
+		}
+		for _, s := range reply.Settlements {
+			fmt.Printf("  %s  %-9s %s -> %s  buyer %d #%d: %d %s for %.2f\n", s.Time.Format("15:04:05"), s.Status,
+				s.Destination, s.Origin, s.BuyerID, s.RequestID, s.Quantity, s.Item, s.Price)
+		}
+	})
+}
+
+func usage() {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "Usage: a4ctl [flags] <command> <address> [args]\n\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	c := &Ctl{}
+	flag.StringVar(&c.Token, "token", os.Getenv("A4_ADMIN_TOKEN"), "Admin token of the node (defaults to $A4_ADMIN_TOKEN)")
+	flag.BoolVar(&c.JSON, "json", false, "Print status replies as JSON")
+	flag.DurationVar(&c.Timeout, "timeout", 5*time.Second, "Time to wait for the node to answer")
+	caFile := flag.String("ca", os.Getenv("A4_CA"), "PEM certificate of the cluster CA; the node is called over TLS and must present a certificate it signed (defaults to $A4_CA)")
+	tlsCert := flag.String("tls-cert", os.Getenv("A4_TLS_CERT"), "PEM client certificate signed by -ca, for nodes running -mtls (defaults to $A4_TLS_CERT)")
+	tlsKey := flag.String("tls-key", os.Getenv("A4_TLS_KEY"), "PEM private key of -tls-cert (defaults to $A4_TLS_KEY)")
+	flag.Usage = usage
+	flag.Parse()
+	_, clientTLS, err := common.LoadTLS(*tlsCert, *tlsKey, *caFile, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	common.UseTLS(clientTLS)
+
+	if flag.NArg() < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(c, flag.Arg(1), flag.Args()[2:]); err != nil {
+		log.Fatalf("a4ctl %s: %v", flag.Arg(0), err)
+	}
+}
@@ -0,0 +1,901 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"math/rand"
+	"net/rpc"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"a4/common"
+	"a4/config"
+	"a4/metrics"
+	"a4/rpcserver"
+)
+
+// Messages exchanged with Traders are defined in package common, shared with the Trader
+type (
+	BuyRequest   = common.BuyRequest
+	Response     = common.Response
+	BuyerInfo    = common.BuyerInfo
+	LeaderUpdate = common.LeaderUpdate
+	NodeIdentity = common.NodeIdentity
+
+	SellerContact  = common.SellerContact
+	DirectOffer    = common.DirectOffer
+	DirectDecision = common.DirectDecision
+	DirectReply    = common.DirectReply
+)
+
+// Buyer takes stock out of the market through the leader Trader
+type Buyer struct {
+	ID          int
+	Address     string
+	Post        int
+	Items       []string // Items to buy, picked at random
+	MaxQuantity int      // Largest quantity of a single purchase
+	MaxAttempts int      // Give up on a purchase after this many attempts
+	Secret      string   // Cluster secret; when set, purchases are signed and unsigned or forged Trader messages are rejected
+	DevMode     bool     // Pick a free port automatically if Address is taken
+	AdminToken  string   // Credential required by GetHistory; empty disables it
+	RequestID   int      // Last request ID used (guarded by statsMu)
+	Bought      int      // Purchases that went through (guarded by statsMu)
+	OutOfStock  int      // Purchases refused for lack of stock (guarded by statsMu)
+	Failed      int      // Purchases that exhausted their attempts (guarded by statsMu)
+	Spent       float64  // Total paid (guarded by statsMu)
+	statsMu     sync.Mutex
+
+	Ledger *PurchaseLedger // Every finished purchase, for the spend report
+
+	TraderAddr   string   // Trader purchases are sent to (guarded by leaderMu)
+	LeaderTerm   int64    // Highest leadership term accepted (guarded by leaderMu)
+	KnownTraders []string // Trader addresses probed during leader re-discovery (guarded by leaderMu)
+	leaderMu     sync.Mutex
+
+	DirectAfter time.Duration   // Trade directly with Sellers once no Trader has answered for this long, before time scaling; 0 disables
+	Sellers     []SellerContact // Sellers to trade with directly, as last listed by a Trader (guarded by leaderMu)
+	lastReached time.Time       // Last time a Trader answered (guarded by leaderMu)
+
+	Timeouts common.Timeouts // Deadlines of outgoing RPCs by method, before time scaling
+
+	TLS *tls.Config // Serves RPCs over TLS if non-nil; outgoing connections are set up with common.UseTLS
+
+	RetryDelay time.Duration // Wait before retrying a purchase or registration after a failed attempt (guarded by settingsMu)
+	settingsMu sync.Mutex
+
+	prom buyerMetrics // Prometheus metrics; the zero value records nothing
+}
+
+// retryDelay returns the wall-clock wait before the next attempt after a failed one
+func (b *Buyer) retryDelay() time.Duration {
+	b.settingsMu.Lock()
+	defer b.settingsMu.Unlock()
+	return common.Scaled(b.RetryDelay)
+}
+
+// call makes an RPC on client under the method's deadline
+func (b *Buyer) call(client *rpc.Client, method string, args, reply interface{}) error {
+	start := time.Now()
+	err := common.CallTimeout(client, method, args, reply, common.Scaled(b.Timeouts.For(method)))
+	b.prom.rpcLatency.ObserveSince(start, method)
+	if errors.Is(err, common.ErrTimeout) {
+		b.prom.rpcTimeouts.Inc(method)
+	}
+	return err
+}
+
+// buyerMetrics are the Buyer's counters and histograms exposed on /metrics
+type buyerMetrics struct {
+	purchases   *metrics.Counter   // Finished purchases by outcome
+	spent       *metrics.Counter   // Total paid
+	rpcLatency  *metrics.Histogram // Outgoing RPCs by method
+	rpcTimeouts *metrics.Counter   // Outgoing RPCs abandoned at their deadline by method
+}
+
+// registerMetrics creates the Buyer's metrics in reg
+func (b *Buyer) registerMetrics(reg *metrics.Registry) {
+	b.prom = buyerMetrics{
+		purchases:   reg.Counter("a4_buyer_purchases_total", "Finished purchases by outcome", "outcome"),
+		spent:       reg.Counter("a4_buyer_spent_total", "Total paid for purchases"),
+		rpcLatency:  reg.Histogram("a4_rpc_duration_seconds", "Latency of outgoing RPCs by method", metrics.DefaultBuckets, "method"),
+		rpcTimeouts: reg.Counter("a4_rpc_timeouts_total", "Outgoing RPCs abandoned at their deadline by method", "method"),
+	}
+}
+
+// rediscoverAfter is the number of consecutive connection failures that trigger leader re-discovery
+const rediscoverAfter = 2
+
+// ======= MESSAGE SIGNING =======
+
+// verifyResponse checks a response's signature when a cluster secret is configured
+func (b *Buyer) verifyResponse(res *Response) bool {
+	if b.Secret == "" {
+		return true
+	}
+	return hmac.Equal([]byte(common.ResponseSignature(b.Secret, res)), []byte(res.Signature))
+}
+
+// ======= PURCHASES =======
+
+// Buy sends one purchase of a random item and quantity, directly to a Seller if no Trader
+// has answered for DirectAfter
+func (b *Buyer) Buy() {
+	item := b.Items[rand.Intn(len(b.Items))]
+	quantity := 1 + rand.Intn(b.MaxQuantity)
+
+	b.statsMu.Lock()
+	b.RequestID++
+	req := BuyRequest{
+		BuyerID:   b.ID,
+		Post:      b.Post,
+		Item:      item,
+		Quantity:  quantity,
+		RequestID: b.RequestID,
+		Path:      []string{fmt.Sprintf("buyer-%d", b.ID)},
+	}
+	b.statsMu.Unlock()
+
+	if b.traderLost() && !b.rediscoverLeader() {
+		b.buyDirect(req)
+		return
+	}
+	b.purchase(req)
+}
+
+// purchase sends a purchase to the leader, retrying with the same request ID across
+// connection failures and failovers until the Trader answers for good
+func (b *Buyer) purchase(req BuyRequest) {
+	if b.Secret != "" {
+		req.Signature = common.BuyRequestSignature(b.Secret, &req)
+	}
+	start := time.Now()
+	dialFailures := 0
+	for attempt := 1; attempt <= b.MaxAttempts; attempt++ {
+		traderAddr := b.currentTrader()
+		client, err := common.DialTimeouts(traderAddr, b.Timeouts)
+		if err != nil {
+			slog.Warn("Failed to connect to Trader; retrying", "addr", traderAddr)
+			dialFailures++
+			if dialFailures >= rediscoverAfter {
+				b.rediscoverLeader()
+				dialFailures = 0
+			}
+			time.Sleep(b.retryDelay())
+			continue
+		}
+		dialFailures = 0
+
+		var res Response
+		err = b.call(client, "Trader.Buy", &req, &res)
+		client.Close()
+		if err != nil {
+			slog.Warn("Error sending purchase; retrying", "request", req.RequestID, "err", err)
+			time.Sleep(b.retryDelay())
+			continue
+		}
+		b.noteReached()
+		if !b.verifyResponse(&res) {
+			slog.Warn("Rejecting response with invalid signature; retrying", "request", req.RequestID)
+			time.Sleep(b.retryDelay())
+			continue
+		}
+
+		switch res.Status {
+		case "Purchased":
+			b.statsMu.Lock()
+			b.Bought++
+			b.Spent += res.Price
+			rule := "list price"
+			if res.PriceRule != "" {
+				rule = "rule " + res.PriceRule
+			}
+			slog.Info("Bought", "request", req.RequestID, "quantity", req.Quantity, "item", req.Item, "post", req.Post, "price", fmt.Sprintf("%.2f", res.Price), "rule", rule,
+				"path", strings.Join(res.Path, " > "), "bought", b.Bought, "out_of_stock", b.OutOfStock, "failed", b.Failed, "spent", fmt.Sprintf("%.2f", b.Spent))
+			b.statsMu.Unlock()
+			b.prom.purchases.Inc("bought")
+			b.prom.spent.Add(res.Price)
+			b.record(&req, "bought", &res, attempt, start, 0)
+			return
+		case "OutOfStock":
+			b.statsMu.Lock()
+			b.OutOfStock++
+			b.statsMu.Unlock()
+			b.prom.purchases.Inc("out-of-stock")
+			slog.Info("Purchase refused", "request", req.RequestID, "reason", res.Message)
+			b.record(&req, "out-of-stock", &res, attempt, start, 0)
+			return
+		case "Invalid", "RoutingError":
+			b.prom.purchases.Inc("rejected")
+			slog.Warn("Purchase rejected", "request", req.RequestID, "status", res.Status, "reason", res.Message)
+			b.record(&req, "rejected", &res, attempt, start, 0)
+			return
+		default:
+			slog.Warn("Purchase not processed; retrying", "request", req.RequestID, "status", res.Status, "reason", res.Message)
+			time.Sleep(b.retryDelay())
+		}
+	}
+
+	b.statsMu.Lock()
+	b.Failed++
+	b.statsMu.Unlock()
+	b.prom.purchases.Inc("failed")
+	slog.Warn("Giving up on purchase", "request", req.RequestID, "attempts", b.MaxAttempts)
+	b.record(&req, "failed", nil, b.MaxAttempts, start, 0)
+}
+
+// record writes a finished purchase to the ledger; res is nil if nobody answered for good,
+// and seller is the Seller that answered a direct purchase (0 for a Trader)
+func (b *Buyer) record(req *BuyRequest, outcome string, res *Response, attempts int, start time.Time, seller int) {
+	p := Purchase{
+		RequestID: req.RequestID,
+		Item:      req.Item,
+		Quantity:  req.Quantity,
+		Post:      req.Post,
+		Seller:    seller,
+		Outcome:   outcome,
+		Attempts:  attempts,
+		Latency:   time.Since(start),
+		At:        time.Now(),
+	}
+	if res != nil {
+		p.Price, p.Rule = res.Price, res.PriceRule
+		if outcome != "bought" {
+			p.Reason = res.Message
+		}
+	}
+	if err := b.Ledger.Record(p); err != nil {
+		slog.Error("Failed to write purchase to the ledger", "request", req.RequestID, "err", err)
+	}
+}
+
+// ======= PURCHASE LEDGER =======
+
+// ledgerRecent is the number of latest purchases the ledger keeps in memory for GetHistory;
+// the totals cover every purchase in the file
+const ledgerRecent = 1000
+
+// Purchase is one finished purchase, as written to a line of the ledger file
+type Purchase struct {
+	RequestID int           `json:"request_id"`
+	Item      string        `json:"item"`
+	Quantity  int           `json:"quantity"`
+	Post      int           `json:"post"`
+	Seller    int           `json:"seller,omitempty"` // Seller that traded directly (0 through a Trader)
+	Outcome   string        `json:"outcome"`          // bought, out-of-stock, rejected or failed
+	Price     float64       `json:"price,omitempty"`
+	Rule      string        `json:"rule,omitempty"`   // Pricing rule applied, empty for the list price
+	Reason    string        `json:"reason,omitempty"` // Trader's message for a purchase not bought
+	Attempts  int           `json:"attempts"`
+	Latency   time.Duration `json:"latency"` // From the first attempt to the final answer
+	At        time.Time     `json:"at"`
+}
+
+// ItemSpend is what was bought of one item
+type ItemSpend struct {
+	Item      string
+	Purchases int
+	Quantity  int
+	Spent     float64
+}
+
+// PurchaseLedger records every finished purchase in memory and, if it has a path, in a
+// JSON-lines file, so the spend report survives a Buyer restart. A nil PurchaseLedger
+// records nothing.
+type PurchaseLedger struct {
+	path     string
+	mu       sync.Mutex
+	recent   []Purchase            // Latest purchases, oldest first (guarded by mu)
+	outcomes map[string]int        // Purchases by outcome (guarded by mu)
+	items    map[string]*ItemSpend // Bought purchases by item (guarded by mu)
+	spent    float64               // (guarded by mu)
+	latency  time.Duration         // Sum over every purchase (guarded by mu)
+}
+
+// OpenPurchaseLedger loads the purchases left in the ledger file by earlier runs; an empty
+// path keeps the ledger in memory only
+func OpenPurchaseLedger(path string) (*PurchaseLedger, error) {
+	l := &PurchaseLedger{path: path, outcomes: make(map[string]int), items: make(map[string]*ItemSpend)}
+	if path == "" {
+		return l, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var p Purchase
+		if err := json.Unmarshal([]byte(line), &p); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, i+1, err)
+		}
+		l.addLocked(p)
+	}
+	return l, nil
+}
+
+// Record appends a purchase to the ledger file and syncs it, then counts it
+func (l *PurchaseLedger) Record(p Purchase) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.path != "" {
+		line, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	l.addLocked(p)
+	return nil
+}
+
+// addLocked counts a purchase in the totals and the latest purchases; mu must be held
+func (l *PurchaseLedger) addLocked(p Purchase) {
+	l.outcomes[p.Outcome]++
+	l.latency += p.Latency
+	if p.Outcome == "bought" {
+		spend := l.items[p.Item]
+		if spend == nil {
+			spend = &ItemSpend{Item: p.Item}
+			l.items[p.Item] = spend
+		}
+		spend.Purchases++
+		spend.Quantity += p.Quantity
+		spend.Spent += p.Price
+		l.spent += p.Price
+	}
+	if len(l.recent) == ledgerRecent {
+		l.recent = append(l.recent[:0], l.recent[1:]...)
+	}
+	l.recent = append(l.recent, p)
+}
+
+// HistoryArgs selects the latest purchases listed by GetHistory
+type HistoryArgs struct {
+	Token string
+	Item  string // Only purchases of this item (all if empty)
+	Limit int    // Latest purchases listed (defaults to 20)
+}
+
+// PurchaseHistory is the Buyer's spend report
+type PurchaseHistory struct {
+	BuyerID    int
+	Bought     int
+	OutOfStock int
+	Rejected   int
+	Failed     int
+	Spent      float64
+	AvgLatency time.Duration // Over every finished purchase
+	Items      []ItemSpend   // By item name
+	Purchases  []Purchase    // Latest first
+}
+
+// defaultHistoryLimit is the number of purchases GetHistory lists without a limit
+const defaultHistoryLimit = 20
+
+// History fills in the spend report from the ledger
+func (l *PurchaseLedger) History(args *HistoryArgs, reply *PurchaseHistory) {
+	if l == nil {
+		return
+	}
+	limit := args.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	reply.Bought, reply.OutOfStock = l.outcomes["bought"], l.outcomes["out-of-stock"]
+	reply.Rejected, reply.Failed = l.outcomes["rejected"], l.outcomes["failed"]
+	reply.Spent = l.spent
+	if n := reply.Bought + reply.OutOfStock + reply.Rejected + reply.Failed; n > 0 {
+		reply.AvgLatency = l.latency / time.Duration(n)
+	}
+	for _, spend := range l.items {
+		reply.Items = append(reply.Items, *spend)
+	}
+	sort.Slice(reply.Items, func(i, j int) bool { return reply.Items[i].Item < reply.Items[j].Item })
+	for i := len(l.recent) - 1; i >= 0 && len(reply.Purchases) < limit; i-- {
+		if args.Item == "" || l.recent[i].Item == args.Item {
+			reply.Purchases = append(reply.Purchases, l.recent[i])
+		}
+	}
+}
+
+// GetHistory reports what the Buyer bought, what it paid, the purchases that failed and
+// the average purchase latency to an admin
+func (b *Buyer) GetHistory(args *HistoryArgs, reply *PurchaseHistory) error {
+	if err := b.checkAdmin("history", args.Token); err != nil {
+		return err
+	}
+	reply.BuyerID = b.ID
+	b.Ledger.History(args, reply)
+	return nil
+}
+
+// checkAdmin verifies the admin token for an operation in constant time
+func (b *Buyer) checkAdmin(op, token string) error {
+	if b.AdminToken == "" {
+		return fmt.Errorf("%s disabled on Buyer %d (no -admin-token configured)", op, b.ID)
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(b.AdminToken)) != 1 {
+		slog.Warn("Rejected admin call with invalid token", "op", op)
+		return fmt.Errorf("admin authentication failed")
+	}
+	return nil
+}
+
+// ======= DIRECT TRADES =======
+
+// sellersRefresh is how often a Buyer trading directly asks its Trader for the Sellers
+const sellersRefresh = 30 * time.Second
+
+// noteReached records that a Trader answered
+func (b *Buyer) noteReached() {
+	b.leaderMu.Lock()
+	b.lastReached = time.Now()
+	b.leaderMu.Unlock()
+}
+
+// traderLost reports whether no Trader has answered for DirectAfter
+func (b *Buyer) traderLost() bool {
+	if b.DirectAfter <= 0 {
+		return false
+	}
+	b.leaderMu.Lock()
+	defer b.leaderMu.Unlock()
+	return time.Since(b.lastReached) > common.Scaled(b.DirectAfter)
+}
+
+// RefreshSellers periodically asks the Trader for the registered Sellers, so the Buyer
+// knows whom to trade with once no Trader is reachable
+func (b *Buyer) RefreshSellers() {
+	for {
+		b.refreshSellers(b.currentTrader())
+		time.Sleep(common.Scaled(sellersRefresh))
+	}
+}
+
+// refreshSellers replaces the known Sellers with those registered at the Trader at addr
+func (b *Buyer) refreshSellers(addr string) {
+	info := BuyerInfo{ID: b.ID, Address: b.Address}
+	if b.Secret != "" {
+		info.Signature = common.BuyerRegistrationSignature(b.Secret, &info)
+	}
+	client, err := common.DialTimeouts(addr, b.Timeouts)
+	if err != nil {
+		return
+	}
+	var sellers []SellerContact
+	err = b.call(client, "Trader.DirectSellers", &info, &sellers)
+	client.Close()
+	if err != nil {
+		slog.Warn("Failed to list Sellers for direct trades", "addr", addr, "err", err)
+		return
+	}
+	b.leaderMu.Lock()
+	b.Sellers = sellers
+	b.leaderMu.Unlock()
+	b.noteReached()
+}
+
+// callSeller makes one phase of a direct trade with the Seller at addr and checks the
+// reply's signature
+func (b *Buyer) callSeller(addr, method string, args interface{}) (DirectReply, error) {
+	var reply DirectReply
+	client, err := common.DialTimeouts(addr, b.Timeouts)
+	if err != nil {
+		return reply, err
+	}
+	err = b.call(client, method, args, &reply)
+	client.Close()
+	if err != nil {
+		return reply, err
+	}
+	if b.Secret != "" && !hmac.Equal([]byte(common.DirectReplySignature(b.Secret, &reply)), []byte(reply.Signature)) {
+		return reply, errors.New("invalid direct trade reply signature")
+	}
+	return reply, nil
+}
+
+// buyDirect buys from a Seller while no Trader is reachable. The Buyer asks the known
+// Sellers in turn to hold the stock, then commits with the first that holds it; the
+// Seller reports the trade to a Trader once one is reachable again.
+func (b *Buyer) buyDirect(req BuyRequest) {
+	start := time.Now()
+	b.leaderMu.Lock()
+	sellers := append([]SellerContact(nil), b.Sellers...)
+	b.leaderMu.Unlock()
+	rand.Shuffle(len(sellers), func(i, j int) { sellers[i], sellers[j] = sellers[j], sellers[i] })
+
+	offer := DirectOffer{BuyerID: req.BuyerID, RequestID: req.RequestID, Post: req.Post, Item: req.Item, Quantity: req.Quantity}
+	if b.Secret != "" {
+		offer.Signature = common.DirectOfferSignature(b.Secret, &offer)
+	}
+	outcome, reason := "failed", "no Seller reachable"
+	for _, seller := range sellers {
+		prepared, err := b.callSeller(seller.Address, "Seller.PrepareDirect", &offer)
+		if err != nil {
+			slog.Warn("Failed to reach Seller for a direct purchase", "request", req.RequestID, "seller", seller.ID, "err", err)
+			continue
+		}
+		if prepared.Status == "OutOfStock" || prepared.Status == "Refused" {
+			outcome, reason = "out-of-stock", prepared.Message
+			continue
+		}
+		status := prepared.Status
+		if status == "Prepared" {
+			status = b.commitDirect(seller, &req)
+		}
+		if status != "Committed" {
+			slog.Warn("Direct purchase not confirmed", "request", req.RequestID, "seller", seller.ID, "status", status)
+			outcome, reason = "failed", fmt.Sprintf("Seller %d did not confirm", seller.ID)
+			continue
+		}
+
+		b.statsMu.Lock()
+		b.Bought++
+		b.Spent += prepared.Price
+		slog.Info("Bought directly", "request", req.RequestID, "quantity", req.Quantity, "item", req.Item, "post", req.Post, "seller", seller.ID,
+			"price", fmt.Sprintf("%.2f", prepared.Price), "bought", b.Bought, "spent", fmt.Sprintf("%.2f", b.Spent))
+		b.statsMu.Unlock()
+		b.prom.purchases.Inc("bought")
+		b.prom.spent.Add(prepared.Price)
+		b.record(&req, "bought", &Response{Price: prepared.Price, PriceRule: "direct"}, 1, start, seller.ID)
+		return
+	}
+
+	b.prom.purchases.Inc(outcome)
+	slog.Warn("Direct purchase failed", "request", req.RequestID, "sellers", len(sellers), "outcome", outcome, "reason", reason)
+	if outcome == "failed" {
+		b.statsMu.Lock()
+		b.Failed++
+		b.statsMu.Unlock()
+	} else {
+		b.statsMu.Lock()
+		b.OutOfStock++
+		b.statsMu.Unlock()
+	}
+	b.record(&req, outcome, &Response{Message: reason, PriceRule: "direct"}, 1, start, 0)
+}
+
+// commitDirect confirms a direct trade the Seller holds stock for, retrying until the
+// Seller answers, and returns its final status. A Seller that never hears the decision
+// releases the stock when its hold expires.
+func (b *Buyer) commitDirect(seller SellerContact, req *BuyRequest) string {
+	decision := DirectDecision{BuyerID: req.BuyerID, RequestID: req.RequestID, Commit: true}
+	if b.Secret != "" {
+		decision.Signature = common.DirectDecisionSignature(b.Secret, &decision)
+	}
+	for attempt := 1; attempt <= b.MaxAttempts; attempt++ {
+		reply, err := b.callSeller(seller.Address, "Seller.CommitDirect", &decision)
+		if err == nil {
+			return reply.Status
+		}
+		slog.Warn("Failed to confirm direct purchase; retrying", "request", req.RequestID, "seller", seller.ID, "err", err)
+		time.Sleep(b.retryDelay())
+	}
+	return "Unconfirmed"
+}
+
+// ======= LEADER TRACKING =======
+
+// currentTrader returns the address of the Trader purchases are sent to
+func (b *Buyer) currentTrader() string {
+	b.leaderMu.Lock()
+	defer b.leaderMu.Unlock()
+	return b.TraderAddr
+}
+
+// rediscoverLeader probes every known Trader and switches to the leader with the highest term
+func (b *Buyer) rediscoverLeader() bool {
+	b.leaderMu.Lock()
+	known := append([]string(nil), b.KnownTraders...)
+	b.leaderMu.Unlock()
+
+	best, bestTerm := "", int64(-1)
+	for _, addr := range known {
+		id, err := common.ProbeTrader(addr)
+		if err != nil || id.Role != "trader" || !id.Leader {
+			continue
+		}
+		if id.Term > bestTerm {
+			best, bestTerm = addr, id.Term
+		}
+	}
+	if best == "" {
+		slog.Warn("Leader re-discovery found no live leader", "known", known)
+		return false
+	}
+
+	b.leaderMu.Lock()
+	previous := b.TraderAddr
+	b.TraderAddr = best
+	if bestTerm > b.LeaderTerm {
+		b.LeaderTerm = bestTerm
+	}
+	b.lastReached = time.Now()
+	b.leaderMu.Unlock()
+	if previous != best {
+		slog.Info("Leader re-discovery switched Trader", "from", previous, "to", best, "term", bestTerm)
+		go b.registerWithRetry(best)
+	}
+	return true
+}
+
+// UpdateLeader switches to the Trader that took over. With a cluster secret configured,
+// only fresh notifications signed by a legitimate Trader are accepted.
+func (b *Buyer) UpdateLeader(update *LeaderUpdate, reply *string) error {
+	if b.Secret != "" {
+		if !hmac.Equal([]byte(common.LeaderUpdateSignature(b.Secret, update)), []byte(update.Signature)) {
+			slog.Warn("Rejecting leader update with invalid signature", "addr", update.Address)
+			return errors.New("invalid leader update signature")
+		}
+		if age := time.Since(time.Unix(0, update.IssuedAt)); age > common.LeaderUpdateMaxAge || age < -common.LeaderUpdateMaxAge {
+			slog.Warn("Rejecting stale leader update", "addr", update.Address, "age", age)
+			return errors.New("stale leader update")
+		}
+	}
+
+	b.leaderMu.Lock()
+	if update.Term < b.LeaderTerm {
+		term := b.LeaderTerm
+		b.leaderMu.Unlock()
+		slog.Warn("Rejecting leader update from an old term", "addr", update.Address, "term", update.Term, "current_term", term)
+		return fmt.Errorf("leader update from term %d is older than current term %d", update.Term, term)
+	}
+	previous := b.TraderAddr
+	b.TraderAddr = update.Address
+	b.LeaderTerm = update.Term
+	b.leaderMu.Unlock()
+
+	if previous != update.Address {
+		slog.Info("Updating Trader to new leader", "trader", update.TraderID, "addr", update.Address, "term", update.Term)
+		go b.registerWithRetry(update.Address)
+	}
+	*reply = "Leader updated successfully"
+	return nil
+}
+
+// Identify reports the Buyer's identity to probes
+func (b *Buyer) Identify(_ int, reply *NodeIdentity) error {
+	*reply = NodeIdentity{Role: "buyer", ID: b.ID, Address: b.Address, Time: time.Now()}
+	return nil
+}
+
+// registerWithRetry keeps trying to register until the Trader accepts, so it can notify
+// the Buyer of leader changes
+func (b *Buyer) registerWithRetry(traderAddr string) {
+	info := BuyerInfo{ID: b.ID, Address: b.Address}
+	if b.Secret != "" {
+		info.Signature = common.BuyerRegistrationSignature(b.Secret, &info)
+	}
+	for {
+		client, err := common.DialTimeouts(traderAddr, b.Timeouts)
+		if err == nil {
+			var reply string
+			err = b.call(client, "Trader.RegisterBuyer", &info, &reply)
+			client.Close()
+		}
+		if err == nil {
+			slog.Info("Registered with Trader", "addr", traderAddr)
+			b.noteReached()
+			if b.DirectAfter > 0 {
+				b.refreshSellers(traderAddr)
+			}
+			return
+		}
+		slog.Warn("Failed to register with Trader; retrying", "addr", traderAddr, "err", err)
+		time.Sleep(b.retryDelay())
+	}
+}
+
+// StartRPCServer starts the Buyer's RPC server to handle leader updates
+func StartRPCServer(b *Buyer, ready chan<- struct{}) {
+	srv := rpcserver.New(rpcserver.Options{
+		Name:    fmt.Sprintf("Buyer %d", b.ID),
+		Address: b.Address,
+		DevMode: b.DevMode,
+		TLS:     b.TLS,
+	})
+	if err := srv.Register(b); err != nil {
+		common.Fatal("Error registering Buyer service", "err", err)
+	}
+
+	addr, err := srv.Listen()
+	if err != nil {
+		common.Fatal("Error starting RPC server", "addr", b.Address, "err", err)
+	}
+	b.Address = addr
+	close(ready)
+
+	slog.Info("RPC server started", "addr", b.Address)
+	srv.Serve()
+}
+
+func main() {
+	id := flag.Int("id", 0, "Buyer ID")
+	address := flag.String("address", "", "Buyer Address")
+	traders := flag.String("traders", "", "Comma-separated Trader addresses; the first is used until leader re-discovery")
+	post := flag.Int("post", 0, "Post to buy from")
+	items := flag.String("items", "apples,oranges,pears", "Comma-separated items to buy, picked at random")
+	maxQuantity := flag.Int("max-quantity", 5, "Largest quantity of a single purchase")
+	interval := flag.Duration("interval", 10*time.Second, "Interval between purchases")
+	maxAttempts := flag.Int("max-attempts", 10, "Give up on a purchase after this many attempts")
+	retryDelay := flag.Duration("retry-delay", 5*time.Second, "Wait before retrying a purchase or registration after a failed attempt; reloaded on SIGHUP")
+	secret := flag.String("secret", "", "Cluster secret for signing purchases and registrations and verifying Trader responses and leader notifications (unsigned if empty)")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate served to Traders over TLS and presented to nodes running -mtls (plaintext if empty; needs -tls-key and -ca)")
+	tlsKey := flag.String("tls-key", "", "PEM private key of -tls-cert")
+	caFile := flag.String("ca", "", "PEM certificate of the cluster CA; connections to Traders use TLS and trust only it")
+	mtls := flag.Bool("mtls", false, "Refuse any Trader or tool connecting without a certificate signed by -ca (needs -tls-cert)")
+	ledgerPath := flag.String("ledger", "", "Record every finished purchase in this JSON-lines file, kept across restarts for the spend report (in memory only if empty)")
+	adminToken := flag.String("admin-token", "", "Token required by the GetHistory RPC (disabled if empty)")
+	directAfter := flag.Duration("direct-after", 0, "Buy directly from the Sellers once no Trader has answered for this long, until one does again (0 disables)")
+	devMode := flag.Bool("dev", false, "Development mode: listen on a free port if -address is taken")
+	flag.Float64Var(&common.TimeScale, "time-scale", 1.0, "Speed factor applied to all delays, tickers and timeouts (e.g. 10 runs 10x faster)")
+	rpcTimeout := flag.Duration("rpc-timeout", 5*time.Second, "Deadline for dialing and for RPCs without their own timeout (0 waits indefinitely)")
+	rpcTimeouts := flag.String("rpc-timeouts", "", "Per-RPC deadlines overriding the defaults, as method=duration pairs keyed by Service.Method or Service, e.g. Trader.Buy=30s")
+	configPath := flag.String("config", "", "Cluster config file (.yaml, .yml or .toml) setting the flags not given here; A4_<FLAG> environment variables override it")
+	logLevel := flag.String("log-level", "info", "Lowest level logged: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log record format: text (key=value) or json")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on at /metrics (disabled if empty)")
+	pprofAddr := flag.String("pprof-addr", "", "Debug address to serve net/http/pprof profiles on at /debug/pprof/; may equal -metrics-addr (disabled if empty)")
+	flag.Parse()
+	if err := config.Apply(flag.CommandLine, *configPath, "buyer"); err != nil {
+		log.Fatal(err)
+	}
+
+	parsed, err := common.ParseLogLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	level := new(slog.LevelVar) // Changed by a configuration reload
+	level.Set(parsed)
+	logger, err := common.NewLogger(os.Stderr, *logFormat, level, nil, "node", "buyer", "id", *id, "post", *post)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	if common.TimeScale <= 0 {
+		common.Fatal("-time-scale must be positive", "time_scale", common.TimeScale)
+	}
+	serverTLS, clientTLS, err := common.LoadTLS(*tlsCert, *tlsKey, *caFile, *mtls)
+	if err != nil {
+		common.Fatal("Error loading TLS configuration", "err", err)
+	}
+	common.UseTLS(clientTLS)
+
+	if *id == 0 || *address == "" || *traders == "" || *post == 0 {
+		common.Fatal("Usage: buyer -id=<id> -address=<address> -traders=<trader>[,<trader>] -post=<post>")
+	}
+	if *maxQuantity < 1 || *maxAttempts < 1 {
+		common.Fatal("-max-quantity and -max-attempts must be at least 1")
+	}
+	if *retryDelay <= 0 {
+		common.Fatal("-retry-delay must be positive", "retry_delay", *retryDelay)
+	}
+	timeouts, err := common.ParseTimeouts(*rpcTimeout, *rpcTimeouts)
+	if err != nil {
+		common.Fatal("Error parsing -rpc-timeouts", "err", err)
+	}
+
+	ledger, err := OpenPurchaseLedger(*ledgerPath)
+	if err != nil {
+		common.Fatal("Error opening purchase ledger", "err", err)
+	}
+
+	known := strings.Split(*traders, ",")
+	buyer := &Buyer{
+		ID:          *id,
+		Address:     *address,
+		Post:        *post,
+		Items:       strings.Split(*items, ","),
+		MaxQuantity: *maxQuantity,
+		MaxAttempts: *maxAttempts,
+		Secret:      *secret,
+		DevMode:     *devMode,
+		AdminToken:  *adminToken,
+		Ledger:      ledger,
+		TLS:         serverTLS,
+		// Request IDs start from the clock so a restarted Buyer never repeats one the
+		// Traders still remember
+		RequestID: int(time.Now().Unix()) * 1000,
+
+		TraderAddr:   known[0],
+		KnownTraders: known,
+		DirectAfter:  *directAfter,
+		lastReached:  time.Now(),
+
+		Timeouts: timeouts,
+
+		RetryDelay: *retryDelay,
+	}
+
+	endpoints := make(metrics.Endpoints)
+	if *metricsAddr != "" {
+		reg := metrics.NewRegistry()
+		buyer.registerMetrics(reg)
+		endpoints.Handle(*metricsAddr, "/metrics", reg)
+	}
+	endpoints.Handle(*pprofAddr, "/debug/pprof/", metrics.Profiles())
+	if err := endpoints.Serve(); err != nil {
+		common.Fatal("Error starting HTTP server", "err", err)
+	}
+	if *metricsAddr != "" {
+		slog.Info("Serving Prometheus metrics", "addr", *metricsAddr)
+	}
+	if *pprofAddr != "" {
+		slog.Info("Serving pprof profiles", "addr", *pprofAddr)
+	}
+
+	ready := make(chan struct{})
+	go StartRPCServer(buyer, ready)
+	<-ready
+	go config.Watch(flag.CommandLine, *configPath, "buyer", []string{"log-level", "retry-delay"}, func() error {
+		parsed, err := common.ParseLogLevel(*logLevel)
+		if err != nil {
+			return err
+		}
+		if *retryDelay <= 0 {
+			return fmt.Errorf("-retry-delay must be positive, got %v", *retryDelay)
+		}
+		level.Set(parsed)
+		buyer.settingsMu.Lock()
+		buyer.RetryDelay = *retryDelay
+		buyer.settingsMu.Unlock()
+		return nil
+	})
+	go buyer.registerWithRetry(buyer.currentTrader())
+	if buyer.DirectAfter > 0 {
+		go buyer.RefreshSellers()
+	}
+
+	// On SIGINT or SIGTERM, finish the purchase in progress and exit
+	stop := make(chan struct{})
+	common.OnTerminate(func() { close(stop) })
+
+	// Periodically buy
+	ticker := time.NewTicker(common.Scaled(*interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			buyer.Buy()
+		case <-stop:
+			buyer.statsMu.Lock()
+			slog.Info("Shut down gracefully", "bought", buyer.Bought, "out_of_stock", buyer.OutOfStock, "failed", buyer.Failed, "spent", fmt.Sprintf("%.2f", buyer.Spent))
+			buyer.statsMu.Unlock()
+			return
+		}
+	}
+}
@@ -0,0 +1,1288 @@
+// Package common is the wire protocol between Traders and the Sellers and Buyers that
+// trade through them: the RPC argument and reply types, the delivery and response modes,
+// the HMAC signatures on Trader messages, and helpers for calling a Trader. The Trader,
+// Seller and Buyer binaries share these definitions, and third-party Sellers and Buyers
+// can import the package instead of copying them.
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/rpc"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"a4/tracing"
+)
+
+// ======= REQUESTS =======
+
+// Delivery semantics a sender can ask for. At-least-once requests are retried by the
+// sender and deduplicated by the session watermark; at-most-once requests are sent once,
+// and a Trader drops any copy it has already seen.
+const (
+	DeliveryAtLeastOnce = "at-least-once"
+	DeliveryAtMostOnce  = "at-most-once"
+)
+
+// Response delivery modes; a Trader and its Sellers must use the same one. In sync mode
+// the outcome is the reply to Trader.ReceiveRequest; in push, poll and stream mode the
+// reply only acknowledges the request with status "Accepted", and the outcome is later
+// pushed to Seller.ReceiveResponse, fetched with Trader.GetPending, or sent down the
+// Seller's response stream (Trader.Stream).
+const (
+	ResponseSync   = "sync"
+	ResponsePush   = "push"
+	ResponsePoll   = "poll"
+	ResponseStream = "stream"
+)
+
+// Request is a Seller's deposit, sent to Trader.ReceiveRequest
+type Request struct {
+	SellerID  int
+	Post      int
+	Item      string
+	Quantity  int
+	RequestID int      // Unique ID for each request
+	DryRun    bool     // Validate and report without mutating state
+	Path      []string // Hops so far, e.g. [seller-5 trader-1]; each Trader appends itself
+	Delivery  string   // DeliveryAtLeastOnce (default if empty) or DeliveryAtMostOnce
+
+	ResponseMode string // How the Seller expects the outcome: ResponseSync (default if empty), ResponsePush, ResponsePoll or ResponseStream
+
+	// Scheduling metadata, carried unchanged when a Trader forwards the request
+	Priority int       // Higher is served first when a Trader's work slots are contested (0 is the default)
+	Deadline time.Time // The request is refused as Expired if it cannot start by then (zero for none)
+	Term     int64     // Leadership term of the Trader that forwarded it (0 when sent by a Seller)
+
+	ReadReplica bool // A dry run that any Trader may answer from its replica of the owner's stock
+
+	Summarizes int // Deposits the Seller recorded locally during an overload and nets into this one (0 for an ordinary request)
+
+	Trace tracing.Context // Span of the sender's call; the receiver's span is its child (zero if untraced)
+
+	Signature string // HMAC over the request with the cluster secret (empty if unsigned); see RequestSignature
+}
+
+// Response is a Trader's answer to a Request or BuyRequest
+type Response struct {
+	Status    string
+	Message   string
+	RequestID int
+	Processed bool     // Indicates if the request was processed
+	TraderID  int      // Trader that produced the response
+	Signature string   // HMAC over the response with the cluster secret (empty if unsigned)
+	Session   string   // Refreshed session token for registered Sellers (empty otherwise)
+	Path      []string // Hops the request took, ending with the Trader that handled it
+
+	RetryAfter time.Duration // How long to back off before retrying (only set with status Overloaded)
+
+	// Dry-run report (only populated when Request.DryRun is set); Price is also the
+	// total paid for a purchase
+	Price     float64       // Total price of the requested quantity
+	PriceRule string        // Pricing rule the price was computed with (empty for list price)
+	Stock     int           // Stock of the item currently held by the Trader
+	ETA       time.Duration // Expected time until the request would be processed
+
+	Trace tracing.Context // Span that pushed or produced the response (zero if untraced)
+}
+
+// BuyRequest is a Buyer's purchase, sent to Trader.Buy
+type BuyRequest struct {
+	BuyerID   int
+	Post      int
+	Item      string
+	Quantity  int
+	RequestID int      // Unique per Buyer; retries reuse it
+	Path      []string // Hops so far, e.g. [buyer-7 trader-1]; each Trader appends itself
+
+	Federated bool // Sent by a federation gateway on behalf of another cluster; filled here or refused, never federated again
+
+	Signature string // HMAC over the purchase with the cluster secret (empty if unsigned); see BuyRequestSignature
+}
+
+// CancelArgs identifies a request the Seller is no longer waiting for
+type CancelArgs struct {
+	SellerID  int
+	RequestID int
+	Signature string // See CancelSignature (empty if unsigned)
+}
+
+// ListPrices is the unit list price of every item the market trades
+var ListPrices = map[string]float64{
+	"apples":  1.0,
+	"oranges": 1.5,
+	"pears":   2.0,
+}
+
+// ======= DIRECT TRADES =======
+
+// SellerContact is a registered Seller a Buyer can trade with directly while no Trader is
+// reachable
+type SellerContact struct {
+	ID      int
+	Address string
+	Post    int
+}
+
+// DirectOffer asks a Seller to hold stock for a direct purchase; the first phase of a
+// direct trade
+type DirectOffer struct {
+	BuyerID   int
+	RequestID int // Unique per Buyer, like a purchase sent to a Trader
+	Post      int
+	Item      string
+	Quantity  int
+	Signature string // See DirectOfferSignature (empty if unsigned)
+}
+
+// DirectDecision commits or aborts a direct trade the Seller holds stock for; the second
+// phase of a direct trade
+type DirectDecision struct {
+	BuyerID   int
+	RequestID int
+	Commit    bool
+	Signature string // See DirectDecisionSignature (empty if unsigned)
+}
+
+// DirectReply is a Seller's answer to either phase of a direct trade
+type DirectReply struct {
+	SellerID  int
+	RequestID int
+	Status    string  // Prepared, Committed, Aborted, OutOfStock or Refused
+	Price     float64 // Total price of the quantity held or sold
+	Message   string
+	Signature string // See DirectReplySignature (empty if unsigned)
+}
+
+// DirectTrade is a direct trade a Seller committed, kept until a Trader reconciles it
+type DirectTrade struct {
+	BuyerID   int       `json:"buyer_id"`
+	RequestID int       `json:"request_id"`
+	SellerID  int       `json:"seller_id"`
+	Post      int       `json:"post"`
+	Item      string    `json:"item"`
+	Quantity  int       `json:"quantity"`
+	Price     float64   `json:"price"`
+	At        time.Time `json:"at"`
+}
+
+// DirectTradeReport carries a Seller's direct trades to a Trader once one is reachable again
+type DirectTradeReport struct {
+	SellerID  int
+	Trades    []DirectTrade
+	Signature string // See DirectReportSignature (empty if unsigned)
+}
+
+// ======= REGISTRATION AND SESSIONS =======
+
+// streamAddressPrefix marks the address of a client-only Seller (see StreamAddress)
+const streamAddressPrefix = "stream:"
+
+// StreamAddress is the address a client-only Seller registers under. Nothing listens
+// there: Traders never dial it and send the Seller everything over its response stream.
+func StreamAddress(sellerID int) string {
+	return fmt.Sprintf("%sseller-%d", streamAddressPrefix, sellerID)
+}
+
+// IsStreamAddress reports whether addr belongs to a client-only Seller
+func IsStreamAddress(addr string) bool {
+	return strings.HasPrefix(addr, streamAddressPrefix)
+}
+
+// SellerInfo is a Seller's registration, sent to Trader.RegisterSeller. The Trader keeps
+// more per Seller (generation, watermark, leases); only these fields travel.
+type SellerInfo struct {
+	ID        int
+	Address   string
+	Post      int
+	Signature string // See RegistrationSignature (empty if unsigned)
+}
+
+// BuyerInfo is a Buyer's registration, sent to Trader.RegisterBuyer
+type BuyerInfo struct {
+	ID        int
+	Address   string
+	Signature string // See BuyerRegistrationSignature (empty if unsigned)
+}
+
+// RegisterReply reports the outcome of a registration
+type RegisterReply struct {
+	Generation int64
+	Replaced   string // Previous address of the Seller, if this registration replaced it
+	Session    string // Token for resuming the session on any Trader
+}
+
+// ResumeArgs presents a session token, from the Seller's current address
+type ResumeArgs struct {
+	Token     string
+	Address   string
+	Signature string // See ResumeSignature (empty if unsigned)
+}
+
+// LeaseArgs asks for a block of request IDs for a Seller
+type LeaseArgs struct {
+	SellerID int
+	Count    int
+	Above    int // Highest request ID the Seller has used; the block starts above it
+	Floor    int // Every request ID below this one is resolved and will not be sent again
+
+	Signature string // See LeaseSignature (empty if unsigned)
+}
+
+// LeaseReply is a leased block of request IDs, First through Last inclusive
+type LeaseReply struct {
+	First, Last int
+	Session     string // Refreshed session token carrying the lease (empty if the Seller is not registered)
+}
+
+// PendingArgs identifies a Seller fetching its poll-mode responses by its session token
+type PendingArgs struct {
+	Session string
+}
+
+// StreamArgs identifies a Seller reading its response stream by its session token. Ack
+// is the highest Seq it has received; those messages are forgotten.
+type StreamArgs struct {
+	Session string
+	Ack     int64
+}
+
+// StreamMessage is one outcome or notification sent down a Seller's response stream
+type StreamMessage struct {
+	Seq        int64
+	Kind       string // "response", "leader", "correction", "spoilage" or "marker"
+	Response   *Response
+	Leader     *LeaderUpdate
+	Correction *Correction
+	Spoilage   *SpoilageNotice
+	Marker     *Marker // Snapshot marker, sent to client-only Sellers instead of calling Seller.Snapshot
+}
+
+// ======= NOTIFICATIONS =======
+
+// LeaderUpdate tells Sellers and Buyers which Trader to talk to after a failover
+type LeaderUpdate struct {
+	Address   string
+	TraderID  int
+	Term      int64  // Leadership term; Sellers ignore updates from older terms
+	IssuedAt  int64  // Unix nanoseconds; stale updates are rejected
+	Signature string // HMAC over the update with the cluster secret (empty if unsigned)
+}
+
+// LeaderUpdateMaxAge bounds how old a signed leader notification may be, limiting replays
+const LeaderUpdateMaxAge = 30 * time.Second
+
+// NodeIdentity describes the node answering at an address, as returned by Trader.Identify
+type NodeIdentity struct {
+	Role    string // "trader" or "seller"
+	ID      int
+	Address string
+	Domain  string    // Failure domain (machine or rack label); empty if unset
+	Time    time.Time // Node's wall clock when answering, used for skew checks
+	Leader  bool      // Whether the node currently considers itself leader
+	Term    int64     // Leadership term of the node
+	Post    int       // Post a Trader owns; 0 for other nodes
+}
+
+// Correction is a Trader's signed record of a voided or adjusted trade, sent to
+// Seller.TradeCorrected
+type Correction struct {
+	Type        string    `json:"type"` // Always "correction", distinguishing it in the audit log
+	Time        time.Time `json:"time"`
+	TraderID    int       `json:"trader_id"`
+	SellerID    int       `json:"seller_id"`
+	RequestID   int       `json:"request_id"`
+	Post        int       `json:"post"`
+	Item        string    `json:"item"`
+	OldQuantity int       `json:"old_quantity"`
+	NewQuantity int       `json:"new_quantity"`
+	Reason      string    `json:"reason"`
+	Signature   string    `json:"signature"` // HMAC over the correction with the session key
+}
+
+// SpoilageNotice tells a Seller that stock it deposited expired unsold, sent to
+// Seller.Spoiled
+type SpoilageNotice struct {
+	TraderID  int
+	SellerID  int
+	RequestID int
+	Item      string
+	Quantity  int
+	Expired   time.Time
+	Signature string // HMAC over the notice with the cluster secret (empty if unsigned)
+}
+
+// SubscribeArgs asks a Trader to send market summaries to <Service>.MarketSummary at Address
+type SubscribeArgs struct {
+	Address     string
+	Service     string
+	Unsubscribe bool
+}
+
+// MarketSummary is a Trader's periodic view of the market
+type MarketSummary struct {
+	TraderID     int
+	Time         time.Time
+	Interval     time.Duration      // Period the volume covers
+	Stock        map[string]int     // Total stock per item held by this Trader (plus its peer's, if replicated)
+	IncludesPeer bool               // Whether Stock includes the replica of the peer's inventory
+	Prices       map[string]float64 // Current unit price per item
+	Volume       map[string]int     // Quantity traded per item during the interval
+	Trades       int                // Requests committed during the interval
+	Value        float64            // Valuation of Stock at current prices
+	Leaderboard  *Leaderboard       // Cumulative sales ranking when the summary was computed
+}
+
+// ItemSales is the cumulative quantity of one item Sellers sold to a Trader
+type ItemSales struct {
+	Item     string
+	Quantity int
+	Leader   int     // Seller that sold the most of the item
+	Share    float64 // Leader's fraction of the item's sales
+}
+
+// SellerSales is one Seller's cumulative sales to a Trader
+type SellerSales struct {
+	SellerID int
+	Quantity int            // Units sold across all items
+	Items    map[string]int // Units sold per item
+	Share    float64        // Fraction of all units the Trader bought from Sellers
+}
+
+// Leaderboard ranks items and Sellers by cumulative sales to a Trader, best first
+type Leaderboard struct {
+	TraderID int
+	Time     time.Time
+	Total    int // Units sold by all Sellers
+	Items    []ItemSales
+	Sellers  []SellerSales
+}
+
+// ShareOf returns a Seller's share of all sales, or 0 if it has sold nothing
+func (lb *Leaderboard) ShareOf(sellerID int) float64 {
+	for _, s := range lb.Sellers {
+		if s.SellerID == sellerID {
+			return s.Share
+		}
+	}
+	return 0
+}
+
+// Marker starts or joins a global snapshot; Traders send it to their peer and Sellers
+type Marker struct {
+	SnapshotID int64 // Unix nanoseconds at which the snapshot was started
+	From       int   // Trader that sent the marker
+}
+
+// ShutdownArgs asks a Trader or Seller to stop
+type ShutdownArgs struct {
+	Token string
+	Mode  string // "graceful" (default) or "immediate"
+}
+
+// ======= MESSAGE SIGNING =======
+
+// Sign computes a hex HMAC-SHA256 over the fields using the cluster secret
+func Sign(secret string, fields ...interface{}) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, f := range fields {
+		fmt.Fprintf(mac, "%v|", f)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ResponseSignature covers the Response fields a Seller acts on
+func ResponseSignature(secret string, res *Response) string {
+	return Sign(secret, "response", res.TraderID, res.RequestID, res.Status, res.Processed, res.Message)
+}
+
+// RequestSignature covers the Request fields a Trader acts on. The hop path, forwarding
+// term and trace change as the request travels between Traders, so they are left out
+// and the Seller's signature stays valid on every hop.
+func RequestSignature(secret string, req *Request) string {
+	return Sign(secret, "request", req.SellerID, req.Post, req.Item, req.Quantity, req.RequestID, req.DryRun, req.Delivery,
+		req.ResponseMode, req.Priority, req.Deadline.UnixNano(), req.ReadReplica, req.Summarizes)
+}
+
+// BuyRequestSignature covers every BuyRequest field except the hop path
+func BuyRequestSignature(secret string, req *BuyRequest) string {
+	return Sign(secret, "buy", req.BuyerID, req.Post, req.Item, req.Quantity, req.RequestID, req.Federated)
+}
+
+// RegistrationSignature covers every field of a Seller's registration
+func RegistrationSignature(secret string, info *SellerInfo) string {
+	return Sign(secret, "register", info.ID, info.Address, info.Post)
+}
+
+// ResumeSignature covers the session token and the address it is resumed from
+func ResumeSignature(secret string, args *ResumeArgs) string {
+	return Sign(secret, "resume", args.Token, args.Address)
+}
+
+// BuyerRegistrationSignature covers every field of a Buyer's registration
+func BuyerRegistrationSignature(secret string, info *BuyerInfo) string {
+	return Sign(secret, "register-buyer", info.ID, info.Address)
+}
+
+// PeerSignature covers the arguments of a call between the Traders of a cluster, such as
+// a replication batch or an election message. args must be a pointer to a struct whose
+// Signature field is tagged json:"-"; every other exported field is covered, as the
+// receiver decodes it, since gob turns empty slices and maps into nil ones.
+func PeerSignature(secret, method string, args interface{}) string {
+	decoded := reflect.New(reflect.TypeOf(args).Elem())
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(args); err == nil {
+		gob.NewDecoder(&buf).DecodeValue(decoded)
+	}
+	data, _ := json.Marshal(decoded.Interface())
+	return Sign(secret, "peer", method, string(data))
+}
+
+// LeaseSignature covers every field of a request ID lease
+func LeaseSignature(secret string, args *LeaseArgs) string {
+	return Sign(secret, "lease", args.SellerID, args.Count, args.Above, args.Floor)
+}
+
+// CancelSignature covers the Seller and request a cancellation names
+func CancelSignature(secret string, args *CancelArgs) string {
+	return Sign(secret, "cancel", args.SellerID, args.RequestID)
+}
+
+// LeaderUpdateSignature covers every field of a leader notification
+func LeaderUpdateSignature(secret string, u *LeaderUpdate) string {
+	return Sign(secret, "leader", u.TraderID, u.Address, u.Term, u.IssuedAt)
+}
+
+// CorrectionSignature covers every field of a correction except the signature itself. A
+// Trader signs with the cluster secret, or its own session key if it has none.
+func CorrectionSignature(secret string, c *Correction) string {
+	return Sign(secret, "correction", c.TraderID, c.SellerID, c.RequestID, c.Post, c.Item, c.OldQuantity, c.NewQuantity, c.Reason, c.Time.UnixNano())
+}
+
+// SpoilageSignature covers every field of a spoilage notice except the signature itself
+func SpoilageSignature(secret string, n *SpoilageNotice) string {
+	return Sign(secret, "spoilage", n.TraderID, n.SellerID, n.RequestID, n.Item, n.Quantity, n.Expired.UnixNano())
+}
+
+// DirectOfferSignature covers every field of a direct offer
+func DirectOfferSignature(secret string, o *DirectOffer) string {
+	return Sign(secret, "direct-offer", o.BuyerID, o.RequestID, o.Post, o.Item, o.Quantity)
+}
+
+// DirectDecisionSignature covers every field of a direct trade decision
+func DirectDecisionSignature(secret string, d *DirectDecision) string {
+	return Sign(secret, "direct-decision", d.BuyerID, d.RequestID, d.Commit)
+}
+
+// DirectReplySignature covers every field of a Seller's direct trade reply
+func DirectReplySignature(secret string, r *DirectReply) string {
+	return Sign(secret, "direct-reply", r.SellerID, r.RequestID, r.Status, r.Price, r.Message)
+}
+
+// DirectReportSignature covers the Seller and every trade of a direct trade report
+func DirectReportSignature(secret string, r *DirectTradeReport) string {
+	fields := []interface{}{"direct-report", r.SellerID}
+	for _, t := range r.Trades {
+		fields = append(fields, t.BuyerID, t.RequestID, t.SellerID, t.Post, t.Item, t.Quantity, t.Price, t.At.UnixNano())
+	}
+	return Sign(secret, fields...)
+}
+
+// ======= CLIENT =======
+
+// TimeScale speeds up (>1) or slows down (<1) every simulated delay, ticker and timeout,
+// so the same configuration can run as a quick smoke test or a full-speed experiment
+var TimeScale = 1.0
+
+// Scaled converts a nominal duration into wall-clock time under the current time scale
+func Scaled(d time.Duration) time.Duration {
+	return time.Duration(float64(d) / TimeScale)
+}
+
+// Dial connects to the node at addr, giving up after timeout (0 leaves it to the OS)
+func Dial(addr string, timeout time.Duration) (*rpc.Client, error) {
+	conn, err := DialConn(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// DialTimeouts connects to the node at addr, giving up after the default deadline of
+// timeouts under the time scale
+func DialTimeouts(addr string, timeouts Timeouts) (*rpc.Client, error) {
+	return Dial(addr, Scaled(timeouts.Default))
+}
+
+// DialConn opens a connection to the node at addr, over TLS once UseTLS installed a
+// client configuration. With a timeout, the TLS handshake also fails after it.
+func DialConn(addr string, timeout time.Duration) (net.Conn, error) {
+	tlsMu.RLock()
+	cfg, dial := clientTLS, dialer
+	tlsMu.RUnlock()
+	if dial != nil {
+		return dial(addr, timeout)
+	}
+	if cfg == nil {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, cfg)
+}
+
+// Call dials addr, makes one call and closes the connection. With a timeout, dialing and
+// the call each fail after it.
+func Call(addr, method string, args, reply interface{}, timeout time.Duration) error {
+	client, err := Dial(addr, timeout)
+	if err != nil {
+		return err
+	}
+	return callOnce(client, addr, method, args, reply, timeout)
+}
+
+// CallNode is Call through DialNode: over TLS, the server's certificate must name the node
+func CallNode(addr, name, method string, args, reply interface{}, timeout time.Duration) error {
+	client, err := DialNode(addr, name, timeout)
+	if err != nil {
+		return err
+	}
+	return callOnce(client, addr, method, args, reply, timeout)
+}
+
+// callOnce makes one call on client and closes it
+func callOnce(client *rpc.Client, addr, method string, args, reply interface{}, timeout time.Duration) error {
+	defer client.Close()
+	if err := CallTimeout(client, method, args, reply, timeout); err != nil {
+		if errors.Is(err, ErrTimeout) {
+			return fmt.Errorf("%s on %s: %w", method, addr, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// ErrTimeout is wrapped by the errors of calls that ran out of time. A connection with a
+// timed-out call may be half dead, so callers that keep connections should drop it.
+var ErrTimeout = errors.New("timed out")
+
+// CallContext makes a call on an open connection and returns when it completes or ctx
+// is done, whichever comes first. The reply of an abandoned call must not be used.
+func CallContext(ctx context.Context, client *rpc.Client, method string, args, reply interface{}) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%s %w", method, ErrTimeout)
+		}
+		return ctx.Err()
+	}
+}
+
+// CallTimeout makes a call on an open connection, failing after timeout (0 waits
+// indefinitely)
+func CallTimeout(client *rpc.Client, method string, args, reply interface{}, timeout time.Duration) error {
+	if timeout <= 0 {
+		return client.Call(method, args, reply)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := CallContext(ctx, client, method, args, reply); err != nil {
+		if errors.Is(err, ErrTimeout) {
+			return fmt.Errorf("%w after %s", err, timeout)
+		}
+		return err
+	}
+	return nil
+}
+
+// DefaultTimeouts are the deadlines of RPCs that legitimately take longer than a control
+// call: processing a request, waiting on a stream, or moving a batch of state.
+var DefaultTimeouts = map[string]time.Duration{
+	"Trader.ReceiveRequest":   60 * time.Second,
+	"Trader.Buy":              60 * time.Second,
+	"Gateway.Buy":             60 * time.Second,
+	"Trader.Stream":           30 * time.Second,
+	"Trader.FetchStateChunk":  30 * time.Second,
+	"Trader.AcceptHandback":   30 * time.Second,
+	"Trader.AppendRequest":    2 * time.Second,
+	"Trader.ReceiveHeartbeat": 2 * time.Second,
+	"Trader.Ping":             time.Second,
+}
+
+// Timeouts gives every RPC a deadline, configurable per method or per service
+type Timeouts struct {
+	Default time.Duration            // Dialing, and methods not listed; 0 waits indefinitely
+	Methods map[string]time.Duration // By "Service.Method", or "Service" for all its methods
+}
+
+// ParseTimeouts starts from DefaultTimeouts and applies a spec such as
+// "Trader.ReceiveRequest=30s,Warehouse=2s"
+func ParseTimeouts(def time.Duration, spec string) (Timeouts, error) {
+	t := Timeouts{Default: def, Methods: make(map[string]time.Duration)}
+	for method, d := range DefaultTimeouts {
+		t.Methods[method] = d
+	}
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(field, "=")
+		if !ok || name == "" {
+			return t, fmt.Errorf("expected <method>=<duration>, got %q", field)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return t, fmt.Errorf("bad timeout for %s: %q", name, value)
+		}
+		t.Methods[name] = d
+	}
+	return t, nil
+}
+
+// For returns the deadline of method: its own, else its service's, else the default
+func (t Timeouts) For(method string) time.Duration {
+	if d, ok := t.Methods[method]; ok {
+		return d
+	}
+	if service, _, ok := strings.Cut(method, "."); ok {
+		if d, ok := t.Methods[service]; ok {
+			return d
+		}
+	}
+	return t.Default
+}
+
+// Identify asks the node at addr to identify itself
+func Identify(addr string, timeout time.Duration) (NodeIdentity, error) {
+	var id NodeIdentity
+	err := Call(addr, "Trader.Identify", 0, &id, timeout)
+	return id, err
+}
+
+// ProbeTrader asks the node at addr to identify itself, giving up after 2s under the time
+// scale
+func ProbeTrader(addr string) (NodeIdentity, error) {
+	return Identify(addr, Scaled(2*time.Second))
+}
+
+// Retry runs an operation until it succeeds, sleeping Backoff after the first failure and
+// doubling the sleep up to MaxBackoff
+type Retry struct {
+	Attempts   int           // Total attempts; 0 retries forever
+	Backoff    time.Duration // Sleep after the first failure
+	MaxBackoff time.Duration // Longest sleep; 0 keeps doubling
+}
+
+// Do runs op until it succeeds or the attempts run out, returning its last error. An
+// error the server returned (rpc.ServerError) means the call arrived and was refused, so
+// it is returned at once instead of retried.
+func (r Retry) Do(op func() error) error {
+	sleep := r.Backoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		var refused rpc.ServerError
+		if err == nil || errors.As(err, &refused) {
+			return err
+		}
+		if r.Attempts > 0 && attempt >= r.Attempts {
+			return err
+		}
+		time.Sleep(sleep)
+		sleep *= 2
+		if r.MaxBackoff > 0 && sleep > r.MaxBackoff {
+			sleep = r.MaxBackoff
+		}
+	}
+}
+
+// ReadRouter picks the Trader each read goes to. With Split, reads are spread round
+// robin over every healthy Trader, so they take load off the leader; without it they go
+// to the leader like writes. It is safe for concurrent use.
+type ReadRouter struct {
+	Split    bool
+	Cooldown time.Duration // How long a Trader that failed a read is skipped (default 10s)
+
+	mu        sync.Mutex
+	next      int
+	down      map[string]time.Time
+	toLeader  int
+	offloaded int
+}
+
+// Pick returns the Trader for the next read, among the leader and the other traders
+func (r *ReadRouter) Pick(leader string, traders []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.Split {
+		r.toLeader++
+		return leader
+	}
+	healthy := []string{leader}
+	for _, addr := range traders {
+		if addr != leader && time.Now().After(r.down[addr]) {
+			healthy = append(healthy, addr)
+		}
+	}
+	addr := healthy[r.next%len(healthy)]
+	r.next++
+	if addr == leader {
+		r.toLeader++
+	} else {
+		r.offloaded++
+	}
+	return addr
+}
+
+// Failed skips addr for the next reads, until the cooldown passes
+func (r *ReadRouter) Failed(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.down == nil {
+		r.down = make(map[string]time.Time)
+	}
+	cooldown := r.Cooldown
+	if cooldown <= 0 {
+		cooldown = 10 * time.Second
+	}
+	r.down[addr] = time.Now().Add(cooldown)
+}
+
+// Counts returns how many reads went to the leader and how many to other Traders
+func (r *ReadRouter) Counts() (toLeader, offloaded int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.toLeader, r.offloaded
+}
+
+// Pool keeps one reusable connection per remote address, so repeated calls to the same
+// node skip the dial. An rpc.Client multiplexes calls, so one connection per address
+// carries any number of concurrent calls. It is safe for concurrent use.
+type Pool struct {
+	Dial        func(addr string) (*rpc.Client, error)
+	MaxConns    int           // Most connections kept; the least recently used idle one makes room (0 for no limit)
+	IdleTimeout time.Duration // Connections unused this long are closed by Reap (0 keeps them)
+
+	mu        sync.Mutex
+	conns     map[string]*pooledConn
+	dials     int
+	reuses    int
+	evictions int
+}
+
+// pooledConn is a pooled connection, with the calls running on it
+type pooledConn struct {
+	client   *rpc.Client
+	inUse    int
+	lastUsed time.Time
+}
+
+// PoolStats counts a pool's connections and how they were used
+type PoolStats struct {
+	Open      int // Connections held
+	Dials     int // Connections dialed
+	Reuses    int // Calls made over a connection already held
+	Evictions int // Connections closed for being idle or to make room
+}
+
+// Do runs op over the pooled connection to addr, dialing one if needed. A connection op
+// finds broken is dropped; if it was already closed before op used it, Do redials and
+// runs op once more. When the pool is full of busy connections, op gets a connection of
+// its own that is closed afterwards.
+func (p *Pool) Do(addr string, op func(client *rpc.Client) error) error {
+	for attempt := 0; ; attempt++ {
+		pc, err := p.acquire(addr)
+		if err != nil {
+			return err
+		}
+		err = op(pc.client)
+		p.release(addr, pc, err)
+		if err != rpc.ErrShutdown || attempt > 0 {
+			return err
+		}
+	}
+}
+
+// acquire returns the connection to addr, marked in use
+func (p *Pool) acquire(addr string) (*pooledConn, error) {
+	p.mu.Lock()
+	if pc := p.conns[addr]; pc != nil {
+		pc.inUse++
+		p.reuses++
+		p.mu.Unlock()
+		return pc, nil
+	}
+	p.mu.Unlock()
+
+	client, err := p.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	pc := &pooledConn{client: client, inUse: 1}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dials++
+	if held := p.conns[addr]; held != nil {
+		client.Close() // Another caller dialed first
+		held.inUse++
+		return held, nil
+	}
+	if p.MaxConns > 0 && len(p.conns) >= p.MaxConns && !p.evictLocked() {
+		return pc, nil // Not pooled; release closes it
+	}
+	if p.conns == nil {
+		p.conns = make(map[string]*pooledConn)
+	}
+	p.conns[addr] = pc
+	return pc, nil
+}
+
+// release marks a call on pc finished, dropping the connection if err shows it broke.
+// An answer with an error still proves the connection works.
+func (p *Pool) release(addr string, pc *pooledConn, err error) {
+	_, answered := err.(rpc.ServerError)
+	broken := err != nil && !answered
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc.inUse--
+	pc.lastUsed = time.Now()
+	pooled := p.conns[addr] == pc
+	if pooled && broken {
+		delete(p.conns, addr)
+		pooled = false
+	}
+	if !pooled && pc.inUse == 0 {
+		pc.client.Close()
+	}
+}
+
+// evictLocked closes the least recently used idle connection, reporting false if every
+// connection is busy
+func (p *Pool) evictLocked() bool {
+	victim := ""
+	for addr, pc := range p.conns {
+		if pc.inUse == 0 && (victim == "" || pc.lastUsed.Before(p.conns[victim].lastUsed)) {
+			victim = addr
+		}
+	}
+	if victim == "" {
+		return false
+	}
+	p.conns[victim].client.Close()
+	delete(p.conns, victim)
+	p.evictions++
+	return true
+}
+
+// Get returns the connection held for addr without using it, or nil
+func (p *Pool) Get(addr string) *rpc.Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc := p.conns[addr]; pc != nil {
+		return pc.client
+	}
+	return nil
+}
+
+// Drop closes the connection held for addr once its calls finish. With a non-nil client,
+// it is dropped only if it is still the one held.
+func (p *Pool) Drop(addr string, client *rpc.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc := p.conns[addr]
+	if pc == nil || (client != nil && pc.client != client) {
+		return
+	}
+	delete(p.conns, addr)
+	if pc.inUse == 0 {
+		pc.client.Close()
+	}
+}
+
+// Reap closes the connections idle for longer than IdleTimeout and returns how many
+func (p *Pool) Reap() int {
+	if p.IdleTimeout <= 0 {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	reaped := 0
+	for addr, pc := range p.conns {
+		if pc.inUse == 0 && time.Since(pc.lastUsed) > p.IdleTimeout {
+			pc.client.Close()
+			delete(p.conns, addr)
+			reaped++
+		}
+	}
+	p.evictions += reaped
+	return reaped
+}
+
+// Stats returns the pool's counters
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{Open: len(p.conns), Dials: p.dials, Reuses: p.reuses, Evictions: p.evictions}
+}
+
+// TraderClient calls the Seller- and Buyer-facing RPCs of one Trader. Each call uses its
+// own connection; Stream callers that want one long-lived connection use Dial instead.
+// Writes always go to Addr, the leader. Reads go wherever Reads picks among Addr and
+// Readers, falling back to Addr if that Trader fails.
+type TraderClient struct {
+	Addr    string
+	Timeout time.Duration // Per dial and per call; 0 waits indefinitely
+	Secret  string        // Cluster secret the Seller's and Buyer's calls are signed with (unsigned if empty)
+
+	Readers []string    // Other Traders that may serve reads
+	Reads   *ReadRouter // nil sends reads to Addr
+}
+
+// call invokes method on the Trader
+func (c *TraderClient) call(method string, args, reply interface{}) error {
+	return Call(c.Addr, method, args, reply, c.Timeout)
+}
+
+// read invokes a read-only method on the Trader the router picks
+func (c *TraderClient) read(method string, args, reply interface{}) error {
+	if c.Reads == nil {
+		return c.call(method, args, reply)
+	}
+	addr := c.Reads.Pick(c.Addr, c.Readers)
+	err := Call(addr, method, args, reply, c.Timeout)
+	var refused rpc.ServerError
+	if err == nil || addr == c.Addr || errors.As(err, &refused) {
+		return err
+	}
+	c.Reads.Failed(addr)
+	return c.call(method, args, reply)
+}
+
+// Market fetches a Trader's latest market summary
+func (c *TraderClient) Market() (MarketSummary, error) {
+	var sum MarketSummary
+	err := c.read("Trader.Market", 0, &sum)
+	return sum, err
+}
+
+// Leaderboard fetches a Trader's sales ranking, limited to the top sellers (0 for all)
+func (c *TraderClient) Leaderboard(top int) (Leaderboard, error) {
+	var lb Leaderboard
+	err := c.read("Trader.GetLeaderboard", top, &lb)
+	return lb, err
+}
+
+// Quote sends a request as a dry run. With split reads, the Trader that gets it may
+// answer from its replica of the owning Trader's stock.
+func (c *TraderClient) Quote(req Request) (Response, error) {
+	req.DryRun = true
+	req.ReadReplica = c.Reads != nil && c.Reads.Split
+	if c.Secret != "" {
+		req.Signature = RequestSignature(c.Secret, &req)
+	}
+	var res Response
+	err := c.read("Trader.ReceiveRequest", &req, &res)
+	return res, err
+}
+
+// Identify asks the Trader for its identity, role and term
+func (c *TraderClient) Identify() (NodeIdentity, error) {
+	return Identify(c.Addr, c.Timeout)
+}
+
+// RegisterSeller registers a Seller and returns its session
+func (c *TraderClient) RegisterSeller(info SellerInfo) (RegisterReply, error) {
+	if c.Secret != "" {
+		info.Signature = RegistrationSignature(c.Secret, &info)
+	}
+	var reply RegisterReply
+	err := c.call("Trader.RegisterSeller", &info, &reply)
+	return reply, err
+}
+
+// RegisterSellersBulk registers many Sellers in one call and returns their sessions in
+// the same order; nothing is registered if any entry is invalid
+func (c *TraderClient) RegisterSellersBulk(infos []SellerInfo) ([]RegisterReply, error) {
+	if c.Secret != "" {
+		signed := make([]SellerInfo, len(infos))
+		for i, info := range infos {
+			info.Signature = RegistrationSignature(c.Secret, &info)
+			signed[i] = info
+		}
+		infos = signed
+	}
+	var replies []RegisterReply
+	err := c.call("Trader.RegisterSellersBulk", infos, &replies)
+	return replies, err
+}
+
+// ResumeSession resumes a Seller's session from its token
+func (c *TraderClient) ResumeSession(token, address string) (RegisterReply, error) {
+	args := ResumeArgs{Token: token, Address: address}
+	if c.Secret != "" {
+		args.Signature = ResumeSignature(c.Secret, &args)
+	}
+	var reply RegisterReply
+	err := c.call("Trader.ResumeSession", &args, &reply)
+	return reply, err
+}
+
+// LeaseRequestIDs leases a block of request IDs for a Seller
+func (c *TraderClient) LeaseRequestIDs(args LeaseArgs) (LeaseReply, error) {
+	if c.Secret != "" {
+		args.Signature = LeaseSignature(c.Secret, &args)
+	}
+	var reply LeaseReply
+	err := c.call("Trader.LeaseRequestIDs", &args, &reply)
+	return reply, err
+}
+
+// Deposit sends a Seller's request
+func (c *TraderClient) Deposit(req Request) (Response, error) {
+	if c.Secret != "" {
+		req.Signature = RequestSignature(c.Secret, &req)
+	}
+	var res Response
+	err := c.call("Trader.ReceiveRequest", &req, &res)
+	return res, err
+}
+
+// Buy sends a Buyer's purchase
+func (c *TraderClient) Buy(req BuyRequest) (Response, error) {
+	if c.Secret != "" {
+		req.Signature = BuyRequestSignature(c.Secret, &req)
+	}
+	var res Response
+	err := c.call("Trader.Buy", &req, &res)
+	return res, err
+}
+
+// RegisterBuyer registers a Buyer for leader updates
+func (c *TraderClient) RegisterBuyer(info BuyerInfo) error {
+	if c.Secret != "" {
+		info.Signature = BuyerRegistrationSignature(c.Secret, &info)
+	}
+	var reply string
+	return c.call("Trader.RegisterBuyer", &info, &reply)
+}
+
+// GetPending fetches the poll-mode outcomes ready for the session's Seller
+func (c *TraderClient) GetPending(session string) ([]Response, error) {
+	var ready []Response
+	err := c.call("Trader.GetPending", &PendingArgs{Session: session}, &ready)
+	return ready, err
+}
+
+// CancelRequest tells the Trader the Seller no longer waits for a request
+func (c *TraderClient) CancelRequest(sellerID, requestID int) error {
+	args := CancelArgs{SellerID: sellerID, RequestID: requestID}
+	if c.Secret != "" {
+		args.Signature = CancelSignature(c.Secret, &args)
+	}
+	var reply string
+	return c.call("Trader.CancelRequest", &args, &reply)
+}
+
+// ======= TLS =======
+
+var (
+	clientTLS *tls.Config // Configuration of outgoing connections; nil dials plaintext (guarded by tlsMu)
+	dialer    DialFunc    // Replaces the network for outgoing connections if set (guarded by tlsMu)
+	tlsMu     sync.RWMutex
+)
+
+// LoadTLS builds the TLS configurations of a node from its -tls-cert, -tls-key, -ca and
+// -mtls flags. The server configuration presents the node's certificate and is nil without
+// one; with mutual set, it also refuses clients without a certificate the cluster CA
+// signed. The client configuration trusts only the cluster CA, presents the node's
+// certificate to servers that ask for one, and is nil without -ca. Neither set means the
+// node stays plaintext.
+func LoadTLS(certFile, keyFile, caFile string, mutual bool) (server, client *tls.Config, err error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, nil, errors.New("-tls-cert and -tls-key must be given together")
+	}
+	if certFile != "" && caFile == "" {
+		return nil, nil, errors.New("-tls-cert needs -ca to verify the other nodes")
+	}
+	if mutual && certFile == "" {
+		return nil, nil, errors.New("-mtls needs -tls-cert, -tls-key and -ca")
+	}
+	var certs []tls.Certificate
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("loading TLS key pair: %w", err)
+		}
+		certs = []tls.Certificate{cert}
+	}
+	if caFile == "" {
+		return nil, nil, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading CA: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+	}
+	client = &tls.Config{RootCAs: roots, Certificates: certs, MinVersion: tls.VersionTLS12}
+	if certs != nil {
+		server = &tls.Config{Certificates: certs, MinVersion: tls.VersionTLS12}
+		if mutual {
+			server.ClientAuth = tls.RequireAndVerifyClientCert
+			server.ClientCAs = roots
+		}
+	}
+	return server, client, nil
+}
+
+// UseTLS makes every connection dialed through this package use cfg (nil for plaintext)
+func UseTLS(cfg *tls.Config) {
+	tlsMu.Lock()
+	clientTLS = cfg
+	tlsMu.Unlock()
+}
+
+// DialFunc opens a connection to the node at addr, giving up after timeout
+type DialFunc func(addr string, timeout time.Duration) (net.Conn, error)
+
+// UseDialer makes every connection dialed through this package come from dial instead of
+// the network (nil dials over TCP again), e.g. an in-memory transport in tests
+func UseDialer(dial DialFunc) {
+	tlsMu.Lock()
+	dialer = dial
+	tlsMu.Unlock()
+}
+
+// CertNames returns the node identities a certificate vouches for: its common name and
+// DNS subject alternative names, e.g. "trader-2"
+func CertNames(cert *x509.Certificate) []string {
+	names := []string{cert.Subject.CommonName}
+	return append(names, cert.DNSNames...)
+}
+
+// ErrWrongNode is wrapped by the error of DialNode when the server's certificate does
+// not name the node expected at the address
+var ErrWrongNode = errors.New("certificate names another node")
+
+// DialNode connects like Dial and, over TLS, also checks that the server's certificate
+// names the node expected there, so an impostor holding some other certificate the
+// cluster CA signed is refused. Plaintext connections are not checked.
+func DialNode(addr, name string, timeout time.Duration) (*rpc.Client, error) {
+	conn, err := DialConn(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		var names []string
+		if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+			names = CertNames(certs[0])
+		}
+		if !slices.Contains(names, name) {
+			conn.Close()
+			return nil, fmt.Errorf("node at %s: %w: expected %s, got %s", addr, ErrWrongNode, name, strings.Join(names, ", "))
+		}
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// ======= LOGGING =======
+
+// ParseLogLevel parses a -log-level flag: debug, info, warn or error
+func ParseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q (expected debug, info, warn or error)", s)
+	}
+	return level, nil
+}
+
+// NewLogger returns a structured logger writing text or JSON records at or above level
+// to w; a *slog.LevelVar lets the level change while the logger is in use. Every record carries attrs (the node kind, ID and so on) and, if role is not nil,
+// the node's role at the time of the record. The caller installs it with slog.SetDefault,
+// which also routes the standard log package through it.
+func NewLogger(w io.Writer, format string, level slog.Leveler, role func() string, attrs ...any) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q (expected text or json)", format)
+	}
+	h = h.WithAttrs(slog.Group("", attrs...).Value.Group())
+	if role != nil {
+		h = roleHandler{Handler: h, role: role}
+	}
+	return slog.New(h), nil
+}
+
+// roleHandler adds the node's current role to every record
+type roleHandler struct {
+	slog.Handler
+	role func() string
+}
+
+func (h roleHandler) Handle(ctx context.Context, r slog.Record) error {
+	rec := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	rec.AddAttrs(slog.String("role", h.role())) // Ahead of the record's own attributes
+	r.Attrs(func(a slog.Attr) bool {
+		rec.AddAttrs(a)
+		return true
+	})
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h roleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return roleHandler{Handler: h.Handler.WithAttrs(attrs), role: h.role}
+}
+
+func (h roleHandler) WithGroup(name string) slog.Handler {
+	return roleHandler{Handler: h.Handler.WithGroup(name), role: h.role}
+}
+
+// Fatal logs msg at error level and exits, like log.Fatal
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// OnTerminate runs stop on the first SIGINT or SIGTERM, which is expected to exit once
+// the process has shut down gracefully; a second signal exits right away
+func OnTerminate(stop func()) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		slog.Info("Shutting down gracefully; signal again to exit now", "signal", sig)
+		go stop()
+		sig = <-sigs
+		slog.Warn("Exiting without finishing the graceful shutdown", "signal", sig)
+		os.Exit(1)
+	}()
+}
@@ -0,0 +1,586 @@
+// Package config loads a cluster configuration file that sets the flags of every node,
+// so a deployment is described once instead of on every command line. A file is YAML
+// (.yaml, .yml) or TOML (.toml), in a subset of each: nested mappings or tables of
+// scalars and flat lists. Keys are flag names, at three levels:
+//   - top-level keys apply to every binary that has the flag, e.g. secret or time-scale;
+//   - a section named after a binary (trader, seller, buyer, warehouse, gateway) applies
+//     to every node of that kind, and must only name flags that binary has;
+//   - a section under the plural (traders, sellers, ...) keyed by -id applies to one node.
+//
+// More specific levels win. An environment variable A4_<FLAG> (upper case, dashes as
+// underscores, e.g. A4_TIME_SCALE) overrides the file, and a flag given on the command
+// line overrides both. Lists are passed to the flag joined with commas. Watch reloads the
+// file on SIGHUP for the settings a node can change while it runs.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Kinds are the binaries a file can have sections for
+var Kinds = []string{"trader", "seller", "buyer", "warehouse", "gateway"}
+
+// EnvPrefix starts the environment variable overriding each flag
+const EnvPrefix = "A4_"
+
+// entry is one value read from a file
+type entry struct {
+	path  []string // Key path, e.g. [traders 1 peer]
+	value string   // Scalar value; lists joined with commas
+	line  int
+}
+
+// Error is a problem in a config file, at the line it is on
+type Error struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// EnvName returns the environment variable overriding flag name
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Apply sets every flag of fs not given on the command line from the environment and
+// from the config file at path (environment only if path is empty). kind names the
+// binary; its node section is picked by the id flag, from the command line or A4_ID.
+// A4_CONFIG names the file if path is empty. It must be called after fs is parsed.
+func Apply(fs *flag.FlagSet, path, kind string) error {
+	given := commandLine(fs)
+
+	if v, ok := os.LookupEnv(EnvName("config")); ok && path == "" && !given["config"] {
+		path = v
+	}
+
+	// Values by flag, each level overriding the one before
+	values := make(map[string]string)
+	lines := make(map[string]int) // Line each value from the file is on
+	if path != "" {
+		entries, err := load(path)
+		if err != nil {
+			return err
+		}
+		id := ""
+		if f := fs.Lookup("id"); f != nil {
+			id = f.Value.String()
+			if v, ok := os.LookupEnv(EnvName("id")); ok && !given["id"] {
+				id = v
+			}
+		}
+		for level := 1; level <= 3; level++ {
+			for _, e := range entries {
+				name, err := resolve(e.path, kind, id)
+				if err != nil {
+					return &Error{path, e.line, err.Error()}
+				}
+				if name == "" || len(e.path) != level {
+					continue
+				}
+				if fs.Lookup(name) == nil {
+					if level == 1 {
+						continue // A shared setting for binaries that have the flag
+					}
+					return &Error{path, e.line, fmt.Sprintf("%s has no flag -%s%s", kind, name, suggest(fs, name))}
+				}
+				values[name], lines[name] = e.value, e.line
+			}
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(EnvName(f.Name)); ok {
+			values[f.Name] = v
+			delete(lines, f.Name)
+		}
+	})
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if given[name] || name == "config" {
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			if line, ok := lines[name]; ok {
+				return &Error{path, line, fmt.Sprintf("invalid value %q for -%s: %v", values[name], name, err)}
+			}
+			return fmt.Errorf("invalid value %q for -%s in %s: %v", values[name], name, EnvName(name), err)
+		}
+	}
+	snapshot := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) { snapshot[f.Name] = f.Value.String() })
+	givenMu.Lock()
+	loaded[fs] = snapshot
+	givenMu.Unlock()
+	return nil
+}
+
+// commandLine returns the flags of fs given on the command line. It is recorded on the
+// first call, before Apply sets any flag itself.
+func commandLine(fs *flag.FlagSet) map[string]bool {
+	givenMu.Lock()
+	defer givenMu.Unlock()
+	if given, ok := givenFlags[fs]; ok {
+		return given
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	givenFlags[fs] = given
+	return given
+}
+
+var (
+	givenFlags = make(map[*flag.FlagSet]map[string]bool)   // Command-line flags by flag set (guarded by givenMu)
+	loaded     = make(map[*flag.FlagSet]map[string]string) // Every flag's value as last loaded, by flag set (guarded by givenMu)
+	givenMu    sync.Mutex
+)
+
+// Watch reloads the configuration whenever the process receives SIGHUP, and never
+// returns. Every flag not given on the command line is reset to its default and set
+// again from the config file and the environment, as at startup. If only flags named in
+// reloadable changed, apply is called to hand their new values to the running node. A
+// change to any other flag is reverted with a warning, since it takes a restart; a file
+// that fails to load, or an apply that fails, leaves every flag as it was.
+func Watch(fs *flag.FlagSet, path, kind string, reloadable []string, apply func() error) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		reload(fs, path, kind, reloadable, apply)
+	}
+}
+
+// reload is one reload of Watch. Changes are found against the values the previous
+// load produced, since a binary may adjust a flag's value after loading it.
+func reload(fs *flag.FlagSet, path, kind string, reloadable []string, apply func() error) {
+	given := commandLine(fs)
+	givenMu.Lock()
+	prev := loaded[fs]
+	givenMu.Unlock()
+	current := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		current[f.Name] = f.Value.String()
+		if !given[f.Name] {
+			fs.Set(f.Name, f.DefValue)
+		}
+	})
+	restore := func(names ...string) {
+		for _, name := range names {
+			fs.Set(name, current[name])
+		}
+	}
+	err := Apply(fs, path, kind)
+	givenMu.Lock()
+	next := loaded[fs]
+	loaded[fs] = prev
+	givenMu.Unlock()
+	if err != nil {
+		fs.VisitAll(func(f *flag.Flag) { restore(f.Name) })
+		slog.Error("Failed to reload configuration; keeping the current settings", "err", err)
+		return
+	}
+
+	canReload := make(map[string]bool)
+	for _, name := range reloadable {
+		canReload[name] = true
+	}
+	var changed []string
+	fs.VisitAll(func(f *flag.Flag) {
+		switch {
+		case given[f.Name] || next[f.Name] == prev[f.Name]:
+			restore(f.Name) // Keeps any adjustment the binary made
+		case !canReload[f.Name]:
+			slog.Warn("Setting changed in the configuration, but only takes effect after a restart", "flag", f.Name, "value", prev[f.Name], "new", next[f.Name])
+			restore(f.Name)
+		default:
+			changed = append(changed, f.Name)
+		}
+	})
+	if len(changed) == 0 {
+		slog.Info("Reloaded configuration; no reloadable setting changed")
+		return
+	}
+	if err := apply(); err != nil {
+		restore(changed...)
+		slog.Error("Failed to apply reloaded configuration; keeping the current settings", "err", err)
+		return
+	}
+	givenMu.Lock()
+	for _, name := range changed {
+		loaded[fs][name] = next[name]
+	}
+	givenMu.Unlock()
+	attrs := []any{"changed", strings.Join(changed, ",")}
+	for _, name := range changed {
+		attrs = append(attrs, name, next[name])
+	}
+	slog.Info("Reloaded configuration", attrs...)
+}
+
+// resolve returns the flag an entry sets for node id of kind, or "" if the entry is for
+// another binary or node; it fails if the entry is in no known section
+func resolve(path []string, kind, id string) (string, error) {
+	known := func(section string) bool {
+		for _, k := range Kinds {
+			if section == k {
+				return true
+			}
+		}
+		return false
+	}
+	switch len(path) {
+	case 1:
+		return path[0], nil
+	case 2:
+		if !known(path[0]) {
+			return "", fmt.Errorf("unknown section %q (expected one of %s, or their plurals keyed by node ID)", path[0], strings.Join(Kinds, ", "))
+		}
+		if path[0] != kind {
+			return "", nil
+		}
+		return path[1], nil
+	case 3:
+		section := strings.TrimSuffix(path[0], "s")
+		if !strings.HasSuffix(path[0], "s") || !known(section) {
+			return "", fmt.Errorf("unknown section %q (node sections are under %ss and so on, keyed by node ID)", path[0], Kinds[0])
+		}
+		if _, err := strconv.Atoi(path[1]); err != nil {
+			return "", fmt.Errorf("%s.%s: node sections are keyed by numeric ID", path[0], path[1])
+		}
+		if section != kind || path[1] != id {
+			return "", nil
+		}
+		return path[2], nil
+	}
+	return "", fmt.Errorf("%s is nested too deeply", strings.Join(path, "."))
+}
+
+// suggest returns a hint naming the flag of fs closest to name, if any is close
+func suggest(fs *flag.FlagSet, name string) string {
+	best, bestDist := "", 3
+	fs.VisitAll(func(f *flag.Flag) {
+		if d := EditDistance(name, f.Name); d < bestDist || (d == bestDist && f.Name < best) {
+			best, bestDist = f.Name, d
+		}
+	})
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean -%s?)", best)
+}
+
+// EditDistance is the Levenshtein distance between a and b, used to suggest the name
+// closest to a misspelt one
+func EditDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// load reads the entries of a YAML or TOML file, chosen by its extension
+func load(path string) ([]entry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []entry
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		entries, err = parseYAML(string(data))
+	case ".toml":
+		entries, err = parseTOML(string(data))
+	default:
+		return nil, fmt.Errorf("%s: unknown config format %q (expected .yaml, .yml or .toml)", path, ext)
+	}
+	if err != nil {
+		err.(*Error).File = path
+		return nil, err
+	}
+	seen := make(map[string]int)
+	for _, e := range entries {
+		key := strings.Join(e.path, ".")
+		if line, dup := seen[key]; dup {
+			return nil, &Error{path, e.line, fmt.Sprintf("%s is already set on line %d", key, line)}
+		}
+		seen[key] = e.line
+	}
+	return entries, nil
+}
+
+// ======= YAML =======
+
+// parseYAML reads block mappings nested by indentation, with scalar values, flow lists
+// ([a, b]) or block lists (- a), and # comments
+func parseYAML(text string) ([]entry, error) {
+	type level struct {
+		indent int
+		key    string
+	}
+	var entries []entry
+	var stack []level
+	var list *entry // Block list being collected, if the last key had no value
+	listIndent := -1
+	for n, raw := range strings.Split(text, "\n") {
+		line := n + 1
+		content := strings.TrimRight(stripComment(raw), " \r")
+		if strings.TrimSpace(content) == "" || content == "---" {
+			continue
+		}
+		if strings.Contains(content[:len(content)-len(strings.TrimLeft(content, " \t"))], "\t") {
+			return nil, &Error{Line: line, Msg: "indent with spaces, not tabs"}
+		}
+		indent := len(content) - len(strings.TrimLeft(content, " "))
+		content = strings.TrimSpace(content)
+
+		if item, ok := strings.CutPrefix(content, "- "); ok || content == "-" {
+			if list == nil || (listIndent >= 0 && indent != listIndent) {
+				return nil, &Error{Line: line, Msg: "list item outside a list"}
+			}
+			listIndent = indent
+			value, err := scalar(item)
+			if err != nil {
+				return nil, &Error{Line: line, Msg: err.Error()}
+			}
+			if list.value != "" {
+				list.value += ","
+			}
+			list.value += value
+			continue
+		}
+		if list != nil {
+			entries = append(entries, *list)
+			list, listIndent = nil, -1
+		}
+
+		key, value, ok := strings.Cut(content, ":")
+		if !ok || key == "" {
+			return nil, &Error{Line: line, Msg: fmt.Sprintf("expected key: value, got %q", content)}
+		}
+		key = unquote(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		path := make([]string, 0, len(stack)+1)
+		for _, l := range stack {
+			path = append(path, l.key)
+		}
+		path = append(path, key)
+
+		if value == "" {
+			// A nested mapping or a block list follows
+			stack = append(stack, level{indent, key})
+			list = &entry{path: path, line: line}
+			continue
+		}
+		if strings.HasPrefix(value, "[") {
+			items, err := flowList(value)
+			if err != nil {
+				return nil, &Error{Line: line, Msg: err.Error()}
+			}
+			entries = append(entries, entry{path, items, line})
+			continue
+		}
+		v, err := scalar(value)
+		if err != nil {
+			return nil, &Error{Line: line, Msg: err.Error()}
+		}
+		entries = append(entries, entry{path, v, line})
+	}
+	if list != nil && list.value != "" {
+		entries = append(entries, *list)
+	}
+	// A key with neither a value nor items is an empty section, not an entry
+	kept := entries[:0]
+	for _, e := range entries {
+		if e.value != "" || !isSection(entries, e.path) {
+			kept = append(kept, e)
+		}
+	}
+	return kept, nil
+}
+
+// isSection reports whether another entry is nested under path
+func isSection(entries []entry, path []string) bool {
+	prefix := strings.Join(path, ".") + "."
+	for _, e := range entries {
+		if strings.HasPrefix(strings.Join(e.path, "."), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripComment removes a # comment outside quotes
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// scalar returns a value with its quotes removed
+func scalar(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "{") {
+		return "", fmt.Errorf("flow mappings are not supported; nest the keys on their own lines")
+	}
+	if strings.HasPrefix(s, "\"") {
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("bad quoted string %s", s)
+		}
+		return v, nil
+	}
+	return unquote(s), nil
+}
+
+// unquote removes single quotes, or double quotes without escapes
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// flowList reads a single-line list such as [a, "b", 3] and joins its items with commas
+func flowList(s string) (string, error) {
+	if !strings.HasSuffix(s, "]") {
+		return "", fmt.Errorf("unterminated list %s", s)
+	}
+	inner := strings.TrimSpace(s[1 : len(s)-1])
+	if inner == "" {
+		return "", nil
+	}
+	var items []string
+	for _, item := range splitList(inner) {
+		v, err := scalar(item)
+		if err != nil {
+			return "", err
+		}
+		items = append(items, v)
+	}
+	return strings.Join(items, ","), nil
+}
+
+// splitList splits list items on commas outside quotes
+func splitList(s string) []string {
+	var items []string
+	var quote rune
+	start := 0
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	if rest := strings.TrimSpace(s[start:]); rest != "" {
+		items = append(items, rest)
+	}
+	return items
+}
+
+// ======= TOML =======
+
+// parseTOML reads [table] headers and key = value pairs with strings, numbers, booleans
+// and single-line arrays, and # comments
+func parseTOML(text string) ([]entry, error) {
+	var entries []entry
+	var table []string
+	for n, raw := range strings.Split(text, "\n") {
+		line := n + 1
+		content := strings.TrimSpace(stripComment(raw))
+		if content == "" {
+			continue
+		}
+		if strings.HasPrefix(content, "[") {
+			if strings.HasPrefix(content, "[[") || !strings.HasSuffix(content, "]") {
+				return nil, &Error{Line: line, Msg: fmt.Sprintf("expected a [table] header, got %q", content)}
+			}
+			table = dottedKey(content[1 : len(content)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(content, "=")
+		if !ok {
+			return nil, &Error{Line: line, Msg: fmt.Sprintf("expected key = value, got %q", content)}
+		}
+		path := append(append([]string(nil), table...), dottedKey(key)...)
+		value = strings.TrimSpace(value)
+		var v string
+		var err error
+		switch {
+		case strings.HasPrefix(value, "["):
+			v, err = flowList(value)
+		case strings.HasPrefix(value, "\"") || strings.HasPrefix(value, "'"):
+			v, err = scalar(value)
+		case value == "true" || value == "false":
+			v = value
+		default:
+			if _, perr := strconv.ParseFloat(strings.ReplaceAll(value, "_", ""), 64); perr != nil {
+				err = fmt.Errorf("%s: strings such as durations and addresses must be quoted, got %s", strings.Join(path, "."), value)
+			}
+			v = strings.ReplaceAll(value, "_", "")
+		}
+		if err != nil {
+			return nil, &Error{Line: line, Msg: err.Error()}
+		}
+		entries = append(entries, entry{path, v, line})
+	}
+	return entries, nil
+}
+
+// dottedKey splits a TOML key such as traders.1 or traders."1" into its parts
+func dottedKey(key string) []string {
+	var parts []string
+	for _, part := range strings.Split(key, ".") {
+		parts = append(parts, unquote(strings.TrimSpace(part)))
+	}
+	return parts
+}
@@ -3,4 +3,6 @@
 sudo fuser -k 8003/tcp
 sudo fuser -k 8001/tcp
 sudo fuser -k 8002/tcp
-sudo fuser -k 8004/tcp
\ No newline at end of file
+sudo fuser -k 8004/tcp
+sudo fuser -k 8005/tcp
+sudo fuser -k 8006/tcp
\ No newline at end of file
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"a4/common"
+	"a4/config"
+	"a4/metrics"
+	"a4/rpcserver"
+)
+
+// ======= STRUCTS =======
+
+// FederatedBuy is a purchase a Trader could not fill from its own cluster, sent to
+// Gateway.Buy
+type FederatedBuy struct {
+	Cluster string // Cluster the purchase comes from; it is never routed back there
+	Request common.BuyRequest
+}
+
+// ClusterRoute is how the gateway reaches one cluster
+type ClusterRoute struct {
+	Traders []string `json:"traders"` // Trader addresses, tried in order; each sells from the post it owns
+	Timeout string   `json:"timeout"` // Deadline of each call into the cluster, e.g. "10s" (default -timeout)
+	Secret  string   `json:"secret"`  // The cluster's secret, to sign purchases and verify responses (unsigned if empty)
+
+	timeout time.Duration
+}
+
+// RoutingTable lists the federated clusters and the order to try them in for each item
+type RoutingTable struct {
+	Clusters map[string]*ClusterRoute `json:"clusters"`
+	Items    map[string][]string      `json:"items"` // Clusters to try for an item, in order; other items try every cluster by name
+}
+
+// Settlement is a purchase the gateway forwarded between clusters, appended to the
+// settlement log. The origin cluster owes the destination Price for the stock it sold.
+type Settlement struct {
+	Time            time.Time `json:"time"`
+	Status          string    `json:"status"` // "Purchased", or "InDoubt" if the destination did not answer and may have sold the stock
+	Origin          string    `json:"origin"`
+	Destination     string    `json:"destination"`
+	Trader          string    `json:"trader"` // Address of the destination Trader
+	TraderID        int       `json:"trader_id"`
+	BuyerID         int       `json:"buyer_id"`          // Buyer in the origin cluster
+	RequestID       int       `json:"request_id"`        // That Buyer's request ID
+	RemoteRequestID int       `json:"remote_request_id"` // Request ID the gateway bought under in the destination
+	Post            int       `json:"post"`              // Destination post the stock came from
+	Item            string    `json:"item"`
+	Quantity        int       `json:"quantity"`
+	Price           float64   `json:"price"`
+	PriceRule       string    `json:"price_rule,omitempty"`
+	Message         string    `json:"message"`
+}
+
+// SettlementsArgs asks for the gateway's balances and latest settlements
+type SettlementsArgs struct {
+	Token string
+	Limit int // Latest settlements to return (0 for none)
+}
+
+// SettlementsReply is the state of settlement between the federated clusters
+type SettlementsReply struct {
+	Balances    map[string]float64 // Net amount owed to each cluster; negative if it owes
+	Outcomes    map[string]int     // Forwarded purchases by outcome
+	InDoubt     int                // Purchases a cluster may have filled without answering
+	Settlements []Settlement       // Latest settlements, oldest first
+}
+
+// settlementKey identifies a purchase across the origin's retries
+type settlementKey struct {
+	Origin    string
+	BuyerID   int
+	RequestID int
+}
+
+// Gateway forwards purchases a cluster cannot fill to the other federated clusters,
+// buying in them as a Buyer of its own, and records what each cluster owes the others
+type Gateway struct {
+	ID         int // Buyer ID the gateway buys under in every cluster
+	Address    string
+	Routes     *RoutingTable
+	Deadline   time.Duration // Time spent on one purchase across every cluster tried
+	Path       string        // Settlement log
+	AdminToken string        // Credential required by Settlements; empty disables it
+	DevMode    bool
+
+	mu        sync.Mutex
+	log       *os.File                     // Settlement log, appended to (guarded by mu)
+	remoteIDs map[settlementKey]int        // Request ID each forwarded purchase is bought under (guarded by mu)
+	settled   map[settlementKey]Settlement // Filled purchases, so a retry gets the same answer (guarded by mu)
+	inDoubt   map[settlementKey]Settlement // Purchases whose destination may have filled them (guarded by mu)
+	nextID    int                          // Next remote request ID (guarded by mu)
+	balances  map[string]float64           // Net amount owed to each cluster (guarded by mu)
+	outcomes  map[string]int               // Forwarded purchases by outcome (guarded by mu)
+	recent    []Settlement                 // Latest settlements, oldest first (guarded by mu)
+	posts     map[string]int               // Post owned by each Trader, learned from its identity (guarded by mu)
+
+	purchases *metrics.Counter // Prometheus count of forwarded purchases by route and outcome; nil records nothing
+}
+
+// maxRecent bounds the settlements kept for Settlements replies
+const maxRecent = 1000
+
+// shutdownGrace bounds how long a graceful shutdown waits for forwarded purchases
+const shutdownGrace = 30 * time.Second
+
+// gatewayHop names the gateway in a purchase's hop path as it enters a cluster
+func gatewayHop(cluster string) string {
+	return "gateway-" + cluster
+}
+
+// ======= ROUTING =======
+
+// loadRoutes reads and checks a routing table
+func loadRoutes(path string, def time.Duration) (*RoutingTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rt RoutingTable
+	if err := json.Unmarshal(data, &rt); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if len(rt.Clusters) < 2 {
+		return nil, fmt.Errorf("%s: a federation needs at least two clusters, got %d", path, len(rt.Clusters))
+	}
+	for name, route := range rt.Clusters {
+		if len(route.Traders) == 0 {
+			return nil, fmt.Errorf("%s: cluster %q has no traders", path, name)
+		}
+		route.timeout = def
+		if route.Timeout != "" {
+			if route.timeout, err = time.ParseDuration(route.Timeout); err != nil || route.timeout <= 0 {
+				return nil, fmt.Errorf("%s: bad timeout for cluster %q: %q", path, name, route.Timeout)
+			}
+		}
+	}
+	for item, clusters := range rt.Items {
+		for _, name := range clusters {
+			if rt.Clusters[name] == nil {
+				return nil, fmt.Errorf("%s: item %q routes to unknown cluster %q", path, item, name)
+			}
+		}
+	}
+	return &rt, nil
+}
+
+// candidates returns the clusters to try for an item bought in origin, in order
+func (rt *RoutingTable) candidates(origin, item string) []string {
+	names, ok := rt.Items[item]
+	if !ok {
+		for name := range rt.Clusters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	var out []string
+	for _, name := range names {
+		if name != origin {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// ======= SETTLEMENT LOG =======
+
+// load replays the settlement log of earlier runs, so retries of purchases forwarded
+// before a restart are answered from it and keep their remote request IDs
+func (g *Gateway) load() error {
+	g.remoteIDs = make(map[settlementKey]int)
+	g.settled = make(map[settlementKey]Settlement)
+	g.inDoubt = make(map[settlementKey]Settlement)
+	g.balances = make(map[string]float64)
+	g.outcomes = make(map[string]int)
+	g.posts = make(map[string]int)
+	// Request IDs seeded from the clock stay clear of those a previous run used
+	g.nextID = int(time.Now().Unix()) * 1000
+
+	f, err := os.Open(g.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var s Settlement
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			return fmt.Errorf("%s:%d: %v", g.Path, line, err)
+		}
+		g.noteLocked(s)
+	}
+	return scanner.Err()
+}
+
+// noteLocked applies a settlement to the in-memory state; mu must be held
+func (g *Gateway) noteLocked(s Settlement) {
+	key := settlementKey{s.Origin, s.BuyerID, s.RequestID}
+	g.remoteIDs[key] = s.RemoteRequestID
+	g.nextID = max(g.nextID, s.RemoteRequestID+1)
+	switch s.Status {
+	case "Purchased":
+		g.settled[key] = s
+		delete(g.inDoubt, key)
+		g.balances[s.Destination] += s.Price
+		g.balances[s.Origin] -= s.Price
+	case "InDoubt":
+		g.inDoubt[key] = s
+	}
+	g.outcomes[s.Status]++
+	g.recent = append(g.recent, s)
+	if len(g.recent) > maxRecent {
+		g.recent = g.recent[1:]
+	}
+}
+
+// settleLocked appends a settlement to the log, synced before the origin is answered,
+// and applies it; mu must be held
+func (g *Gateway) settleLocked(s Settlement) error {
+	if g.log == nil {
+		f, err := os.OpenFile(g.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		g.log = f
+	}
+	data, err := json.Marshal(&s)
+	if err != nil {
+		return err
+	}
+	if _, err := g.log.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := g.log.Sync(); err != nil {
+		return err
+	}
+	g.noteLocked(s)
+	return nil
+}
+
+// ======= FORWARDING =======
+
+// errNotSent marks a failure before the purchase reached a Trader, which cannot have filled it
+var errNotSent = errors.New("purchase not sent")
+
+// post returns the post the Trader at addr owns, asking it the first time
+func (g *Gateway) post(addr string, timeout time.Duration) (int, error) {
+	g.mu.Lock()
+	post, ok := g.posts[addr]
+	g.mu.Unlock()
+	if ok {
+		return post, nil
+	}
+	id, err := common.Identify(addr, timeout)
+	if err != nil {
+		return 0, err
+	}
+	if id.Role != "trader" || id.Post <= 0 {
+		return 0, fmt.Errorf("%s is a %s, not a Trader owning a post", addr, id.Role)
+	}
+	g.mu.Lock()
+	g.posts[addr] = id.Post
+	g.mu.Unlock()
+	return id.Post, nil
+}
+
+// tryTrader buys from one Trader of a cluster. An error wrapping errNotSent means the
+// purchase never reached the Trader; any other error leaves it in doubt.
+func (g *Gateway) tryTrader(cluster, addr string, req common.BuyRequest) (common.Response, error) {
+	var res common.Response
+	route := g.Routes.Clusters[cluster]
+	req.Path = append(req.Path, gatewayHop(cluster))
+	if route.Secret != "" {
+		req.Signature = common.BuyRequestSignature(route.Secret, &req)
+	}
+	client, err := common.Dial(addr, route.timeout)
+	if err != nil {
+		return res, fmt.Errorf("%w: %v", errNotSent, err)
+	}
+	defer client.Close()
+	if err := common.CallTimeout(client, "Trader.Buy", &req, &res, route.timeout); err != nil {
+		return res, err
+	}
+	if route.Secret != "" && !hmac.Equal([]byte(common.ResponseSignature(route.Secret, &res)), []byte(res.Signature)) {
+		return res, fmt.Errorf("response from %s has an invalid signature", addr)
+	}
+	return res, nil
+}
+
+// Buy fills a purchase from the other clusters, trying their Traders in routing order
+// until one sells. A retry of a filled purchase gets its recorded answer; one left in
+// doubt goes back first to the Trader that may have filled it, under the same request ID.
+func (g *Gateway) Buy(args *FederatedBuy, res *common.Response) error {
+	if g.Routes.Clusters[args.Cluster] == nil {
+		return fmt.Errorf("unknown cluster %q", args.Cluster)
+	}
+	req := args.Request
+	if req.Federated {
+		return fmt.Errorf("purchase %d was already federated", req.RequestID)
+	}
+	key := settlementKey{args.Cluster, req.BuyerID, req.RequestID}
+	res.RequestID = req.RequestID
+	res.Path = req.Path
+
+	g.mu.Lock()
+	if s, ok := g.settled[key]; ok {
+		g.mu.Unlock()
+		slog.Info("Purchase was already settled; repeating its outcome", "origin", args.Cluster, "buyer", req.BuyerID, "request", req.RequestID)
+		settledResponse(res, s)
+		return nil
+	}
+	remoteID, ok := g.remoteIDs[key]
+	if !ok {
+		remoteID = g.nextID
+		g.nextID++
+		g.remoteIDs[key] = remoteID
+	}
+	doubt, pending := g.inDoubt[key]
+	g.mu.Unlock()
+
+	slog.Info("Forwarding purchase", "origin", args.Cluster, "buyer", req.BuyerID, "request", req.RequestID, "remote_request", remoteID,
+		"quantity", req.Quantity, "item", req.Item)
+	remote := common.BuyRequest{BuyerID: g.ID, Item: req.Item, Quantity: req.Quantity, RequestID: remoteID, Path: req.Path, Federated: true}
+
+	type attempt struct{ cluster, addr string }
+	var attempts []attempt
+	if pending {
+		attempts = append(attempts, attempt{doubt.Destination, doubt.Trader})
+	}
+	for _, cluster := range g.Routes.candidates(args.Cluster, req.Item) {
+		for _, addr := range g.Routes.Clusters[cluster].Traders {
+			if !pending || cluster != doubt.Destination || addr != doubt.Trader {
+				attempts = append(attempts, attempt{cluster, addr})
+			}
+		}
+	}
+
+	deadline := time.Now().Add(g.Deadline)
+	var refusals []string
+	for _, a := range attempts {
+		if time.Now().After(deadline) {
+			refusals = append(refusals, fmt.Sprintf("gave up after %s", g.Deadline))
+			break
+		}
+		post, err := g.post(a.addr, g.Routes.Clusters[a.cluster].timeout)
+		var fwd common.Response
+		if err == nil {
+			remote.Post = post
+			fwd, err = g.tryTrader(a.cluster, a.addr, remote)
+		} else {
+			err = fmt.Errorf("%w: %v", errNotSent, err)
+		}
+		if errors.Is(err, errNotSent) {
+			slog.Warn("Could not reach Trader", "cluster", a.cluster, "addr", a.addr, "err", err)
+			refusals = append(refusals, fmt.Sprintf("%s (%s) unreachable", a.addr, a.cluster))
+			continue
+		}
+
+		s := Settlement{Time: time.Now(), Origin: args.Cluster, Destination: a.cluster, Trader: a.addr, TraderID: fwd.TraderID,
+			BuyerID: req.BuyerID, RequestID: req.RequestID, RemoteRequestID: remoteID, Post: post, Item: req.Item, Quantity: req.Quantity}
+		if err != nil {
+			// The Trader may have sold the stock without answering; the origin's retry
+			// comes back to it under the same request ID and learns the outcome
+			s.Status = "InDoubt"
+			s.Message = err.Error()
+			g.mu.Lock()
+			if serr := g.settleLocked(s); serr != nil {
+				g.inDoubt[key] = s
+				slog.Warn("Failed to write settlement log", "err", serr)
+			}
+			g.mu.Unlock()
+			g.purchases.Inc(args.Cluster, a.cluster, s.Status)
+			slog.Warn("Purchase left in doubt", "origin", args.Cluster, "buyer", req.BuyerID, "request", req.RequestID, "cluster", a.cluster, "addr", a.addr, "err", err)
+			res.Status = "FederationInDoubt"
+			res.Message = fmt.Sprintf("Cluster %s did not answer purchase %d and may have filled it: %v", a.cluster, req.RequestID, err)
+			return nil
+		}
+		if fwd.Status != "Purchased" {
+			slog.Info("Cluster refused purchase", "cluster", a.cluster, "addr", a.addr, "request", req.RequestID, "status", fwd.Status, "reason", fwd.Message)
+			refusals = append(refusals, fmt.Sprintf("%s: %s", a.cluster, fwd.Message))
+			g.mu.Lock()
+			delete(g.inDoubt, key)
+			g.mu.Unlock()
+			continue
+		}
+
+		s.Status = "Purchased"
+		s.Price = fwd.Price
+		s.PriceRule = fwd.PriceRule
+		s.Message = fmt.Sprintf("Sold %d %s from Post %d of cluster %s to Buyer %d of cluster %s for %.2f",
+			req.Quantity, req.Item, post, a.cluster, req.BuyerID, args.Cluster, fwd.Price)
+		g.mu.Lock()
+		err = g.settleLocked(s)
+		if err != nil {
+			// Sold but not recorded: keep the destination first in line for the retry
+			g.inDoubt[key] = s
+		}
+		g.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("purchase %d was filled by cluster %s but could not be recorded: %v", req.RequestID, a.cluster, err)
+		}
+		g.purchases.Inc(args.Cluster, a.cluster, s.Status)
+		slog.Info(s.Message, "request", req.RequestID, "remote_request", remoteID, "addr", a.addr)
+		settledResponse(res, s)
+		res.Path = fwd.Path
+		return nil
+	}
+
+	g.mu.Lock()
+	g.outcomes["OutOfStock"]++
+	g.mu.Unlock()
+	g.purchases.Inc(args.Cluster, "none", "OutOfStock")
+	if len(refusals) == 0 {
+		refusals = append(refusals, "no other cluster is routed for it")
+	}
+	res.Status = "OutOfStock"
+	res.Message = fmt.Sprintf("No federated cluster could fill %d %s: %s", req.Quantity, req.Item, strings.Join(refusals, "; "))
+	slog.Info("Purchase not filled by any cluster", "origin", args.Cluster, "buyer", req.BuyerID, "request", req.RequestID, "reason", res.Message)
+	return nil
+}
+
+// Settlements reports the balances between clusters and the latest settlements
+func (g *Gateway) Settlements(args *SettlementsArgs, reply *SettlementsReply) error {
+	if g.AdminToken == "" {
+		return fmt.Errorf("settlements disabled on the gateway (no -admin-token configured)")
+	}
+	if subtle.ConstantTimeCompare([]byte(args.Token), []byte(g.AdminToken)) != 1 {
+		return fmt.Errorf("invalid admin token")
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	reply.Balances = make(map[string]float64)
+	for name := range g.Routes.Clusters {
+		reply.Balances[name] = g.balances[name]
+	}
+	reply.Outcomes = make(map[string]int)
+	for status, n := range g.outcomes {
+		reply.Outcomes[status] = n
+	}
+	reply.InDoubt = len(g.inDoubt)
+	if n := min(args.Limit, len(g.recent)); n > 0 {
+		reply.Settlements = append([]Settlement(nil), g.recent[len(g.recent)-n:]...)
+	}
+	return nil
+}
+
+// settledResponse fills res with the outcome of a settled purchase
+func settledResponse(res *common.Response, s Settlement) {
+	res.Status = "Purchased"
+	res.Message = s.Message
+	res.Processed = true
+	res.Price = s.Price
+	res.PriceRule = s.PriceRule
+}
+
+func main() {
+	address := flag.String("address", "localhost:8007", "Gateway Address")
+	id := flag.Int("id", 900, "Buyer ID the gateway buys under in every cluster")
+	routes := flag.String("routes", "routes.json", "Routing table of the federated clusters")
+	settlements := flag.String("settlements", "settlements.jsonl", "File the settlement records are appended to and replayed from")
+	timeout := flag.Duration("timeout", 10*time.Second, "Deadline of each call into a cluster without its own timeout")
+	deadline := flag.Duration("deadline", 30*time.Second, "Time spent on one purchase across every cluster tried")
+	adminToken := flag.String("admin-token", "", "Token required by the Settlements RPC (disabled if empty)")
+	devMode := flag.Bool("dev", false, "Development mode: listen on a free port if -address is taken")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate served to Traders and Buyers over TLS and presented to nodes running -mtls (plaintext if empty; needs -tls-key and -ca)")
+	tlsKey := flag.String("tls-key", "", "PEM private key of -tls-cert")
+	caFile := flag.String("ca", "", "PEM certificate of the cluster CA; calls into the clusters use TLS and trust only it")
+	mtls := flag.Bool("mtls", false, "Refuse any Trader or Buyer or tool connecting without a certificate signed by -ca (needs -tls-cert)")
+	configPath := flag.String("config", "", "Cluster config file (.yaml, .yml or .toml) setting the flags not given here; A4_<FLAG> environment variables override it")
+	logLevel := flag.String("log-level", "info", "Lowest level logged: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log record format: text (key=value) or json")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on at /metrics (disabled if empty)")
+	pprofAddr := flag.String("pprof-addr", "", "Debug address to serve net/http/pprof profiles on at /debug/pprof/; may equal -metrics-addr (disabled if empty)")
+	flag.Parse()
+	if err := config.Apply(flag.CommandLine, *configPath, "gateway"); err != nil {
+		log.Fatal(err)
+	}
+
+	parsed, err := common.ParseLogLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	level := new(slog.LevelVar) // Changed by a configuration reload
+	level.Set(parsed)
+	logger, err := common.NewLogger(os.Stderr, *logFormat, level, nil, "node", "gateway")
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+	go config.Watch(flag.CommandLine, *configPath, "gateway", []string{"log-level"}, func() error {
+		parsed, err := common.ParseLogLevel(*logLevel)
+		if err != nil {
+			return err
+		}
+		level.Set(parsed)
+		return nil
+	})
+
+	if *id <= 0 {
+		common.Fatal("-id must be positive", "id", *id)
+	}
+	serverTLS, clientTLS, err := common.LoadTLS(*tlsCert, *tlsKey, *caFile, *mtls)
+	if err != nil {
+		common.Fatal("Error loading TLS configuration", "err", err)
+	}
+	common.UseTLS(clientTLS)
+	rt, err := loadRoutes(*routes, *timeout)
+	if err != nil {
+		common.Fatal("Error loading routing table", "err", err)
+	}
+	g := &Gateway{
+		ID:         *id,
+		Address:    *address,
+		Routes:     rt,
+		Deadline:   *deadline,
+		Path:       *settlements,
+		AdminToken: *adminToken,
+		DevMode:    *devMode,
+	}
+	if err := g.load(); err != nil {
+		common.Fatal("Error replaying settlement log", "err", err)
+	}
+	slog.Info("Loaded routing table", "clusters", len(rt.Clusters), "item_routes", len(rt.Items), "settled", len(g.settled), "in_doubt", len(g.inDoubt))
+
+	endpoints := make(metrics.Endpoints)
+	if *metricsAddr != "" {
+		reg := metrics.NewRegistry()
+		g.purchases = reg.Counter("a4_gateway_purchases_total", "Forwarded purchases by origin, destination and outcome", "origin", "destination", "status")
+		balance := reg.Gauge("a4_gateway_balance", "Net amount owed to each cluster; negative if it owes", "cluster")
+		reg.OnScrape(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			for name := range g.Routes.Clusters {
+				balance.Set(g.balances[name], name)
+			}
+		})
+		endpoints.Handle(*metricsAddr, "/metrics", reg)
+	}
+	endpoints.Handle(*pprofAddr, "/debug/pprof/", metrics.Profiles())
+	if err := endpoints.Serve(); err != nil {
+		common.Fatal("Error starting HTTP server", "err", err)
+	}
+	if *metricsAddr != "" {
+		slog.Info("Serving Prometheus metrics", "addr", *metricsAddr)
+	}
+	if *pprofAddr != "" {
+		slog.Info("Serving pprof profiles", "addr", *pprofAddr)
+	}
+
+	srv := rpcserver.New(rpcserver.Options{
+		Name:    "Gateway",
+		Address: g.Address,
+		DevMode: g.DevMode,
+		TLS:     serverTLS,
+	})
+	if err := srv.Register(g); err != nil {
+		common.Fatal("Error registering Gateway service", "err", err)
+	}
+	addr, err := srv.Listen()
+	if err != nil {
+		common.Fatal("Error starting RPC server", "addr", g.Address, "err", err)
+	}
+	g.Address = addr
+
+	slog.Info("RPC server started", "addr", g.Address)
+
+	// On SIGINT or SIGTERM, stop accepting connections, let the purchases being forwarded
+	// settle and exit with the settlement log closed
+	common.OnTerminate(func() {
+		if cut := srv.Shutdown(shutdownGrace); cut > 0 {
+			slog.Warn("Closed connections with calls still in progress", "calls", cut)
+		}
+		g.mu.Lock() // Held until exit, so no settlement is half written
+		if g.log != nil {
+			if err := g.log.Close(); err != nil {
+				slog.Warn("Failed to close settlement log", "err", err)
+			}
+		}
+		slog.Info("Shut down gracefully", "in_doubt", len(g.inDoubt))
+		os.Exit(0)
+	})
+	srv.Serve()
+	select {} // Serve returns on shutdown, which exits once calls are answered
+}
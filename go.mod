@@ -0,0 +1,3 @@
+module a4
+
+go 1.22
@@ -0,0 +1,1367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"a4/common"
+	"a4/config"
+)
+
+// ======= TOPOLOGY =======
+
+// Deployment is the topology file: how many of each node to run and where they listen
+type Deployment struct {
+	Host       string         `json:"host"`        // Host every node listens on (default localhost)
+	BasePort   int            `json:"base_port"`   // First port; Traders, Sellers, Buyers and the Warehouse follow in that order
+	Traders    int            `json:"traders"`     // Number of Traders, paired as leader and backup
+	Sellers    int            `json:"sellers"`     // Number of Sellers, spread over the Traders
+	Buyers     int            `json:"buyers"`      // Number of Buyers, spread over the posts
+	Warehouse  bool           `json:"warehouse"`   // Run a Warehouse and route every Trader through it
+	Bully      bool           `json:"bully"`       // Elect the leader among all Traders with the Bully algorithm; any number of Traders may then run
+	Ports      map[string]int `json:"ports"`       // Port overrides by node name (e.g. "trader1", "warehouse")
+	StatusPort int            `json:"status_port"` // First port of the Traders' HTTP /status endpoints, one per Trader in order; 0 disables them
+	TraderArgs []string       `json:"trader_args"` // Extra flags for every Trader
+	SellerArgs []string       `json:"seller_args"` // Extra flags for every Seller
+	BuyerArgs  []string       `json:"buyer_args"`  // Extra flags for every Buyer
+
+	BulkRegister bool `json:"bulk_register"` // Register every Seller with its Trader in one call before the Sellers start
+}
+
+// Node is one process of the deployment
+type Node struct {
+	Name string   // e.g. "trader1"
+	Bin  string   // Binary it runs: trader, seller, buyer or warehouse
+	Args []string // Flags it is started with
+
+	StatusURL string // HTTP health endpoint polled after start (empty if the node serves none)
+}
+
+// loadDeployment reads a topology file and validates it (see validate). Every problem
+// found is returned at once as ConfigErrors.
+func loadDeployment(path string) (*Deployment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	src := &source{path: path, data: data, at: make(map[string]int64)}
+	if err := src.walk(json.NewDecoder(bytes.NewReader(data)), ""); err != nil {
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			src.errorAt(syntax.Offset, "%v", err)
+		} else {
+			src.errorAt(int64(len(data)), "%v", err)
+		}
+		return nil, src.errs
+	}
+	d := &Deployment{Host: "localhost", BasePort: 8001}
+	if err := json.Unmarshal(data, d); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			src.errorf(typeErr.Field, "%s must be %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		} else {
+			src.errorf("", "%v", err)
+		}
+	}
+	d.validate(src)
+	if len(src.errs) > 0 {
+		sort.SliceStable(src.errs, func(i, j int) bool { return src.errs[i].before(src.errs[j]) })
+		return nil, src.errs
+	}
+	return d, nil
+}
+
+// addr returns the address of the named node; index is its position in port order
+func (d *Deployment) addr(name string, index int) string {
+	port, ok := d.Ports[name]
+	if !ok {
+		port = d.BasePort + index
+	}
+	return fmt.Sprintf("%s:%d", d.Host, port)
+}
+
+// plan works out every node and the flags that wire it to the others. Trader i serves
+// post i and is paired with its neighbour (1 with 2, 3 with 4, ...); with bully set, an
+// odd last Trader runs without a peer and every Trader gets the full -cluster list.
+// Seller j deposits at Trader ((j-1) mod N)+1 with that Trader's peer as fallback; Buyer k
+// buys from the post of the same Trader and knows both Traders of the pair.
+func (d *Deployment) plan(logDir string) []Node {
+	n := d.Traders
+	trader := func(i int) string { return d.addr(fmt.Sprintf("trader%d", i), i-1) }
+	peerOf := func(i int) int {
+		if i%2 == 0 {
+			return i - 1
+		}
+		if i == n {
+			return 0 // Unpaired last Trader of a Bully cluster
+		}
+		return i + 1
+	}
+	var members []string
+	for i := 1; i <= n; i++ {
+		members = append(members, fmt.Sprintf("%d=%s", i, trader(i)))
+	}
+	warehouse := d.addr("warehouse", n+d.Sellers+d.Buyers)
+
+	var nodes []Node
+	if d.Warehouse {
+		nodes = append(nodes, Node{Name: "warehouse", Bin: "warehouse", Args: []string{
+			"-address=" + warehouse,
+			"-file=" + filepath.Join(logDir, "warehouse.json"),
+		}})
+	}
+	for i := 1; i <= n; i++ {
+		args := []string{
+			fmt.Sprintf("-id=%d", i),
+			"-address=" + trader(i),
+			fmt.Sprintf("-post=%d", i),
+			"-term-file=" + filepath.Join(logDir, fmt.Sprintf("trader%d-term.json", i)),
+		}
+		if p := peerOf(i); p != 0 {
+			args = append(args, "-peer="+trader(p), fmt.Sprintf("-peer-id=%d", p))
+		}
+		if d.Bully {
+			args = append(args, "-cluster="+strings.Join(members, ","))
+		}
+		if d.Warehouse {
+			args = append(args, "-warehouse="+warehouse)
+		}
+		var statusURL string
+		if d.StatusPort > 0 {
+			statusAddr := fmt.Sprintf("%s:%d", d.Host, d.StatusPort+i-1)
+			args = append(args, "-status-addr="+statusAddr)
+			statusURL = "http://" + statusAddr + "/status"
+		}
+		for _, arg := range d.TraderArgs {
+			// {id} gives each Trader its own file, such as the certificate naming it
+			args = append(args, strings.ReplaceAll(arg, "{id}", strconv.Itoa(i)))
+		}
+		nodes = append(nodes, Node{Name: fmt.Sprintf("trader%d", i), Bin: "trader", Args: args, StatusURL: statusURL})
+	}
+	for j := 1; j <= d.Sellers; j++ {
+		t := (j-1)%n + 1
+		name := fmt.Sprintf("seller%d", j)
+		args := []string{
+			fmt.Sprintf("-id=%d", j),
+			"-address=" + d.addr(name, n+j-1),
+			"-trader=" + trader(t),
+			fmt.Sprintf("-post=%d", t),
+		}
+		if p := peerOf(t); p != 0 {
+			args = append(args, "-fallback-trader="+trader(p))
+		}
+		nodes = append(nodes, Node{Name: name, Bin: "seller", Args: append(args, d.SellerArgs...)})
+	}
+	for k := 1; k <= d.Buyers; k++ {
+		t := (k-1)%n + 1
+		name := fmt.Sprintf("buyer%d", k)
+		traders := trader(t)
+		if p := peerOf(t); p != 0 {
+			traders += "," + trader(p)
+		}
+		args := []string{
+			fmt.Sprintf("-id=%d", k),
+			"-address=" + d.addr(name, n+d.Sellers+k-1),
+			"-traders=" + traders,
+			fmt.Sprintf("-post=%d", t),
+		}
+		nodes = append(nodes, Node{Name: name, Bin: "buyer", Args: append(args, d.BuyerArgs...)})
+	}
+	return nodes
+}
+
+// ======= VALIDATION =======
+
+// traderHeartbeat mirrors defaultHeartbeatInterval in trader.go, the time between a
+// Trader's heartbeats to its peer unless trader_args sets -heartbeat-interval
+const traderHeartbeat = 5 * time.Second
+
+// ConfigError is one problem in the topology file, at the line and column of the key or
+// array element it concerns (0 if it concerns the file as a whole)
+type ConfigError struct {
+	Path string
+	Line int
+	Col  int
+	Msg  string
+}
+
+func (e ConfigError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Path, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.Path, e.Line, e.Col, e.Msg)
+}
+
+// before orders errors by their position in the file
+func (e ConfigError) before(o ConfigError) bool {
+	return e.Line < o.Line || (e.Line == o.Line && e.Col < o.Col)
+}
+
+// ConfigErrors are all the problems found in a topology file, in file order
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, e := range errs {
+		lines[i] = e.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// source is a topology file being validated: where each key and array element starts,
+// and the problems found so far
+type source struct {
+	path string
+	data []byte
+	at   map[string]int64 // Offset of each key ("ports.trader1") and array element ("trader_args[2]")
+	errs ConfigErrors
+}
+
+// walk records the position of every key and array element of the value dec is at
+func (src *source) walk(dec *json.Decoder, path string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			start := src.skip(dec.InputOffset())
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key := tok.(string)
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			if _, dup := src.at[child]; dup {
+				src.errorAt(start, "duplicate key %q; only its last value would be used", key)
+			}
+			src.at[child] = start
+			if err := src.walk(dec, child); err != nil {
+				return err
+			}
+		}
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			child := fmt.Sprintf("%s[%d]", path, i)
+			src.at[child] = src.skip(dec.InputOffset())
+			if err := src.walk(dec, child); err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+	_, err = dec.Token() // The closing delimiter
+	return err
+}
+
+// skip returns the offset of the first token at or after off
+func (src *source) skip(off int64) int64 {
+	for off < int64(len(src.data)) && strings.IndexByte(" \t\r\n,:", src.data[off]) >= 0 {
+		off++
+	}
+	return off
+}
+
+// errorAt records a problem at a byte offset of the file
+func (src *source) errorAt(off int64, format string, args ...any) {
+	if off > int64(len(src.data)) {
+		off = int64(len(src.data))
+	}
+	before := src.data[:off]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := int(off) - bytes.LastIndexByte(before, '\n')
+	src.errs = append(src.errs, ConfigError{Path: src.path, Line: line, Col: col, Msg: fmt.Sprintf(format, args...)})
+}
+
+// errorf records a problem at the key or array element path, or for the whole file if
+// the path is not in the file (such as a setting left at its default)
+func (src *source) errorf(path string, format string, args ...any) {
+	if off, ok := src.at[path]; ok {
+		src.errorAt(off, format, args...)
+		return
+	}
+	src.errs = append(src.errs, ConfigError{Path: src.path, Msg: fmt.Sprintf(format, args...)})
+}
+
+// validate checks the topology for problems that would otherwise show up only as
+// confusing runtime behaviour: unknown keys, node counts the launcher cannot lay out,
+// ports outside the valid range or shared by two listeners, extra flags that replace the
+// wiring the launcher gives each node (such as a -peer making a Trader its own peer), and
+// failure detector settings at odds with the heartbeat interval
+func (d *Deployment) validate(src *source) {
+	known := make(map[string]bool)
+	t := reflect.TypeOf(*d)
+	for i := 0; i < t.NumField(); i++ {
+		known[strings.Split(t.Field(i).Tag.Get("json"), ",")[0]] = true
+	}
+	for key := range src.at {
+		if !strings.ContainsAny(key, ".[") && !known[key] {
+			src.errorf(key, "unknown key %q%s", key, suggest(key, known))
+		}
+	}
+
+	if d.Bully && d.Traders < 1 {
+		src.errorf("traders", "traders must be positive, got %d", d.Traders)
+	}
+	if !d.Bully && (d.Traders < 2 || d.Traders%2 != 0) {
+		src.errorf("traders", "traders must be a positive even number (Traders run in leader/backup pairs unless bully is set), got %d", d.Traders)
+	}
+	if d.Sellers < 0 {
+		src.errorf("sellers", "sellers cannot be negative, got %d", d.Sellers)
+	}
+	if d.Buyers < 0 {
+		src.errorf("buyers", "buyers cannot be negative, got %d", d.Buyers)
+	}
+	if d.Traders < 1 || d.Sellers < 0 || d.Buyers < 0 {
+		return // The nodes cannot be laid out to check their ports
+	}
+
+	names := make(map[string]bool)
+	for _, n := range d.plan("") {
+		names[n.Name] = true
+	}
+	for name, port := range d.Ports {
+		if !names[name] {
+			src.errorf("ports."+name, "ports names %q, but the deployment has no such node%s", name, suggest(name, names))
+		} else if port < 1 || port > 65535 {
+			src.errorf("ports."+name, "port of %s must be between 1 and 65535, got %d", name, port)
+		}
+	}
+	d.checkPorts(src)
+
+	for kind, args := range map[string][]string{"trader": d.TraderArgs, "seller": d.SellerArgs, "buyer": d.BuyerArgs} {
+		for i, arg := range args {
+			if !strings.HasPrefix(arg, "-") {
+				src.errorf(fmt.Sprintf("%s_args[%d]", kind, i), "%q is not a flag; each element of %s_args is one argument such as \"-time-scale=10\"", arg, kind)
+			}
+		}
+		d.checkWiring(src, kind, args)
+	}
+	d.checkHeartbeat(src)
+}
+
+// suggest returns a hint naming the known word closest to word, if any is close
+func suggest(word string, known map[string]bool) string {
+	best, bestDist := "", 3
+	for k := range known {
+		if dist := config.EditDistance(word, k); dist < bestDist || (dist == bestDist && k < best) {
+			best, bestDist = k, dist
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean %q?)", best)
+}
+
+// flagArg finds flag name in args, as -name=value, --name=value or -name value, and
+// returns its value and index; the last occurrence wins, as with the flag package
+func flagArg(args []string, name string) (value string, index int, ok bool) {
+	for i := 0; i < len(args); i++ {
+		arg := strings.TrimPrefix(strings.TrimPrefix(args[i], "-"), "-")
+		if arg == name && i+1 < len(args) {
+			value, index, ok = args[i+1], i, true
+			i++
+		} else if v, found := strings.CutPrefix(arg, name+"="); found {
+			value, index, ok = v, i, true
+		}
+	}
+	return value, index, ok
+}
+
+// listener is a port a node of the deployment listens on, and the setting it comes from
+type listener struct {
+	owner string // e.g. "trader1" or "trader1 -status-addr"
+	path  string // Key or array element that set the port
+}
+
+// checkPorts reports ports outside the valid range and ports two listeners would share.
+// Every process runs on this machine, so listeners collide on the port alone.
+func (d *Deployment) checkPorts(src *source) {
+	taken := make(map[int]listener)
+	claim := func(port int, l listener) {
+		if port < 1 || port > 65535 {
+			if !strings.HasPrefix(l.path, "ports.") {
+				src.errorf(l.path, "%s would listen on port %d, outside 1-65535", l.owner, port)
+			}
+			return
+		}
+		if prev, ok := taken[port]; ok {
+			src.errorf(l.path, "port %d of %s is already taken by %s", port, l.owner, prev.owner)
+			return
+		}
+		taken[port] = l
+	}
+
+	portOf := func(name string, index int) (int, string) {
+		if port, ok := d.Ports[name]; ok {
+			return port, "ports." + name
+		}
+		return d.BasePort + index, "base_port"
+	}
+	n := d.Traders
+	var order []string
+	for i := 1; i <= n; i++ {
+		order = append(order, fmt.Sprintf("trader%d", i))
+	}
+	for j := 1; j <= d.Sellers; j++ {
+		order = append(order, fmt.Sprintf("seller%d", j))
+	}
+	for k := 1; k <= d.Buyers; k++ {
+		order = append(order, fmt.Sprintf("buyer%d", k))
+	}
+	if d.Warehouse {
+		order = append(order, "warehouse")
+	}
+	for index, name := range order {
+		port, path := portOf(name, index)
+		claim(port, listener{owner: name, path: path})
+	}
+	if d.StatusPort != 0 {
+		for i := 1; i <= n; i++ {
+			claim(d.StatusPort+i-1, listener{owner: fmt.Sprintf("trader%d -status-addr", i), path: "status_port"})
+		}
+	}
+
+	// Address flags in the extra args go to every node of the kind; with more than one
+	// such node they would all bind the same port
+	counts := map[string]int{"trader": n, "seller": d.Sellers, "buyer": d.Buyers}
+	for kind, args := range map[string][]string{"trader": d.TraderArgs, "seller": d.SellerArgs, "buyer": d.BuyerArgs} {
+		for _, name := range []string{"metrics-addr", "pprof-addr", "status-addr"} {
+			value, i, ok := flagArg(args, name)
+			if !ok || value == "" || counts[kind] == 0 {
+				continue
+			}
+			path := fmt.Sprintf("%s_args[%d]", kind, i)
+			_, portStr, err := net.SplitHostPort(value)
+			port, perr := strconv.Atoi(portStr)
+			if err != nil || perr != nil {
+				src.errorf(path, "-%s=%s is not a host:port address", name, value)
+				continue
+			}
+			if counts[kind] > 1 {
+				src.errorf(path, "-%s=%s in %s_args gives all %d %ss the same port %d; set it per node outside the launcher or leave it out", name, value, kind, counts[kind], kind, port)
+			}
+			claim(port, listener{owner: fmt.Sprintf("%s1 -%s", kind, name), path: path})
+		}
+	}
+}
+
+// checkWiring reports extra args that replace a flag the launcher sets on every node of
+// the kind, since the last occurrence of a flag wins and every node would get the same
+// value
+func (d *Deployment) checkWiring(src *source, kind string, args []string) {
+	wired := map[string][]string{
+		"trader": {"id", "address", "post", "term-file"},
+		"seller": {"id", "address", "trader", "post"},
+		"buyer":  {"id", "address", "traders", "post"},
+	}[kind]
+	if kind == "trader" {
+		if d.Traders > 1 {
+			wired = append(wired, "peer", "peer-id")
+		}
+		if d.Bully {
+			wired = append(wired, "cluster")
+		}
+		if d.Warehouse {
+			wired = append(wired, "warehouse")
+		}
+		if d.StatusPort != 0 {
+			wired = append(wired, "status-addr")
+		}
+	}
+	if kind == "seller" && d.Traders > 1 {
+		wired = append(wired, "fallback-trader")
+	}
+
+	traders := make(map[string]string)
+	for i := 1; i <= d.Traders; i++ {
+		traders[d.addr(fmt.Sprintf("trader%d", i), i-1)] = fmt.Sprintf("trader%d", i)
+	}
+	for _, name := range wired {
+		value, i, ok := flagArg(args, name)
+		if !ok {
+			continue
+		}
+		path := fmt.Sprintf("%s_args[%d]", kind, i)
+		if self, isTrader := traders[value]; name == "peer" && isTrader {
+			src.errorf(path, "-peer=%s in trader_args makes %s its own peer and pairs every other Trader with it; the launcher pairs the Traders itself", value, self)
+			continue
+		}
+		src.errorf(path, "-%s in %s_args replaces the -%s the launcher gives each %s, so every %s would get %q", name, kind, name, kind, kind, value)
+	}
+}
+
+// checkHeartbeat reports failure detector settings in trader_args that conflict with the
+// heartbeat interval: a heartbeat deadline that lets heartbeats overlap, or a fixed
+// timeout that suspects a healthy peer between two heartbeats
+func (d *Deployment) checkHeartbeat(src *source) {
+	interval, path := traderHeartbeat, ""
+	if value, i, ok := flagArg(d.TraderArgs, "heartbeat-interval"); ok {
+		parsed, err := time.ParseDuration(value)
+		path = fmt.Sprintf("trader_args[%d]", i)
+		if err != nil || parsed <= 0 {
+			src.errorf(path, "-heartbeat-interval=%s is not a positive duration", value)
+			return
+		}
+		interval = parsed
+	}
+	deadline := common.DefaultTimeouts["Trader.ReceiveHeartbeat"]
+	if spec, i, ok := flagArg(d.TraderArgs, "rpc-timeouts"); ok {
+		timeouts, err := common.ParseTimeouts(0, spec)
+		if err != nil {
+			src.errorf(fmt.Sprintf("trader_args[%d]", i), "-rpc-timeouts: %v", err)
+			return
+		}
+		deadline, path = timeouts.For("Trader.ReceiveHeartbeat"), fmt.Sprintf("trader_args[%d]", i)
+	}
+	if path != "" && deadline >= interval {
+		src.errorf(path, "the Trader.ReceiveHeartbeat deadline of %v must be shorter than the %v heartbeat interval, or heartbeats to a slow peer overlap", deadline, interval)
+	}
+	value, i, ok := flagArg(d.TraderArgs, "fd-timeout")
+	if !ok {
+		return
+	}
+	path = fmt.Sprintf("trader_args[%d]", i)
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		src.errorf(path, "-fd-timeout=%s is not a duration", value)
+		return
+	}
+	if detector, _, _ := flagArg(d.TraderArgs, "failure-detector"); detector != "fixed-timeout" {
+		return // Only the fixed-timeout detector uses it
+	}
+	if timeout <= interval+deadline {
+		src.errorf(path, "-fd-timeout=%v must be longer than the %v heartbeat interval plus the %v heartbeat deadline, or the fixed-timeout detector suspects a healthy peer between heartbeats", timeout, interval, deadline)
+	}
+}
+
+// ======= PROCESSES =======
+
+// Outcome is how one process ended
+type Outcome struct {
+	Node    Node
+	Pid     int
+	Err     error // Start or exit error; nil for a clean exit
+	Stopped bool  // Ended by the launcher's own stop signal
+	Runtime time.Duration
+}
+
+// Launcher runs the processes of a deployment and collects how they end
+type Launcher struct {
+	BinDir   string
+	LogDir   string
+	mu       sync.Mutex
+	procs    map[string]*exec.Cmd // Running processes by node name (guarded by mu)
+	stopping bool                 // Set once the launcher stops the deployment (guarded by mu)
+	outcomes []Outcome            // Ended processes in the order they ended (guarded by mu)
+	wg       sync.WaitGroup
+}
+
+// build compiles the four binaries from the repository into BinDir
+func (l *Launcher) build(repo string) error {
+	for bin, pkg := range map[string]string{"trader": "trader.go", "seller": "./seller", "buyer": "./buyer", "warehouse": "./warehouse"} {
+		cmd := exec.Command("go", "build", "-o", filepath.Join(l.BinDir, bin), pkg)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("building %s: %v\n%s", bin, err, out)
+		}
+	}
+	return nil
+}
+
+// start launches a node with its output in LogDir/<name>.txt and watches for its exit
+func (l *Launcher) start(n Node) error {
+	logFile, err := os.Create(filepath.Join(l.LogDir, n.Name+".txt"))
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(filepath.Join(l.BinDir, n.Bin), n.Args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// In a process group of its own, a node gets a Ctrl-C in the terminal only as the
+	// launcher's SIGTERM, not twice, which would cut its graceful shutdown short
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return err
+	}
+	log.Printf("Launcher: Started %s (pid %d) %s", n.Name, cmd.Process.Pid, strings.Join(n.Args, " "))
+
+	l.mu.Lock()
+	l.procs[n.Name] = cmd
+	l.mu.Unlock()
+
+	started := time.Now()
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		err := cmd.Wait()
+		logFile.Close()
+
+		l.mu.Lock()
+		delete(l.procs, n.Name)
+		out := Outcome{Node: n, Pid: cmd.Process.Pid, Err: err, Stopped: l.stopping && err != nil, Runtime: time.Since(started)}
+		l.outcomes = append(l.outcomes, out)
+		l.mu.Unlock()
+
+		switch {
+		case out.Stopped:
+			log.Printf("Launcher: %s stopped", n.Name)
+		case err != nil:
+			log.Printf("Launcher: %s exited: %v", n.Name, err)
+		default:
+			log.Printf("Launcher: %s exited cleanly", n.Name)
+		}
+	}()
+	return nil
+}
+
+// stop signals every running process to terminate, killing those still running after grace
+func (l *Launcher) stop(grace time.Duration) {
+	l.mu.Lock()
+	l.stopping = true
+	for _, cmd := range l.procs {
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+	l.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(grace):
+		l.mu.Lock()
+		for name, cmd := range l.procs {
+			log.Printf("Launcher: %s did not exit within %s; killing it", name, grace)
+			cmd.Process.Kill()
+		}
+		l.mu.Unlock()
+		<-done
+	}
+}
+
+// startAll starts the nodes in plan order. With bulk set, the Sellers and Buyers start
+// only once registerSellers has registered every Seller with its Trader, and each
+// registered Seller gets its session with -session instead of registering itself.
+func (l *Launcher) startAll(nodes []Node, bulk bool, timeout time.Duration) error {
+	registered := !bulk
+	var sessions map[string]string
+	for _, n := range nodes {
+		if !registered && (n.Bin == "seller" || n.Bin == "buyer") {
+			sessions = l.registerSellers(nodes, timeout)
+			registered = true
+		}
+		if token := sessions[n.Name]; token != "" {
+			n.Args = append(n.Args[:len(n.Args):len(n.Args)], "-session="+token)
+		}
+		if err := l.start(n); err != nil {
+			return fmt.Errorf("%s: %w", n.Name, err)
+		}
+	}
+	return nil
+}
+
+// registerSellers registers the Sellers of each Trader with one Trader.RegisterSellersBulk
+// call, retrying until the Trader answers or timeout passes, so dozens of Sellers do not
+// race the Traders' startup with registrations of their own. It returns the session of
+// each registered Seller by node name. A Seller left unregistered registers itself once
+// it starts, as without bulk registration.
+func (l *Launcher) registerSellers(nodes []Node, timeout time.Duration) map[string]string {
+	batches := make(map[string][]common.SellerInfo)
+	names := make(map[string][]string)
+	var traders []string
+	for _, n := range nodes {
+		if _, _, clientOnly := flagArg(n.Args, "client-only"); n.Bin != "seller" || clientOnly {
+			continue // A client-only Seller has no address to register
+		}
+		addr, _, _ := flagArg(n.Args, "trader")
+		idArg, _, _ := flagArg(n.Args, "id")
+		postArg, _, _ := flagArg(n.Args, "post")
+		address, _, _ := flagArg(n.Args, "address")
+		id, _ := strconv.Atoi(idArg)
+		post, _ := strconv.Atoi(postArg)
+		if _, ok := batches[addr]; !ok {
+			traders = append(traders, addr)
+		}
+		info := common.SellerInfo{ID: id, Address: address, Post: post}
+		if secret, _, _ := flagArg(n.Args, "secret"); secret != "" {
+			info.Signature = common.RegistrationSignature(secret, &info) // Signed as the Seller would
+		}
+		batches[addr] = append(batches[addr], info)
+		names[addr] = append(names[addr], n.Name)
+	}
+
+	sessions := make(map[string]string)
+	deadline := time.Now().Add(timeout)
+	for _, addr := range traders {
+		client := &common.TraderClient{Addr: addr, Timeout: 2 * time.Second}
+		for {
+			replies, err := client.RegisterSellersBulk(batches[addr])
+			if err == nil {
+				for i, reply := range replies {
+					sessions[names[addr][i]] = reply.Session
+				}
+				log.Printf("Launcher: Registered %d Sellers with the Trader at %s", len(replies), addr)
+				break
+			}
+			var refused rpc.ServerError
+			if errors.As(err, &refused) || time.Now().After(deadline) {
+				log.Printf("Launcher: Could not register Sellers with the Trader at %s: %v; they will register themselves", addr, err)
+				break
+			}
+			time.Sleep(250 * time.Millisecond)
+		}
+	}
+	return sessions
+}
+
+// NodeHealth mirrors the fields of a Trader's /status answer that the launcher reports
+type NodeHealth struct {
+	Role    string `json:"role"`
+	Term    int64  `json:"term"`
+	Healthy bool   `json:"healthy"`
+}
+
+// awaitHealthy polls the health endpoint of every node that serves one until each reports
+// healthy, and returns the nodes that did not within timeout
+func (l *Launcher) awaitHealthy(nodes []Node, timeout time.Duration) []string {
+	client := &http.Client{Timeout: time.Second}
+	deadline := time.Now().Add(timeout)
+	pending := make(map[string]Node)
+	for _, n := range nodes {
+		if n.StatusURL != "" {
+			pending[n.Name] = n
+		}
+	}
+	for len(pending) > 0 && time.Now().Before(deadline) {
+		for name, n := range pending {
+			resp, err := client.Get(n.StatusURL)
+			if err != nil {
+				continue
+			}
+			var h NodeHealth
+			err = json.NewDecoder(resp.Body).Decode(&h)
+			resp.Body.Close()
+			if err == nil && h.Healthy {
+				log.Printf("Launcher: %s is healthy as %s in term %d", name, h.Role, h.Term)
+				delete(pending, name)
+			}
+		}
+		if len(pending) > 0 {
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+
+	var missing []string
+	for name := range pending {
+		missing = append(missing, name)
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// report prints the exit status of every process and returns how many failed. A
+// process stopped by the launcher did not fail.
+func (l *Launcher) report() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	failed := 0
+	fmt.Printf("%-12s %-8s %-10s %s\n", "NODE", "PID", "RUNTIME", "STATUS")
+	for _, o := range l.outcomes {
+		status := "exit 0"
+		switch {
+		case o.Stopped:
+			status = "stopped"
+		case o.Err != nil:
+			status = o.Err.Error()
+			failed++
+		}
+		fmt.Printf("%-12s %-8d %-10s %s\n", o.Node.Name, o.Pid, o.Runtime.Round(time.Millisecond), status)
+	}
+	return failed
+}
+
+// ======= TUNING =======
+
+// Targets a calibration run can be scored on
+const (
+	targetThroughput = "throughput"  // Trades completed per second across the Traders; higher is better
+	targetLatency    = "latency"     // Mean time to complete a trade; lower is better
+	targetMaxLatency = "max-latency" // Slowest trade; lower is better
+	targetFairness   = "fairness"    // Lowest fairness index across the Traders' posts; higher is better
+)
+
+// Tuning strategies
+const (
+	strategySweep = "sweep" // One parameter at a time, keeping the best value of those already swept
+	strategyGrid  = "grid"  // Every combination of values
+)
+
+// Param is a Trader flag the tuner varies and the values it tries, in order
+type Param struct {
+	Flag   string
+	Values []string
+}
+
+// parseTuneSpec parses -tune, e.g. "workers=2,4,8;repl-batch=16,64"
+func parseTuneSpec(spec string) ([]Param, error) {
+	var params []Param
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, values, ok := strings.Cut(part, "=")
+		name = strings.TrimLeft(strings.TrimSpace(name), "-")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q is not flag=value,value,...", part)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("-%s is listed twice", name)
+		}
+		seen[name] = true
+		p := Param{Flag: name}
+		for _, v := range strings.Split(values, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				p.Values = append(p.Values, v)
+			}
+		}
+		if len(p.Values) == 0 {
+			return nil, fmt.Errorf("-%s has no values", name)
+		}
+		params = append(params, p)
+	}
+	if len(params) == 0 {
+		return nil, errors.New("no parameters to tune")
+	}
+	return params, nil
+}
+
+// withFlag returns a copy of args with every setting of the flag name replaced by value
+func withFlag(args []string, name, value string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		arg := strings.TrimPrefix(strings.TrimPrefix(args[i], "-"), "-")
+		if arg == name {
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++ // Value given as the next argument
+			}
+			continue
+		}
+		if strings.HasPrefix(arg, name+"=") {
+			continue
+		}
+		out = append(out, args[i])
+	}
+	return append(out, fmt.Sprintf("-%s=%s", name, value))
+}
+
+// Settings are the values of the tuned flags in one calibration run
+type Settings map[string]string
+
+// args renders the settings as Trader flags in the order of params
+func (s Settings) args(params []Param) []string {
+	var args []string
+	for _, p := range params {
+		args = append(args, fmt.Sprintf("-%s=%s", p.Flag, s[p.Flag]))
+	}
+	return args
+}
+
+// RunResult is what one calibration run measured
+type RunResult struct {
+	Run        int
+	Settings   Settings
+	Throughput float64       // Trades completed per second across the Traders
+	Latency    time.Duration // Mean time to complete a trade, weighted by trades
+	MaxLatency time.Duration
+	Fairness   float64 // Lowest fairness index of any Trader
+	Trades     int     // Trades completed across the Traders
+	Failed     int     // Seller requests that failed or were abandoned
+	Note       string  // Why the run does not count, or what was odd about it
+	Valid      bool    // Whether the run may be picked as the best
+}
+
+// score orders runs by target: higher is better
+func (r RunResult) score(target string) float64 {
+	switch target {
+	case targetThroughput:
+		return r.Throughput
+	case targetLatency:
+		return -float64(r.Latency)
+	case targetMaxLatency:
+		return -float64(r.MaxLatency)
+	}
+	return r.Fairness
+}
+
+// better reports whether a beats b on target; ties go to fewer failed requests
+func better(a, b RunResult, target string) bool {
+	if sa, sb := a.score(target), b.score(target); sa != sb {
+		return sa > sb
+	}
+	return a.Failed < b.Failed
+}
+
+// traderMetrics mirrors the parts of a Trader's TraderState snapshot the tuner scores
+type traderMetrics struct {
+	Fairness struct {
+		Posts []struct {
+			Deposits   int
+			Purchases  int
+			AvgLatency time.Duration
+			MaxLatency time.Duration
+		}
+		Fairness float64
+	}
+}
+
+// sellerMetrics mirrors the parts of a Seller's SellerStatus snapshot the tuner counts
+type sellerMetrics struct {
+	Failed    int
+	Abandoned int
+}
+
+// lastSnapshot decodes the metrics of the last snapshot in a node's metrics file and
+// reports whether it is the final one written on a graceful shutdown
+func lastSnapshot(path string, metrics any) (final bool, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var last struct {
+		Trigger string          `json:"trigger"`
+		Metrics json.RawMessage `json:"metrics"`
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil || last.Metrics == nil {
+		return false, fmt.Errorf("%s: no snapshot: %v", path, err)
+	}
+	return last.Trigger == "final", json.Unmarshal(last.Metrics, metrics)
+}
+
+// Tuner runs short calibrations of a deployment with different Trader flags
+type Tuner struct {
+	Deployment Deployment
+	Params     []Param
+	Target     string
+	Strategy   string
+	RunFor     time.Duration // Length of a calibration run, from the start of its last node
+	BinDir     string
+	Dir        string // Each run keeps its logs, state and metrics in Dir/run<n>
+	Grace      time.Duration
+	Health     time.Duration
+	Sigs       <-chan os.Signal // Interrupts the tuning
+
+	results     []RunResult
+	measured    map[string]RunResult // By settings, so a sweep does not repeat a run
+	interrupted bool
+}
+
+// key identifies settings in measured
+func (t *Tuner) key(s Settings) string {
+	return strings.Join(s.args(t.Params), " ")
+}
+
+// measure returns the result of the settings, running a calibration unless they were
+// already measured
+func (t *Tuner) measure(s Settings) RunResult {
+	if r, ok := t.measured[t.key(s)]; ok {
+		return r
+	}
+	r := t.calibrate(s)
+	t.results = append(t.results, r)
+	t.measured[t.key(s)] = r
+	log.Printf("Tuner: Run %d (%s): %s", r.Run, t.key(s), formatResult(r))
+	return r
+}
+
+// Run measures the settings the strategy picks and returns the best valid run, false if
+// no run was valid
+func (t *Tuner) Run() (RunResult, bool) {
+	t.measured = make(map[string]RunResult)
+	var best RunResult
+	found := false
+	consider := func(r RunResult) {
+		if r.Valid && (!found || better(r, best, t.Target)) {
+			best, found = r, true
+		}
+	}
+
+	if t.Strategy == strategyGrid {
+		var walk func(i int, s Settings)
+		walk = func(i int, s Settings) {
+			if t.interrupted {
+				return
+			}
+			if i == len(t.Params) {
+				consider(t.measure(s))
+				return
+			}
+			for _, v := range t.Params[i].Values {
+				next := Settings{t.Params[i].Flag: v}
+				for k, v := range s {
+					next[k] = v
+				}
+				walk(i+1, next)
+			}
+		}
+		walk(0, Settings{})
+		return best, found
+	}
+
+	current := make(Settings)
+	for _, p := range t.Params {
+		current[p.Flag] = p.Values[0]
+	}
+	for _, p := range t.Params {
+		pick, picked := "", false
+		var pickResult RunResult
+		for _, v := range p.Values {
+			if t.interrupted {
+				return best, found
+			}
+			s := make(Settings)
+			for k, v := range current {
+				s[k] = v
+			}
+			s[p.Flag] = v
+			r := t.measure(s)
+			consider(r)
+			if r.Valid && (!picked || better(r, pickResult, t.Target)) {
+				pick, pickResult, picked = v, r, true
+			}
+		}
+		if picked {
+			current[p.Flag] = pick
+			log.Printf("Tuner: Keeping -%s=%s", p.Flag, pick)
+		}
+	}
+	return best, found
+}
+
+// calibrate runs the deployment with the settings for RunFor, stops it and scores it from
+// the final metrics snapshots of its nodes
+func (t *Tuner) calibrate(s Settings) RunResult {
+	r := RunResult{Run: len(t.results) + 1, Settings: s}
+	dir := filepath.Join(t.Dir, fmt.Sprintf("run%d", r.Run))
+	metricsDir := filepath.Join(dir, "metrics")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		r.Note = err.Error()
+		return r
+	}
+
+	d := t.Deployment
+	d.TraderArgs = withFlag(d.TraderArgs, "metrics-dir", metricsDir)
+	for _, p := range t.Params {
+		d.TraderArgs = withFlag(d.TraderArgs, p.Flag, s[p.Flag])
+	}
+	d.SellerArgs = withFlag(d.SellerArgs, "metrics-dir", metricsDir)
+	nodes := d.plan(dir)
+
+	l := &Launcher{BinDir: t.BinDir, LogDir: dir, procs: make(map[string]*exec.Cmd)}
+	if err := l.startAll(nodes, d.BulkRegister, t.Health); err != nil {
+		l.stop(t.Grace)
+		r.Note = fmt.Sprintf("failed to start %v", err)
+		return r
+	}
+	if d.StatusPort > 0 {
+		if missing := l.awaitHealthy(nodes, t.Health); len(missing) > 0 {
+			r.Note = "not healthy: " + strings.Join(missing, ", ")
+		}
+	}
+	started := time.Now()
+	allExited := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(allExited)
+	}()
+	select {
+	case <-time.After(t.RunFor):
+	case sig := <-t.Sigs:
+		log.Printf("Tuner: Received %v; stopping after this run", sig)
+		t.interrupted = true
+		r.Note = "interrupted"
+	case <-allExited:
+	}
+	l.stop(t.Grace)
+	elapsed := time.Since(started)
+
+	for _, o := range l.outcomes {
+		if !o.Stopped && o.Err != nil && r.Note == "" {
+			r.Note = fmt.Sprintf("%s exited: %v", o.Node.Name, o.Err)
+		}
+	}
+
+	var latencySum time.Duration
+	r.Fairness = 1
+	notFinal := 0
+	for _, n := range nodes {
+		var final bool
+		var err error
+		switch n.Bin {
+		case "trader":
+			var m traderMetrics
+			if final, err = lastSnapshot(filepath.Join(metricsDir, strings.Replace(n.Name, "trader", "trader-", 1)+".jsonl"), &m); err != nil {
+				break
+			}
+			for _, ps := range m.Fairness.Posts {
+				trades := ps.Deposits + ps.Purchases
+				r.Trades += trades
+				latencySum += time.Duration(trades) * ps.AvgLatency
+				if ps.MaxLatency > r.MaxLatency {
+					r.MaxLatency = ps.MaxLatency
+				}
+			}
+			if len(m.Fairness.Posts) > 0 && m.Fairness.Fairness < r.Fairness {
+				r.Fairness = m.Fairness.Fairness
+			}
+		case "seller":
+			var m sellerMetrics
+			if final, err = lastSnapshot(filepath.Join(metricsDir, strings.Replace(n.Name, "seller", "seller-", 1)+".jsonl"), &m); err != nil {
+				break
+			}
+			r.Failed += m.Failed + m.Abandoned
+		default:
+			continue
+		}
+		if err != nil {
+			if r.Note == "" {
+				r.Note = fmt.Sprintf("no metrics from %s", n.Name)
+			}
+		} else if !final {
+			notFinal++
+		}
+	}
+	if r.Trades > 0 {
+		r.Latency = latencySum / time.Duration(r.Trades)
+	}
+	r.Throughput = float64(r.Trades) / elapsed.Seconds()
+	switch {
+	case r.Note != "":
+	case r.Trades == 0:
+		r.Note = "no trades completed"
+	default:
+		r.Valid = true
+		if notFinal > 0 {
+			r.Note = fmt.Sprintf("%d node(s) killed before a final snapshot", notFinal)
+		}
+	}
+	return r
+}
+
+// formatResult renders a run's measurements for the log
+func formatResult(r RunResult) string {
+	s := fmt.Sprintf("%.2f trades/s, latency %v (max %v), fairness %.3f, %d failed", r.Throughput, r.Latency.Round(time.Millisecond), r.MaxLatency.Round(time.Millisecond), r.Fairness, r.Failed)
+	if r.Note != "" {
+		s += "; " + r.Note
+	}
+	return s
+}
+
+// reportTuning prints every run as a table and the best settings for the target
+func (t *Tuner) reportTuning(best RunResult, found bool) {
+	fmt.Printf("%-4s", "RUN")
+	for _, p := range t.Params {
+		fmt.Printf(" %-*s", max(len(p.Flag), 8), p.Flag)
+	}
+	fmt.Printf(" %-10s %-9s %-11s %-8s %-6s %s\n", "TRADES/S", "LATENCY", "MAX-LATENCY", "FAIRNESS", "FAILED", "NOTE")
+	for _, r := range t.results {
+		fmt.Printf("%-4d", r.Run)
+		for _, p := range t.Params {
+			fmt.Printf(" %-*s", max(len(p.Flag), 8), r.Settings[p.Flag])
+		}
+		fmt.Printf(" %-10.2f %-9v %-11v %-8.3f %-6d %s\n", r.Throughput, r.Latency.Round(time.Millisecond), r.MaxLatency.Round(time.Millisecond), r.Fairness, r.Failed, r.Note)
+	}
+	if !found {
+		fmt.Println("No valid run; check the logs in", t.Dir)
+		return
+	}
+	args, _ := json.Marshal(best.Settings.args(t.Params))
+	fmt.Printf("Best for %s: run %d, %s\n", t.Target, best.Run, formatResult(best))
+	fmt.Printf("\"trader_args\" additions: %s\n", args)
+}
+
+func main() {
+	topologyPath := flag.String("topology", "topology.json", "Topology file describing the deployment")
+	repo := flag.String("repo", ".", "Path to the repository root containing trader.go")
+	logDir := flag.String("log-dir", "log", "Directory for process output, term files and Warehouse state")
+	duration := flag.Duration("duration", 0, "Stop the deployment after this long (runs until interrupted if 0)")
+	grace := flag.Duration("grace", 5*time.Second, "Time processes get to exit after being stopped before they are killed")
+	dryRun := flag.Bool("dry-run", false, "Print the command line of every process without starting anything")
+	healthTimeout := flag.Duration("health-timeout", 30*time.Second, "Time Traders with a status_port get to report healthy after starting, and Traders get to accept bulk registrations")
+	check := flag.Bool("check", false, "Validate the topology file and exit")
+	tuneSpec := flag.String("tune", "", "Tune Trader flags with calibration runs instead of running the deployment, e.g. workers=2,4,8;repl-batch=16,64;heartbeat-interval=1s,5s")
+	tuneTarget := flag.String("tune-target", targetLatency, "Metric the tuner optimises: throughput, latency, max-latency or fairness")
+	tuneStrategy := flag.String("tune-strategy", strategySweep, "Settings the tuner tries: sweep (one flag at a time, keeping the best value of those swept) or grid (every combination)")
+	tuneRun := flag.Duration("tune-run", 30*time.Second, "Length of each calibration run")
+	flag.Parse()
+
+	d, err := loadDeployment(*topologyPath)
+	var invalid ConfigErrors
+	if errors.As(err, &invalid) {
+		for _, e := range invalid {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		log.Fatalf("Invalid topology: %d problem(s) found", len(invalid))
+	}
+	if err != nil {
+		log.Fatalf("Error loading topology: %v", err)
+	}
+	if *check {
+		fmt.Printf("%s: %d Traders, %d Sellers, %d Buyers; no problems found\n", *topologyPath, d.Traders, d.Sellers, d.Buyers)
+		return
+	}
+	var params []Param
+	if *tuneSpec != "" {
+		if params, err = parseTuneSpec(*tuneSpec); err != nil {
+			log.Fatalf("Invalid -tune: %v", err)
+		}
+		switch *tuneTarget {
+		case targetThroughput, targetLatency, targetMaxLatency, targetFairness:
+		default:
+			log.Fatalf("Unknown -tune-target %q (expected throughput, latency, max-latency or fairness)", *tuneTarget)
+		}
+		if *tuneStrategy != strategySweep && *tuneStrategy != strategyGrid {
+			log.Fatalf("Unknown -tune-strategy %q (expected sweep or grid)", *tuneStrategy)
+		}
+		if *tuneRun <= 0 {
+			log.Fatalf("-tune-run must be positive, got %v", *tuneRun)
+		}
+		// Check every value against the topology, as if trader_args set it
+		src := &source{path: "-tune", at: make(map[string]int64)}
+		for _, p := range params {
+			for _, v := range p.Values {
+				tuned := *d
+				tuned.TraderArgs = withFlag(d.TraderArgs, p.Flag, v)
+				tuned.validate(src)
+			}
+		}
+		if len(src.errs) > 0 {
+			for _, e := range src.errs {
+				fmt.Fprintln(os.Stderr, e)
+			}
+			log.Fatalf("Invalid -tune: %d problem(s) found", len(src.errs))
+		}
+	}
+
+	// The launcher calls the Traders itself to register Sellers in bulk, presenting the
+	// first Trader's certificate to Traders running -mtls
+	if ca, _, ok := flagArg(d.TraderArgs, "ca"); ok && d.BulkRegister {
+		cert, _, _ := flagArg(d.TraderArgs, "tls-cert")
+		key, _, _ := flagArg(d.TraderArgs, "tls-key")
+		cert, key = strings.ReplaceAll(cert, "{id}", "1"), strings.ReplaceAll(key, "{id}", "1")
+		_, clientTLS, err := common.LoadTLS(cert, key, ca, false)
+		if err != nil {
+			log.Fatalf("Error loading the TLS settings of trader_args: %v", err)
+		}
+		common.UseTLS(clientTLS)
+	}
+
+	nodes := d.plan(*logDir)
+	if *dryRun {
+		for _, n := range nodes {
+			fmt.Printf("%s %s\n", n.Bin, strings.Join(n.Args, " "))
+		}
+		return
+	}
+
+	if err := os.MkdirAll(*logDir, 0o755); err != nil {
+		log.Fatalf("Error creating log directory: %v", err)
+	}
+	binDir, err := os.MkdirTemp("", "a4-launcher-")
+	if err != nil {
+		log.Fatalf("Error creating build directory: %v", err)
+	}
+
+	l := &Launcher{BinDir: binDir, LogDir: *logDir, procs: make(map[string]*exec.Cmd)}
+	if err := l.build(*repo); err != nil {
+		log.Fatalf("Error building binaries: %v", err)
+	}
+
+	if params != nil {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		tuneDir := filepath.Join(*logDir, "tune")
+		os.RemoveAll(tuneDir)
+		tuner := &Tuner{Deployment: *d, Params: params, Target: *tuneTarget, Strategy: *tuneStrategy, RunFor: *tuneRun,
+			BinDir: binDir, Dir: tuneDir, Grace: *grace, Health: *healthTimeout, Sigs: sigs}
+		log.Printf("Launcher: Tuning %d flag(s) for %s with %s runs of %v; logs in %s", len(params), *tuneTarget, *tuneStrategy, *tuneRun, tuneDir)
+		best, found := tuner.Run()
+		os.RemoveAll(binDir)
+		tuner.reportTuning(best, found)
+		if !found || tuner.interrupted {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := l.startAll(nodes, d.BulkRegister, *healthTimeout); err != nil {
+		log.Printf("Launcher: Failed to start %v", err)
+		l.stop(*grace)
+		os.RemoveAll(binDir)
+		l.report()
+		os.Exit(1)
+	}
+	log.Printf("Launcher: %d Traders, %d Sellers and %d Buyers running; logs in %s", d.Traders, d.Sellers, d.Buyers, *logDir)
+	if d.StatusPort > 0 {
+		if missing := l.awaitHealthy(nodes, *healthTimeout); len(missing) > 0 {
+			log.Printf("Launcher: Not healthy after %s: %s", *healthTimeout, strings.Join(missing, ", "))
+		}
+	}
+
+	// Run until interrupted, the duration elapses or every process has exited on its own
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	allExited := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(allExited)
+	}()
+	var timeout <-chan time.Time
+	if *duration > 0 {
+		timeout = time.After(*duration)
+	}
+	select {
+	case sig := <-sigs:
+		log.Printf("Launcher: Received %v; stopping the deployment", sig)
+	case <-timeout:
+		log.Printf("Launcher: %s elapsed; stopping the deployment", *duration)
+	case <-allExited:
+		log.Printf("Launcher: Every process has exited")
+	}
+	l.stop(*grace)
+	os.RemoveAll(binDir)
+
+	if failed := l.report(); failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,385 @@
+// Package metrics writes local metrics snapshots shared by the Trader and the Seller. Each
+// node appends JSON lines to its own file, on an interval and after every N events, so
+// experiments on machines without a metrics server still keep the time series for the
+// report. A Registry also exposes counters, gauges and histograms on an HTTP /metrics
+// endpoint in the Prometheus text format, for nodes scraped by a metrics server, and
+// Endpoints serves it alongside a node's other HTTP endpoints such as the pprof profiles.
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot is one line of a node's metrics file
+type Snapshot struct {
+	Time    time.Time `json:"time"`
+	Node    string    `json:"node"`    // e.g. "trader-1"
+	Seq     int64     `json:"seq"`     // Position in the file, from 1
+	Trigger string    `json:"trigger"` // "interval", "count" or "final"
+	Events  int64     `json:"events"`  // Events counted since the Writer was opened
+	Metrics any       `json:"metrics"` // The node's own state report
+}
+
+// Writer appends snapshots to <dir>/<node>.jsonl. Collect is called for every snapshot
+// and must not need locks held by callers of Event.
+type Writer struct {
+	Node    string
+	Every   int // Events between count-based snapshots; 0 writes on the interval only
+	Collect func() any
+
+	mu     sync.Mutex
+	f      *os.File
+	enc    *json.Encoder
+	seq    int64
+	events int64
+}
+
+// Open creates dir if needed and opens the node's metrics file for appending
+func Open(dir, node string, every int, collect func() any) (*Writer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, node+".jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{Node: node, Every: every, Collect: collect, f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Write appends a snapshot of the node's current state
+func (w *Writer) Write(trigger string) error {
+	metrics := w.Collect()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return fmt.Errorf("metrics file of %s is closed", w.Node)
+	}
+	w.seq++
+	return w.enc.Encode(Snapshot{Time: time.Now(), Node: w.Node, Seq: w.seq, Trigger: trigger, Events: w.events, Metrics: metrics})
+}
+
+// Event counts one event, e.g. a finished request, and writes a count-based snapshot
+// every Every events
+func (w *Writer) Event() error {
+	w.mu.Lock()
+	w.events++
+	due := w.Every > 0 && w.events%int64(w.Every) == 0
+	w.mu.Unlock()
+	if !due {
+		return nil
+	}
+	return w.Write("count")
+}
+
+// Run writes an interval snapshot every interval until the process exits
+func (w *Writer) Run(interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := w.Write("interval"); err != nil {
+			onError(err)
+		}
+	}
+}
+
+// Close writes a final snapshot and closes the file
+func (w *Writer) Close() error {
+	err := w.Write("final")
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return err
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f = nil
+	return err
+}
+
+// ======= PROMETHEUS =======
+
+// DefaultBuckets are histogram bucket bounds in seconds, suited to RPC latencies
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Registry holds the metrics a node exposes, in registration order
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	onScrape []func()
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// family is one named metric and its series, one per combination of label values
+type family struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64 // Upper bounds of a histogram's buckets
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is the value of a family for one combination of label values
+type series struct {
+	values []string
+	value  float64  // Counter or gauge value
+	counts []uint64 // Histogram observations per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// Counter only goes up; a nil Counter counts nothing
+type Counter struct{ f *family }
+
+// Gauge is set to the current value of something; a nil Gauge records nothing
+type Gauge struct{ f *family }
+
+// Histogram counts observations into buckets; a nil Histogram records nothing
+type Histogram struct{ f *family }
+
+// add registers a family
+func (r *Registry) add(name, help, kind string, buckets []float64, labels []string) *family {
+	f := &family{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*series)}
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+	return f
+}
+
+// Counter registers a counter with the given label names
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{r.add(name, help, "counter", nil, labels)}
+}
+
+// Gauge registers a gauge with the given label names
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.add(name, help, "gauge", nil, labels)}
+}
+
+// Histogram registers a histogram with the given bucket bounds and label names
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r.add(name, help, "histogram", buckets, labels)}
+}
+
+// OnScrape registers fn to run before every scrape, e.g. to set gauges from a node's
+// state report
+func (r *Registry) OnScrape(fn func()) {
+	r.mu.Lock()
+	r.onScrape = append(r.onScrape, fn)
+	r.mu.Unlock()
+}
+
+// get returns the series for the label values, creating it; f.mu must be held
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has labels %v, got values %v", f.name, f.labels, values))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Inc adds 1 to the series with the label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the series with the label values
+func (c *Counter) Add(v float64, values ...string) {
+	if c == nil {
+		return
+	}
+	c.f.mu.Lock()
+	c.f.get(values).value += v
+	c.f.mu.Unlock()
+}
+
+// Set sets the series with the label values to v
+func (g *Gauge) Set(v float64, values ...string) {
+	if g == nil {
+		return
+	}
+	g.f.mu.Lock()
+	g.f.get(values).value = v
+	g.f.mu.Unlock()
+}
+
+// Reset drops every series, so values no longer set stop being exposed
+func (g *Gauge) Reset() {
+	if g == nil {
+		return
+	}
+	g.f.mu.Lock()
+	g.f.series = make(map[string]*series)
+	g.f.mu.Unlock()
+}
+
+// Observe records one observation in the series with the label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	if h == nil {
+		return
+	}
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	s := h.f.get(values)
+	if i := sort.SearchFloat64s(h.f.buckets, v); i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+// ObserveSince records the time since start in seconds
+func (h *Histogram) ObserveSince(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	hooks := append([]func(){}, r.onScrape...)
+	families := append([]*family{}, r.families...)
+	r.mu.Unlock()
+	for _, fn := range hooks {
+		fn()
+	}
+
+	var b strings.Builder
+	for _, f := range families {
+		f.write(&b)
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// write appends the family's HELP and TYPE lines and its series, sorted by label values
+func (f *family) write(b *strings.Builder) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		if f.kind != "histogram" {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, f.labelSet(s.values, ""), formatValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelSet(s.values, formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelSet(s.values, "+Inf"), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, f.labelSet(s.values, ""), formatValue(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, f.labelSet(s.values, ""), s.count)
+	}
+}
+
+// labelSet formats label pairs as {a="x",b="y"}, adding le for a histogram bucket
+func (f *family) labelSet(values []string, le string) string {
+	var pairs []string
+	for i, name := range f.labels {
+		pairs = append(pairs, name+"="+strconv.Quote(values[i]))
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatValue formats a sample value the way Prometheus parses it
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// ServeHTTP answers a scrape
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// ======= HTTP ENDPOINTS =======
+
+// Endpoints collects a node's HTTP handlers by listen address, so endpoints configured on
+// the same address share one server
+type Endpoints map[string]*http.ServeMux
+
+// Handle serves h at pattern on addr; an empty addr leaves the endpoint disabled
+func (e Endpoints) Handle(addr, pattern string, h http.Handler) {
+	if addr == "" {
+		return
+	}
+	if e[addr] == nil {
+		e[addr] = http.NewServeMux()
+	}
+	e[addr].Handle(pattern, h)
+}
+
+// Serve binds every address and serves its endpoints until the process exits. It returns
+// once the addresses are bound, so a port already in use is reported to the caller.
+func (e Endpoints) Serve() error {
+	listeners := make(map[string]net.Listener, len(e))
+	for addr := range e {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return err
+		}
+		listeners[addr] = ln
+	}
+	for addr, ln := range listeners {
+		go http.Serve(ln, e[addr])
+	}
+	return nil
+}
+
+// Profiles serves the net/http/pprof profiles under /debug/pprof/: goroutine, heap,
+// allocs, block, mutex and threadcreate by name, plus CPU profiles and execution traces
+func Profiles() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"a4/common"
+	"a4/rpcserver"
+)
+
+// TestModel drives two real Traders through random interleavings of crashes, restarts,
+// partitions, heartbeats, commits and replication flushes (including lost
+// acknowledgements) over an in-memory network. After every step it checks election safety
+// (no two Traders lead the same term) and log matching (a replica holds exactly the
+// sender's entries up to the last one applied), and prints the execution if either fails.
+//
+// Follower restarts are recovered by state transfer, which is left out: a restarted
+// Trader's replica starts empty and only the sender's entries sent afterwards are compared.
+
+var (
+	modelWalks   = flag.Int("model.walks", 300, "Random executions explored by TestModel")
+	modelSteps   = flag.Int("model.steps", 40, "Events in each execution of TestModel")
+	modelSeed    = flag.Int64("model.seed", 1, "Seed of the first execution of TestModel; each further one adds 1")
+	modelPersist = flag.Bool("model.persist", true, "Run the Traders of TestModel with a term file")
+)
+
+// Budgets of each execution
+const (
+	modelCrashes    = 3
+	modelPartitions = 3
+	modelCommits    = 8
+)
+
+// ======= IN-MEMORY NETWORK =======
+
+var errUnreachable = errors.New("node unreachable")
+
+// memNet connects the Traders of the model through in-memory pipes
+type memNet struct {
+	mu      sync.Mutex
+	servers map[string]*rpc.Server // Running Traders by address (guarded by mu)
+	conns   map[string][]net.Conn  // Server ends of the open connections by address (guarded by mu)
+	cut     bool                   // Partitioned: every dial fails (guarded by mu)
+	dropAck bool                   // Replication batches are applied but not acknowledged (guarded by mu)
+}
+
+func newMemNet() *memNet {
+	return &memNet{servers: make(map[string]*rpc.Server), conns: make(map[string][]net.Conn)}
+}
+
+// dial connects to the Trader at addr, unless it is down or the network is partitioned
+func (n *memNet) dial(addr string, _ time.Duration) (net.Conn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	srv := n.servers[addr]
+	if n.cut || srv == nil {
+		return nil, fmt.Errorf("dial %s: %w", addr, errUnreachable)
+	}
+	client, server := net.Pipe()
+	n.conns[addr] = append(n.conns[addr], server)
+	go srv.ServeCodec(&lossyCodec{ServerCodec: rpcserver.GobCodec(server), net: n, conn: server})
+	return client, nil
+}
+
+// serve makes srv answer at addr; nil takes the node down along with its connections
+func (n *memNet) serve(addr string, srv *rpc.Server) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.servers[addr] = srv
+	if srv == nil {
+		n.dropLocked(addr)
+	}
+}
+
+// partition cuts or heals the network, dropping the open connections when cutting
+func (n *memNet) partition(cut bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cut = cut
+	if cut {
+		for addr := range n.conns {
+			n.dropLocked(addr)
+		}
+	}
+}
+
+// setDropAck starts or stops losing the acknowledgements of replication batches
+func (n *memNet) setDropAck(drop bool) {
+	n.mu.Lock()
+	n.dropAck = drop
+	n.mu.Unlock()
+}
+
+// dropLocked closes the open connections to addr; mu must be held
+func (n *memNet) dropLocked(addr string) {
+	for _, conn := range n.conns[addr] {
+		conn.Close()
+	}
+	delete(n.conns, addr)
+}
+
+// lossyCodec closes the connection instead of acknowledging a replication batch while the
+// network drops acknowledgements, so the receiver applies it and the sender keeps it pending
+type lossyCodec struct {
+	rpc.ServerCodec
+	net  *memNet
+	conn net.Conn
+}
+
+func (c *lossyCodec) WriteResponse(r *rpc.Response, body any) error {
+	c.net.mu.Lock()
+	drop := c.net.dropAck
+	c.net.mu.Unlock()
+	if drop && r.ServiceMethod == "Trader.ReplicateBatch" {
+		c.conn.Close()
+		return errUnreachable
+	}
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+// ======= MODEL =======
+
+// model is one execution: the Traders, the network and the history checked against
+type model struct {
+	t       *testing.T
+	net     *memNet
+	dir     string
+	traders [2]*Trader // nil while crashed
+
+	epochs   int64              // Replication epochs handed out so far
+	logs     map[int64][]string // Items committed in each Trader lifetime, by replication epoch
+	leaderOf map[int64]int      // Trader that led each term
+	items    int
+
+	crashes, partitions, commits int
+	trace                        []string
+}
+
+// traderAddr is the in-memory address of a Trader
+func traderAddr(id int) string {
+	return fmt.Sprintf("trader-%d", id)
+}
+
+// start runs Trader i+1 as main would with a counter detector suspecting at the first
+// missed heartbeat, restoring its term file if persist is set
+func (m *model) start(i int) *Trader {
+	id := i + 1
+	tr := &Trader{
+		ID:           id,
+		Address:      traderAddr(id),
+		Peer:         traderAddr(3 - id),
+		PeerID:       3 - id,
+		Post:         id,
+		Inventory:    make(map[string]int),
+		Cancelled:    make(map[RequestKey]bool),
+		HBHistory:    NewHeartbeatHistory(20),
+		Handback:     make(map[string]int),
+		History:      NewRequestHistory(100),
+		Registry:     make(map[int]*SellerInfo),
+		leases:       make(map[int]int),
+		faults:       make(map[string]Fault),
+		snapshots:    make(map[int64]*stateSnapshot),
+		forwardSlots: newWorkSlots(1),
+		workers:      newWorkSlots(0),
+		ResponseMode: responseSync,
+		negotiating:  true,
+		Detector:     &counterDetector{threshold: 1},
+	}
+	tr.Conns = &common.Pool{Dial: tr.dialNode}
+	if *modelPersist {
+		store, st, err := OpenTermStore(filepath.Join(m.dir, traderAddr(id)+".term"))
+		if err != nil {
+			m.t.Fatal(err)
+		}
+		tr.TermStore = store
+		tr.Term, tr.votedFor, tr.voteTerm = st.Term, st.VotedFor, st.VoteTerm
+	}
+	tr.Replicator = NewReplicator(tr, 2, time.Second)
+	m.epochs++
+	tr.Replicator.epoch = m.epochs
+	tr.pulling.Store(true) // State transfer is not part of the model
+
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Trader", tr); err != nil {
+		m.t.Fatal(err)
+	}
+	m.net.serve(tr.Address, srv)
+	m.traders[i] = tr
+	return tr
+}
+
+// event is a named step of an execution
+type event struct {
+	name  string
+	apply func()
+}
+
+// events lists the steps enabled in the current state
+func (m *model) events() []event {
+	var evs []event
+	for i, tr := range m.traders {
+		i, tr := i, tr
+		name := fmt.Sprintf("T%d", i+1)
+		if tr == nil {
+			evs = append(evs, event{name + " restarts", func() { m.start(i).negotiateRole(0) }})
+			continue
+		}
+		if m.crashes < modelCrashes {
+			evs = append(evs, event{name + " crashes", func() {
+				m.net.serve(tr.Address, nil)
+				m.traders[i] = nil
+				m.crashes++
+			}})
+		}
+		evs = append(evs, event{name + " sends a heartbeat", tr.SendHeartbeat})
+		if tr.Replicator.backlog() > 0 {
+			evs = append(evs, event{name + " flushes replication", tr.Replicator.flush})
+			evs = append(evs, event{name + " flushes replication, ack lost", func() {
+				m.net.setDropAck(true)
+				tr.Replicator.flush()
+				m.net.setDropAck(false)
+			}})
+		}
+		if m.commits < modelCommits {
+			evs = append(evs, event{name + " commits a request", func() { m.commit(tr) }})
+		}
+	}
+	if m.net.cut {
+		evs = append(evs, event{"heal", func() { m.net.partition(false) }})
+	} else if m.partitions < modelPartitions {
+		evs = append(evs, event{"partition", func() {
+			m.net.partition(true)
+			m.partitions++
+		}})
+	}
+	return evs
+}
+
+// commit deposits a new item, which the Trader queues for replication
+func (m *model) commit(tr *Trader) {
+	m.items++
+	item := fmt.Sprintf("item-%d", m.items)
+	tr.InventoryMu.Lock()
+	tr.applyLocked(StateEvent{Kind: "deposit", Bucket: bucketInventory, Item: item, Quantity: 1})
+	tr.InventoryMu.Unlock()
+	epoch := tr.Replicator.epoch
+	m.logs[epoch] = append(m.logs[epoch], item)
+	m.commits++
+}
+
+// check records who leads which term and returns a description of any violated property
+func (m *model) check() string {
+	for _, tr := range m.traders {
+		if tr == nil {
+			continue
+		}
+		tr.HeartbeatMu.Lock()
+		leader, term := tr.IsLeader, tr.Term
+		tr.HeartbeatMu.Unlock()
+		if !leader {
+			continue
+		}
+		if owner, ok := m.leaderOf[term]; ok && owner != tr.ID {
+			return fmt.Sprintf("election safety: Traders %d and %d both led term %d", owner, tr.ID, term)
+		}
+		m.leaderOf[term] = tr.ID
+	}
+
+	for i, sender := range m.traders {
+		receiver := m.traders[1-i]
+		if sender == nil || receiver == nil {
+			continue
+		}
+		receiver.InventoryMu.Lock()
+		epoch, applied, replica := receiver.replEpoch, receiver.replApplied, maps.Clone(receiver.PeerInventory)
+		receiver.InventoryMu.Unlock()
+		if epoch != sender.Replicator.epoch || len(replica) == 0 {
+			continue
+		}
+		log := m.logs[epoch]
+		if applied > int64(len(log)) {
+			return fmt.Sprintf("log matching: Trader %d applied entry %d of Trader %d's log, which has %d entries", receiver.ID, applied, sender.ID, len(log))
+		}
+		held := 0
+		for seq := applied; seq >= 1 && replica[log[seq-1]] == 1; seq-- {
+			held++
+		}
+		if held != len(replica) {
+			return fmt.Sprintf("log matching: Trader %d applied up to entry %d of Trader %d's log %v but holds %v", receiver.ID, applied, sender.ID, log, replica)
+		}
+	}
+	return ""
+}
+
+// run plays one execution from both Traders starting together and returns the violation
+// found, if any
+func (m *model) run(rnd *rand.Rand, steps int) string {
+	m.start(0)
+	m.start(1)
+	m.traders[0].negotiateRole(0)
+	m.traders[1].negotiateRole(0)
+	if v := m.check(); v != "" {
+		return v
+	}
+	for step := 0; step < steps; step++ {
+		evs := m.events()
+		ev := evs[rnd.Intn(len(evs))]
+		m.trace = append(m.trace, ev.name)
+		ev.apply()
+		if v := m.check(); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func TestModel(t *testing.T) {
+	quiet(t)
+	t.Cleanup(func() { common.UseDialer(nil) })
+
+	for walk := 0; walk < *modelWalks; walk++ {
+		seed := *modelSeed + int64(walk)
+		m := &model{t: t, net: newMemNet(), dir: t.TempDir(), logs: make(map[int64][]string), leaderOf: make(map[int64]int)}
+		common.UseDialer(m.net.dial)
+		violation := m.run(rand.New(rand.NewSource(seed)), *modelSteps)
+		m.net.partition(true)
+		if violation == "" {
+			continue
+		}
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s (reproduce with -model.seed=%d -model.walks=1)\n", violation, seed)
+		fmt.Fprintln(&b, "  both Traders start and negotiate")
+		for i, step := range m.trace {
+			fmt.Fprintf(&b, "  %d. %s\n", i+1, step)
+		}
+		t.Fatal(b.String())
+	}
+}
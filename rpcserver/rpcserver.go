@@ -0,0 +1,402 @@
+// Package rpcserver is the net/rpc server shared by the Trader, Seller, Buyer and
+// Warehouse. It binds the listen address with diagnostics, optionally wraps connections in
+// TLS, limits concurrent connections and lets callers observe or reject individual calls.
+package rpcserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/rpc"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Call describes one incoming RPC call as seen by interceptors
+type Call struct {
+	Method string            // e.g. "Trader.ReceiveRequest"
+	Remote string            // Remote address of the connection
+	Cert   *x509.Certificate // Client certificate the TLS handshake verified; nil if none
+}
+
+// Interceptor runs before a call is dispatched. Returning an error rejects the call with
+// that error; the returned done func (may be nil) runs once the reply has been written,
+// with the call's error message ("" on success) and how long the call took.
+type Interceptor func(call *Call) (done func(errMsg string, elapsed time.Duration), err error)
+
+// Codec builds the server codec for one connection; nil selects gob, as net/rpc does
+type Codec func(conn io.ReadWriteCloser) rpc.ServerCodec
+
+// Options configures a Server
+type Options struct {
+	Name         string      // Used in log messages, e.g. "Trader 1"
+	Address      string      // host:port to listen on
+	DevMode      bool        // Fall back to a free port if Address is taken
+	TLS          *tls.Config // Serve TLS if non-nil
+	MaxConns     int         // Maximum concurrent connections; 0 is unlimited
+	IdleTimeout  time.Duration
+	Interceptors []Interceptor // Run in order for every call
+	Codec        Codec
+}
+
+// Server is a net/rpc server with its own service registry
+type Server struct {
+	opts     Options
+	rpc      *rpc.Server
+	listener net.Listener
+	sem      chan struct{} // Connection slots when MaxConns > 0
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{} // Open connections (guarded by mu)
+	calls int                   // Calls read but not yet answered (guarded by mu)
+}
+
+// New returns a Server; register services before calling Listen
+func New(opts Options) *Server {
+	s := &Server{opts: opts, rpc: rpc.NewServer(), conns: make(map[net.Conn]struct{})}
+	if opts.MaxConns > 0 {
+		s.sem = make(chan struct{}, opts.MaxConns)
+	}
+	return s
+}
+
+// Register publishes rcvr's exported RPC methods under its type name
+func (s *Server) Register(rcvr interface{}) error {
+	return s.rpc.Register(rcvr)
+}
+
+// Listen binds the configured address and returns the address actually bound, which
+// differs from Options.Address only after a dev-mode fallback
+func (s *Server) Listen() (string, error) {
+	listener, addr, err := listenWithDiagnostics(s.opts.Address, s.opts.DevMode)
+	if err != nil {
+		return "", err
+	}
+	if s.opts.TLS != nil {
+		listener = tls.NewListener(listener, s.opts.TLS)
+	}
+	s.listener = listener
+	return addr, nil
+}
+
+// Serve accepts connections until the listener is closed
+func (s *Server) Serve() {
+	defer s.listener.Close()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("Failed to accept connection", "server", s.opts.Name, "err", err)
+			continue
+		}
+		if s.sem != nil {
+			select {
+			case s.sem <- struct{}{}:
+			default:
+				slog.Warn("Rejected connection; connection limit reached", "server", s.opts.Name, "from", conn.RemoteAddr(), "max_conns", s.opts.MaxConns)
+				conn.Close()
+				continue
+			}
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// Shutdown stops accepting connections, waits up to grace for the calls in progress to
+// be answered and then closes every connection. It returns the number of calls cut off.
+func (s *Server) Shutdown(grace time.Duration) int {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	deadline := time.Now().Add(grace)
+	for {
+		s.mu.Lock()
+		calls := s.calls
+		if calls == 0 || !time.Now().Before(deadline) {
+			for conn := range s.conns {
+				conn.Close()
+			}
+			s.mu.Unlock()
+			return calls
+		}
+		s.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// handshakeTimeout bounds the TLS handshake of a new connection
+const handshakeTimeout = 10 * time.Second
+
+// serveConn serves one connection until the client hangs up
+func (s *Server) serveConn(conn net.Conn) {
+	if s.sem != nil {
+		defer func() { <-s.sem }()
+	}
+	// Handshake up front, so a client the TLS configuration refuses (such as one without
+	// a certificate the cluster CA signed) is logged rather than dropped on its first read
+	var cert *x509.Certificate
+	if tc, ok := conn.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tc.Handshake(); err != nil {
+			slog.Warn("Rejected TLS connection", "server", s.opts.Name, "from", conn.RemoteAddr(), "err", err)
+			conn.Close()
+			return
+		}
+		tc.SetDeadline(time.Time{})
+		if state := tc.ConnectionState(); len(state.VerifiedChains) > 0 {
+			cert = state.PeerCertificates[0]
+		}
+	}
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	var rwc io.ReadWriteCloser = conn
+	if s.opts.IdleTimeout > 0 {
+		rwc = &idleConn{Conn: conn, timeout: s.opts.IdleTimeout}
+	}
+
+	newCodec := s.opts.Codec
+	if newCodec == nil {
+		newCodec = GobCodec
+	}
+	codec := newCodec(rwc)
+	if len(s.opts.Interceptors) > 0 {
+		codec = &interceptCodec{
+			ServerCodec:  codec,
+			remote:       conn.RemoteAddr().String(),
+			cert:         cert,
+			interceptors: s.opts.Interceptors,
+			calls:        make(map[uint64]*pendingCall),
+		}
+	}
+	s.rpc.ServeCodec(&trackCodec{ServerCodec: codec, s: s})
+}
+
+// idleConn closes connections that send nothing for the idle timeout
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+// ======= CODECS =======
+
+// gobCodec is the gob server codec net/rpc uses by default, which it does not export
+type gobCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+}
+
+// GobCodec returns net/rpc's default gob server codec for conn
+func GobCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobCodec{rwc: conn, dec: gob.NewDecoder(conn), enc: gob.NewEncoder(buf), encBuf: buf}
+}
+
+func (c *gobCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Gob couldn't encode the header; shut the connection down
+			slog.Error("Failed to encode RPC response header", "err", err)
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Was a gob problem encoding the body but the header has been written
+			slog.Error("Failed to encode RPC response body", "err", err)
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+// trackCodec counts the calls in progress on a Server, so Shutdown can wait for them
+type trackCodec struct {
+	rpc.ServerCodec
+	s *Server
+}
+
+func (c *trackCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.ServerCodec.ReadRequestHeader(r)
+	if err == nil {
+		c.s.mu.Lock()
+		c.s.calls++
+		c.s.mu.Unlock()
+	}
+	return err
+}
+
+func (c *trackCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	defer func() {
+		c.s.mu.Lock()
+		c.s.calls--
+		c.s.mu.Unlock()
+	}()
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+// ======= INTERCEPTORS =======
+
+// rejectedMethod is substituted for the method of a rejected call so that net/rpc
+// replies with an error without dispatching it; the real error replaces that reply
+const rejectedMethod = "rpcserver.rejected"
+
+// pendingCall tracks a dispatched call until its reply is written
+type pendingCall struct {
+	method   string
+	start    time.Time
+	done     []func(errMsg string, elapsed time.Duration)
+	rejected error
+}
+
+// interceptCodec runs interceptors around each call passing through a codec
+type interceptCodec struct {
+	rpc.ServerCodec
+	remote       string
+	cert         *x509.Certificate
+	interceptors []Interceptor
+
+	mu    sync.Mutex
+	calls map[uint64]*pendingCall // By sequence number (guarded by mu)
+}
+
+func (c *interceptCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.ServerCodec.ReadRequestHeader(r); err != nil {
+		return err
+	}
+	pc := &pendingCall{method: r.ServiceMethod, start: time.Now()}
+	call := &Call{Method: r.ServiceMethod, Remote: c.remote, Cert: c.cert}
+	for _, ic := range c.interceptors {
+		done, err := ic(call)
+		if done != nil {
+			pc.done = append(pc.done, done)
+		}
+		if err != nil {
+			pc.rejected = err
+			r.ServiceMethod = rejectedMethod
+			break
+		}
+	}
+	c.mu.Lock()
+	c.calls[r.Seq] = pc
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *interceptCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.mu.Lock()
+	pc := c.calls[r.Seq]
+	delete(c.calls, r.Seq)
+	c.mu.Unlock()
+	if pc == nil {
+		return c.ServerCodec.WriteResponse(r, body)
+	}
+
+	if pc.rejected != nil {
+		r.ServiceMethod = pc.method
+		r.Error = pc.rejected.Error()
+	}
+	err := c.ServerCodec.WriteResponse(r, body)
+	for _, done := range pc.done {
+		done(r.Error, time.Since(pc.start))
+	}
+	return err
+}
+
+// ======= LISTENING =======
+
+// listenWithDiagnostics binds addr and, on failure, explains who holds the port and
+// suggests a free one. In dev mode it falls back to a free port on the same host.
+// It returns the address actually bound, which differs from addr only after a fallback.
+func listenWithDiagnostics(addr string, devMode bool) (net.Listener, string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err == nil {
+		return listener, addr, nil
+	}
+
+	host, port, splitErr := net.SplitHostPort(addr)
+	if splitErr != nil {
+		return nil, "", fmt.Errorf("invalid address %q: %v (expected host:port)", addr, splitErr)
+	}
+
+	slog.Error("Cannot listen", "addr", addr, "err", err)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		slog.Info("Port is already in use", "port", port)
+		if owner := portOwner(port); owner != "" {
+			slog.Info("Port is held by another process", "port", port, "owner", owner)
+		} else {
+			slog.Info("Run lsof to see which process holds the port", "command", fmt.Sprintf("lsof -iTCP:%s -sTCP:LISTEN", port))
+		}
+	} else if errors.Is(err, syscall.EACCES) {
+		slog.Info("Permission denied; ports below 1024 usually require root", "port", port)
+	}
+
+	free, freeErr := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if freeErr != nil {
+		return nil, "", err
+	}
+	if !devMode {
+		slog.Info("Suggested free port (or pass -dev to pick one automatically)", "addr", free.Addr().String())
+		free.Close()
+		return nil, "", err
+	}
+
+	slog.Warn("Dev mode: using a free address instead", "addr", free.Addr().String())
+	return free, free.Addr().String(), nil
+}
+
+// portOwner returns a description of the process listening on port, if lsof is available
+func portOwner(port string) string {
+	out, err := exec.Command("lsof", "-nP", "-iTCP:"+port, "-sTCP:LISTEN").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
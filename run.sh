@@ -1,11 +1,15 @@
 #!/bin/bash
 
+# Start the Warehouse
+go run warehouse/warehouse.go -address=localhost:8006 -file=log/warehouse.json > log/warehouse.txt 2>&1 &
+echo "Warehouse started at localhost:8006"
+
 # Start Trader 1
-go run trader.go -id=1 -address=localhost:8001 -peer=localhost:8002 -post=1 > log/trader1.txt 2>&1 &
+go run trader.go -id=1 -address=localhost:8001 -peer=localhost:8002 -peer-id=2 -post=1 -term-file=log/trader1-term.json -warehouse=localhost:8006 > log/trader1.txt 2>&1 &
 echo "Trader 1 started at localhost:8001"
 
 # Start Trader 2
-go run trader.go -id=2 -address=localhost:8002 -peer=localhost:8001 -post=2 > log/trader2.txt 2>&1 &
+go run trader.go -id=2 -address=localhost:8002 -peer=localhost:8001 -peer-id=1 -post=2 -term-file=log/trader2-term.json -warehouse=localhost:8006 > log/trader2.txt 2>&1 &
 echo "Trader 2 started at localhost:8002"
 
 # Start Seller 1
@@ -14,4 +18,8 @@ echo "Seller 1 started at localhost:8003"
 
 # Start Seller 2
 go run seller/seller.go -id=2 -address=localhost:8004 -trader=localhost:8002 -post=2 > log/seller2.txt 2>&1 &
-echo "Seller 2 started at localhost:8004"
\ No newline at end of file
+echo "Seller 2 started at localhost:8004"
+
+# Start Buyer 1
+go run buyer/buyer.go -id=1 -address=localhost:8005 -traders=localhost:8001,localhost:8002 -post=1 -items=apples > log/buyer1.txt 2>&1 &
+echo "Buyer 1 started at localhost:8005"
\ No newline at end of file
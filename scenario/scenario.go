@@ -0,0 +1,695 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"a4/common"
+)
+
+// Request mirrors the Trader's request type
+type Request struct {
+	SellerID  int
+	Post      int
+	Item      string
+	Quantity  int
+	RequestID int
+	DryRun    bool
+}
+
+// Response mirrors the Trader's response type
+type Response struct {
+	Status    string
+	Message   string
+	RequestID int
+	Processed bool
+	TraderID  int
+	Signature string
+	Session   string
+	Path      []string
+	Price     float64
+	Stock     int
+	ETA       time.Duration
+}
+
+// AdminArgs mirrors the Trader's admin credential
+type AdminArgs struct {
+	Token  string
+	Enable bool
+}
+
+// ShutdownArgs mirrors the Trader's shutdown request
+type ShutdownArgs struct {
+	Token string
+	Mode  string
+}
+
+// TraderState mirrors the Trader's admin state report
+type TraderState struct {
+	ID        int
+	IsLeader  bool
+	PeerUp    bool
+	Inventory map[string]int
+	Adopted   map[string]int
+	Handback  map[string]int
+	Processed int
+	Abandoned int
+
+	InFlight      int
+	HistoryLen    int
+	TrackingBytes int
+	MemoryBytes   int
+	MemoryLimit   int
+
+	Faults map[string]Fault
+
+	QueryHits   int
+	QueryMisses int
+	QuerySeq    uint64
+
+	Pool common.PoolStats
+
+	Fairness FairnessReport
+
+	Offloaded     int
+	ReadOnlyLocal int
+	ReplicaReads  int
+
+	DupsDropped int
+	Repeated    int
+
+	FailoverPolicy  string
+	FailoverPending bool
+
+	RateLimited int
+	Overloaded  int
+	Summaries   int
+	Summarized  int
+	Federated   int
+	TimedOut    int
+	Alerts      map[string]int
+	StaleConns  int
+
+	Spoiled int
+
+	Term      int64
+	Draining  bool
+	ReplQueue int
+	Forwards  int
+	PollQueue int
+	Streams   int
+
+	Members  int
+	LeaderID int
+
+	PeerAccepted int
+
+	ForwardsWaiting int
+	Working         int
+	WorkWaiting     int
+	Expired         int
+
+	WorkerLimit    int
+	WorkerScalings int
+
+	AcceptQueue  int
+	AsyncWorkers int
+
+	CachePending  int
+	CacheWritten  int
+	CacheRefused  int
+	CacheOversold int
+}
+
+// PostStats mirrors the service one post got from a Trader
+type PostStats struct {
+	Post       int
+	Received   int
+	Deposits   int
+	Purchases  int
+	Rate       float64
+	AvgLatency time.Duration
+	MaxLatency time.Duration
+}
+
+// FairnessReport mirrors a Trader's per-post service and fairness index
+type FairnessReport struct {
+	Posts    []PostStats
+	Fairness float64
+}
+
+// Fault mirrors the Trader's injected RPC fault
+type Fault struct {
+	Delay    time.Duration
+	Jitter   time.Duration
+	DropProb float64
+}
+
+// Scenario is an executable regression test against real Trader processes
+type Scenario func(h *Harness) error
+
+// scenarios lists the built-in scenarios by name
+var scenarios = map[string]Scenario{
+	"split-brain":      splitBrain,
+	"standby-failover": standbyFailover,
+	"torn-journal":     tornJournal,
+	"disk-full":        diskFull,
+}
+
+// Harness launches Traders and talks to them over their admin API
+type Harness struct {
+	Bin       string
+	Token     string
+	TimeScale float64
+	BasePort  int
+	Args      map[int][]string // Extra flags for Trader i
+	FileLimit map[int]int      // Largest file Trader i may write, in 512-byte blocks (0 for no limit)
+	procs     map[int]*exec.Cmd
+	exited    map[int]chan error // Receives the exit of Trader i's process
+	logDir    string
+	nextReqID int
+}
+
+// addr returns the address of Trader id
+func (h *Harness) addr(id int) string {
+	return fmt.Sprintf("localhost:%d", h.BasePort+id)
+}
+
+// StartTrader launches Trader id (1 or 2) paired with the other one
+func (h *Harness) StartTrader(id int) error {
+	peer := 3 - id
+	logFile, err := os.Create(filepath.Join(h.logDir, fmt.Sprintf("trader%d.txt", id)))
+	if err != nil {
+		return err
+	}
+	args := []string{
+		fmt.Sprintf("-id=%d", id),
+		"-address=" + h.addr(id),
+		"-peer=" + h.addr(peer),
+		fmt.Sprintf("-peer-id=%d", peer),
+		fmt.Sprintf("-post=%d", id),
+		"-admin-token=" + h.Token,
+		fmt.Sprintf("-time-scale=%g", h.TimeScale),
+	}
+	args = append(args, h.Args[id]...)
+	cmd := exec.Command(h.Bin, args...)
+	if blocks := h.FileLimit[id]; blocks > 0 {
+		// Writes past the limit fail part-way, as they do when the disk fills up
+		cmd = exec.Command("sh", append([]string{"-c", fmt.Sprintf(`ulimit -f %d && exec "$0" "$@"`, blocks), h.Bin}, args...)...)
+	}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	h.procs[id], h.exited[id] = cmd, exited
+	return nil
+}
+
+// Exited reports whether Trader id's process exits within the (scaled) timeout
+func (h *Harness) Exited(id int, timeout time.Duration) bool {
+	select {
+	case <-h.exited[id]:
+		delete(h.procs, id)
+		return true
+	case <-time.After(time.Duration(float64(timeout) / h.TimeScale)):
+		return false
+	}
+}
+
+// StopTrader asks Trader id to shut down (mode "graceful" or "immediate") and waits
+// for it to exit, killing it only if the RPC fails or it does not exit in time
+func (h *Harness) StopTrader(id int, mode string) error {
+	cmd, ok := h.procs[id]
+	if !ok {
+		return nil
+	}
+	delete(h.procs, id)
+	done := h.exited[id]
+
+	var reply string
+	err := h.call(id, "Trader.Shutdown", &ShutdownArgs{Token: h.Token, Mode: mode}, &reply)
+	if err == nil {
+		select {
+		case <-done:
+			return nil
+		case <-time.After(time.Duration(float64(40*time.Second) / h.TimeScale)):
+			err = fmt.Errorf("Trader %d did not exit after %s shutdown", id, mode)
+		}
+	}
+	cmd.Process.Kill()
+	<-done
+	return err
+}
+
+// Alerts returns the anomaly alerts the Traders logged, which fail any scenario
+func (h *Harness) Alerts() ([]string, error) {
+	logs, err := filepath.Glob(filepath.Join(h.logDir, "trader*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	var alerts []string
+	for _, path := range logs {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.Contains(line, "ALERT: ") {
+				alerts = append(alerts, filepath.Base(path)+": "+line)
+			}
+		}
+	}
+	return alerts, nil
+}
+
+// StopAll shuts down every launched Trader
+func (h *Harness) StopAll() {
+	for id := range h.procs {
+		if err := h.StopTrader(id, "immediate"); err != nil {
+			log.Printf("Scenario: %v", err)
+		}
+	}
+}
+
+// callTimeout bounds every harness RPC, so a hung Trader fails the scenario instead of
+// stalling it
+const callTimeout = 30 * time.Second
+
+// call invokes an RPC on Trader id
+func (h *Harness) call(id int, method string, args, reply interface{}) error {
+	return common.Call(h.addr(id), method, args, reply, callTimeout)
+}
+
+// State fetches the admin state of Trader id
+func (h *Harness) State(id int) (TraderState, error) {
+	var st TraderState
+	err := h.call(id, "Trader.State", &AdminArgs{Token: h.Token}, &st)
+	return st, err
+}
+
+// SetPartition injects or heals the partition on Trader id
+func (h *Harness) SetPartition(id int, enable bool) error {
+	var reply string
+	return h.call(id, "Trader.Partition", &AdminArgs{Token: h.Token, Enable: enable}, &reply)
+}
+
+// Deposit sends a seller request to Trader id and requires it to be processed
+func (h *Harness) Deposit(id, post int, item string, qty int) error {
+	h.nextReqID++
+	req := Request{SellerID: 900, Post: post, Item: item, Quantity: qty, RequestID: h.nextReqID}
+	var res Response
+	if err := h.call(id, "Trader.ReceiveRequest", &req, &res); err != nil {
+		return err
+	}
+	if !res.Processed {
+		return fmt.Errorf("deposit of %d %s at Trader %d not processed: %s %s", qty, item, id, res.Status, res.Message)
+	}
+	log.Printf("Scenario: Deposited %d %s for Post %d at Trader %d", qty, item, post, id)
+	return nil
+}
+
+// WaitFor polls cond until it holds or the (scaled) timeout elapses
+func (h *Harness) WaitFor(what string, timeout time.Duration, cond func() bool) error {
+	deadline := time.Now().Add(time.Duration(float64(timeout) / h.TimeScale))
+	for time.Now().Before(deadline) {
+		if cond() {
+			log.Printf("Scenario: %s", what)
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting until %s", what)
+}
+
+// bothStates fetches both Traders' states, returning ok=false if either is unreachable
+func (h *Harness) bothStates() (TraderState, TraderState, bool) {
+	s1, err1 := h.State(1)
+	s2, err2 := h.State(2)
+	return s1, s2, err1 == nil && err2 == nil
+}
+
+// splitBrain partitions the Traders symmetrically so both become leader, writes
+// conflicting deposits on both sides, heals the partition and verifies that exactly one
+// leader remains and every deposit ends up, exactly once, with the Trader owning its post.
+func splitBrain(h *Harness) error {
+	for id := 1; id <= 2; id++ {
+		if err := h.StartTrader(id); err != nil {
+			return err
+		}
+	}
+
+	if err := h.WaitFor("both Traders see each other", 30*time.Second, func() bool {
+		s1, s2, ok := h.bothStates()
+		return ok && s1.PeerUp && s2.PeerUp
+	}); err != nil {
+		return err
+	}
+
+	for id := 1; id <= 2; id++ {
+		if err := h.SetPartition(id, true); err != nil {
+			return err
+		}
+	}
+	if err := h.WaitFor("both Traders claim leadership during the partition", 30*time.Second, func() bool {
+		s1, s2, ok := h.bothStates()
+		return ok && s1.IsLeader && s2.IsLeader
+	}); err != nil {
+		return err
+	}
+
+	// Conflicting writes on both sides, including deposits for the other side's post
+	deposits := []struct {
+		trader, post int
+		item         string
+		qty          int
+	}{
+		{1, 1, "apples", 10},
+		{1, 2, "oranges", 5},
+		{2, 2, "apples", 7},
+		{2, 1, "pears", 3},
+	}
+	want := map[int]map[string]int{1: {}, 2: {}}
+	for _, d := range deposits {
+		if err := h.Deposit(d.trader, d.post, d.item, d.qty); err != nil {
+			return err
+		}
+		want[d.post][d.item] += d.qty
+	}
+
+	for id := 1; id <= 2; id++ {
+		if err := h.SetPartition(id, false); err != nil {
+			return err
+		}
+	}
+
+	var s1, s2 TraderState
+	if err := h.WaitFor("the partition is reconciled", 30*time.Second, func() bool {
+		var ok bool
+		s1, s2, ok = h.bothStates()
+		return ok && s1.IsLeader != s2.IsLeader && len(s1.Handback) == 0 && len(s2.Handback) == 0 &&
+			len(s1.Adopted) == 0 && len(s2.Adopted) == 0
+	}); err != nil {
+		return err
+	}
+
+	var problems []string
+	if !s1.IsLeader {
+		problems = append(problems, "Trader 1 should keep leadership after the heal")
+	}
+	if !reflect.DeepEqual(s1.Inventory, want[1]) {
+		problems = append(problems, fmt.Sprintf("Trader 1 inventory %v, want %v", s1.Inventory, want[1]))
+	}
+	if !reflect.DeepEqual(s2.Inventory, want[2]) {
+		problems = append(problems, fmt.Sprintf("Trader 2 inventory %v, want %v", s2.Inventory, want[2]))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("inconsistent state after heal:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// standbyFailover stops the leader while the backup runs the standby failover policy and
+// verifies the backup refuses deposits until an operator approves the takeover, then
+// serves them as leader.
+func standbyFailover(h *Harness) error {
+	h.Args = map[int][]string{2: {"-failover=standby"}}
+	for id := 1; id <= 2; id++ {
+		if err := h.StartTrader(id); err != nil {
+			return err
+		}
+	}
+	if err := h.WaitFor("both Traders see each other", 30*time.Second, func() bool {
+		s1, s2, ok := h.bothStates()
+		return ok && s1.PeerUp && s2.PeerUp
+	}); err != nil {
+		return err
+	}
+
+	if err := h.StopTrader(1, "immediate"); err != nil {
+		return err
+	}
+	if err := h.WaitFor("Trader 2 holds back the failover", 30*time.Second, func() bool {
+		s2, err := h.State(2)
+		return err == nil && s2.FailoverPending && !s2.IsLeader
+	}); err != nil {
+		return err
+	}
+	if err := h.Deposit(2, 2, "apples", 4); err == nil {
+		return fmt.Errorf("Trader 2 processed a deposit on standby before the failover was approved")
+	}
+
+	var reply string
+	if err := h.call(2, "Trader.ApproveFailover", &AdminArgs{Token: h.Token}, &reply); err != nil {
+		return err
+	}
+	if err := h.WaitFor("Trader 2 leads after approval", 30*time.Second, func() bool {
+		s2, err := h.State(2)
+		return err == nil && s2.IsLeader && !s2.FailoverPending
+	}); err != nil {
+		return err
+	}
+	if err := h.Deposit(2, 2, "apples", 4); err != nil {
+		return err
+	}
+	s2, err := h.State(2)
+	if err != nil {
+		return err
+	}
+	if s2.Inventory["apples"] != 4 {
+		return fmt.Errorf("Trader 2 inventory %v after approval, want 4 apples", s2.Inventory)
+	}
+	return nil
+}
+
+// WaitUp waits until Trader id answers on its admin API
+func (h *Harness) WaitUp(id int) error {
+	return h.WaitFor(fmt.Sprintf("Trader %d is up", id), 30*time.Second, func() bool {
+		_, err := h.State(id)
+		return err == nil
+	})
+}
+
+// tornJournal crashes a Trader, tears its last journal record as a crash mid-write would,
+// and then corrupts an earlier record. The torn record must be truncated on restart. The
+// corrupt one must keep the Trader from starting until -force-recover truncates it there.
+func tornJournal(h *Harness) error {
+	journal := filepath.Join(h.logDir, "journal1.log")
+	h.Args = map[int][]string{1: {"-journal=" + journal}}
+	if err := h.StartTrader(1); err != nil {
+		return err
+	}
+	if err := h.WaitUp(1); err != nil {
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		if err := h.Deposit(1, 1, "apples", 5); err != nil {
+			return err
+		}
+	}
+	if err := h.StopTrader(1, "immediate"); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(journal)
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	last := lines[len(lines)-1]
+	if err := os.WriteFile(journal, append(data, last[:len(last)/2]...), 0o644); err != nil {
+		return err
+	}
+	log.Printf("Scenario: Tore the last record of %s", journal)
+
+	if err := h.StartTrader(1); err != nil {
+		return err
+	}
+	if err := h.WaitUp(1); err != nil {
+		return err
+	}
+	s1, err := h.State(1)
+	if err != nil {
+		return err
+	}
+	if s1.Inventory["apples"] != 15 {
+		return fmt.Errorf("Trader 1 inventory %v after a torn write, want 15 apples", s1.Inventory)
+	}
+	if err := h.StopTrader(1, "immediate"); err != nil {
+		return err
+	}
+	if data, err = os.ReadFile(journal); err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		return fmt.Errorf("the torn record was not truncated from %s", journal)
+	}
+
+	// Change the second deposit without fixing its checksum
+	deposits := 0
+	lines = bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if bytes.Contains(line, []byte(`"kind":"deposit"`)) {
+			if deposits++; deposits == 2 {
+				lines[i] = bytes.Replace(line, []byte(`"quantity":5`), []byte(`"quantity":9`), 1)
+			}
+		}
+	}
+	if err := os.WriteFile(journal, bytes.Join(lines, []byte("\n")), 0o644); err != nil {
+		return err
+	}
+	log.Printf("Scenario: Corrupted the second deposit in %s", journal)
+
+	if err := h.StartTrader(1); err != nil {
+		return err
+	}
+	if !h.Exited(1, 30*time.Second) {
+		return fmt.Errorf("Trader 1 started from a journal with a checksum mismatch")
+	}
+	log.Printf("Scenario: Trader 1 refused to start from the corrupt journal")
+
+	h.Args[1] = append(h.Args[1], "-force-recover")
+	if err := h.StartTrader(1); err != nil {
+		return err
+	}
+	if err := h.WaitUp(1); err != nil {
+		return err
+	}
+	if s1, err = h.State(1); err != nil {
+		return err
+	}
+	if s1.Inventory["apples"] != 5 {
+		return fmt.Errorf("Trader 1 inventory %v after -force-recover, want the 5 apples journaled before the corrupt record", s1.Inventory)
+	}
+	return nil
+}
+
+// diskFull runs a Trader whose journal hits a file size limit part-way through a record,
+// as on a full disk. The partial record must be cut off at once, and a restart with room
+// again must rebuild every deposit written whole, without -force-recover.
+func diskFull(h *Harness) error {
+	journal := filepath.Join(h.logDir, "journal1.log")
+	h.Args = map[int][]string{1: {"-journal=" + journal}}
+	h.FileLimit = map[int]int{1: 4}
+	if err := h.StartTrader(1); err != nil {
+		return err
+	}
+	if err := h.WaitUp(1); err != nil {
+		return err
+	}
+	for i := 0; i < 12; i++ {
+		if err := h.Deposit(1, 1, "apples", 1); err != nil {
+			return err
+		}
+	}
+	data, err := os.ReadFile(journal)
+	if err != nil {
+		return err
+	}
+	if len(data) == 4*512 || !bytes.HasSuffix(data, []byte("\n")) {
+		return fmt.Errorf("journal %s ends in a partial record after the disk filled up (%d bytes)", journal, len(data))
+	}
+	written := bytes.Count(data, []byte(`"kind":"deposit"`))
+	if written == 12 {
+		return fmt.Errorf("every deposit fit in the journal; the file size limit was not reached")
+	}
+	log.Printf("Scenario: %d of 12 deposits fit in the journal before it filled up", written)
+	if err := h.StopTrader(1, "immediate"); err != nil {
+		return err
+	}
+
+	h.FileLimit = nil
+	if err := h.StartTrader(1); err != nil {
+		return err
+	}
+	if err := h.WaitUp(1); err != nil {
+		return err
+	}
+	s1, err := h.State(1)
+	if err != nil {
+		return err
+	}
+	if s1.Processed != written || s1.Inventory["apples"] != written {
+		return fmt.Errorf("Trader 1 rebuilt %d deposits and %v after the disk filled up, want the %d journaled", s1.Processed, s1.Inventory, written)
+	}
+	return h.Deposit(1, 1, "apples", 1)
+}
+
+func main() {
+	name := flag.String("scenario", "", "Scenario to run (or \"all\")")
+	repo := flag.String("repo", ".", "Path to the repository root containing trader.go")
+	basePort := flag.Int("base-port", 9200, "Trader i listens on base-port+i")
+	timeScale := flag.Float64("time-scale", 5, "Time scale passed to the Traders to speed the scenario up")
+	flag.Parse()
+
+	var names []string
+	for n := range scenarios {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if *name != "all" {
+		if _, ok := scenarios[*name]; !ok {
+			log.Fatalf("Usage: scenario -scenario=<%s|all>", strings.Join(names, "|"))
+		}
+		names = []string{*name}
+	}
+
+	workDir, err := os.MkdirTemp("", "a4-scenario-")
+	if err != nil {
+		log.Fatalf("Error creating work directory: %v", err)
+	}
+	bin := filepath.Join(workDir, "trader")
+	build := exec.Command("go", "build", "-o", bin, "trader.go")
+	build.Dir = *repo
+	if out, err := build.CombinedOutput(); err != nil {
+		log.Fatalf("Error building trader: %v\n%s", err, out)
+	}
+
+	failed := 0
+	for _, n := range names {
+		h := &Harness{
+			Bin:       bin,
+			Token:     "scenario-admin",
+			TimeScale: *timeScale,
+			BasePort:  *basePort,
+			procs:     make(map[int]*exec.Cmd),
+			exited:    make(map[int]chan error),
+			logDir:    filepath.Join(workDir, n),
+		}
+		os.MkdirAll(h.logDir, 0o755)
+
+		log.Printf("Scenario %s: starting (logs in %s)", n, h.logDir)
+		err := scenarios[n](h)
+		h.StopAll()
+		if err == nil {
+			alerts, aerr := h.Alerts()
+			switch {
+			case aerr != nil:
+				err = aerr
+			case len(alerts) > 0:
+				err = fmt.Errorf("Traders raised %d anomaly alerts:\n%s", len(alerts), strings.Join(alerts, "\n"))
+			}
+		}
+		if err != nil {
+			failed++
+			log.Printf("Scenario %s: FAIL: %v", n, err)
+		} else {
+			log.Printf("Scenario %s: PASS", n)
+		}
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
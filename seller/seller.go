@@ -1,140 +1,2547 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
-	"net"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"log"
+	"log/slog"
 	"net/rpc"
 	"sync"
 	"time"
+
+	"a4/common"
+	"a4/config"
+	"a4/metrics"
+	"a4/rpcserver"
+	"a4/tracing"
 )
 
-// Request represents a Seller's request to the Trader
-type Request struct {
-	SellerID  int
-	Post      int
-	Item      string
-	Quantity  int
-	RequestID int // Unique ID for each request
-}
+// Messages exchanged with Traders are defined in package common, shared with the Trader
+type (
+	Request        = common.Request
+	Response       = common.Response
+	CancelArgs     = common.CancelArgs
+	SellerInfo     = common.SellerInfo
+	RegisterReply  = common.RegisterReply
+	ResumeArgs     = common.ResumeArgs
+	LeaseArgs      = common.LeaseArgs
+	LeaseReply     = common.LeaseReply
+	PendingArgs    = common.PendingArgs
+	StreamArgs     = common.StreamArgs
+	StreamMessage  = common.StreamMessage
+	LeaderUpdate   = common.LeaderUpdate
+	NodeIdentity   = common.NodeIdentity
+	Correction     = common.Correction
+	SpoilageNotice = common.SpoilageNotice
+	SubscribeArgs  = common.SubscribeArgs
+	MarketSummary  = common.MarketSummary
+	Marker         = common.Marker
+	ShutdownArgs   = common.ShutdownArgs
+	DirectOffer    = common.DirectOffer
+	DirectDecision = common.DirectDecision
+	DirectReply    = common.DirectReply
+	DirectTrade    = common.DirectTrade
+	DirectReport   = common.DirectTradeReport
+)
 
-// Response represents a Trader's response to the Seller
-type Response struct {
-	Status    string
-	Message   string
-	RequestID int
-	Processed bool // Indicates if the request was processed
+// Delivery semantics and response modes (see package common). At-least-once requests are
+// retried until processed; at-most-once requests are sent once and never retried. The
+// Seller and its Traders must use the same response mode.
+const (
+	deliveryAtLeastOnce = common.DeliveryAtLeastOnce
+	deliveryAtMostOnce  = common.DeliveryAtMostOnce
+
+	responseSync   = common.ResponseSync
+	responsePush   = common.ResponsePush
+	responsePoll   = common.ResponsePoll
+	responseStream = common.ResponseStream
+)
+
+// FailureStrategy is invoked when a request exhausts its attempts, letting the Seller adapt
+type FailureStrategy func(s *Seller, req *Request)
+
+// tradeItems is the list of items a Seller can offer
+var tradeItems = []string{"apples", "oranges", "pears"}
+
+// failureStrategies maps -on-failure names to strategies
+var failureStrategies = map[string]FailureStrategy{
+	"none": func(s *Seller, req *Request) {},
+	"next-item": func(s *Seller, req *Request) {
+		for i, item := range tradeItems {
+			if item == req.Item {
+				s.Item = tradeItems[(i+1)%len(tradeItems)]
+				break
+			}
+		}
+		slog.Info("Switching to item after failure", "item", s.Item)
+	},
+	"scarcest-item": func(s *Seller, req *Request) {
+		market := s.market()
+		if market == nil {
+			slog.Info("No market summary yet; staying with the current item", "item", s.Item)
+			return
+		}
+		// Offer what the market holds least of, preferring the pricier item on a tie
+		best := ""
+		for _, item := range tradeItems {
+			if item == req.Item {
+				continue
+			}
+			if best == "" || market.Stock[item] < market.Stock[best] ||
+				(market.Stock[item] == market.Stock[best] && market.Prices[item] > market.Prices[best]) {
+				best = item
+			}
+		}
+		s.Item = best
+		slog.Info("Switching to item after failure", "item", s.Item, "stock", market.Stock[best])
+	},
+	"niche-item": func(s *Seller, req *Request) {
+		market := s.market()
+		if market == nil || market.Leaderboard == nil {
+			slog.Info("No sales leaderboard yet; staying with the current item", "item", s.Item)
+			return
+		}
+		// Offer what Sellers have sold least of, where a new Seller gains share fastest
+		sold := make(map[string]int)
+		for _, is := range market.Leaderboard.Items {
+			sold[is.Item] = is.Quantity
+		}
+		best := ""
+		for _, item := range tradeItems {
+			if item == req.Item {
+				continue
+			}
+			if best == "" || sold[item] < sold[best] {
+				best = item
+			}
+		}
+		s.Item = best
+		slog.Info("Switching to item after failure", "item", s.Item, "sold", sold[best])
+	},
+	"switch-trader": func(s *Seller, req *Request) {
+		s.leaderMu.Lock()
+		defer s.leaderMu.Unlock()
+		if s.FallbackTrader == "" {
+			slog.Info("No fallback Trader configured; staying with the current Trader", "addr", s.TraderAddr)
+			return
+		}
+		s.TraderAddr, s.FallbackTrader = s.FallbackTrader, s.TraderAddr
+		slog.Info("Switching to Trader after failure", "addr", s.TraderAddr)
+	},
 }
 
 // Seller struct represents a seller node
 type Seller struct {
-	ID          int
-	Address     string
-	TraderAddr  string
-	Post        int
-	RequestID   int
-	RequestLock sync.Mutex
+	ID             int
+	Address        string
+	TraderAddr     string
+	FallbackTrader string // Alternative Trader used by the switch-trader strategy
+	Post           int
+	Item           string
+	RequestID      int
+	RequestLock    sync.Mutex
+	DryRun         bool            // Send requests as dry runs
+	Patience       time.Duration   // Abandon a request after waiting this long (0 waits forever)
+	MaxAttempts    int             // Give up on a request after this many attempts (0 retries forever)
+	OnFailure      FailureStrategy // Called when a request is given up on
+	Abandoned      int             // Number of requests abandoned (guarded by RequestLock)
+	Succeeded      int             // Number of requests processed (guarded by RequestLock)
+	Failed         int             // Number of requests that exhausted their attempts (guarded by RequestLock)
+	DevMode        bool            // Pick a free port automatically if Address is taken
+	Secret         string          // Cluster secret; when set, deposits are signed and unsigned or forged Trader messages are rejected
+	LeaderTerm     int64           // Highest leadership term accepted (guarded by leaderMu)
+	KnownTraders   []string        // Trader addresses probed during leader re-discovery (guarded by leaderMu)
+	Session        string          // Latest session token from a Trader (guarded by leaderMu)
+	leaderMu       sync.Mutex      // Guards TraderAddr, FallbackTrader, LeaderTerm, KnownTraders and Session
+	Pending        map[int]Request // Requests sent and not yet answered, by request ID (guarded by RequestLock)
+	Delivered      map[string]int  // Quantities confirmed processed, by item (guarded by RequestLock)
+	SnapshotDir    string          // Directory global snapshot parts are written to
+	lastSnapshotID int64           // Most recent snapshot recorded (guarded by RequestLock)
+	Buffer         *DeferredBuffer // Durable buffer for requests made while no Trader is reachable; nil disables
+	Direct         *DirectDesk     // Sells buffered stock directly to Buyers during an outage; nil disables (needs Buffer)
+	Ledger         *LocalLedger    // Deposits recorded locally while the Trader is overloaded; nil disables
+	AdminToken     string          // Credential required by Shutdown and Status; empty disables them
+	Stopping       bool            // Set by a graceful shutdown; no new requests are sent (guarded by RequestLock)
+
+	IDBlock   int        // Request IDs leased from the Trader at a time; 0 numbers requests locally
+	leaseNext int        // Next unused ID of the current lease (guarded by RequestLock)
+	leaseLast int        // Last ID of the current lease (guarded by RequestLock)
+	leaseMu   sync.Mutex // Serializes leasing so concurrent requests share one new block
+
+	ResponseMode string                // How outcomes arrive; must match the Trader's -response-mode
+	PollInterval time.Duration         // Interval between GetPending calls in poll mode, or stream reconnections
+	awaiting     map[int]chan Response // Push and poll outcomes awaited, by request ID (guarded by RequestLock)
+	ClientOnly   bool                  // Runs no listener; registered under a stream address, reached only over the stream
+
+	Misbehave      []string // Misbehaviours picked from for every request; empty behaves
+	firstRequestID int      // First request ID sent (guarded by RequestLock)
+	lastRequestID  int      // Most recent request ID sent (guarded by RequestLock)
+	firstSession   string   // First session token received (guarded by leaderMu)
+
+	SpoiledStock map[string]int // Quantities of our deposits that expired unsold, by item (guarded by RequestLock)
+
+	Delivery          string         // Default delivery semantics for requests without their own
+	SubscribeToMarket bool           // Subscribe to market summaries when registering with a Trader
+	Market            *MarketSummary // Latest market summary received (guarded by marketMu)
+	marketMu          sync.Mutex
+
+	Priority int           // Priority of our requests; Traders serve higher priorities first
+	Deadline time.Duration // Time a request may wait before processing starts, from when it is made (0 for none)
+
+	Metrics *metrics.Writer // Optional local metrics snapshots of the Seller's status
+	prom    sellerMetrics   // Prometheus metrics; the zero value records nothing
+
+	Reads common.ReadRouter // Where dry runs go; with Split they are spread over every known Trader
+
+	Tracer *tracing.Tracer // Exports OpenTelemetry spans of our requests; nil records none
+
+	Timeouts common.Timeouts // Deadlines of outgoing RPCs by method, before time scaling
+
+	TLS *tls.Config // Serves RPCs over TLS if non-nil; outgoing connections are set up with common.UseTLS
+
+	RetryDelay time.Duration // Wait before resending a request or registration after a failed attempt (guarded by settingsMu)
+	settingsMu sync.Mutex
+
+	conns        map[string]*rpc.Client // Long-lived connections to Traders, by address (guarded by connMu)
+	Reconnects   int                    // Connections dropped after breaking or failing a ping (guarded by connMu)
+	PingInterval time.Duration          // Interval between pings of the pooled connections
+	connMu       sync.Mutex
+}
+
+// retryDelay returns the wall-clock wait before the next attempt after a failed one
+func (s *Seller) retryDelay() time.Duration {
+	s.settingsMu.Lock()
+	defer s.settingsMu.Unlock()
+	return common.Scaled(s.RetryDelay)
+}
+
+// call makes an RPC on client under the method's deadline, so a half-dead Trader cannot
+// hold the Seller forever
+func (s *Seller) call(client *rpc.Client, method string, args, reply interface{}) error {
+	start := time.Now()
+	err := common.CallTimeout(client, method, args, reply, common.Scaled(s.Timeouts.For(method)))
+	s.prom.rpcLatency.ObserveSince(start, method)
+	if errors.Is(err, common.ErrTimeout) {
+		s.prom.rpcTimeouts.Inc(method)
+		slog.Warn("RPC call timed out", "method", method, "err", err)
+	}
+	return err
+}
+
+// sellerMetrics are the Seller's counters and histograms exposed on /metrics
+type sellerMetrics struct {
+	requests    *metrics.Counter   // Finished requests by outcome
+	rpcLatency  *metrics.Histogram // Outgoing RPCs by method
+	rpcTimeouts *metrics.Counter   // Outgoing RPCs abandoned at their deadline by method
+}
+
+// registerMetrics creates the Seller's metrics in reg. Gauges are set from the Seller's
+// status report on every scrape.
+func (s *Seller) registerMetrics(reg *metrics.Registry) {
+	s.prom = sellerMetrics{
+		requests:    reg.Counter("a4_seller_requests_total", "Finished requests by outcome", "outcome"),
+		rpcLatency:  reg.Histogram("a4_rpc_duration_seconds", "Latency of outgoing RPCs by method", metrics.DefaultBuckets, "method"),
+		rpcTimeouts: reg.Counter("a4_rpc_timeouts_total", "Outgoing RPCs abandoned at their deadline by method", "method"),
+	}
+
+	pending := reg.Gauge("a4_seller_pending_requests", "Requests sent and not yet answered")
+	conns := reg.Gauge("a4_seller_connections", "Long-lived Trader connections held")
+	reconnects := reg.Gauge("a4_seller_reconnects", "Connections dropped after breaking or failing a ping")
+	term := reg.Gauge("a4_seller_leader_term", "Highest leadership term accepted")
+	reg.OnScrape(func() {
+		var st SellerStatus
+		s.status(&st)
+		pending.Set(float64(len(st.Pending)))
+		conns.Set(float64(st.Connections))
+		reconnects.Set(float64(st.Reconnects))
+		term.Set(float64(st.LeaderTerm))
+	})
 }
 
+// rediscoverAfter is the number of consecutive connection failures that trigger leader re-discovery
+const rediscoverAfter = 2
+
 // SendRequest sends incremental requests to the Trader
 func (s *Seller) SendRequest() {
+	if s.stopping() {
+		return
+	}
+	s.sendRequest(s.Item, 10, s.Post, s.Delivery)
+}
+
+// Shutdown timing: replies go out before the process exits, and a graceful shutdown waits
+// at most shutdownGrace (nominal time) for pending requests
+const (
+	shutdownReplyDelay = 100 * time.Millisecond
+	shutdownGrace      = 30 * time.Second
+)
+
+// Shutdown stops the Seller. A graceful shutdown sends no new requests and waits for
+// pending ones to be answered; an immediate one exits right after replying. SIGINT and
+// SIGTERM start a graceful shutdown too.
+func (s *Seller) Shutdown(args *ShutdownArgs, reply *string) error {
+	if err := s.checkAdmin("shutdown", args.Token); err != nil {
+		return err
+	}
+
+	switch args.Mode {
+	case "immediate":
+		slog.Info("Immediate shutdown requested by admin")
+		time.AfterFunc(shutdownReplyDelay, func() { os.Exit(0) })
+	case "", "graceful":
+		slog.Info("Graceful shutdown requested by admin")
+		go s.shutdownGracefully()
+	default:
+		return fmt.Errorf("unknown shutdown mode %q (want graceful or immediate)", args.Mode)
+	}
+	*reply = fmt.Sprintf("Seller %d shutting down (%s)", s.ID, args.Mode)
+	return nil
+}
+
+// checkAdmin verifies the admin token for an operation in constant time
+func (s *Seller) checkAdmin(op, token string) error {
+	if s.AdminToken == "" {
+		return fmt.Errorf("%s disabled on Seller %d (no -admin-token configured)", op, s.ID)
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+		slog.Warn("Rejected admin call with invalid token", "op", op)
+		return fmt.Errorf("admin authentication failed")
+	}
+	return nil
+}
+
+// StatusArgs carries the admin credential for Status
+type StatusArgs struct {
+	Token string
+}
+
+// SellerStatus is the Seller's view of its Trader and its outstanding requests
+type SellerStatus struct {
+	ID         int
+	Trader     string    // Trader requests are sent to
+	LeaderTerm int64     // Highest leadership term accepted
+	Stopping   bool      // Whether a graceful shutdown is in progress
+	Pending    []Request // Requests sent and not yet answered, by request ID
+	Succeeded  int
+	Failed     int
+	Abandoned  int
+	Delivered  map[string]int
+	Spoiled    map[string]int
+
+	ReadsToLeader  int // Dry runs sent to the leader
+	ReadsOffloaded int // Dry runs sent to other Traders with -split-reads
+
+	Connections int // Long-lived Trader connections held
+	Reconnects  int // Connections dropped after breaking or failing a ping
+
+	LocalOnly     bool // Whether deposits are recorded locally because the Trader is overloaded
+	LocalWaiting  int  // Deposits recorded locally and not yet submitted in a summary
+	LocalRecorded int  // Deposits recorded locally since the Seller started
+
+	DirectSold    int // Direct trades committed since the Seller started
+	DirectPending int // Direct trades committed and not yet reconciled with a Trader
+}
+
+// Status reports the Seller's Trader and outstanding requests to an admin
+func (s *Seller) Status(args *StatusArgs, reply *SellerStatus) error {
+	if err := s.checkAdmin("status", args.Token); err != nil {
+		return err
+	}
+	s.status(reply)
+	return nil
+}
+
+// status fills in the Seller's status report
+func (s *Seller) status(reply *SellerStatus) {
+	reply.ID = s.ID
+
+	s.leaderMu.Lock()
+	reply.Trader = s.TraderAddr
+	reply.LeaderTerm = s.LeaderTerm
+	s.leaderMu.Unlock()
+
+	s.connMu.Lock()
+	reply.Connections, reply.Reconnects = len(s.conns), s.Reconnects
+	s.connMu.Unlock()
+
+	reply.LocalOnly, reply.LocalWaiting, reply.LocalRecorded = s.Ledger.Stats()
+	reply.DirectSold, reply.DirectPending = s.Direct.Stats()
+
+	s.RequestLock.Lock()
+	defer s.RequestLock.Unlock()
+	reply.Stopping = s.Stopping
+	for _, req := range s.Pending {
+		reply.Pending = append(reply.Pending, req)
+	}
+	sort.Slice(reply.Pending, func(i, j int) bool { return reply.Pending[i].RequestID < reply.Pending[j].RequestID })
+	reply.Succeeded, reply.Failed, reply.Abandoned = s.Succeeded, s.Failed, s.Abandoned
+	reply.ReadsToLeader, reply.ReadsOffloaded = s.Reads.Counts()
+	reply.Delivered = make(map[string]int, len(s.Delivered))
+	for item, qty := range s.Delivered {
+		reply.Delivered[item] = qty
+	}
+	reply.Spoiled = make(map[string]int, len(s.SpoiledStock))
+	for item, qty := range s.SpoiledStock {
+		reply.Spoiled[item] = qty
+	}
+}
+
+// stopping reports whether a graceful shutdown is in progress
+func (s *Seller) stopping() bool {
+	s.RequestLock.Lock()
+	defer s.RequestLock.Unlock()
+	return s.Stopping
+}
+
+// shutdownGracefully waits for pending requests and exits
+func (s *Seller) shutdownGracefully() {
+	s.RequestLock.Lock()
+	if s.Stopping {
+		s.RequestLock.Unlock()
+		return
+	}
+	s.Stopping = true
+	s.RequestLock.Unlock()
+
+	deadline := time.Now().Add(common.Scaled(shutdownGrace))
+	for {
+		s.RequestLock.Lock()
+		pending := len(s.Pending)
+		s.RequestLock.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			slog.Info("Shutting down", "pending", pending)
+			break
+		}
+		time.Sleep(common.Scaled(100 * time.Millisecond))
+	}
+	if _, waiting, _ := s.Ledger.Stats(); waiting > 0 {
+		slog.Warn("Shutting down with deposits recorded locally and never submitted", "deposits", waiting)
+	}
+
 	s.RequestLock.Lock()
-	s.RequestID++ // Increment request ID for each new request
-	reqID := s.RequestID
+	slog.Info("Shut down gracefully", "succeeded", s.Succeeded, "failed", s.Failed, "abandoned", s.Abandoned)
 	s.RequestLock.Unlock()
+	if s.Metrics != nil {
+		if err := s.Metrics.Close(); err != nil {
+			slog.Warn("Failed to close metrics file", "err", err)
+		}
+	}
+	s.Tracer.Close()
+	time.Sleep(shutdownReplyDelay)
+	os.Exit(0)
+}
 
+// sendRequest sends one request for the given item, quantity and post, retrying until it
+// is processed, abandoned or out of attempts
+func (s *Seller) sendRequest(item string, quantity, post int, delivery string) {
+	reqID := s.nextRequestID()
+	s.RequestLock.Lock()
 	req := Request{
 		SellerID:  s.ID,
-		Post:      s.Post,
-		Item:      "apples",
-		Quantity:  10,
+		Post:      post,
+		Item:      item,
+		Quantity:  quantity,
 		RequestID: reqID,
+		DryRun:    s.DryRun,
+		Path:      []string{fmt.Sprintf("seller-%d", s.ID)},
+		Delivery:  delivery,
+		Priority:  s.Priority,
+	}
+	if s.Deadline > 0 {
+		req.Deadline = time.Now().Add(common.Scaled(s.Deadline))
+	}
+	s.RequestLock.Unlock()
+	s.misbehave(&req)
+
+	// Requests queue behind deferred ones so the Trader sees them in their original order
+	if s.Buffer != nil && s.Buffer.Len() > 0 && delivery != deliveryAtMostOnce {
+		s.deferRequest(req, "queued behind earlier deferred requests")
+		return
+	}
+	if s.Ledger.Active() && summarizable(&req) {
+		s.Ledger.Record(req)
+		return
+	}
+	switch s.deliver(req) {
+	case errOutage:
+		s.deferRequest(req, "no Trader reachable")
+	case errOverload:
+		s.Ledger.Record(req)
+	}
+}
+
+// deliver sends a request, retrying until it is processed, abandoned or out of attempts.
+// With a deferred-request buffer it returns errOutage instead of retrying when no Trader
+// is reachable at all. At-most-once requests get a single attempt.
+func (s *Seller) deliver(req Request) (err error) {
+	reqID := req.RequestID
+	req.ResponseMode = s.ResponseMode
+	outcome := make(chan Response, 1)
+	s.RequestLock.Lock()
+	s.Pending[reqID] = req
+	if s.ResponseMode != responseSync {
+		s.awaiting[reqID] = outcome
+	}
+	s.RequestLock.Unlock()
+
+	// The root of the request's trace; every attempt is a child span whose context goes
+	// out with the request
+	span := s.Tracer.Start("Seller.deliver", tracing.Internal, tracing.Context{})
+	span.Set("a4.request", reqID)
+	span.Set("a4.seller", s.ID)
+	span.Set("a4.item", req.Item)
+	span.Set("a4.quantity", req.Quantity)
+	span.Set("a4.post", req.Post)
+	defer func() {
+		span.End()
+		s.RequestLock.Lock()
+		delete(s.Pending, reqID)
+		delete(s.awaiting, reqID)
+		s.RequestLock.Unlock()
+		if err != errOutage && err != errOverload && s.Metrics != nil {
+			if err := s.Metrics.Event(); err != nil {
+				slog.Warn("Failed to write metrics snapshot", "err", err)
+			}
+		}
+	}()
+
+	var deadline <-chan time.Time
+	if s.Patience > 0 {
+		timer := time.NewTimer(common.Scaled(s.Patience))
+		defer timer.Stop()
+		deadline = timer.C
 	}
 
+	attempts, dialFailures := 0, 0
+	redialed := false
 	for {
-		client, err := rpc.Dial("tcp", s.TraderAddr)
+		if s.MaxAttempts > 0 && attempts >= s.MaxAttempts {
+			s.fail(&req, attempts)
+			return nil
+		}
+		if req.Delivery == deliveryAtMostOnce && attempts > 0 {
+			slog.Info("Not retrying at-most-once request", "request", reqID)
+			s.fail(&req, attempts)
+			return nil
+		}
+		attempts++
+
+		select {
+		case <-deadline:
+			s.abandon(reqID)
+			return nil
+		default:
+		}
+
+		traderAddr := s.currentTrader()
+		if req.DryRun {
+			traderAddr = s.Reads.Pick(traderAddr, s.knownTraders())
+			req.ReadReplica = s.Reads.Split
+		}
+		client, err := s.conn(traderAddr)
+		if err != nil && traderAddr != s.currentTrader() {
+			slog.Warn("Failed to connect to Trader for a read; skipping it for a while", "addr", traderAddr)
+			s.Reads.Failed(traderAddr)
+			continue
+		}
 		if err != nil {
-			log.Printf("Seller %d: Failed to connect to Trader at %s. Retrying...", s.ID, s.TraderAddr)
-			time.Sleep(5 * time.Second) // Retry after a delay
+			slog.Warn("Failed to connect to Trader; retrying", "addr", traderAddr)
+			dialFailures++
+			if dialFailures >= rediscoverAfter {
+				if !s.rediscoverLeader() && s.Buffer != nil {
+					return errOutage
+				}
+				dialFailures = 0
+			}
+			time.Sleep(s.retryDelay())
 			continue
 		}
-		defer client.Close()
+		dialFailures = 0
 
 		var res Response
-		err = client.Call("Trader.ReceiveRequest", &req, &res)
+		var timedOut <-chan time.Time
+		if timeout := s.Timeouts.For("Trader.ReceiveRequest"); timeout > 0 {
+			timedOut = time.After(common.Scaled(timeout))
+		}
+		attempt := s.Tracer.Start("Trader.ReceiveRequest", tracing.Client, span.Context())
+		attempt.Set("a4.attempt", attempts)
+		attempt.Set("a4.to", traderAddr)
+		req.Trace = attempt.Context()
+		s.signRequest(&req)
+		call := client.Go("Trader.ReceiveRequest", &req, &res, nil)
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-timedOut:
+			err = fmt.Errorf("Trader.ReceiveRequest %w after %v", common.ErrTimeout, common.Scaled(s.Timeouts.For("Trader.ReceiveRequest")))
+		case <-deadline:
+			attempt.Fail(errors.New("abandoned"))
+			attempt.End()
+			s.abandon(reqID)
+			return nil
+		}
+		if attempt.Fail(err); err == nil {
+			attempt.Set("a4.status", res.Status)
+		}
+		attempt.End()
+		if connBroken(err) {
+			s.dropConn(traderAddr, client)
+		}
+		if err == rpc.ErrShutdown && !redialed {
+			// The pooled connection closed before the request went out, so it was never
+			// sent; redial at once instead of spending an attempt
+			attempts--
+			redialed = true
+			continue
+		}
+		if err != nil && traderAddr != s.currentTrader() {
+			slog.Warn("Read from Trader failed; skipping it for a while", "addr", traderAddr, "err", err)
+			s.Reads.Failed(traderAddr)
+			continue
+		}
 		if err != nil {
-			log.Printf("Seller %d: Error sending request: %v. Retrying...", s.ID, err)
-			time.Sleep(5 * time.Second) // Retry after a delay
+			slog.Warn("Error sending request; retrying", "request", reqID, "err", err)
+			time.Sleep(s.retryDelay())
+			continue
+		}
+
+		if !s.verifyResponse(&res) {
+			slog.Warn("Rejecting response with invalid signature; retrying", "request", reqID)
+			time.Sleep(s.retryDelay())
 			continue
 		}
+		s.setSession(res.Session)
 
-		if res.Processed && res.RequestID == reqID {
-			log.Printf("Seller %d: Request %d processed successfully by Trader", s.ID, reqID)
+		if res.Status == "Accepted" && res.RequestID == reqID {
+			// The outcome follows separately, pushed by the Trader or fetched by polling
+			select {
+			case res = <-outcome:
+			case <-time.After(common.Scaled(responseWait)):
+				slog.Warn("No outcome for request; retrying", "request", reqID, "waited", common.Scaled(responseWait))
+				continue
+			case <-deadline:
+				s.abandon(reqID)
+				return nil
+			}
+		}
+
+		if res.Status == "DryRun" && res.RequestID == reqID {
+			slog.Info("Dry run of request", "request", reqID, "price", fmt.Sprintf("%.2f", res.Price), "stock", res.Stock, "eta", res.ETA)
+			break
+		} else if res.Status == "Invalid" {
+			slog.Warn("Request rejected as invalid", "request", reqID, "reason", res.Message)
+			break
+		} else if res.Status == "Duplicate" {
+			slog.Info("Request dropped as a duplicate", "request", reqID, "reason", res.Message)
+			break
+		} else if res.Status == "Expired" {
+			// Resending cannot meet a deadline that has already passed
+			slog.Warn("Request expired", "request", reqID, "reason", res.Message)
+			s.fail(&req, attempts)
+			break
+		} else if res.Status == "RoutingError" {
+			// Retrying would take the same route; the Traders' configuration must be fixed
+			slog.Warn("Request could not be routed", "request", reqID, "reason", res.Message)
+			break
+		} else if overloadStatuses[res.Status] {
+			// Summaries go back to the ledger at once; other deposits once it is active
+			if active := s.Ledger.Refused(res.Status); (active && summarizable(&req)) || req.Summarizes > 0 {
+				return errOverload
+			}
+			// Back off for as long as the Trader expects its queue to take
+			wait := res.RetryAfter
+			if wait <= 0 {
+				wait = s.retryDelay()
+			}
+			slog.Info("Trader overloaded; retrying request", "request", reqID, "status", res.Status, "after", wait)
+			time.Sleep(wait)
+		} else if res.Processed && res.RequestID == reqID {
+			s.Ledger.Served()
+			s.RequestLock.Lock()
+			s.Succeeded++
+			s.Delivered[req.Item] += req.Quantity
+			s.RequestLock.Unlock()
+			s.prom.requests.Inc("succeeded")
+			slog.Info("Request processed successfully", "request", reqID, "path", strings.Join(res.Path, " > "))
 			break
 		} else {
-			log.Printf("Seller %d: Trader response indicates request %d not processed. Retrying...", s.ID, reqID)
-			time.Sleep(5 * time.Second) // Retry after a delay
+			slog.Warn("Trader did not process request; retrying", "request", reqID)
+			time.Sleep(s.retryDelay())
 		}
 	}
+	return nil
 }
 
-// UpdateLeader updates the Seller's Trader address after failover
-func (s *Seller) UpdateLeader(newLeaderAddr string, reply *string) error {
-	log.Printf("Seller %d: Updating Trader to new leader at %s", s.ID, newLeaderAddr)
-	s.TraderAddr = newLeaderAddr // Update Trader address
-	*reply = "Leader updated successfully"
-	return nil
+// fail marks a request as failed after it exhausted its attempts and runs the failure strategy
+func (s *Seller) fail(req *Request, attempts int) {
+	s.RequestLock.Lock()
+	s.Failed++
+	slog.Warn("Giving up on request", "request", req.RequestID, "attempts", attempts, "succeeded", s.Succeeded, "failed", s.Failed, "abandoned", s.Abandoned)
+	s.RequestLock.Unlock()
+	s.prom.requests.Inc("failed")
+
+	if s.OnFailure != nil {
+		s.OnFailure(s, req)
+	}
 }
 
-// StartRPCServer starts the Seller's RPC server to handle leader updates
-func StartRPCServer(s *Seller) {
-	err := rpc.Register(s)
+// abandon gives up on a request and tells the Trader not to process it
+func (s *Seller) abandon(reqID int) {
+	s.RequestLock.Lock()
+	s.Abandoned++
+	abandoned := s.Abandoned
+	s.RequestLock.Unlock()
+	s.prom.requests.Inc("abandoned")
+
+	slog.Warn("Out of patience; abandoning request", "request", reqID, "patience", s.Patience, "abandoned", abandoned)
+
+	args := CancelArgs{SellerID: s.ID, RequestID: reqID}
+	if s.Secret != "" {
+		args.Signature = common.CancelSignature(s.Secret, &args)
+	}
+	var reply string
+	err := s.callTrader(s.currentTrader(), "Trader.CancelRequest", &args, &reply)
 	if err != nil {
-		log.Fatalf("Error registering Seller service: %v", err)
+		slog.Warn("Failed to cancel request", "request", reqID, "err", err)
+	}
+}
+
+// ======= TRADER CONNECTIONS =======
+
+// conn returns the long-lived connection to the Trader at addr, dialing it if needed
+func (s *Seller) conn(addr string) (*rpc.Client, error) {
+	s.connMu.Lock()
+	client := s.conns[addr]
+	s.connMu.Unlock()
+	if client != nil {
+		return client, nil
 	}
 
-	listener, err := net.Listen("tcp", s.Address)
+	client, err := common.DialTimeouts(addr, s.Timeouts)
 	if err != nil {
-		log.Fatalf("Error starting RPC server on %s: %v", s.Address, err)
+		return nil, err
+	}
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if pooled := s.conns[addr]; pooled != nil {
+		client.Close() // Another caller dialed first
+		return pooled, nil
+	}
+	s.conns[addr] = client
+	return client, nil
+}
+
+// dropConn closes a broken connection so the next use redials. A connection that was
+// already replaced is left alone.
+func (s *Seller) dropConn(addr string, client *rpc.Client) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.conns[addr] == client {
+		client.Close()
+		delete(s.conns, addr)
+		s.Reconnects++
 	}
-	defer listener.Close()
+}
 
-	log.Printf("Seller %d RPC server started at %s", s.ID, s.Address)
+// connBroken reports whether err means the connection failed, rather than the Trader
+// answering with an error
+func connBroken(err error) bool {
+	_, answered := err.(rpc.ServerError)
+	return err != nil && !answered
+}
 
-	for {
-		conn, err := listener.Accept()
+// callTrader makes an RPC over the long-lived connection to the Trader at addr. A
+// connection found already closed is redialed and the call made once more; one that
+// breaks mid-call is dropped, so the caller's next attempt starts on a fresh connection.
+func (s *Seller) callTrader(addr, method string, args, reply interface{}) error {
+	for attempt := 0; ; attempt++ {
+		client, err := s.conn(addr)
 		if err != nil {
-			log.Printf("Error accepting connection: %v", err)
-			continue
+			return err
+		}
+		err = s.call(client, method, args, reply)
+		if connBroken(err) {
+			s.dropConn(addr, client)
+		}
+		if err != rpc.ErrShutdown || attempt > 0 {
+			return err
 		}
-		go rpc.ServeConn(conn)
 	}
 }
 
-func main() {
-	id := flag.Int("id", 0, "Seller ID")
-	address := flag.String("address", "", "Seller Address")
-	traderAddr := flag.String("trader", "", "Trader Address")
-	post := flag.Int("post", 0, "Post ID")
-	flag.Parse()
+// CheckConns pings every pooled connection each PingInterval and drops those the Trader
+// no longer answers on, e.g. after it rebooted, so a request does not find them first
+func (s *Seller) CheckConns() {
+	ticker := time.NewTicker(common.Scaled(s.PingInterval))
+	defer ticker.Stop()
+	for range ticker.C {
+		s.connMu.Lock()
+		pooled := make(map[string]*rpc.Client, len(s.conns))
+		for addr, client := range s.conns {
+			pooled[addr] = client
+		}
+		s.connMu.Unlock()
+
+		for addr, client := range pooled {
+			var reply int64
+			if err := s.call(client, "Trader.Ping", time.Now().UnixNano(), &reply); connBroken(err) {
+				slog.Warn("Connection to Trader is stale; redialing on next use", "addr", addr, "err", err)
+				s.dropConn(addr, client)
+			}
+		}
+	}
+}
+
+// ======= MISBEHAVIOUR =======
+
+// misbehaviours are the ways a Seller started with -misbehave breaks the protocol on
+// purpose, so the Traders' defenses can be exercised
+var misbehaviours = map[string]func(s *Seller, req *Request){
+	// Reuse the previous request ID for a different request
+	"dup-ids": func(s *Seller, req *Request) {
+		s.RequestLock.Lock()
+		last := s.lastRequestID
+		s.RequestLock.Unlock()
+		if last > 0 {
+			req.RequestID = last
+			req.Quantity++
+		}
+	},
+	// Ask for far more than any single request may move
+	"oversized": func(s *Seller, req *Request) {
+		req.Quantity = 1000000
+	},
+	// Fire several copies at once without waiting, as a buggy retry loop would
+	"rapid-retry": func(s *Seller, req *Request) {
+		for i := 0; i < rapidRetries; i++ {
+			go func(copy Request) {
+				var res Response
+				s.signRequest(&copy)
+				if err := s.callTrader(s.currentTrader(), "Trader.ReceiveRequest", &copy, &res); err == nil {
+					slog.Info("Rapid retry answered", "request", copy.RequestID, "status", res.Status, "reason", res.Message)
+				}
+			}(*req)
+		}
+	},
+	// Deposit for a post no Trader owns
+	"wrong-post": func(s *Seller, req *Request) {
+		req.Post = s.Post + 100
+	},
+	// Resume with the first session token ever issued and replay the first request ID
+	"stale-term": func(s *Seller, req *Request) {
+		s.leaderMu.Lock()
+		token := s.firstSession
+		s.leaderMu.Unlock()
+		s.RequestLock.Lock()
+		first := s.firstRequestID
+		s.RequestLock.Unlock()
+		if token == "" || first == 0 {
+			return
+		}
+		var reply RegisterReply
+		err := s.callTrader(s.currentTrader(), "Trader.ResumeSession", s.resumeArgs(token), &reply)
+		slog.Info("Resumed with the first session token", "result", err)
+		req.RequestID = first
+	},
+}
+
+// rapidRetries is the number of extra copies the rapid-retry misbehaviour sends
+const rapidRetries = 5
 
-	if *id == 0 || *address == "" || *traderAddr == "" || *post == 0 {
-		log.Fatal("Usage: seller -id=<id> -address=<address> -trader=<trader> -post=<post>")
+// misbehave distorts a request with one of the Seller's -misbehave modes, picked at random
+func (s *Seller) misbehave(req *Request) {
+	s.RequestLock.Lock()
+	if s.firstRequestID == 0 {
+		s.firstRequestID = req.RequestID
+	}
+	s.RequestLock.Unlock()
+	defer func() {
+		s.RequestLock.Lock()
+		s.lastRequestID = req.RequestID
+		s.RequestLock.Unlock()
+	}()
+	if len(s.Misbehave) == 0 {
+		return
 	}
 
-	seller := &Seller{
-		ID:         *id,
-		Address:    *address,
-		TraderAddr: *traderAddr,
-		Post:       *post,
+	mode := s.Misbehave[rand.Intn(len(s.Misbehave))]
+	id := req.RequestID
+	misbehaviours[mode](s, req)
+	slog.Info("Misbehaving", "mode", mode, "request", id, "sent_id", req.RequestID, "quantity", req.Quantity, "item", req.Item, "post", req.Post)
+}
+
+// ======= REQUEST ID LEASES =======
+
+// nextRequestID returns the ID for a new request, leasing the next block from the Trader
+// when the current one is used up. Without leasing, or while no Trader grants a lease,
+// IDs continue from the highest used so far.
+func (s *Seller) nextRequestID() int {
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+
+	s.RequestLock.Lock()
+	if s.IDBlock > 0 && !s.leasedLocked() {
+		args := LeaseArgs{SellerID: s.ID, Count: s.IDBlock, Above: s.RequestID, Floor: s.floorLocked()}
+		s.RequestLock.Unlock()
+		reply, err := s.leaseIDs(&args)
+		s.RequestLock.Lock()
+		if err != nil {
+			slog.Warn("Could not lease request IDs; numbering locally", "from", s.RequestID+1, "err", err)
+		} else {
+			s.leaseNext, s.leaseLast = reply.First, reply.Last
+			slog.Info("Leased request IDs", "first", reply.First, "last", reply.Last)
+		}
+	}
+	if s.leasedLocked() {
+		s.RequestID = s.leaseNext
+		s.leaseNext++
+	} else {
+		s.RequestID++
+	}
+	id := s.RequestID
+	s.RequestLock.Unlock()
+	return id
+}
+
+// leasedLocked reports whether leased IDs are left; RequestLock must be held
+func (s *Seller) leasedLocked() bool {
+	return s.leaseNext > 0 && s.leaseNext <= s.leaseLast
+}
+
+// floorLocked returns the lowest request ID still awaiting an outcome, deferred, or not
+// yet used; RequestLock must be held
+func (s *Seller) floorLocked() int {
+	floor := s.RequestID + 1
+	for id := range s.Pending {
+		if id < floor {
+			floor = id
+		}
+	}
+	if s.Buffer != nil {
+		if front, ok := s.Buffer.Front(); ok && front.Request.RequestID < floor {
+			floor = front.Request.RequestID
+		}
+	}
+	return floor
+}
+
+// leaseIDs asks the current Trader for a block of request IDs
+func (s *Seller) leaseIDs(args *LeaseArgs) (*LeaseReply, error) {
+	if s.Secret != "" {
+		args.Signature = common.LeaseSignature(s.Secret, args)
+	}
+	var reply LeaseReply
+	if err := s.callTrader(s.currentTrader(), "Trader.LeaseRequestIDs", args, &reply); err != nil {
+		return nil, err
+	}
+	s.setSession(reply.Session)
+	return &reply, nil
+}
+
+// ======= RESPONSE DELIVERY =======
+
+// responseWait is how long an accepted request waits for its outcome before it is resent
+const responseWait = 30 * time.Second
+
+// ReceiveResponse is called by a Trader in push mode with the outcome of a request
+func (s *Seller) ReceiveResponse(res *Response, reply *string) error {
+	span := s.Tracer.Start("Seller.ReceiveResponse", tracing.Server, res.Trace)
+	defer span.End()
+	span.Set("a4.request", res.RequestID)
+	span.Set("a4.status", res.Status)
+	if err := s.acceptOutcome(res); err != nil {
+		span.Fail(err)
+		return err
+	}
+	*reply = "OK"
+	return nil
+}
+
+// acceptOutcome verifies an outcome and hands it to the delivery waiting for it
+func (s *Seller) acceptOutcome(res *Response) error {
+	if !s.verifyResponse(res) {
+		slog.Warn("Rejecting outcome with invalid signature", "request", res.RequestID)
+		return errors.New("invalid response signature")
+	}
+	s.setSession(res.Session)
+
+	s.RequestLock.Lock()
+	outcome, ok := s.awaiting[res.RequestID]
+	s.RequestLock.Unlock()
+	if !ok {
+		slog.Info("Ignoring outcome of a request no longer awaited", "request", res.RequestID)
+		return nil
+	}
+	select {
+	case outcome <- *res:
+	default: // An earlier attempt's outcome is already waiting
+	}
+	return nil
+}
+
+// StartPolling fetches poll-mode outcomes from the current Trader while requests await them
+func (s *Seller) StartPolling() {
+	ticker := time.NewTicker(common.Scaled(s.PollInterval))
+	defer ticker.Stop()
+	for range ticker.C {
+		s.RequestLock.Lock()
+		waiting := len(s.awaiting)
+		s.RequestLock.Unlock()
+		s.leaderMu.Lock()
+		session := s.Session
+		s.leaderMu.Unlock()
+		if waiting == 0 || session == "" {
+			continue
+		}
+
+		traderAddr := s.currentTrader()
+		var ready []Response
+		err := s.callTrader(traderAddr, "Trader.GetPending", &PendingArgs{Session: session}, &ready)
+		if err != nil {
+			slog.Warn("Failed to poll Trader for outcomes", "addr", traderAddr, "err", err)
+			continue
+		}
+		for i := range ready {
+			s.acceptOutcome(&ready[i])
+		}
+	}
+}
+
+// StartStream keeps a response stream open to the current Trader. It calls Trader.Stream
+// in a loop over one connection, acknowledging what it received, and handles each
+// message as if the Trader had called the matching Seller RPC. After a failure it
+// reconnects, re-discovering the leader if the Trader stays unreachable.
+func (s *Seller) StartStream() {
+	failures := 0
+	for {
+		s.leaderMu.Lock()
+		session := s.Session
+		s.leaderMu.Unlock()
+		if session == "" {
+			time.Sleep(common.Scaled(s.PollInterval)) // Not registered yet
+			continue
+		}
+
+		traderAddr := s.currentTrader()
+		client, err := s.conn(traderAddr)
+		if err != nil {
+			failures++
+			if failures >= rediscoverAfter {
+				s.rediscoverLeader()
+				failures = 0
+			}
+			time.Sleep(common.Scaled(s.PollInterval))
+			continue
+		}
+		failures = 0
+		slog.Info("Opened response stream to Trader", "addr", traderAddr)
+
+		// Sequence numbers are per Trader, so acknowledgements restart with the connection
+		var ack int64
+		for s.currentTrader() == traderAddr {
+			s.leaderMu.Lock()
+			session = s.Session
+			s.leaderMu.Unlock()
+			var msgs []StreamMessage
+			if err = s.call(client, "Trader.Stream", &StreamArgs{Session: session, Ack: ack}, &msgs); err != nil {
+				break
+			}
+			for i := range msgs {
+				if msgs[i].Seq <= ack {
+					continue
+				}
+				ack = msgs[i].Seq
+				s.handleStreamMessage(&msgs[i])
+			}
+		}
+		if connBroken(err) {
+			s.dropConn(traderAddr, client)
+		}
+		if err != nil {
+			slog.Warn("Response stream to Trader closed", "addr", traderAddr, "err", err)
+			time.Sleep(common.Scaled(s.PollInterval))
+		}
 	}
+}
 
-	// Start the Seller's RPC server in a goroutine
-	go StartRPCServer(seller)
+// handleStreamMessage dispatches a stream message to the handler of the Seller RPC a
+// Trader would otherwise have called
+func (s *Seller) handleStreamMessage(msg *StreamMessage) {
+	var reply string
+	var err error
+	switch {
+	case msg.Kind == "response" && msg.Response != nil:
+		err = s.acceptOutcome(msg.Response)
+	case msg.Kind == "leader" && msg.Leader != nil:
+		err = s.UpdateLeader(msg.Leader, &reply)
+	case msg.Kind == "correction" && msg.Correction != nil:
+		err = s.TradeCorrected(msg.Correction, &reply)
+	case msg.Kind == "spoilage" && msg.Spoilage != nil:
+		err = s.Spoiled(msg.Spoilage, &reply)
+	case msg.Kind == "marker" && msg.Marker != nil:
+		err = s.Snapshot(msg.Marker, &reply)
+	default:
+		err = fmt.Errorf("unknown stream message kind %q", msg.Kind)
+	}
+	if err != nil {
+		slog.Warn("Bad stream message", "seq", msg.Seq, "kind", msg.Kind, "err", err)
+	}
+}
+
+// ======= DEFERRED REQUESTS =======
+
+// errOutage is returned by deliver when no Trader at all is reachable
+var errOutage = errors.New("no Trader reachable")
+
+// DeferredRequest is a request buffered during a Trader outage
+type DeferredRequest struct {
+	Request    Request   `json:"request"`
+	Status     string    `json:"status"` // Always "deferred" while buffered
+	DeferredAt time.Time `json:"deferred_at"`
+}
+
+// DeferredBuffer keeps deferred requests in their original order in memory and in a
+// JSON-lines file, so they survive a Seller restart
+type DeferredBuffer struct {
+	path    string
+	mu      sync.Mutex
+	entries []DeferredRequest
+}
+
+// OpenDeferredBuffer loads any requests left in the buffer file by an earlier run
+func OpenDeferredBuffer(path string) (*DeferredBuffer, error) {
+	b := &DeferredBuffer{path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var entry DeferredRequest
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, i+1, err)
+		}
+		b.entries = append(b.entries, entry)
+	}
+	return b, nil
+}
+
+// Add appends a request to the buffer and syncs it to disk
+func (b *DeferredBuffer) Add(req Request) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry := DeferredRequest{Request: req, Status: "deferred", DeferredAt: time.Now()}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return len(b.entries), err
+	}
+	f, err := os.OpenFile(b.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return len(b.entries), err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return len(b.entries), err
+	}
+	if err := f.Sync(); err != nil {
+		return len(b.entries), err
+	}
+
+	b.entries = append(b.entries, entry)
+	return len(b.entries), nil
+}
+
+// Len returns the number of buffered requests
+func (b *DeferredBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.entries)
+}
+
+// MaxRequestID returns the highest request ID in the buffer
+func (b *DeferredBuffer) MaxRequestID() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	max := 0
+	for _, entry := range b.entries {
+		if entry.Request.RequestID > max {
+			max = entry.Request.RequestID
+		}
+	}
+	return max
+}
+
+// Held returns the quantity of an item the buffered deposits for post hold
+func (b *DeferredBuffer) Held(post int, item string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	held := 0
+	for _, entry := range b.entries {
+		if req := entry.Request; !req.DryRun && req.Post == post && req.Item == item {
+			held += req.Quantity
+		}
+	}
+	return held
+}
+
+// Front returns the oldest buffered request
+func (b *DeferredBuffer) Front() (DeferredRequest, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.entries) == 0 {
+		return DeferredRequest{}, false
+	}
+	return b.entries[0], true
+}
+
+// Pop removes the oldest buffered request and rewrites the buffer file
+func (b *DeferredBuffer) Pop() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.entries) == 0 {
+		return nil
+	}
+	b.entries = b.entries[1:]
+
+	var data []byte
+	for _, entry := range b.entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// deferRequest buffers a request until a Trader becomes reachable
+func (s *Seller) deferRequest(req Request, reason string) {
+	n, err := s.Buffer.Add(req)
+	if err != nil {
+		slog.Warn("Failed to buffer request", "request", req.RequestID, "err", err)
+		return
+	}
+	slog.Info("Deferred request", "request", req.RequestID, "reason", reason, "buffered", n)
+}
+
+// FlushDeferred periodically checks for a reachable Trader and sends buffered requests in
+// their original order, stopping at the first request that hits another outage
+func (s *Seller) FlushDeferred() {
+	for {
+		if s.Buffer.Len() > 0 && s.rediscoverLeader() {
+			flushed := 0
+			for {
+				entry, ok := s.Buffer.Front()
+				if !ok {
+					break
+				}
+				if err := s.deliver(entry.Request); err == errOutage {
+					break
+				}
+				if err := s.Buffer.Pop(); err != nil {
+					slog.Warn("Failed to update deferred buffer", "err", err)
+				}
+				flushed++
+			}
+			slog.Info("Flushed deferred requests", "flushed", flushed, "buffered", s.Buffer.Len())
+		}
+		// Direct trades sold stock from the buffer, which must reach the Trader first
+		if s.Buffer.Len() == 0 {
+			s.reconcileDirect()
+		}
+		time.Sleep(common.Scaled(5 * time.Second))
+	}
+}
+
+// ======= DIRECT TRADES =======
+
+// directHoldTime is how long a Seller holds stock for a prepared direct trade before it
+// releases it to other Buyers
+const directHoldTime = 30 * time.Second
+
+// directKey identifies a direct trade by its Buyer's purchase
+type directKey struct {
+	BuyerID   int
+	RequestID int
+}
+
+// directHold is stock held for a prepared direct trade
+type directHold struct {
+	trade   DirectTrade
+	expires time.Time
+}
+
+// DirectDesk trades the stock held in the deferred buffer directly with Buyers while no
+// Trader is reachable. A Buyer first asks it to hold stock, then commits or aborts; a
+// hold it never commits expires. Committed trades are kept in a JSON-lines file until a
+// Trader reconciles them. A nil DirectDesk trades nothing.
+type DirectDesk struct {
+	path    string
+	mu      sync.Mutex
+	holds   map[directKey]directHold // Prepared trades (guarded by mu)
+	trades  []DirectTrade            // Committed trades not yet reconciled, oldest first (guarded by mu)
+	settled map[directKey]bool       // Trades reconciled since the Seller started (guarded by mu)
+	sold    int                      // Trades committed since the Seller started (guarded by mu)
+}
+
+// OpenDirectDesk loads the direct trades an earlier run committed and never reconciled
+func OpenDirectDesk(path string) (*DirectDesk, error) {
+	d := &DirectDesk{path: path, holds: make(map[directKey]directHold), settled: make(map[directKey]bool)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var trade DirectTrade
+		if err := json.Unmarshal([]byte(line), &trade); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, i+1, err)
+		}
+		d.trades = append(d.trades, trade)
+	}
+	return d, nil
+}
+
+// committedLocked reports whether a trade was committed; mu must be held
+func (d *DirectDesk) committedLocked(key directKey) bool {
+	if d.settled[key] {
+		return true
+	}
+	for _, trade := range d.trades {
+		if (directKey{trade.BuyerID, trade.RequestID}) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Prepare holds stock for a trade until it is committed or the hold expires at expires,
+// if the stock held in the buffer covers it on top of the trades already held or
+// committed. Repeating a prepared or committed trade reports its state again.
+func (d *DirectDesk) Prepare(trade DirectTrade, held int, expires time.Time) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := directKey{trade.BuyerID, trade.RequestID}
+	now := time.Now()
+	for k, h := range d.holds {
+		if now.After(h.expires) {
+			delete(d.holds, k)
+		}
+	}
+	if d.committedLocked(key) {
+		return "Committed"
+	}
+	if _, ok := d.holds[key]; ok {
+		return "Prepared"
+	}
+	for _, h := range d.holds {
+		if h.trade.Post == trade.Post && h.trade.Item == trade.Item {
+			held -= h.trade.Quantity
+		}
+	}
+	for _, t := range d.trades {
+		if t.Post == trade.Post && t.Item == trade.Item {
+			held -= t.Quantity
+		}
+	}
+	if held < trade.Quantity {
+		return "OutOfStock"
+	}
+	d.holds[key] = directHold{trade: trade, expires: expires}
+	return "Prepared"
+}
+
+// Decide commits or aborts a prepared trade, syncing a committed one to disk. A trade
+// whose hold expired is aborted; a committed one stays committed.
+func (d *DirectDesk) Decide(key directKey, commit bool) (DirectTrade, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.committedLocked(key) {
+		return DirectTrade{}, "Committed", nil
+	}
+	h, ok := d.holds[key]
+	delete(d.holds, key)
+	if !commit || !ok || time.Now().After(h.expires) {
+		return h.trade, "Aborted", nil
+	}
+
+	h.trade.At = time.Now()
+	line, err := json.Marshal(h.trade)
+	if err != nil {
+		return h.trade, "", err
+	}
+	f, err := os.OpenFile(d.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return h.trade, "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return h.trade, "", err
+	}
+	if err := f.Sync(); err != nil {
+		return h.trade, "", err
+	}
+	d.trades = append(d.trades, h.trade)
+	d.sold++
+	return h.trade, "Committed", nil
+}
+
+// Pending returns the committed trades not yet reconciled, oldest first
+func (d *DirectDesk) Pending() []DirectTrade {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]DirectTrade(nil), d.trades...)
+}
+
+// Reconciled drops the n oldest committed trades, which a Trader booked, and rewrites the
+// file
+func (d *DirectDesk) Reconciled(n int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, trade := range d.trades[:n] {
+		d.settled[directKey{trade.BuyerID, trade.RequestID}] = true
+	}
+	d.trades = d.trades[n:]
+
+	var data []byte
+	for _, trade := range d.trades {
+		line, err := json.Marshal(trade)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	tmp := d.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path)
+}
+
+// Stats returns the trades committed since the Seller started and those not yet reconciled
+func (d *DirectDesk) Stats() (sold, pending int) {
+	if d == nil {
+		return 0, 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sold, len(d.trades)
+}
+
+// unitPrice is the price the Seller asks for one unit of an item in a direct trade: the
+// Trader's latest market price, or the list price without a market summary
+func (s *Seller) unitPrice(item string) (float64, bool) {
+	if sum := s.market(); sum != nil {
+		if price, ok := sum.Prices[item]; ok {
+			return price, true
+		}
+	}
+	price, ok := common.ListPrices[item]
+	return price, ok
+}
+
+// signDirectReply signs a direct trade reply when a cluster secret is configured
+func (s *Seller) signDirectReply(reply *DirectReply) {
+	if s.Secret != "" {
+		reply.Signature = common.DirectReplySignature(s.Secret, reply)
+	}
+}
+
+// PrepareDirect holds stock for a Buyer's direct purchase, the first phase of a direct
+// trade. Only deposits buffered while no Trader was reachable are sold this way.
+func (s *Seller) PrepareDirect(offer *DirectOffer, reply *DirectReply) error {
+	if s.Secret != "" && !hmac.Equal([]byte(common.DirectOfferSignature(s.Secret, offer)), []byte(offer.Signature)) {
+		slog.Warn("Rejecting direct offer with invalid signature", "buyer", offer.BuyerID, "request", offer.RequestID)
+		return errors.New("invalid direct offer signature")
+	}
+	reply.SellerID, reply.RequestID = s.ID, offer.RequestID
+	defer s.signDirectReply(reply)
+
+	unit, known := s.unitPrice(offer.Item)
+	switch {
+	case s.Direct == nil:
+		reply.Status = "Refused"
+		reply.Message = fmt.Sprintf("Seller %d does not trade directly", s.ID)
+		return nil
+	case !known || offer.Quantity <= 0:
+		reply.Status = "Refused"
+		reply.Message = fmt.Sprintf("cannot sell %d %s", offer.Quantity, offer.Item)
+		return nil
+	}
+	trade := DirectTrade{BuyerID: offer.BuyerID, RequestID: offer.RequestID, SellerID: s.ID, Post: offer.Post,
+		Item: offer.Item, Quantity: offer.Quantity, Price: unit * float64(offer.Quantity)}
+	reply.Status = s.Direct.Prepare(trade, s.Buffer.Held(offer.Post, offer.Item), time.Now().Add(common.Scaled(directHoldTime)))
+	reply.Price = trade.Price
+	if reply.Status == "OutOfStock" {
+		reply.Message = fmt.Sprintf("Seller %d holds too little %s for Post %d", s.ID, offer.Item, offer.Post)
+		return nil
+	}
+	slog.Info("Holding stock for a direct trade", "buyer", offer.BuyerID, "request", offer.RequestID, "quantity", offer.Quantity, "item", offer.Item,
+		"post", offer.Post, "price", fmt.Sprintf("%.2f", trade.Price), "status", reply.Status)
+	return nil
+}
+
+// CommitDirect commits or aborts a direct trade the Seller holds stock for, the second
+// phase of a direct trade
+func (s *Seller) CommitDirect(decision *DirectDecision, reply *DirectReply) error {
+	if s.Secret != "" && !hmac.Equal([]byte(common.DirectDecisionSignature(s.Secret, decision)), []byte(decision.Signature)) {
+		slog.Warn("Rejecting direct trade decision with invalid signature", "buyer", decision.BuyerID, "request", decision.RequestID)
+		return errors.New("invalid direct trade decision signature")
+	}
+	if s.Direct == nil {
+		return fmt.Errorf("seller %d does not trade directly", s.ID)
+	}
+	reply.SellerID, reply.RequestID = s.ID, decision.RequestID
+	defer s.signDirectReply(reply)
+
+	trade, status, err := s.Direct.Decide(directKey{decision.BuyerID, decision.RequestID}, decision.Commit)
+	if err != nil {
+		slog.Error("Failed to record direct trade", "buyer", decision.BuyerID, "request", decision.RequestID, "err", err)
+		return fmt.Errorf("seller %d could not record the trade: %w", s.ID, err)
+	}
+	reply.Status, reply.Price = status, trade.Price
+	if status == "Committed" && trade.Quantity > 0 {
+		slog.Info("Sold directly", "buyer", trade.BuyerID, "request", trade.RequestID, "quantity", trade.Quantity, "item", trade.Item,
+			"post", trade.Post, "price", fmt.Sprintf("%.2f", trade.Price))
+	}
+	return nil
+}
+
+// reconcileDirect reports the committed direct trades to the Trader, which books them as
+// purchases, and forgets them once it has
+func (s *Seller) reconcileDirect() {
+	trades := s.Direct.Pending()
+	if len(trades) == 0 {
+		return
+	}
+	report := &DirectReport{SellerID: s.ID, Trades: trades}
+	if s.Secret != "" {
+		report.Signature = common.DirectReportSignature(s.Secret, report)
+	}
+	var reply string
+	if err := s.callTrader(s.currentTrader(), "Trader.ReconcileDirect", report, &reply); err != nil {
+		slog.Warn("Failed to reconcile direct trades", "trades", len(trades), "err", err)
+		return
+	}
+	if err := s.Direct.Reconciled(len(trades)); err != nil {
+		slog.Warn("Failed to update direct trade file", "err", err)
+	}
+	slog.Info(reply, "trades", len(trades))
+}
+
+// ======= OVERLOAD BOOKKEEPING =======
+
+// errOverload is returned by deliver when the Trader kept refusing requests as overloaded
+// and the request should be recorded locally instead
+var errOverload = errors.New("Trader overloaded")
+
+// overloadStatuses are the refusals that mean the Trader is short of capacity rather than
+// that the request is wrong
+var overloadStatuses = map[string]bool{"Overloaded": true, "CapacityExceeded": true, "RateLimited": true}
+
+// summarizable reports whether a request may be netted into a summary deposit. Dry runs
+// need an answer now, at-most-once requests must not be merged into one that is retried,
+// and an invalid quantity would spoil the net.
+func summarizable(req *Request) bool {
+	return !req.DryRun && req.Delivery != deliveryAtMostOnce && req.Quantity > 0
+}
+
+// ledgerKey identifies the stock a summary deposit adds to
+type ledgerKey struct {
+	Post int
+	Item string
+}
+
+// ledgerEntry is the net quantity of the deposits recorded for one post and item
+type ledgerEntry struct {
+	Quantity int
+	Intents  int       // Deposits netted into Quantity
+	Since    time.Time // When the first of them was recorded
+}
+
+// LocalLedger degrades the Seller to local bookkeeping while its Trader is overloaded.
+// After Threshold consecutive overload refusals, deposits are recorded here instead of
+// being sent, netted per post and item, and Submit sends each net quantity as one summary
+// deposit. The first request the Trader processes, normally a summary, ends the local
+// bookkeeping. A nil LocalLedger never activates.
+type LocalLedger struct {
+	Threshold int // Consecutive overload refusals that activate local bookkeeping
+
+	mu       sync.Mutex
+	refusals int                       // Consecutive overload refusals (guarded by mu)
+	active   bool                      // (guarded by mu)
+	entries  map[ledgerKey]ledgerEntry // (guarded by mu)
+	recorded int                       // Deposits recorded since the Seller started (guarded by mu)
+}
+
+// NewLocalLedger creates a ledger that activates after threshold consecutive refusals
+func NewLocalLedger(threshold int) *LocalLedger {
+	return &LocalLedger{Threshold: threshold, entries: make(map[ledgerKey]ledgerEntry)}
+}
+
+// Active reports whether deposits are being recorded locally
+func (l *LocalLedger) Active() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active
+}
+
+// Refused counts an overload refusal and reports whether local bookkeeping is active
+func (l *LocalLedger) Refused(status string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refusals++
+	if !l.active && l.refusals >= l.Threshold {
+		l.active = true
+		slog.Warn("Trader keeps refusing requests; recording deposits locally", "status", status, "refusals", l.refusals)
+	}
+	return l.active
+}
+
+// Served ends local bookkeeping after the Trader processed a request
+func (l *LocalLedger) Served() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active {
+		slog.Info("Trader is processing requests again; sending deposits")
+	}
+	l.active, l.refusals = false, 0
+}
+
+// Record nets a deposit into the ledger
+func (l *LocalLedger) Record(req Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := ledgerKey{req.Post, req.Item}
+	entry := l.entries[key]
+	if entry.Intents == 0 {
+		entry.Since = time.Now()
+	}
+	entry.Quantity += req.Quantity
+	entry.Intents++
+	l.entries[key] = entry
+	l.recorded++
+	slog.Info("Recorded deposit locally", "request", req.RequestID, "quantity", req.Quantity, "item", req.Item, "post", req.Post, "net", entry.Quantity, "intents", entry.Intents)
+}
+
+// take removes and returns every entry, in a stable order
+func (l *LocalLedger) take() ([]ledgerKey, []ledgerEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keys := make([]ledgerKey, 0, len(l.entries))
+	for key := range l.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Post != keys[j].Post {
+			return keys[i].Post < keys[j].Post
+		}
+		return keys[i].Item < keys[j].Item
+	})
+	entries := make([]ledgerEntry, len(keys))
+	for i, key := range keys {
+		entries[i] = l.entries[key]
+		delete(l.entries, key)
+	}
+	return keys, entries
+}
+
+// restore nets entries that could not be submitted back into the ledger
+func (l *LocalLedger) restore(key ledgerKey, entry ledgerEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cur := l.entries[key]
+	cur.Quantity += entry.Quantity
+	cur.Intents += entry.Intents
+	if cur.Since.IsZero() || entry.Since.Before(cur.Since) {
+		cur.Since = entry.Since
+	}
+	l.entries[key] = cur
+}
+
+// Stats reports whether the ledger is active, the deposits waiting in it and the deposits
+// recorded since the Seller started
+func (l *LocalLedger) Stats() (active bool, waiting, recorded int) {
+	if l == nil {
+		return false, 0, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, entry := range l.entries {
+		waiting += entry.Intents
+	}
+	return l.active, waiting, l.recorded
+}
+
+// SubmitSummaries periodically sends the ledger's net quantities as summary deposits, one
+// per post and item, keeping them from the first one the Trader refuses or cannot take
+func (s *Seller) SubmitSummaries(interval time.Duration) {
+	for {
+		time.Sleep(common.Scaled(interval))
+		keys, entries := s.Ledger.take()
+		for i, key := range keys {
+			if err := s.submitSummary(key, entries[i]); err == errOverload || err == errOutage {
+				for j := i; j < len(keys); j++ {
+					s.Ledger.restore(keys[j], entries[j])
+				}
+				slog.Info("Keeping deposits recorded locally", "reason", err, "entries", len(keys)-i)
+				break
+			}
+		}
+	}
+}
+
+// submitSummary sends the net quantity of one post and item as a single deposit
+func (s *Seller) submitSummary(key ledgerKey, entry ledgerEntry) error {
+	req := Request{
+		SellerID:   s.ID,
+		Post:       key.Post,
+		Item:       key.Item,
+		Quantity:   entry.Quantity,
+		RequestID:  s.nextRequestID(),
+		Path:       []string{fmt.Sprintf("seller-%d", s.ID)},
+		Delivery:   deliveryAtLeastOnce,
+		Priority:   s.Priority,
+		Summarizes: entry.Intents,
+	}
+	slog.Info("Submitting summary deposit", "request", req.RequestID, "quantity", req.Quantity, "item", req.Item, "post", req.Post, "intents", entry.Intents, "since", entry.Since.Format("15:04:05"))
+	return s.deliver(req)
+}
+
+// ======= DISTRIBUTED SNAPSHOT =======
+
+// SellerSnapshot is a Seller's part of a global snapshot
+type SellerSnapshot struct {
+	SnapshotID int64          `json:"snapshot_id"`
+	Role       string         `json:"role"`
+	ID         int            `json:"id"`
+	Post       int            `json:"post"`
+	RecordedAt time.Time      `json:"recorded_at"`
+	Trader     string         `json:"trader"`
+	LeaderTerm int64          `json:"leader_term"`
+	Pending    []Request      `json:"pending"`   // Requests sent and not yet answered
+	Delivered  map[string]int `json:"delivered"` // Quantities confirmed processed, by item
+	Succeeded  int            `json:"succeeded"`
+	Failed     int            `json:"failed"`
+	Abandoned  int            `json:"abandoned"`
+}
+
+// Snapshot records the Seller's pending requests for a global snapshot. Markers arriving
+// from a second Trader for the same snapshot are ignored.
+func (s *Seller) Snapshot(marker *Marker, reply *string) error {
+	s.leaderMu.Lock()
+	snap := SellerSnapshot{
+		SnapshotID: marker.SnapshotID,
+		Role:       "seller",
+		ID:         s.ID,
+		Post:       s.Post,
+		Trader:     s.TraderAddr,
+		LeaderTerm: s.LeaderTerm,
+	}
+	s.leaderMu.Unlock()
+
+	s.RequestLock.Lock()
+	if marker.SnapshotID <= s.lastSnapshotID {
+		s.RequestLock.Unlock()
+		*reply = "Already recorded"
+		return nil
+	}
+	s.lastSnapshotID = marker.SnapshotID
+	snap.RecordedAt = time.Now()
+	for _, req := range s.Pending {
+		snap.Pending = append(snap.Pending, req)
+	}
+	snap.Delivered = make(map[string]int, len(s.Delivered))
+	for item, qty := range s.Delivered {
+		snap.Delivered[item] = qty
+	}
+	snap.Succeeded, snap.Failed, snap.Abandoned = s.Succeeded, s.Failed, s.Abandoned
+	s.RequestLock.Unlock()
+
+	sort.Slice(snap.Pending, func(i, j int) bool { return snap.Pending[i].RequestID < snap.Pending[j].RequestID })
+
+	if err := os.MkdirAll(s.SnapshotDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.SnapshotDir, fmt.Sprintf("snapshot-%d-seller-%d.json", marker.SnapshotID, s.ID))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+
+	slog.Info("Wrote snapshot", "snapshot", marker.SnapshotID, "trader", marker.From, "path", path, "pending", len(snap.Pending))
+	*reply = "Recorded"
+	return nil
+}
+
+// ======= WORKLOAD TRACES =======
+
+// TraceEntry is one request of a replayed workload, sent AtMs milliseconds after replay starts
+type TraceEntry struct {
+	AtMs     int64  `json:"at_ms"`
+	Item     string `json:"item"`
+	Quantity int    `json:"quantity"`
+	Post     int    `json:"post"`
+	Delivery string `json:"delivery"` // Overrides -delivery for this request
+}
+
+// LoadTrace reads a workload trace from a .json file (array of entries) or a .csv file
+// with columns at_ms,item,quantity,post,delivery (header optional, trailing columns optional)
+func LoadTrace(path string) ([]TraceEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []TraceEntry
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		if err := json.NewDecoder(f).Decode(&entries); err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", path, err)
+		}
+	} else {
+		r := csv.NewReader(f)
+		r.FieldsPerRecord = -1
+		r.TrimLeadingSpace = true
+		records, err := r.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", path, err)
+		}
+		for i, rec := range records {
+			if i == 0 && len(rec) > 0 && rec[0] == "at_ms" {
+				continue // Header
+			}
+			entry, err := parseTraceRecord(rec)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", path, i+1, err)
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].AtMs < entries[j].AtMs })
+	return entries, nil
+}
+
+// parseTraceRecord converts one CSV record into a trace entry
+func parseTraceRecord(rec []string) (TraceEntry, error) {
+	var entry TraceEntry
+	var err error
+	if len(rec) == 0 || rec[0] == "" {
+		return entry, fmt.Errorf("missing at_ms")
+	}
+	if entry.AtMs, err = strconv.ParseInt(rec[0], 10, 64); err != nil {
+		return entry, fmt.Errorf("invalid at_ms %q", rec[0])
+	}
+	if len(rec) > 1 {
+		entry.Item = rec[1]
+	}
+	if len(rec) > 2 && rec[2] != "" {
+		if entry.Quantity, err = strconv.Atoi(rec[2]); err != nil {
+			return entry, fmt.Errorf("invalid quantity %q", rec[2])
+		}
+	}
+	if len(rec) > 3 && rec[3] != "" {
+		if entry.Post, err = strconv.Atoi(rec[3]); err != nil {
+			return entry, fmt.Errorf("invalid post %q", rec[3])
+		}
+	}
+	if len(rec) > 4 {
+		entry.Delivery = rec[4]
+	}
+	return entry, nil
+}
+
+// ReplayTrace sends each trace entry at its offset from the start of the replay, without
+// waiting for earlier requests, so bursts in the trace reach the Trader as bursts
+func (s *Seller) ReplayTrace(entries []TraceEntry) {
+	slog.Info("Replaying trace", "requests", len(entries))
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for _, e := range entries {
+		if wait := common.Scaled(time.Duration(e.AtMs)*time.Millisecond) - time.Since(start); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		item, quantity, post, delivery := e.Item, e.Quantity, e.Post, e.Delivery
+		if item == "" {
+			item = s.Item
+		}
+		if quantity == 0 {
+			quantity = 10
+		}
+		if post == 0 {
+			post = s.Post
+		}
+		if delivery == "" {
+			delivery = s.Delivery
+		}
+
+		if s.stopping() {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.sendRequest(item, quantity, post, delivery)
+		}()
+	}
+	wg.Wait()
+
+	s.RequestLock.Lock()
+	slog.Info("Trace replay finished", "took", time.Since(start).Round(time.Millisecond), "succeeded", s.Succeeded, "failed", s.Failed, "abandoned", s.Abandoned)
+	s.RequestLock.Unlock()
+}
+
+// signRequest signs a request with the cluster secret so the Trader can tell it from a
+// forged one; it must run after the last change to any signed field
+func (s *Seller) signRequest(req *Request) {
+	if s.Secret != "" {
+		req.Signature = common.RequestSignature(s.Secret, req)
+	}
+}
+
+// resumeArgs presents a session token from the Seller's address, signed with the cluster secret
+func (s *Seller) resumeArgs(token string) *ResumeArgs {
+	args := &ResumeArgs{Token: token, Address: s.Address}
+	if s.Secret != "" {
+		args.Signature = common.ResumeSignature(s.Secret, args)
+	}
+	return args
+}
+
+// verifyResponse checks a response's signature when a cluster secret is configured
+func (s *Seller) verifyResponse(res *Response) bool {
+	if s.Secret == "" {
+		return true
+	}
+	want := common.ResponseSignature(s.Secret, res)
+	return hmac.Equal([]byte(want), []byte(res.Signature))
+}
+
+// UpdateLeader updates the Seller's Trader address after failover. With a cluster secret
+// configured, only fresh notifications signed by a legitimate Trader are accepted.
+func (s *Seller) UpdateLeader(update *LeaderUpdate, reply *string) error {
+	if s.Secret != "" {
+		want := common.LeaderUpdateSignature(s.Secret, update)
+		if !hmac.Equal([]byte(want), []byte(update.Signature)) {
+			slog.Warn("Rejecting leader update with invalid signature", "addr", update.Address)
+			return errors.New("invalid leader update signature")
+		}
+		if age := time.Since(time.Unix(0, update.IssuedAt)); age > common.LeaderUpdateMaxAge || age < -common.LeaderUpdateMaxAge {
+			slog.Warn("Rejecting stale leader update", "addr", update.Address, "age", age)
+			return errors.New("stale leader update")
+		}
+	}
+
+	s.leaderMu.Lock()
+	term := s.LeaderTerm
+	s.leaderMu.Unlock()
+	if update.Term < term {
+		slog.Warn("Rejecting leader update from an old term", "addr", update.Address, "term", update.Term, "current_term", term)
+		return fmt.Errorf("leader update from term %d is older than current term %d", update.Term, term)
+	}
+
+	// Probe the claimed leader before switching so a dead or lying address is never adopted
+	id, err := common.ProbeTrader(update.Address)
+	if err != nil {
+		slog.Warn("Rejecting leader update; new leader is not reachable", "addr", update.Address, "err", err)
+		return fmt.Errorf("claimed leader %s is not reachable: %v", update.Address, err)
+	}
+	if id.Role != "trader" || id.ID != update.TraderID || !id.Leader {
+		slog.Warn("Rejecting leader update; address does not identify as the leader", "addr", update.Address, "expected", update.TraderID, "role", id.Role, "id", id.ID, "leader", id.Leader)
+		return fmt.Errorf("claimed leader %s does not identify as leader Trader %d", update.Address, update.TraderID)
+	}
+
+	s.leaderMu.Lock()
+	previous := s.TraderAddr
+	s.TraderAddr = update.Address // Update Trader address
+	s.LeaderTerm = update.Term
+	s.rememberTrader(update.Address)
+	s.leaderMu.Unlock()
+
+	if previous != update.Address {
+		slog.Info("Updating Trader to new leader", "trader", update.TraderID, "addr", update.Address, "term", update.Term)
+		go s.registerWithRetry(update.Address)
+	}
+	*reply = "Leader updated successfully"
+	return nil
+}
+
+// Register announces the Seller's address to a Trader, replacing any registration left
+// by an earlier incarnation with the same ID. A Seller holding a session token resumes its
+// session instead, keeping the Trader-side context such as the dedup watermark.
+func (s *Seller) Register(traderAddr string) error {
+	var reply RegisterReply
+	s.leaderMu.Lock()
+	token := s.Session
+	s.leaderMu.Unlock()
+	if token != "" {
+		err := s.callTrader(traderAddr, "Trader.ResumeSession", s.resumeArgs(token), &reply)
+		if err == nil {
+			s.setSession(reply.Session)
+			slog.Info("Resumed session with Trader", "addr", traderAddr)
+			s.subscribeMarket(traderAddr)
+			return nil
+		}
+		slog.Warn("Could not resume session with Trader; registering afresh", "addr", traderAddr, "err", err)
+	}
+
+	info := SellerInfo{ID: s.ID, Address: s.Address, Post: s.Post}
+	if s.Secret != "" {
+		info.Signature = common.RegistrationSignature(s.Secret, &info)
+	}
+	err := s.callTrader(traderAddr, "Trader.RegisterSeller", &info, &reply)
+	if err != nil {
+		return err
+	}
+	s.setSession(reply.Session)
+	if reply.Replaced != "" {
+		slog.Info("Registered with Trader, replacing stale registration", "addr", traderAddr, "replaced", reply.Replaced)
+	} else {
+		slog.Info("Registered with Trader", "addr", traderAddr)
+	}
+	s.subscribeMarket(traderAddr)
+	return nil
+}
+
+// subscribeMarket asks the Trader to send the Seller its market summaries
+func (s *Seller) subscribeMarket(traderAddr string) {
+	if !s.SubscribeToMarket {
+		return
+	}
+	var reply string
+	if err := s.callTrader(traderAddr, "Trader.SubscribeMarket", &SubscribeArgs{Address: s.Address, Service: "Seller"}, &reply); err != nil {
+		slog.Warn("Failed to subscribe to market summaries from Trader", "addr", traderAddr, "err", err)
+	}
+}
+
+// MarketSummary receives a Trader's periodic market summary
+func (s *Seller) MarketSummary(sum *MarketSummary, reply *string) error {
+	s.marketMu.Lock()
+	s.Market = sum
+	s.marketMu.Unlock()
+
+	slog.Info("Market summary", "trader", sum.TraderID, "stock", sum.Stock, "volume", sum.Volume, "trades", sum.Trades, "value", fmt.Sprintf("%.2f", sum.Value))
+	if sum.Leaderboard != nil {
+		slog.Info("Market share", "trader", sum.TraderID, "share", fmt.Sprintf("%.2f", sum.Leaderboard.ShareOf(s.ID)), "total", sum.Leaderboard.Total)
+	}
+	*reply = "OK"
+	return nil
+}
+
+// market returns the latest market summary, or nil if none has arrived
+func (s *Seller) market() *MarketSummary {
+	s.marketMu.Lock()
+	defer s.marketMu.Unlock()
+	return s.Market
+}
+
+// TradeCorrected is called by a Trader after an admin voided or adjusted one of our trades.
+// The delivered quantity follows the correction; with a cluster secret configured, only
+// corrections signed by a legitimate Trader are accepted.
+func (s *Seller) TradeCorrected(c *Correction, reply *string) error {
+	if c.SellerID != s.ID {
+		return fmt.Errorf("correction for Seller %d sent to Seller %d", c.SellerID, s.ID)
+	}
+	if s.Secret != "" {
+		want := common.CorrectionSignature(s.Secret, c)
+		if !hmac.Equal([]byte(want), []byte(c.Signature)) {
+			slog.Warn("Rejecting correction with invalid signature", "request", c.RequestID)
+			return errors.New("invalid correction signature")
+		}
+	}
+
+	s.RequestLock.Lock()
+	s.Delivered[c.Item] += c.NewQuantity - c.OldQuantity
+	if s.Delivered[c.Item] <= 0 {
+		delete(s.Delivered, c.Item)
+	}
+	s.RequestLock.Unlock()
+
+	slog.Info("Trader corrected request", "trader", c.TraderID, "request", c.RequestID, "item", c.Item, "old_quantity", c.OldQuantity, "quantity", c.NewQuantity, "reason", c.Reason)
+	*reply = "OK"
+	return nil
+}
+
+// Spoiled is called by a Trader after perishable stock we deposited passed its shelf life
+// and was removed. The deposit stays delivered; the spoiled quantity is only tallied.
+func (s *Seller) Spoiled(n *SpoilageNotice, reply *string) error {
+	if n.SellerID != s.ID {
+		return fmt.Errorf("spoilage notice for Seller %d sent to Seller %d", n.SellerID, s.ID)
+	}
+	if s.Secret != "" {
+		want := common.SpoilageSignature(s.Secret, n)
+		if !hmac.Equal([]byte(want), []byte(n.Signature)) {
+			slog.Warn("Rejecting spoilage notice with invalid signature", "request", n.RequestID)
+			return errors.New("invalid spoilage signature")
+		}
+	}
+
+	s.RequestLock.Lock()
+	if s.SpoiledStock == nil {
+		s.SpoiledStock = make(map[string]int)
+	}
+	s.SpoiledStock[n.Item] += n.Quantity
+	s.RequestLock.Unlock()
+
+	slog.Info("Trader reports stock spoiled", "trader", n.TraderID, "request", n.RequestID, "item", n.Item, "quantity", n.Quantity, "expired", n.Expired.Format(time.RFC3339))
+	*reply = "OK"
+	return nil
+}
+
+// setSession stores a session token from a Trader
+func (s *Seller) setSession(token string) {
+	if token == "" {
+		return
+	}
+	s.leaderMu.Lock()
+	s.Session = token
+	if s.firstSession == "" {
+		s.firstSession = token
+	}
+	s.leaderMu.Unlock()
+}
+
+// registerWithRetry keeps trying to register until the Trader accepts
+func (s *Seller) registerWithRetry(traderAddr string) {
+	for {
+		err := s.Register(traderAddr)
+		if err == nil {
+			return
+		}
+		slog.Warn("Failed to register with Trader; retrying", "addr", traderAddr, "err", err)
+		time.Sleep(s.retryDelay())
+	}
+}
+
+// currentTrader returns the address of the Trader requests are sent to
+func (s *Seller) currentTrader() string {
+	s.leaderMu.Lock()
+	defer s.leaderMu.Unlock()
+	return s.TraderAddr
+}
+
+// knownTraders returns the addresses of every Trader the Seller knows of
+func (s *Seller) knownTraders() []string {
+	s.leaderMu.Lock()
+	defer s.leaderMu.Unlock()
+	return append([]string(nil), s.KnownTraders...)
+}
+
+// rememberTrader adds an address to the re-discovery list; the caller holds leaderMu
+func (s *Seller) rememberTrader(addr string) {
+	for _, known := range s.KnownTraders {
+		if known == addr {
+			return
+		}
+	}
+	s.KnownTraders = append(s.KnownTraders, addr)
+}
+
+// rediscoverLeader probes every known Trader and switches to the leader with the highest
+// term, reverting a switch to a leader that turned out to be dead. It reports whether a
+// live leader was found.
+func (s *Seller) rediscoverLeader() bool {
+	s.leaderMu.Lock()
+	known := append([]string(nil), s.KnownTraders...)
+	s.leaderMu.Unlock()
+
+	best, bestTerm := "", int64(-1)
+	for _, addr := range known {
+		id, err := common.ProbeTrader(addr)
+		if err != nil || id.Role != "trader" || !id.Leader {
+			continue
+		}
+		if id.Term > bestTerm {
+			best, bestTerm = addr, id.Term
+		}
+	}
+	if best == "" {
+		slog.Warn("Leader re-discovery found no live leader", "known", known)
+		return false
+	}
+
+	s.leaderMu.Lock()
+	previous := s.TraderAddr
+	s.TraderAddr = best
+	if bestTerm > s.LeaderTerm {
+		s.LeaderTerm = bestTerm
+	}
+	s.leaderMu.Unlock()
+	if previous != best {
+		slog.Info("Leader re-discovery switched Trader", "from", previous, "to", best, "term", bestTerm)
+		go s.registerWithRetry(best)
+	}
+	return true
+}
+
+// StartRPCServer starts the Seller's RPC server to handle leader updates
+func StartRPCServer(s *Seller) {
+	srv := rpcserver.New(rpcserver.Options{
+		Name:    fmt.Sprintf("Seller %d", s.ID),
+		Address: s.Address,
+		DevMode: s.DevMode,
+		TLS:     s.TLS,
+	})
+	if err := srv.Register(s); err != nil {
+		common.Fatal("Error registering Seller service", "err", err)
+	}
+
+	addr, err := srv.Listen()
+	if err != nil {
+		common.Fatal("Error starting RPC server", "addr", s.Address, "err", err)
+	}
+	s.Address = addr
+
+	slog.Info("RPC server started", "addr", s.Address)
+	srv.Serve()
+}
+
+func main() {
+	id := flag.Int("id", 0, "Seller ID")
+	address := flag.String("address", "", "Seller Address (not needed with -client-only)")
+	traderAddr := flag.String("trader", "", "Trader Address")
+	post := flag.Int("post", 0, "Post ID")
+	dryRun := flag.Bool("dry-run", false, "Send requests as dry runs that do not change Trader state")
+	splitReads := flag.Bool("split-reads", false, "Spread dry runs over every known Trader, answered from replicas, instead of sending them to the leader")
+	patience := flag.Duration("patience", 0, "Abandon a request after waiting this long, e.g. 3s (0 waits forever)")
+	maxAttempts := flag.Int("max-attempts", 0, "Give up on a request after this many attempts (0 retries forever)")
+	retryDelay := flag.Duration("retry-delay", 5*time.Second, "Wait before resending a request or registration after a failed attempt; reloaded on SIGHUP")
+	onFailure := flag.String("on-failure", "none", "Strategy after a request fails: none, next-item, scarcest-item, niche-item or switch-trader")
+	fallbackTrader := flag.String("fallback-trader", "", "Alternative Trader Address used by the switch-trader strategy")
+	devMode := flag.Bool("dev", false, "Development mode: listen on a free port if -address is taken")
+	secret := flag.String("secret", "", "Cluster secret for signing deposits and verifying Trader responses and leader notifications (unsigned if empty)")
+	session := flag.String("session", "", "Session token of a registration made on the Seller's behalf, e.g. by the launcher; the Seller then does not register itself")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate served to Traders over TLS and presented to nodes running -mtls (plaintext if empty; needs -tls-key and -ca)")
+	tlsKey := flag.String("tls-key", "", "PEM private key of -tls-cert")
+	caFile := flag.String("ca", "", "PEM certificate of the cluster CA; connections to Traders use TLS and trust only it")
+	mtls := flag.Bool("mtls", false, "Refuse any Trader or tool connecting without a certificate signed by -ca (needs -tls-cert)")
+	tracePath := flag.String("trace", "", "Replay a workload trace (.csv or .json) instead of sending on a fixed ticker")
+	flag.Float64Var(&common.TimeScale, "time-scale", 1.0, "Speed factor applied to all delays, tickers and timeouts (e.g. 10 runs 10x faster)")
+	snapshotDir := flag.String("snapshot-dir", "snapshots", "Directory global snapshots are written to")
+	delivery := flag.String("delivery", deliveryAtLeastOnce, "Delivery semantics of requests: at-least-once (retried until processed) or at-most-once (sent once)")
+	adminToken := flag.String("admin-token", "", "Token required by the Shutdown RPC (disabled if empty)")
+	subscribeMarket := flag.Bool("market", false, "Subscribe to the Trader's market summaries (used by the scarcest-item and niche-item strategies)")
+	responseMode := flag.String("response-mode", responseSync, "How outcomes arrive: sync (reply), push (Trader calls ReceiveResponse), poll (GetPending) or stream (a response stream the Seller opens); must match the Traders")
+	idBlock := flag.Int("id-block", 100, "Request IDs to lease from the Trader at a time, keeping IDs unique across restarts (0 numbers requests locally)")
+	pollInterval := flag.Duration("poll-interval", time.Second, "Interval between GetPending calls in poll mode, and between reconnection attempts in stream mode")
+	misbehave := flag.String("misbehave", "", "Comma-separated misbehaviours for robustness testing: dup-ids, oversized, rapid-retry, wrong-post, stale-term or all (none if empty)")
+	clientOnly := flag.Bool("client-only", false, "Open no listening port: register under a stream address and receive everything from Traders over a response stream (implies -response-mode=stream)")
+	priority := flag.Int("priority", 0, "Priority of our requests; Traders serve higher priorities first when busy")
+	deadline := flag.Duration("deadline", 0, "Give each request this long to start processing before Traders refuse it as expired, e.g. 5s (0 for none)")
+	metricsDir := flag.String("metrics-dir", "", "Directory to append local JSON metrics snapshots to, one file per node (disabled if empty)")
+	metricsInterval := flag.Duration("metrics-interval", 10*time.Second, "Interval between metrics snapshots (0 writes only count-based snapshots)")
+	metricsEvery := flag.Int("metrics-every", 0, "Also write a metrics snapshot after every N finished requests (0 disables)")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on at /metrics (disabled if empty)")
+	pprofAddr := flag.String("pprof-addr", "", "Debug address to serve net/http/pprof profiles on at /debug/pprof/; may equal -metrics-addr (disabled if empty)")
+	spans := flag.String("spans", "", "OpenTelemetry span export: an OTLP/HTTP collector URL such as http://localhost:4318, or a file to append OTLP JSON lines to (disabled if empty)")
+	overloadAfter := flag.Int("overload-after", 0, "Record deposits locally after this many consecutive overload refusals and submit them as net summaries (0 disables)")
+	summaryInterval := flag.Duration("summary-interval", 30*time.Second, "Interval between summary submissions of deposits recorded locally during overload")
+	bufferPath := flag.String("buffer", "", "Buffer requests in this file while no Trader is reachable and send them in order once one is (disabled if empty)")
+	directPath := flag.String("direct-trades", "", "Sell buffered stock directly to Buyers while no Trader is reachable, keeping the trades in this file until a Trader reconciles them (disabled if empty; needs -buffer)")
+	pingInterval := flag.Duration("ping-interval", 5*time.Second, "Interval between pings of the long-lived Trader connections, which are redialed if a Trader stopped answering on them (0 disables)")
+	rpcTimeout := flag.Duration("rpc-timeout", 5*time.Second, "Deadline for dialing and for RPCs without their own timeout (0 waits indefinitely)")
+	rpcTimeouts := flag.String("rpc-timeouts", "", "Per-RPC deadlines overriding the defaults, as method=duration pairs keyed by Service.Method or Service, e.g. Trader.ReceiveRequest=30s")
+	configPath := flag.String("config", "", "Cluster config file (.yaml, .yml or .toml) setting the flags not given here; A4_<FLAG> environment variables override it")
+	logLevel := flag.String("log-level", "info", "Lowest level logged: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log record format: text (key=value) or json")
+	flag.Parse()
+	if err := config.Apply(flag.CommandLine, *configPath, "seller"); err != nil {
+		log.Fatal(err)
+	}
+
+	parsed, err := common.ParseLogLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	level := new(slog.LevelVar) // Changed by a configuration reload
+	level.Set(parsed)
+	logger, err := common.NewLogger(os.Stderr, *logFormat, level, nil, "node", "seller", "id", *id, "post", *post)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	if common.TimeScale <= 0 {
+		common.Fatal("-time-scale must be positive", "time_scale", common.TimeScale)
+	}
+	serverTLS, clientTLS, err := common.LoadTLS(*tlsCert, *tlsKey, *caFile, *mtls)
+	if err != nil {
+		common.Fatal("Error loading TLS configuration", "err", err)
+	}
+	common.UseTLS(clientTLS)
+	if *retryDelay <= 0 {
+		common.Fatal("-retry-delay must be positive", "retry_delay", *retryDelay)
+	}
+
+	if *responseMode == responseStream && *address == "" {
+		*clientOnly = true // A stream-mode Seller without an address has nothing to listen on
+	}
+	if *clientOnly {
+		if *responseMode != responseSync && *responseMode != responseStream {
+			common.Fatal("-client-only needs -response-mode=stream; other modes have no way to reach a Seller without a listener", "response_mode", *responseMode)
+		}
+		*responseMode = responseStream
+		if *address != "" {
+			slog.Warn("-client-only opens no listener; ignoring -address", "address", *address)
+			*address = ""
+		}
+	}
+
+	if *id == 0 || (*address == "" && !*clientOnly) || *traderAddr == "" || *post == 0 {
+		common.Fatal("Usage: seller -id=<id> -address=<address> -trader=<trader> -post=<post> (or -client-only instead of -address)")
+	}
+
+	strategy, ok := failureStrategies[*onFailure]
+	if !ok {
+		common.Fatal("Unknown -on-failure strategy (expected none, next-item, scarcest-item, niche-item or switch-trader)", "on_failure", *onFailure)
+	}
+	if *responseMode != responseSync && *responseMode != responsePush && *responseMode != responsePoll && *responseMode != responseStream {
+		common.Fatal("Unknown -response-mode (expected sync, push, poll or stream)", "response_mode", *responseMode)
+	}
+	var modes []string
+	if *misbehave == "all" {
+		for mode := range misbehaviours {
+			modes = append(modes, mode)
+		}
+		sort.Strings(modes)
+	} else if *misbehave != "" {
+		modes = strings.Split(*misbehave, ",")
+		for _, mode := range modes {
+			if misbehaviours[mode] == nil {
+				common.Fatal("Unknown -misbehave mode (expected dup-ids, oversized, rapid-retry, wrong-post, stale-term or all)", "mode", mode)
+			}
+		}
+	}
+
+	timeouts, err := common.ParseTimeouts(*rpcTimeout, *rpcTimeouts)
+	if err != nil {
+		common.Fatal("Error parsing -rpc-timeouts", "err", err)
+	}
+
+	seller := &Seller{
+		ID:             *id,
+		Address:        *address,
+		TraderAddr:     *traderAddr,
+		FallbackTrader: *fallbackTrader,
+		Post:           *post,
+		Item:           "apples",
+		DryRun:         *dryRun,
+		Reads:          common.ReadRouter{Split: *splitReads},
+		Timeouts:       timeouts,
+		conns:          make(map[string]*rpc.Client),
+		PingInterval:   *pingInterval,
+		Patience:       *patience,
+		MaxAttempts:    *maxAttempts,
+		OnFailure:      strategy,
+		DevMode:        *devMode,
+		TLS:            serverTLS,
+		Secret:         *secret,
+		Pending:        make(map[int]Request),
+		Delivered:      make(map[string]int),
+		SnapshotDir:    *snapshotDir,
+		AdminToken:     *adminToken,
+
+		Delivery:          *delivery,
+		SubscribeToMarket: *subscribeMarket,
+
+		Misbehave: modes,
+
+		IDBlock:      *idBlock,
+		ResponseMode: *responseMode,
+		PollInterval: *pollInterval,
+		awaiting:     make(map[int]chan Response),
+
+		ClientOnly: *clientOnly,
+
+		Priority: *priority,
+		Deadline: *deadline,
+
+		RetryDelay: *retryDelay,
+	}
+	seller.rememberTrader(*traderAddr)
+	if *fallbackTrader != "" {
+		seller.rememberTrader(*fallbackTrader)
+	}
+
+	if *metricsDir != "" {
+		writer, err := metrics.Open(*metricsDir, fmt.Sprintf("seller-%d", seller.ID), *metricsEvery, func() any {
+			var st SellerStatus
+			seller.status(&st)
+			return &st
+		})
+		if err != nil {
+			common.Fatal("Error opening metrics file", "err", err)
+		}
+		seller.Metrics = writer
+		if *metricsInterval > 0 {
+			go writer.Run(common.Scaled(*metricsInterval), func(err error) {
+				slog.Warn("Failed to write metrics snapshot", "err", err)
+			})
+		}
+		slog.Info("Writing metrics snapshots", "dir", *metricsDir)
+	}
+
+	if *spans != "" {
+		tracer, err := tracing.New(*spans, "seller", fmt.Sprintf("seller-%d", seller.ID))
+		if err != nil {
+			common.Fatal("Error configuring span export", "err", err)
+		}
+		seller.Tracer = tracer
+		slog.Info("Exporting spans", "endpoint", *spans)
+	}
+
+	endpoints := make(metrics.Endpoints)
+	if *metricsAddr != "" {
+		reg := metrics.NewRegistry()
+		seller.registerMetrics(reg)
+		endpoints.Handle(*metricsAddr, "/metrics", reg)
+	}
+	endpoints.Handle(*pprofAddr, "/debug/pprof/", metrics.Profiles())
+	if err := endpoints.Serve(); err != nil {
+		common.Fatal("Error starting HTTP server", "err", err)
+	}
+	if *metricsAddr != "" {
+		slog.Info("Serving Prometheus metrics", "addr", *metricsAddr)
+	}
+	if *pprofAddr != "" {
+		slog.Info("Serving pprof profiles", "addr", *pprofAddr)
+	}
+
+	if *overloadAfter > 0 {
+		seller.Ledger = NewLocalLedger(*overloadAfter)
+		go seller.SubmitSummaries(*summaryInterval)
+	}
+
+	if *bufferPath != "" {
+		buffer, err := OpenDeferredBuffer(*bufferPath)
+		if err != nil {
+			common.Fatal("Error opening deferred request buffer", "err", err)
+		}
+		seller.Buffer = buffer
+		if n := buffer.Len(); n > 0 {
+			seller.RequestID = buffer.MaxRequestID() // Keep request IDs unique across restarts
+			slog.Info("Loaded deferred requests", "count", n, "file", *bufferPath)
+		}
+		if *directPath != "" {
+			desk, err := OpenDirectDesk(*directPath)
+			if err != nil {
+				common.Fatal("Error opening direct trade file", "err", err)
+			}
+			seller.Direct = desk
+			if _, pending := desk.Stats(); pending > 0 {
+				slog.Info("Loaded direct trades awaiting reconciliation", "count", pending, "file", *directPath)
+			}
+		}
+		go seller.FlushDeferred()
+	} else if *directPath != "" {
+		common.Fatal("-direct-trades needs -buffer, the stock it sells")
+	}
+
+	// Start the Seller's RPC server in a goroutine. A client-only Seller runs none:
+	// everything a Trader sends it arrives over its response stream.
+	if seller.ClientOnly {
+		seller.Address = common.StreamAddress(seller.ID)
+		if seller.SubscribeToMarket {
+			slog.Info("Market summaries need a listener; not subscribing in client-only mode")
+			seller.SubscribeToMarket = false
+		}
+		slog.Info("Client-only; no listening port, receiving from Traders over a response stream only")
+	} else {
+		go StartRPCServer(seller)
+	}
+	go config.Watch(flag.CommandLine, *configPath, "seller", []string{"log-level", "retry-delay"}, func() error {
+		parsed, err := common.ParseLogLevel(*logLevel)
+		if err != nil {
+			return err
+		}
+		if *retryDelay <= 0 {
+			return fmt.Errorf("-retry-delay must be positive, got %v", *retryDelay)
+		}
+		level.Set(parsed)
+		seller.settingsMu.Lock()
+		seller.RetryDelay = *retryDelay
+		seller.settingsMu.Unlock()
+		return nil
+	})
+	common.OnTerminate(seller.shutdownGracefully)
+	if *session != "" {
+		// Registered on the Seller's behalf, e.g. by the launcher's bulk registration
+		seller.setSession(*session)
+		slog.Info("Using the session registered on the Seller's behalf; not registering", "addr", *traderAddr)
+		go seller.subscribeMarket(*traderAddr)
+	} else {
+		go seller.registerWithRetry(*traderAddr)
+	}
+	if seller.PingInterval > 0 {
+		go seller.CheckConns()
+	}
+	switch seller.ResponseMode {
+	case responsePoll:
+		go seller.StartPolling()
+	case responseStream:
+		go seller.StartStream()
+	}
+
+	if *tracePath != "" {
+		entries, err := LoadTrace(*tracePath)
+		if err != nil {
+			common.Fatal("Error loading trace", "err", err)
+		}
+		seller.ReplayTrace(entries)
+		return
+	}
 
 	// Periodically send requests
-	ticker := time.NewTicker(10 * time.Second)
+	ticker := time.NewTicker(common.Scaled(10 * time.Second))
 	defer ticker.Stop()
 
 	for range ticker.C {
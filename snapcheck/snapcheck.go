@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Request mirrors the request type recorded in snapshots
+type Request struct {
+	SellerID  int
+	Post      int
+	Item      string
+	Quantity  int
+	RequestID int
+	DryRun    bool
+}
+
+// ChannelMessage mirrors a Trader's recorded channel message
+type ChannelMessage struct {
+	Kind     string `json:"kind"`
+	Item     string `json:"item"`
+	Quantity int    `json:"quantity"`
+}
+
+// TraderPart mirrors a Trader's part of a global snapshot
+type TraderPart struct {
+	SnapshotID    int64            `json:"snapshot_id"`
+	ID            int              `json:"id"`
+	Post          int              `json:"post"`
+	RecordedAt    time.Time        `json:"recorded_at"`
+	Leader        bool             `json:"leader"`
+	Term          int64            `json:"term"`
+	Inventory     map[string]int   `json:"inventory"`
+	Adopted       map[string]int   `json:"adopted"`
+	Handback      map[string]int   `json:"handback"`
+	PeerInventory map[string]int   `json:"peer_inventory"`
+	InFlight      []Request        `json:"in_flight"`
+	ReplPending   int              `json:"repl_pending"`
+	Channel       []ChannelMessage `json:"channel"`
+	ChannelClosed bool             `json:"channel_closed"`
+}
+
+// SellerPart mirrors a Seller's part of a global snapshot
+type SellerPart struct {
+	SnapshotID int64          `json:"snapshot_id"`
+	ID         int            `json:"id"`
+	Post       int            `json:"post"`
+	RecordedAt time.Time      `json:"recorded_at"`
+	Trader     string         `json:"trader"`
+	LeaderTerm int64          `json:"leader_term"`
+	Pending    []Request      `json:"pending"`
+	Delivered  map[string]int `json:"delivered"`
+	Succeeded  int            `json:"succeeded"`
+	Failed     int            `json:"failed"`
+	Abandoned  int            `json:"abandoned"`
+}
+
+// Snapshot is every part recorded for one snapshot ID
+type Snapshot struct {
+	ID      int64
+	Traders []TraderPart
+	Sellers []SellerPart
+}
+
+// Violation is a broken invariant and the node states that contributed to it
+type Violation struct {
+	Invariant string
+	Detail    string
+	Nodes     []string
+}
+
+// Invariant checks one global property of a snapshot
+type Invariant struct {
+	Name  string
+	Check func(s *Snapshot) []Violation
+}
+
+// invariants lists the checks run against every snapshot
+var invariants = []Invariant{
+	{"no-negative-stock", checkNegativeStock},
+	{"conservation-of-goods", checkConservation},
+	{"one-leader-per-term", checkLeaders},
+}
+
+// LoadSnapshots reads every snapshot part in dir, grouped by snapshot ID
+func LoadSnapshots(dir string) (map[int64]*Snapshot, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "snapshot-*-*-*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	snaps := make(map[int64]*Snapshot)
+	for _, path := range paths {
+		// snapshot-<id>-<role>-<node id>.json
+		fields := strings.Split(strings.TrimSuffix(filepath.Base(path), ".json"), "-")
+		if len(fields) != 4 {
+			continue
+		}
+		id, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		snap, ok := snaps[id]
+		if !ok {
+			snap = &Snapshot{ID: id}
+			snaps[id] = snap
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		switch fields[2] {
+		case "trader":
+			var part TraderPart
+			if err := json.Unmarshal(data, &part); err != nil {
+				return nil, fmt.Errorf("parsing %s: %v", path, err)
+			}
+			snap.Traders = append(snap.Traders, part)
+		case "seller":
+			var part SellerPart
+			if err := json.Unmarshal(data, &part); err != nil {
+				return nil, fmt.Errorf("parsing %s: %v", path, err)
+			}
+			snap.Sellers = append(snap.Sellers, part)
+		}
+	}
+
+	for _, snap := range snaps {
+		sort.Slice(snap.Traders, func(i, j int) bool { return snap.Traders[i].ID < snap.Traders[j].ID })
+		sort.Slice(snap.Sellers, func(i, j int) bool { return snap.Sellers[i].ID < snap.Sellers[j].ID })
+	}
+	return snaps, nil
+}
+
+// describeTrader summarizes a Trader's recorded state for a violation report
+func describeTrader(t *TraderPart) string {
+	return fmt.Sprintf("Trader %d (post %d, leader=%v, term %d): inventory %v, adopted %v, handback %v, %d in flight, %d channel messages, channel closed=%v",
+		t.ID, t.Post, t.Leader, t.Term, t.Inventory, t.Adopted, t.Handback, len(t.InFlight), len(t.Channel), t.ChannelClosed)
+}
+
+// describeSeller summarizes a Seller's recorded state for a violation report
+func describeSeller(s *SellerPart) string {
+	return fmt.Sprintf("Seller %d (post %d, trader %s, term %d): delivered %v, %d pending, %d abandoned",
+		s.ID, s.Post, s.Trader, s.LeaderTerm, s.Delivered, len(s.Pending), s.Abandoned)
+}
+
+// checkNegativeStock reports any stock map holding a negative quantity
+func checkNegativeStock(s *Snapshot) []Violation {
+	var violations []Violation
+	for i := range s.Traders {
+		t := &s.Traders[i]
+		maps := map[string]map[string]int{
+			"inventory":      t.Inventory,
+			"adopted":        t.Adopted,
+			"handback":       t.Handback,
+			"peer inventory": t.PeerInventory,
+		}
+		for name, stock := range maps {
+			for item, qty := range stock {
+				if qty < 0 {
+					violations = append(violations, Violation{
+						Detail: fmt.Sprintf("Trader %d holds %d %s in its %s", t.ID, qty, item, name),
+						Nodes:  []string{describeTrader(t)},
+					})
+				}
+			}
+		}
+	}
+	return violations
+}
+
+// checkConservation compares the goods the Traders hold against what the Sellers deposited.
+// Every item a Seller saw confirmed must be held by a Trader, and a Trader may hold at most
+// that plus the Seller's pending requests (committed but not yet confirmed). Stock adopted
+// from a Trader is only counted when that Trader is missing from the snapshot, since
+// otherwise the Trader still holds it itself.
+func checkConservation(s *Snapshot) []Violation {
+	if len(s.Sellers) == 0 {
+		return nil
+	}
+
+	held := make(map[string]int)
+	for _, t := range s.Traders {
+		for item, qty := range t.Inventory {
+			held[item] += qty
+		}
+		for item, qty := range t.Handback {
+			held[item] += qty
+		}
+		if len(s.Traders) < 2 { // The peer whose stock was adopted did not answer
+			for item, qty := range t.Adopted {
+				held[item] += qty
+			}
+		}
+		for _, m := range t.Channel {
+			if m.Kind == "handback" {
+				held[m.Item] += m.Quantity
+			}
+		}
+	}
+
+	delivered := make(map[string]int)
+	pending := make(map[string]int)
+	abandoned := 0
+	for _, sp := range s.Sellers {
+		for item, qty := range sp.Delivered {
+			delivered[item] += qty
+		}
+		for _, req := range sp.Pending {
+			if !req.DryRun {
+				pending[req.Item] += req.Quantity
+			}
+		}
+		abandoned += sp.Abandoned
+	}
+
+	items := make(map[string]bool)
+	for item := range held {
+		items[item] = true
+	}
+	for item := range delivered {
+		items[item] = true
+	}
+	names := make([]string, 0, len(items))
+	for item := range items {
+		names = append(names, item)
+	}
+	sort.Strings(names)
+
+	var nodes []string
+	for i := range s.Traders {
+		nodes = append(nodes, describeTrader(&s.Traders[i]))
+	}
+	for i := range s.Sellers {
+		nodes = append(nodes, describeSeller(&s.Sellers[i]))
+	}
+
+	var violations []Violation
+	for _, item := range names {
+		switch {
+		case held[item] < delivered[item]:
+			violations = append(violations, Violation{
+				Detail: fmt.Sprintf("%s lost: Traders hold %d but Sellers had %d confirmed", item, held[item], delivered[item]),
+				Nodes:  nodes,
+			})
+		case held[item] > delivered[item]+pending[item]:
+			detail := fmt.Sprintf("%s created: Traders hold %d but Sellers had %d confirmed and %d pending",
+				item, held[item], delivered[item], pending[item])
+			if abandoned > 0 {
+				detail += fmt.Sprintf(" (%d abandoned requests may have committed after their Seller gave up)", abandoned)
+			}
+			violations = append(violations, Violation{Detail: detail, Nodes: nodes})
+		}
+	}
+	return violations
+}
+
+// checkLeaders reports terms in which more than one Trader considers itself leader
+func checkLeaders(s *Snapshot) []Violation {
+	leaders := make(map[int64][]*TraderPart)
+	for i := range s.Traders {
+		if t := &s.Traders[i]; t.Leader {
+			leaders[t.Term] = append(leaders[t.Term], t)
+		}
+	}
+
+	var violations []Violation
+	for term, ts := range leaders {
+		if len(ts) < 2 {
+			continue
+		}
+		v := Violation{Detail: fmt.Sprintf("%d Traders lead in term %d", len(ts), term)}
+		for _, t := range ts {
+			v.Nodes = append(v.Nodes, describeTrader(t))
+		}
+		violations = append(violations, v)
+	}
+	return violations
+}
+
+// Check runs every invariant against a snapshot and prints a report
+func Check(s *Snapshot) []Violation {
+	fmt.Printf("Snapshot %d (%s): %d Traders, %d Sellers\n",
+		s.ID, time.Unix(0, s.ID).Format(time.RFC3339), len(s.Traders), len(s.Sellers))
+	for _, t := range s.Traders {
+		if !t.ChannelClosed {
+			fmt.Printf("  WARNING: Trader %d never received its peer's marker; its channel state may be incomplete\n", t.ID)
+		}
+	}
+	if len(s.Sellers) == 0 {
+		fmt.Println("  WARNING: no Seller parts; conservation of goods not checked")
+	}
+
+	var all []Violation
+	for _, inv := range invariants {
+		violations := inv.Check(s)
+		if len(violations) == 0 {
+			fmt.Printf("  %-22s ok\n", inv.Name)
+			continue
+		}
+		fmt.Printf("  %-22s %d violation(s)\n", inv.Name, len(violations))
+		for _, v := range violations {
+			v.Invariant = inv.Name
+			fmt.Printf("    - %s\n", v.Detail)
+			for _, n := range v.Nodes {
+				fmt.Printf("        %s\n", n)
+			}
+			all = append(all, v)
+		}
+	}
+	return all
+}
+
+func main() {
+	dir := flag.String("dir", "snapshots", "Directory containing snapshot parts")
+	id := flag.Int64("id", 0, "Snapshot ID to check (0 checks the latest; -1 checks all)")
+	flag.Parse()
+
+	snaps, err := LoadSnapshots(*dir)
+	if err != nil {
+		log.Fatalf("Error loading snapshots: %v", err)
+	}
+	if len(snaps) == 0 {
+		log.Fatalf("No snapshots found in %s", *dir)
+	}
+
+	ids := make([]int64, 0, len(snaps))
+	for sid := range snaps {
+		ids = append(ids, sid)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	switch {
+	case *id == 0:
+		ids = ids[len(ids)-1:]
+	case *id > 0:
+		if _, ok := snaps[*id]; !ok {
+			log.Fatalf("Snapshot %d not found in %s", *id, *dir)
+		}
+		ids = []int64{*id}
+	}
+
+	violations := 0
+	for _, sid := range ids {
+		violations += len(Check(snaps[sid]))
+	}
+	if violations > 0 {
+		fmt.Printf("%d invariant violation(s)\n", violations)
+		os.Exit(1)
+	}
+}
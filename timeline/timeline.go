@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Transition mirrors a role transition recorded by a Trader with -transitions
+type Transition struct {
+	At     time.Time `json:"at"`
+	Trader int       `json:"trader"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Cause  string    `json:"cause"`
+	Term   int64     `json:"term"`
+	Leader bool      `json:"leader"`
+}
+
+// roleMarks are the characters drawn for each role in the timeline
+var roleMarks = map[string]byte{
+	"starting": ' ',
+	"leader":   'L',
+	"backup":   'b',
+	"draining": 'D',
+	"stopped":  '.',
+}
+
+// load reads the transitions in the given files, sorted by time
+func load(paths []string) ([]Transition, error) {
+	var all []Transition
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			var tr Transition
+			if err := json.Unmarshal(scanner.Bytes(), &tr); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			all = append(all, tr)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].At.Before(all[j].At) })
+	return all, nil
+}
+
+// traders returns the IDs of the Traders that recorded transitions, in order
+func traders(all []Transition) []int {
+	seen := make(map[int]bool)
+	var ids []int
+	for _, tr := range all {
+		if !seen[tr.Trader] {
+			seen[tr.Trader] = true
+			ids = append(ids, tr.Trader)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// ======= TEXT =======
+
+// writeNarrative lists every transition with its offset from the first one
+func writeNarrative(w io.Writer, all []Transition) {
+	start, end := all[0].At, all[len(all)-1].At
+	fmt.Fprintf(w, "Role transitions of %d Traders from %s to %s (%s)\n\n", len(traders(all)), start.Format("15:04:05.000"), end.Format("15:04:05.000"), end.Sub(start).Round(time.Millisecond))
+	for _, tr := range all {
+		fmt.Fprintf(w, "%10s  Trader %-3d %8s -> %-8s  %-17s  term %d\n", fmt.Sprintf("+%.3fs", tr.At.Sub(start).Seconds()), tr.Trader, tr.From, tr.To, tr.Cause, tr.Term)
+	}
+}
+
+// writeTimeline draws one row per Trader, one column per slice of the run
+func writeTimeline(w io.Writer, all []Transition, width int) {
+	start, end := all[0].At, all[len(all)-1].At
+	span := end.Sub(start)
+	if span <= 0 {
+		span = time.Millisecond
+	}
+	step := span / time.Duration(width)
+	if step <= 0 {
+		step = 1
+	}
+
+	fmt.Fprintf(w, "\nTimeline (one column = %s; L leader, b backup, D draining, . stopped)\n\n", step.Round(time.Millisecond))
+	for _, id := range traders(all) {
+		row := make([]byte, width)
+		role := "starting"
+		i := 0
+		for col := 0; col < width; col++ {
+			// A column shows the role at its end, so short-lived roles are drawn once
+			// they last to the end of a slice
+			until := start.Add(step * time.Duration(col+1))
+			for ; i < len(all); i++ {
+				if all[i].At.After(until) && col < width-1 {
+					break
+				}
+				if all[i].Trader == id {
+					role = all[i].To
+				}
+			}
+			row[col] = roleMarks[role]
+		}
+		fmt.Fprintf(w, "Trader %-3d |%s|\n", id, row)
+	}
+
+	// Mark the columns in which a Trader became leader, the turning points of a failover
+	fmt.Fprintf(w, "%11s|", "")
+	marks := []byte(strings.Repeat(" ", width))
+	for _, tr := range all {
+		if tr.To == "leader" {
+			col := int(tr.At.Sub(start) / step)
+			if col >= width {
+				col = width - 1
+			}
+			marks[col] = '^'
+		}
+	}
+	fmt.Fprintf(w, "%s|\n", marks)
+}
+
+// ======= MERMAID =======
+
+// writeMermaid emits a state diagram of the observed transitions, each edge labelled
+// with its causes and how often they occurred
+func writeMermaid(w io.Writer, all []Transition) {
+	type edge struct{ from, to string }
+	counts := make(map[edge]map[string]int)
+	var edges []edge
+	for _, tr := range all {
+		e := edge{mermaidState(tr.From), mermaidState(tr.To)}
+		if counts[e] == nil {
+			counts[e] = make(map[string]int)
+			edges = append(edges, e)
+		}
+		counts[e][tr.Cause]++
+	}
+
+	fmt.Fprintln(w, "stateDiagram-v2")
+	for _, e := range edges {
+		var causes []string
+		for cause, n := range counts[e] {
+			causes = append(causes, fmt.Sprintf("%s x%d", cause, n))
+		}
+		sort.Strings(causes)
+		fmt.Fprintf(w, "    %s --> %s: %s\n", e.from, e.to, strings.Join(causes, ", "))
+	}
+}
+
+// mermaidState maps the start and end of a Trader's life to Mermaid's [*]
+func mermaidState(role string) string {
+	if role == "starting" || role == "stopped" {
+		return "[*]"
+	}
+	return role
+}
+
+func main() {
+	format := flag.String("format", "text", "Output format: text (transition list and timeline) or mermaid (state diagram)")
+	width := flag.Int("width", 72, "Columns of the text timeline")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: timeline [-format=text|mermaid] [-width=72] <transitions file>...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *width < 1 {
+		log.Fatal("-width must be at least 1")
+	}
+
+	all, err := load(flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(all) == 0 {
+		log.Fatal("No transitions recorded")
+	}
+
+	switch *format {
+	case "text":
+		writeNarrative(os.Stdout, all)
+		writeTimeline(os.Stdout, all, *width)
+	case "mermaid":
+		writeMermaid(os.Stdout, all)
+	default:
+		log.Fatalf("Unknown -format %q (expected text or mermaid)", *format)
+	}
+}
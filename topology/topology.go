@@ -0,0 +1,327 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"a4/common"
+)
+
+// AdminArgs mirrors the Trader's admin credential
+type AdminArgs struct {
+	Token  string
+	Enable bool
+}
+
+// NodeStatus mirrors one node of a Trader's cluster view
+type NodeStatus struct {
+	Role    string
+	ID      int
+	Address string
+	Post    int
+	Leader  bool
+	Term    int64
+	Domain  string
+	Health  string
+	Self    bool
+}
+
+// LinkStatus mirrors a link of a Trader's cluster view
+type LinkStatus struct {
+	From, To string
+	Kind     string
+	Up       bool
+	Note     string
+}
+
+// ClusterStatus mirrors a Trader's view of the cluster topology
+type ClusterStatus struct {
+	Reporter int
+	Time     time.Time
+	Nodes    []NodeStatus
+	Links    []LinkStatus
+}
+
+// Topology is the merged view of every Trader that answered
+type Topology struct {
+	Time  time.Time
+	Nodes map[string]NodeStatus // By address
+	Links map[string]LinkStatus // By from|to|kind
+}
+
+// collect queries ClusterStatus on every Trader and merges the answers. A node's report
+// about itself wins over what others say about it; an unreachable Trader is marked down.
+func collect(addrs []string, token string, timeout time.Duration) *Topology {
+	topo := &Topology{Time: time.Now(), Nodes: make(map[string]NodeStatus), Links: make(map[string]LinkStatus)}
+	self := make(map[string]bool)
+	unreachable := make(map[string]bool)
+
+	for _, addr := range addrs {
+		var st ClusterStatus
+		if err := common.Call(addr, "Trader.ClusterStatus", &AdminArgs{Token: token}, &st, timeout); err != nil {
+			log.Printf("Topology: Trader at %s did not report: %v", addr, err)
+			unreachable[addr] = true
+			if _, known := topo.Nodes[addr]; !known {
+				topo.Nodes[addr] = NodeStatus{Role: "trader", Address: addr, Health: "down"}
+			}
+			continue
+		}
+
+		for _, n := range st.Nodes {
+			if self[n.Address] {
+				continue
+			}
+			if n.Self {
+				self[n.Address] = true
+				topo.Nodes[n.Address] = n
+				continue
+			}
+			if _, known := topo.Nodes[n.Address]; known && !unreachable[n.Address] {
+				continue
+			}
+			topo.Nodes[n.Address] = n
+		}
+		for _, l := range st.Links {
+			key := l.From + "|" + l.To + "|" + l.Kind
+			if l.Kind == "peer" {
+				// Both Traders report their shared link; draw it once, down if either side says so
+				rev := l.To + "|" + l.From + "|" + l.Kind
+				if old, ok := topo.Links[rev]; ok {
+					old.Up = old.Up && l.Up
+					if old.Note == "" {
+						old.Note = l.Note
+					}
+					topo.Links[rev] = old
+					continue
+				}
+			}
+			topo.Links[key] = l
+		}
+	}
+
+	// A Trader we could not reach is down, whatever its peer last saw, and so are its links
+	for addr := range unreachable {
+		n := topo.Nodes[addr]
+		n.Health, n.Leader = "down", false
+		topo.Nodes[addr] = n
+	}
+	for key, l := range topo.Links {
+		if unreachable[l.From] || unreachable[l.To] {
+			l.Up = false
+			topo.Links[key] = l
+		}
+	}
+	return topo
+}
+
+// sortedNodes returns the nodes with Traders first, then by ID and address
+func (topo *Topology) sortedNodes() []NodeStatus {
+	var nodes []NodeStatus
+	for _, n := range topo.Nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Role != nodes[j].Role {
+			return nodes[i].Role == "trader"
+		}
+		if nodes[i].ID != nodes[j].ID {
+			return nodes[i].ID < nodes[j].ID
+		}
+		return nodes[i].Address < nodes[j].Address
+	})
+	return nodes
+}
+
+// sortedLinks returns the links in a stable order
+func (topo *Topology) sortedLinks() []LinkStatus {
+	var keys []string
+	for k := range topo.Links {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	links := make([]LinkStatus, 0, len(keys))
+	for _, k := range keys {
+		links = append(links, topo.Links[k])
+	}
+	return links
+}
+
+// nodeLabel describes a node in one line per fact
+func nodeLabel(n NodeStatus) []string {
+	name := "Trader"
+	if n.Role == "seller" {
+		name = "Seller"
+	}
+	var lines []string
+	if n.ID > 0 {
+		lines = append(lines, fmt.Sprintf("%s %d", name, n.ID))
+	} else {
+		lines = append(lines, name)
+	}
+	lines = append(lines, n.Address)
+	if n.Role == "trader" {
+		role := "backup"
+		if n.Leader {
+			role = "leader"
+		}
+		lines = append(lines, fmt.Sprintf("%s, term %d", role, n.Term))
+	}
+	if n.Post > 0 {
+		lines = append(lines, fmt.Sprintf("post %d", n.Post))
+	}
+	if n.Domain != "" {
+		lines = append(lines, "domain "+n.Domain)
+	}
+	if n.Health != "up" {
+		lines = append(lines, n.Health)
+	}
+	return lines
+}
+
+// healthColor is the fill colour of a node in either output format
+func healthColor(n NodeStatus) string {
+	switch {
+	case n.Health == "down":
+		return "#f4a6a6"
+	case n.Health == "draining":
+		return "#f7d794"
+	case n.Leader:
+		return "#a8e6a1"
+	default:
+		return "#e8e8e8"
+	}
+}
+
+// linkLabel names a link, noting why it is down
+func linkLabel(l LinkStatus) string {
+	label := l.Kind
+	if l.Note != "" {
+		label += " (" + l.Note + ")"
+	} else if !l.Up {
+		label += " (down)"
+	}
+	return label
+}
+
+// dot renders the topology as a Graphviz digraph
+func (topo *Topology) dot() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Cluster topology at %s\n", topo.Time.Format(time.RFC3339))
+	b.WriteString("digraph cluster {\n  rankdir=LR;\n  node [shape=box, style=\"rounded,filled\", fontname=\"Helvetica\"];\n")
+	for _, n := range topo.sortedNodes() {
+		shape := "box"
+		if n.Role == "seller" {
+			shape = "ellipse"
+		}
+		fmt.Fprintf(&b, "  %q [label=%q, shape=%s, fillcolor=%q];\n", n.Address, strings.Join(nodeLabel(n), "\n"), shape, healthColor(n))
+	}
+	for _, l := range topo.sortedLinks() {
+		attrs := fmt.Sprintf("label=%q", linkLabel(l))
+		if l.Kind == "peer" {
+			attrs += ", dir=both"
+		}
+		if !l.Up {
+			attrs += ", style=dashed, color=red"
+		}
+		fmt.Fprintf(&b, "  %q -> %q [%s];\n", l.From, l.To, attrs)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// mermaid renders the topology as a Mermaid flowchart
+func (topo *Topology) mermaid() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%%%% Cluster topology at %s\n", topo.Time.Format(time.RFC3339))
+	b.WriteString("graph LR\n")
+	ids := make(map[string]string)
+	for i, n := range topo.sortedNodes() {
+		id := fmt.Sprintf("n%d", i)
+		ids[n.Address] = id
+		left, right := "[", "]"
+		if n.Role == "seller" {
+			left, right = "([", "])"
+		}
+		fmt.Fprintf(&b, "  %s%s\"%s\"%s\n", id, left, strings.Join(nodeLabel(n), "<br/>"), right)
+		fmt.Fprintf(&b, "  style %s fill:%s\n", id, healthColor(n))
+	}
+	for _, l := range topo.sortedLinks() {
+		from, to := ids[l.From], ids[l.To]
+		if from == "" || to == "" {
+			continue
+		}
+		arrow := "-->"
+		if l.Kind == "peer" {
+			arrow = "<-->"
+		}
+		if !l.Up {
+			arrow = "-.->"
+			if l.Kind == "peer" {
+				arrow = "<-.->"
+			}
+		}
+		fmt.Fprintf(&b, "  %s %s|%s| %s\n", from, arrow, linkLabel(l), to)
+	}
+	return b.String()
+}
+
+// writeAtomically replaces path with data so readers never see a half-written diagram
+func writeAtomically(path string, data string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(data), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func main() {
+	traders := flag.String("traders", "localhost:8001,localhost:8002", "Comma-separated Trader addresses to query")
+	token := flag.String("token", "", "Admin token of the Traders")
+	format := flag.String("format", "dot", "Output format: dot (Graphviz) or mermaid")
+	out := flag.String("out", "", "File to write the diagram to (stdout if empty)")
+	interval := flag.Duration("interval", 0, "Regenerate the diagram this often until interrupted (0 generates it once)")
+	timeout := flag.Duration("timeout", 5*time.Second, "Time to wait for each Trader to answer")
+	caFile := flag.String("ca", "", "PEM certificate of the cluster CA; Traders are called over TLS and must present a certificate it signed")
+	tlsCert := flag.String("tls-cert", "", "PEM client certificate signed by -ca, for Traders running -mtls")
+	tlsKey := flag.String("tls-key", "", "PEM private key of -tls-cert")
+	flag.Parse()
+
+	if *format != "dot" && *format != "mermaid" {
+		log.Fatalf("Unknown -format %q (expected dot or mermaid)", *format)
+	}
+	if *interval > 0 && *out == "" {
+		log.Fatal("-interval requires -out")
+	}
+	_, clientTLS, err := common.LoadTLS(*tlsCert, *tlsKey, *caFile, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	common.UseTLS(clientTLS)
+	addrs := strings.Split(*traders, ",")
+
+	for {
+		topo := collect(addrs, *token, *timeout)
+		diagram := topo.dot()
+		if *format == "mermaid" {
+			diagram = topo.mermaid()
+		}
+
+		if *out == "" {
+			fmt.Print(diagram)
+		} else if err := writeAtomically(*out, diagram); err != nil {
+			log.Fatalf("Error writing %s: %v", *out, err)
+		} else {
+			log.Printf("Topology: Wrote %d nodes and %d links to %s", len(topo.Nodes), len(topo.Links), *out)
+		}
+
+		if *interval <= 0 {
+			return
+		}
+		time.Sleep(*interval)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportRequest mirrors the OTLP JSON lines a node writes with -spans=<file>
+type exportRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []keyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes"`
+	Status            struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+type keyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue *string  `json:"stringValue"`
+		BoolValue   *bool    `json:"boolValue"`
+		IntValue    *string  `json:"intValue"`
+		DoubleValue *float64 `json:"doubleValue"`
+	} `json:"value"`
+}
+
+// String renders the attribute's value
+func (kv keyValue) String() string {
+	switch v := kv.Value; {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return *v.IntValue
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'g', -1, 64)
+	}
+	return ""
+}
+
+// Span is one exported span with the node that recorded it
+type Span struct {
+	Node     string
+	TraceID  string
+	SpanID   string
+	Parent   string
+	Name     string
+	Kind     int
+	Start    time.Time
+	End      time.Time
+	Attrs    []keyValue
+	Error    string
+	Children []*Span
+}
+
+// Attr returns the value of the span's attribute key, or "" if it has none
+func (s *Span) Attr(key string) string {
+	for _, kv := range s.Attrs {
+		if kv.Key == key {
+			return kv.String()
+		}
+	}
+	return ""
+}
+
+// kindNames label the span kinds in the tree
+var kindNames = map[int]string{1: "internal", 2: "server", 3: "client"}
+
+// unixNano parses an OTLP timestamp
+func unixNano(s string) time.Time {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return time.Unix(0, n)
+}
+
+// load reads the spans in the given files
+func load(paths []string) ([]*Span, error) {
+	var all []*Span
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 64<<20)
+		for line := 1; scanner.Scan(); line++ {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			var req exportRequest
+			if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			for _, rs := range req.ResourceSpans {
+				node := ""
+				for _, kv := range rs.Resource.Attributes {
+					if kv.Key == "service.instance.id" {
+						node = kv.String()
+					}
+				}
+				for _, ss := range rs.ScopeSpans {
+					for _, o := range ss.Spans {
+						all = append(all, &Span{
+							Node: node, TraceID: o.TraceID, SpanID: o.SpanID, Parent: o.ParentSpanID,
+							Name: o.Name, Kind: o.Kind, Attrs: o.Attributes, Error: o.Status.Message,
+							Start: unixNano(o.StartTimeUnixNano), End: unixNano(o.EndTimeUnixNano),
+						})
+					}
+				}
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return all, nil
+}
+
+// Trace is the span tree of one trace
+type Trace struct {
+	ID    string
+	Roots []*Span // Spans whose parent was not exported, normally just the Seller's
+	Spans int
+}
+
+// build links the spans into trees, one per trace, ordered by start time
+func build(all []*Span) []*Trace {
+	byID := make(map[string]*Span)
+	for _, s := range all {
+		byID[s.TraceID+"/"+s.SpanID] = s
+	}
+	traces := make(map[string]*Trace)
+	var order []*Trace
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Start.Before(all[j].Start) })
+	for _, s := range all {
+		tr, ok := traces[s.TraceID]
+		if !ok {
+			tr = &Trace{ID: s.TraceID}
+			traces[s.TraceID] = tr
+			order = append(order, tr)
+		}
+		tr.Spans++
+		if parent, ok := byID[s.TraceID+"/"+s.Parent]; ok && s.Parent != "" {
+			parent.Children = append(parent.Children, s)
+		} else {
+			tr.Roots = append(tr.Roots, s)
+		}
+	}
+	return order
+}
+
+// requestOf returns the request ID the trace is about, or "" if no span names one
+func requestOf(tr *Trace) string {
+	for _, root := range tr.Roots {
+		if id := root.Attr("a4.request"); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// writeTrace prints the trace as an indented tree with each span's node, duration and result
+func writeTrace(w io.Writer, tr *Trace) {
+	fmt.Fprintf(w, "trace %s (request %s, %d spans)\n", tr.ID, requestOf(tr), tr.Spans)
+	var walk func(s *Span, depth int, orphan bool)
+	walk = func(s *Span, depth int, orphan bool) {
+		line := fmt.Sprintf("%s%-10s %s (%s) %v", strings.Repeat("  ", depth+1), s.Node, s.Name, kindNames[s.Kind], s.End.Sub(s.Start).Round(time.Microsecond))
+		for _, key := range []string{"a4.to", "a4.status", "a4.path"} {
+			if v := s.Attr(key); v != "" {
+				line += fmt.Sprintf(" %s=%q", strings.TrimPrefix(key, "a4."), v)
+			}
+		}
+		if s.Error != "" {
+			line += fmt.Sprintf(" ERROR=%q", s.Error)
+		}
+		if orphan {
+			line += " [parent not exported]"
+		}
+		fmt.Fprintln(w, line)
+		for _, c := range s.Children {
+			walk(c, depth+1, false)
+		}
+	}
+	for _, root := range tr.Roots {
+		walk(root, 0, root.Parent != "")
+	}
+}
+
+func main() {
+	traceID := flag.String("trace", "", "Only print the trace with this ID")
+	request := flag.Int("request", 0, "Only print traces of this request ID (0 prints all)")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: traces [-trace=<id>] [-request=<id>] <span file>...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	all, err := load(flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(all) == 0 {
+		log.Fatal("No spans recorded")
+	}
+
+	printed := 0
+	for _, tr := range build(all) {
+		if *traceID != "" && tr.ID != *traceID {
+			continue
+		}
+		if *request != 0 && requestOf(tr) != strconv.Itoa(*request) {
+			continue
+		}
+		if printed > 0 {
+			fmt.Println()
+		}
+		writeTrace(os.Stdout, tr)
+		printed++
+	}
+	if printed == 0 {
+		log.Fatal("No matching traces")
+	}
+}
@@ -0,0 +1,336 @@
+// Package tracing records OpenTelemetry spans for the hops of a request across processes
+// and exports them as OTLP JSON, either to a collector over OTLP/HTTP or as lines appended
+// to a file. Span contexts travel inside the RPC messages, so the spans of one trace link
+// the Seller, the Trader it sent to, the peers the Trader forwarded to and the response
+// pushed back.
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind is the OTLP span kind
+type Kind int
+
+const (
+	Internal Kind = 1 // Work inside one process
+	Server   Kind = 2 // Handling of an incoming RPC
+	Client   Kind = 3 // An outgoing RPC
+)
+
+const (
+	batchSize  = 256             // Spans per export
+	flushEvery = 2 * time.Second // Export interval for partial batches
+	queueSize  = 4096            // Ended spans waiting for export before new ones are dropped
+)
+
+// Context identifies a span across processes. The zero Context means "not traced".
+type Context struct {
+	TraceID string // 32 lowercase hex digits
+	SpanID  string // 16 lowercase hex digits
+}
+
+// Valid reports whether the context names a span
+func (c Context) Valid() bool { return c.TraceID != "" && c.SpanID != "" }
+
+// Tracer starts spans for one process and exports them in batches. A nil *Tracer is
+// valid: its spans are not recorded but still pass their parent's context on, so a
+// process without an exporter does not break the traces of the processes around it.
+type Tracer struct {
+	service  string // e.g. "trader"
+	instance string // e.g. "trader-1"
+	export   func(body []byte) error
+
+	spans   chan *Span
+	done    chan struct{}
+	dropped int64 // Spans dropped on a full queue since the last warning (guarded by mu)
+	mu      sync.Mutex
+	closed  bool // (guarded by mu)
+}
+
+// New creates a Tracer exporting to endpoint: an http:// or https:// URL of an OTLP/HTTP
+// collector (the path defaults to /v1/traces), or otherwise a file to append OTLP JSON
+// lines to.
+func New(endpoint, service, instance string) (*Tracer, error) {
+	t := &Tracer{service: service, instance: instance, spans: make(chan *Span, queueSize), done: make(chan struct{})}
+	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/traces"
+		}
+		client := &http.Client{Timeout: 5 * time.Second}
+		t.export = func(body []byte) error {
+			resp, err := client.Post(u.String(), "application/json", bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				return fmt.Errorf("collector returned %s", resp.Status)
+			}
+			return nil
+		}
+	} else {
+		f, err := os.OpenFile(endpoint, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		t.export = func(body []byte) error {
+			_, err := f.Write(append(body, '\n'))
+			return err
+		}
+	}
+	go t.run()
+	return t, nil
+}
+
+// Start begins a span that is a child of parent, or the root of a new trace if parent is
+// not Valid. The span is exported once End is called.
+func (t *Tracer) Start(name string, kind Kind, parent Context) *Span {
+	if t == nil {
+		return &Span{ctx: parent}
+	}
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now(), parent: parent.SpanID}
+	s.ctx.TraceID = parent.TraceID
+	if !parent.Valid() {
+		s.ctx.TraceID = fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+		s.parent = ""
+	}
+	s.ctx.SpanID = fmt.Sprintf("%016x", rand.Uint64()|1)
+	return s
+}
+
+// Close exports the spans that have ended and stops the Tracer; later spans are dropped
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	close(t.spans)
+	t.mu.Unlock()
+	<-t.done
+}
+
+// enqueue hands an ended span to the exporter without blocking the request it belongs to
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		if t.dropped++; t.dropped == 1 {
+			slog.Warn("Span export queue is full, dropping spans", "queue", queueSize)
+		}
+	}
+}
+
+// run batches ended spans and exports them until Close
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(flushEvery)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(t.encode(batch)); err != nil {
+			slog.Warn("Failed to export spans", "spans", len(batch), "err", err)
+		}
+		batch = batch[:0]
+		t.mu.Lock()
+		if t.dropped > 0 {
+			slog.Warn("Dropped spans on a full export queue", "spans", t.dropped)
+			t.dropped = 0
+		}
+		t.mu.Unlock()
+	}
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			if batch = append(batch, s); len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Span is one timed operation of a trace. Its methods are not safe for concurrent use.
+type Span struct {
+	tracer *Tracer // nil if the span is not recorded
+	ctx    Context
+	parent string // SpanID of the parent span, empty for a root
+	name   string
+	kind   Kind
+	start  time.Time
+	end    time.Time
+	attrs  []keyValue
+	err    string
+	ended  bool
+}
+
+// Context returns the context to send with RPCs made on behalf of the span; for a span
+// that is not recorded it is the parent's context
+func (s *Span) Context() Context { return s.ctx }
+
+// Set records an attribute; value is a string, bool, integer or float64
+func (s *Span) Set(key string, value any) {
+	if s.tracer == nil {
+		return
+	}
+	var v anyValue
+	switch value := value.(type) {
+	case string:
+		v.StringValue = &value
+	case bool:
+		v.BoolValue = &value
+	case int:
+		n := strconv.Itoa(value)
+		v.IntValue = &n
+	case int64:
+		n := strconv.FormatInt(value, 10)
+		v.IntValue = &n
+	case float64:
+		v.DoubleValue = &value
+	default:
+		str := fmt.Sprint(value)
+		v.StringValue = &str
+	}
+	s.attrs = append(s.attrs, keyValue{Key: key, Value: v})
+}
+
+// Fail marks the span as failed with err's message; a nil err is ignored
+func (s *Span) Fail(err error) {
+	if err != nil {
+		s.err = err.Error()
+	}
+}
+
+// End finishes the span and queues it for export; later calls do nothing
+func (s *Span) End() {
+	if s.tracer == nil || s.ended {
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.tracer.enqueue(s)
+}
+
+// ======= OTLP JSON =======
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+// otlpSpan is a span in the OTLP JSON encoding, where IDs are hex and times are decimal
+// strings of Unix nanoseconds
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              Kind       `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            status     `json:"status"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// status codes: 1 is OK, 2 is ERROR
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func ptr[T any](v T) *T { return &v }
+
+// encode renders a batch as one OTLP ExportTraceServiceRequest
+func (t *Tracer) encode(batch []*Span) []byte {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		o := otlpSpan{
+			TraceID: s.ctx.TraceID, SpanID: s.ctx.SpanID, ParentSpanID: s.parent,
+			Name: s.name, Kind: s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        s.attrs,
+			Status:            status{Code: 1},
+		}
+		if s.err != "" {
+			o.Status = status{Code: 2, Message: s.err}
+		}
+		spans = append(spans, o)
+	}
+	req := exportRequest{ResourceSpans: []resourceSpans{{
+		Resource: resource{Attributes: []keyValue{
+			{Key: "service.name", Value: anyValue{StringValue: ptr(t.service)}},
+			{Key: "service.instance.id", Value: anyValue{StringValue: ptr(t.instance)}},
+		}},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: "a4"}, Spans: spans}},
+	}}}
+	body, err := json.Marshal(req)
+	if err != nil {
+		// Every field is a string, number or bool, so this cannot happen
+		panic(errors.Join(errors.New("encoding spans"), err))
+	}
+	return body
+}
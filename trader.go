@@ -1,217 +1,9024 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
 	"log"
+	"log/slog"
+	"math"
+	"math/rand"
 	"net"
+	"net/http"
 	"net/rpc"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unsafe"
+
+	"a4/common"
+	"a4/config"
+	"a4/metrics"
+	"a4/rpcserver"
+	"a4/tracing"
+)
+
+// ======= WIRE TYPES =======
+
+// Messages exchanged with Sellers and Buyers are defined in package common, shared with
+// the Seller and Buyer binaries and any third-party client
+type (
+	Request        = common.Request
+	Response       = common.Response
+	BuyRequest     = common.BuyRequest
+	CancelArgs     = common.CancelArgs
+	BuyerInfo      = common.BuyerInfo
+	SellerContact  = common.SellerContact
+	DirectTrade    = common.DirectTrade
+	DirectReport   = common.DirectTradeReport
+	RegisterReply  = common.RegisterReply
+	ResumeArgs     = common.ResumeArgs
+	LeaseArgs      = common.LeaseArgs
+	LeaseReply     = common.LeaseReply
+	PendingArgs    = common.PendingArgs
+	StreamArgs     = common.StreamArgs
+	StreamMessage  = common.StreamMessage
+	LeaderUpdate   = common.LeaderUpdate
+	NodeIdentity   = common.NodeIdentity
+	Correction     = common.Correction
+	SpoilageNotice = common.SpoilageNotice
+	SubscribeArgs  = common.SubscribeArgs
+	MarketSummary  = common.MarketSummary
+	Leaderboard    = common.Leaderboard
+	ItemSales      = common.ItemSales
+	SellerSales    = common.SellerSales
+	Marker         = common.Marker
+	ShutdownArgs   = common.ShutdownArgs
+)
+
+const (
+	deliveryAtLeastOnce = common.DeliveryAtLeastOnce
+	deliveryAtMostOnce  = common.DeliveryAtMostOnce
+
+	responseSync   = common.ResponseSync
+	responsePush   = common.ResponsePush
+	responsePoll   = common.ResponsePoll
+	responseStream = common.ResponseStream
 )
 
 // ======= STRUCTS =======
 type Trader struct {
 	ID          int
 	Address     string
-	Peer        string
+	Peer        string // Address of the peer Trader; re-pointed when a standby pool promotes another leader (guarded by peerMu)
 	Post        int
 	IsLeader    bool
 	Heartbeat   bool
 	HeartbeatMu sync.Mutex
-	Requests    []Request
+	Requests    []Request // Requests currently being processed (guarded by RequestMu)
 	RequestMu   sync.Mutex
+	Exporter    EventExporter // Optional sink for trade and leadership events
+	AdminToken  string        // Credential required for admin operations; empty disables them
+	Draining    bool          // When set, new requests are rejected (guarded by RequestMu)
+	Inventory   map[string]int
+	InventoryMu sync.Mutex
+	Cancelled   map[RequestKey]bool // Requests abandoned by their sender (guarded by RequestMu)
+	Processed   int                 // Number of committed requests (guarded by RequestMu)
+	Abandoned   int                 // Number of requests abandoned before processing (guarded by RequestMu)
+	HBHistory   *HeartbeatHistory   // Recent heartbeat attempts, dumped on takeover
+	Transitions *TransitionLog      // Role changes and their causes, optionally appended to a file
+	Detector    FailureDetector     // Decides from heartbeat outcomes when the peer has failed
+	PeerID      int                 // Expected ID of the peer Trader; 0 skips identity verification (guarded by peerMu)
+	DevMode     bool                // Pick a free port automatically if Address is taken
+
+	PeerInventory map[string]int      // Last state pulled from the peer, merged on takeover (guarded by InventoryMu)
+	PeerRegistry  map[int]*SellerInfo // Warm copy of the peer's Seller registry, merged on takeover (guarded by InventoryMu)
+	peerEvicted   map[int]*SellerInfo // Sellers the peer evicted while idle, merged on takeover (guarded by InventoryMu)
+	ChunkSize     int                 // Inventory entries per state transfer chunk
+	snapshots     map[int64]*stateSnapshot
+	snapshotMu    sync.Mutex
+	Replicator    *Replicator  // Pushes committed trades to the peer; nil disables replication
+	replEpoch     int64        // Epoch of the peer's replication stream (guarded by InventoryMu)
+	replApplied   int64        // Highest replication sequence applied from the peer (guarded by InventoryMu)
+	PeerUp        bool         // Whether the last heartbeat reached the peer (guarded by HeartbeatMu)
+	Conns         *common.Pool // Reusable connections to the peer, Sellers and Buyers, by address
+	StaleConns    int          // Pooled peer connections found dead by a ping and replaced (guarded by HeartbeatMu)
+	forwardSlots  *workSlots   // Bounds the number of in-flight forwards
+	MaxHops       int          // Most Traders a request may visit before forwarding is refused
+	Domain        string       // Failure domain (machine or rack label) of this Trader
+	peerDomain    string       // Last failure domain reported by the peer (guarded by HeartbeatMu)
+	peerPost      int          // Post the peer reported owning; 0 until it has (guarded by HeartbeatMu)
+
+	Adopted     map[string]int // Peer stock adopted at takeover, returned to the peer on heal (guarded by InventoryMu)
+	Handback    map[string]int // Deposits accepted for the peer's post, handed back on heal (guarded by InventoryMu)
+	Partitioned bool           // Fault injection: all traffic to and from the peer is dropped (guarded by HeartbeatMu)
+	Secret      string         // Cluster secret used to sign responses and leader notifications and to verify requests
+	Term        int64          // Leadership term, incremented whenever this Trader becomes leader (guarded by HeartbeatMu)
+	peerTerm    int64          // Last term reported by the peer (guarded by HeartbeatMu)
+	peerLeader  bool           // Whether the peer last reported itself leader (guarded by HeartbeatMu)
+	negotiating bool           // Startup role negotiation in progress (guarded by HeartbeatMu)
+	votedFor    int            // Trader granted leadership in voteTerm (guarded by HeartbeatMu)
+	voteTerm    int64          // Latest term a vote was cast in (guarded by HeartbeatMu)
+	TermStore   *TermStore     // Durable term and vote; nil keeps them in memory only
+
+	leases     map[int]int // Highest request ID leased to each Seller (guarded by RegistryMu)
+	LeaseStore *LeaseStore // Durable leases; nil keeps them in memory only
+
+	buyers         map[int]string          // Registered Buyer addresses by ID (guarded by RegistryMu)
+	purchases      map[RequestKey]purchase // Recent purchases by Buyer ID and request ID (guarded by RequestMu)
+	purchaseExpiry expiryQueue             // Keys of purchases in the order sold (guarded by RequestMu)
+
+	deposits      map[RequestKey]purchase // Recent committed Seller requests by Seller ID and request ID (guarded by RequestMu)
+	depositExpiry expiryQueue             // Keys of deposits in the order committed (guarded by RequestMu)
+	Repeated      int                     // Retries answered from deposits without processing (guarded by RequestMu)
+
+	OffloadAbove  int // Delegate read-only requests to the backup at this many requests in flight; 0 disables
+	Offloaded     int // Read-only requests delegated to the backup (guarded by RequestMu)
+	ReplicaReads  int // Split reads for the peer's post answered from the replica (guarded by RequestMu)
+	ReadOnlyLocal int // Read-only requests served locally (guarded by RequestMu)
+
+	seenOnce    map[RequestKey]time.Time // At-most-once requests received, by arrival (guarded by RequestMu)
+	seenExpiry  expiryQueue              // Keys of seenOnce in the order received (guarded by RequestMu)
+	corrections map[RequestKey]int       // Current quantity of corrected trades (guarded by RequestMu)
+	DupsDropped int                      // Repeated at-most-once requests dropped (guarded by RequestMu)
+
+	localSessionKey string // Signs session tokens when no cluster secret is configured
+	peerSessionKey  string // The peer's localSessionKey, so its tokens resume here after a takeover (guarded by InventoryMu)
+
+	faults  map[string]Fault // Injected faults by RPC method (guarded by faultMu)
+	faultMu sync.Mutex
+
+	History  *RequestHistory // Bounded history of completed requests
+	Queries  *QueryCache     // Cached replies of history queries; nil caches nothing
+	Posts    *PostTracker    // Trades and latency by post for the fairness report; nil tracks nothing
+	AuditLog *AuditLog       // Optional append-only record of completed requests
+	Journal  *Journal        // Optional durable log of the events the Trader's state derives from
+	Metrics  *metrics.Writer // Optional local metrics snapshots of the Trader's state
+	prom     traderMetrics   // Prometheus metrics; the zero value records nothing
+	MemLimit int             // Approximate memory limit in bytes for admitting new work; 0 disables
+
+	MaxQueue   int // Requests queued or in flight before new ones are refused as Overloaded; 0 for unbounded
+	Overloaded int // Requests refused as Overloaded (guarded by RequestMu)
+
+	Summaries  int // Summary deposits committed (guarded by RequestMu)
+	Summarized int // Deposits Sellers recorded locally and netted into those summaries (guarded by RequestMu)
+
+	Timeouts  common.Timeouts // Deadlines of outgoing RPCs by method, before time scaling
+	TimedOut  int             // Outgoing calls abandoned at their deadline (guarded by timeoutMu)
+	timeoutMu sync.Mutex
+
+	NotifyAttempts int             // Attempts at each notification to a Seller or Buyer before it is given up with an alert (guarded by alertMu)
+	NotifyBackoff  time.Duration   // Wait after the first failed notification attempt, doubling up to 8 times it (guarded by alertMu)
+	Alerts         map[string]int  // Anomalies detected, by kind (guarded by alertMu)
+	unreachable    map[string]bool // Nodes whose lost notification was alerted, until one reaches them again (guarded by alertMu)
+	alertMu        sync.Mutex
+
+	Tracer *tracing.Tracer // Exports OpenTelemetry spans of request handling; nil records none but still passes trace contexts on
+
+	Registry   map[int]*SellerInfo // Registered Sellers by ID (guarded by RegistryMu)
+	RegistryMu sync.Mutex
+	evicted    map[int]*SellerInfo // Sellers evicted while idle, kept so their watermarks still catch duplicates (guarded by RegistryMu)
+
+	SnapshotDir    string         // Directory global snapshot parts are written to
+	recording      *LocalSnapshot // Snapshot whose peer channel is being recorded (guarded by globalSnapMu)
+	lastSnapshotID int64          // Most recent snapshot this Trader took part in (guarded by globalSnapMu)
+	globalSnapMu   sync.Mutex
+
+	marketSubs   map[string]string // Market summary subscribers: address to RPC service (guarded by marketMu)
+	lastMarket   *MarketSummary    // Most recent summary (guarded by marketMu)
+	marketMu     sync.Mutex
+	marketVolume map[string]int // Quantity traded per item this interval (guarded by InventoryMu)
+	marketTrades int            // Trades committed this interval (guarded by InventoryMu)
+
+	sales map[int]map[string]int // Cumulative units sold per Seller and item, rebuilt from the journal (guarded by InventoryMu)
+
+	ResponseMode   string             // How outcomes reach Sellers: responseSync, responsePush, responsePoll or responseStream
+	readyResponses map[int][]Response // Poll-mode outcomes not yet fetched, by Seller ID (guarded by RequestMu)
+
+	Pricing *PricingConfig // Discounts applied when purchases are settled; nil charges list prices
+
+	acceptQueue  chan Request // Accepted push, poll and stream requests waiting for a dispatcher; nil starts one goroutine each
+	AsyncWorkers int          // Dispatchers draining acceptQueue
+
+	streams  map[int]*sellerStream // Response streams by Seller ID (guarded by streamMu)
+	streamMu sync.Mutex
+
+	Warehouse string          // Address of the Warehouse holding the authoritative stock; empty keeps stock local
+	Scheduler *Scheduler      // Periodic jobs such as state sync, checkpoints and spoilage sweeps
+	Cache     *WarehouseCache // Write-back cache of the Warehouse's stock; nil sends every transaction through
+
+	ShelfLife map[string]time.Duration // Time perishable items stay sellable after deposit, by item
+	lots      map[string][]stockLot    // Perishable stock in our inventory by item, oldest first (guarded by InventoryMu)
+	Spoiled   int                      // Quantity removed after its shelf life (guarded by RequestMu)
+
+	SellerRate  float64              // Requests per second each Seller may send; 0 disables rate limiting
+	buckets     map[int]*tokenBucket // Request allowance by Seller ID (guarded by RequestMu)
+	RateLimited int                  // Requests refused by the rate limit (guarded by RequestMu)
+
+	FailoverPolicy  string // How a backup reacts to leader failure: failoverTakeover, failoverStandby or failoverReadOnly
+	failoverPending bool   // Leader failure suspected but takeover held back by the policy (guarded by HeartbeatMu)
+
+	Members     map[int]string // Every Trader of the cluster by ID, including this one; nil leaves leadership to the pair
+	leaderID    int            // Trader leading in the Bully election, as far as we know; 0 if unknown (guarded by HeartbeatMu)
+	electing    bool           // A Bully election is in progress (guarded by HeartbeatMu)
+	postOwners  map[int]int    // Cluster member owning each post, learned from their identities (guarded by HeartbeatMu)
+	coordinated chan struct{}  // Signalled when the winner of an election announces itself
+
+	Pool      map[int]string // Every Trader of the standby pool by ID, including this one; nil for a plain pair
+	PromoteBy string         // How the pool ranks standbys for promotion: promoteByLag or promoteByID
+	Standby   bool           // Started as an extra standby of the Trader at Peer, so it never leads at startup
+	pulling   atomic.Bool    // A state transfer from the peer is running
+	peerMu    sync.Mutex
+
+	server       *rpcserver.Server // Serves the Trader's RPCs; closed by a graceful shutdown
+	shuttingDown atomic.Bool       // A graceful shutdown is running
+	Leaving      bool              // Told the peer it is shutting down; heartbeats are refused (guarded by HeartbeatMu)
+	TLS          *tls.Config       // Serves RPCs over TLS if non-nil; outgoing connections are set up with common.UseTLS
+
+	heartbeatSent     time.Time // Last heartbeat the peer acknowledged (guarded by HeartbeatMu)
+	heartbeatReceived time.Time // Last heartbeat received from the peer (guarded by HeartbeatMu)
+
+	HeartbeatInterval time.Duration // Nominal time between heartbeats to the peer (guarded by HeartbeatMu)
+
+	Gateway     string // Address of the federation gateway offered purchases we cannot fill; empty disables federation
+	ClusterName string // Name of this cluster in the gateway's routing table
+	Federated   int    // Purchases another cluster filled through the gateway (guarded by RequestMu)
+
+	workers *workSlots // Bounds concurrent request processing, serving higher priorities first
+	Expired int        // Requests refused because their deadline passed before they could start (guarded by RequestMu)
+
+	WorkersMin     int           // Lower bound of the autoscaled worker pool
+	WorkersMax     int           // Upper bound of the autoscaled worker pool; 0 for a fixed pool
+	WorkerScalings int           // Times the worker pool was resized (guarded by RequestMu)
+	lastCPU        time.Duration // CPU time at the last autoscaling run (autoscaler only)
+	lastCPUTime    time.Time     // When lastCPU was sampled (autoscaler only)
+	idleRuns       int           // Autoscaling runs in a row that found an idle slot (autoscaler only)
+
+	walAccepted map[RequestKey]bool // Requests journaled as accepted and not finished yet (guarded by RequestMu)
+
+	SyncRequests bool                         // Store each accepted request on the peer before acknowledging it
+	logIndex     int64                        // Last index of our request log (guarded by RequestMu)
+	logged       map[RequestKey]bool          // Our requests stored on the peer and not settled yet (guarded by RequestMu)
+	peerAccepted map[RequestKey]loggedRequest // Requests the peer accepted and has not settled (guarded by InventoryMu)
+	peerLogEpoch int64                        // Epoch of the peer's request log (guarded by InventoryMu)
+
+	leading atomic.Bool // Mirrors IsLeader for the logger, which must not take HeartbeatMu
 }
 
-type Response struct {
-	Status    string
-	Message   string
-	RequestID int
-	Processed bool // Indicates if the request was processed
+// SellerInfo is a Seller's registration with a Trader
+type SellerInfo struct {
+	ID         int
+	Address    string
+	Post       int
+	Generation int64     // Incremented whenever the Seller re-registers from a new address
+	Registered time.Time // Time of the latest registration
+	Watermark  int       // Every request ID up to this one has been committed, or resolved by the Seller
+
+	LeasedThrough int // Highest request ID leased to the Seller
+
+	LastCommit time.Time // Time a request of the Seller was last committed
+
+	committedAbove map[int]bool // Committed request IDs above the watermark
 }
 
-type Request struct {
+// RequestKey identifies a request across Sellers
+type RequestKey struct {
 	SellerID  int
-	Post      int
-	Item      string
-	Quantity  int
-	RequestID int // Unique ID for each request
+	RequestID int
 }
 
-// ForwardRequest forwards the request to the peer Trader
-func (t *Trader) ForwardRequest(req *Request) {
-	client, err := rpc.Dial("tcp", t.Peer)
-	if err != nil {
-		log.Printf("Trader %d: Failed to connect to peer Trader at %s to forward request.", t.ID, t.Peer)
-		return
-	}
-	defer client.Close()
+// maxReadyResponses bounds the poll-mode responses held for a Seller that stopped polling
+const maxReadyResponses = 1000
 
-	var reply string
-	err = client.Call("Trader.ReceiveRequest", req, &reply)
-	if err != nil {
-		log.Printf("Trader %d: Failed to forward request: %v", t.ID, err)
-		return
+// atMostOnceRetention is how long a Trader remembers at-most-once requests it has seen
+const atMostOnceRetention = 10 * time.Minute
+
+// traderHop names a Trader in a request's hop path
+func traderHop(id int) string {
+	return fmt.Sprintf("trader-%d", id)
+}
+
+// formatPath renders a hop path for logs
+func formatPath(path []string) string {
+	if len(path) == 0 {
+		return "(untagged)"
 	}
+	return strings.Join(path, " > ")
+}
 
-	log.Printf("Trader %d: Request forwarded successfully to Trader %s", t.ID, t.Peer)
+// call makes an RPC on client under the method's deadline, so a half-dead node cannot
+// hold the caller forever
+func (t *Trader) call(client *rpc.Client, method string, args, reply interface{}) error {
+	start := time.Now()
+	err := common.CallTimeout(client, method, args, reply, common.Scaled(t.Timeouts.For(method)))
+	t.prom.rpcLatency.ObserveSince(start, method)
+	if errors.Is(err, common.ErrTimeout) {
+		t.prom.rpcTimeouts.Inc(method)
+		t.timeoutMu.Lock()
+		t.TimedOut++
+		t.timeoutMu.Unlock()
+		slog.Warn("RPC call timed out", "method", method, "err", err)
+	}
+	return err
 }
 
-// ReceiveHeartbeat handles heartbeat messages from the peer Trader
-func (t *Trader) ReceiveHeartbeat(req int, reply *string) error {
-	t.HeartbeatMu.Lock()
-	t.Heartbeat = true
-	t.HeartbeatMu.Unlock()
+// processingTime is the simulated time it takes to process one request
+const processingTime = 2 * time.Second
 
-	log.Printf("Trader %d: Received heartbeat from Trader %d", t.ID, req)
-	*reply = "Alive"
+// itemPrices is the unit price of every item the market trades
+var itemPrices = common.ListPrices
+
+// maxRequestQuantity is the largest quantity a single request may move
+const maxRequestQuantity = 1000
+
+// validateRequest checks that a request is well formed and tradeable
+func validateRequest(req *Request) error {
+	if req.Item == "" {
+		return fmt.Errorf("missing item")
+	}
+	if _, ok := itemPrices[req.Item]; !ok {
+		return fmt.Errorf("unknown item %q", req.Item)
+	}
+	if req.Quantity <= 0 {
+		return fmt.Errorf("quantity must be positive, got %d", req.Quantity)
+	}
+	if req.Summarizes < 0 {
+		return fmt.Errorf("invalid summary of %d deposits", req.Summarizes)
+	}
+	if req.Summarizes > 0 && (req.DryRun || req.Delivery == deliveryAtMostOnce) {
+		return fmt.Errorf("a summary deposit cannot be a dry run or at-most-once")
+	}
+	// A summary nets many deposits, each of which was within the limit
+	if limit := maxRequestQuantity * max(req.Summarizes, 1); req.Quantity > limit {
+		return fmt.Errorf("quantity %d exceeds the limit of %d per request", req.Quantity, limit)
+	}
+	if req.Post <= 0 {
+		return fmt.Errorf("invalid post %d", req.Post)
+	}
+	if req.Delivery != "" && req.Delivery != deliveryAtLeastOnce && req.Delivery != deliveryAtMostOnce {
+		return fmt.Errorf("unknown delivery semantics %q", req.Delivery)
+	}
 	return nil
 }
 
-// SendHeartbeat sends heartbeat messages to the peer Trader
-func (t *Trader) SendHeartbeat() {
-	client, err := rpc.Dial("tcp", t.Peer)
-	if err != nil {
-		log.Printf("Trader %d: Failed to connect to peer Trader at %s. Assuming failure.", t.ID, t.Peer)
-		t.TakeOverLeadership()
-		return
-	}
-	defer client.Close()
+// ======= EVENT EXPORT =======
 
-	var reply string
-	err = client.Call("Trader.ReceiveHeartbeat", t.ID, &reply)
-	if err != nil {
-		log.Printf("Trader %d: Failed to send heartbeat: %v", t.ID, err)
-		t.TakeOverLeadership()
-		return
-	}
+// Event is a committed trade or leadership change published to external subscribers
+type Event struct {
+	Type      string    `json:"type"` // "trade", "purchase", "leader", "correction", "spoilage" or "failover-held"
+	TraderID  int       `json:"trader_id"`
+	Time      time.Time `json:"time"`
+	SellerID  int       `json:"seller_id,omitempty"`
+	RequestID int       `json:"request_id,omitempty"`
+	Post      int       `json:"post,omitempty"`
+	Item      string    `json:"item,omitempty"`
+	Quantity  int       `json:"quantity,omitempty"`
+	Leader    string    `json:"leader,omitempty"`
+}
 
-	log.Printf("Trader %d: Heartbeat acknowledged by peer %s", t.ID, t.Peer)
+// EventExporter publishes events to an external pipeline
+type EventExporter interface {
+	Publish(ev Event)
+	Close() error
 }
 
-// StartHeartbeat sends periodic heartbeat messages to the peer Trader
-func (t *Trader) StartHeartbeat() {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+// NATSExporter publishes events as JSON on a NATS subject using the plain-text client protocol
+type NATSExporter struct {
+	Addr     string
+	Subject  string
+	events   chan Event
+	closed   bool // Set by Close; later events are dropped (guarded by eventsMu)
+	eventsMu sync.Mutex
+	conn     net.Conn
+	connMu   sync.Mutex
+}
 
-	for range ticker.C {
-		t.SendHeartbeat()
+// NewExporter builds an exporter from a URL such as nats://localhost:4222
+func NewExporter(url, subject string) (EventExporter, error) {
+	switch {
+	case strings.HasPrefix(url, "nats://"):
+		e := &NATSExporter{
+			Addr:    strings.TrimPrefix(url, "nats://"),
+			Subject: subject,
+			events:  make(chan Event, 1024),
+		}
+		go e.run()
+		return e, nil
+	case strings.HasPrefix(url, "kafka://"):
+		return nil, fmt.Errorf("kafka export requires a Kafka client library, which this build does not include; use nats:// instead")
+	default:
+		return nil, fmt.Errorf("unsupported export URL %q (expected nats://host:port)", url)
 	}
 }
 
-// StartRPCServer starts the Trader's RPC server
-func StartRPCServer(t *Trader) {
-	err := rpc.Register(t)
-	if err != nil {
-		log.Fatalf("Error registering Trader service: %v", err)
+// Publish queues an event without blocking trade processing; events are dropped if the
+// queue is full or the exporter is closed
+func (e *NATSExporter) Publish(ev Event) {
+	e.eventsMu.Lock()
+	defer e.eventsMu.Unlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.events <- ev:
+	default:
+		slog.Warn("Exporter queue full; dropping event", "type", ev.Type)
 	}
+}
 
-	listener, err := net.Listen("tcp", t.Address)
-	if err != nil {
-		log.Fatalf("Error starting RPC server on %s: %v", t.Address, err)
+// Close stops the exporter and closes the NATS connection. Events published afterwards
+// are dropped.
+func (e *NATSExporter) Close() error {
+	e.eventsMu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.events)
 	}
-	defer listener.Close()
+	e.eventsMu.Unlock()
 
-	log.Printf("Trader %d RPC server started at %s", t.ID, t.Address)
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+	if e.conn != nil {
+		return e.conn.Close()
+	}
+	return nil
+}
 
-	for {
-		conn, err := listener.Accept()
+// run drains the event queue, reconnecting to NATS when the connection drops
+func (e *NATSExporter) run() {
+	for ev := range e.events {
+		payload, err := json.Marshal(ev)
 		if err != nil {
-			log.Printf("Error accepting connection: %v", err)
+			slog.Warn("Exporter failed to encode event", "err", err)
 			continue
 		}
-		go rpc.ServeConn(conn)
+		if err := e.publish(payload); err != nil {
+			slog.Warn("Exporter failed to publish to NATS", "addr", e.Addr, "err", err)
+		}
 	}
 }
 
-func main() {
-	id := flag.Int("id", 0, "Trader ID")
-	address := flag.String("address", "", "Trader Address")
-	peer := flag.String("peer", "", "Peer Trader Address")
-	post := flag.Int("post", 0, "Post ID")
-	flag.Parse()
+// publish writes a single PUB frame, dialing NATS first if needed
+func (e *NATSExporter) publish(payload []byte) error {
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
 
-	if *id == 0 || *address == "" || *peer == "" || *post == 0 {
-		log.Fatal("Usage: trader -id=<id> -address=<address> -peer=<peer> -post=<post>")
+	if e.conn == nil {
+		conn, err := net.DialTimeout("tcp", e.Addr, common.Scaled(2*time.Second))
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"a4-trader\"}\r\n"); err != nil {
+			conn.Close()
+			return err
+		}
+		e.conn = conn
+		go e.answerPings(conn)
 	}
 
-	trader := &Trader{
-		ID:       *id,
-		Address:  *address,
-		Peer:     *peer,
-		Post:     *post,
-		IsLeader: *id == 1, // Assume Trader 1 starts as the leader
+	_, err := fmt.Fprintf(e.conn, "PUB %s %d\r\n%s\r\n", e.Subject, len(payload), payload)
+	if err != nil {
+		e.conn.Close()
+		e.conn = nil
 	}
+	return err
+}
 
-	go StartRPCServer(trader)
-	go trader.StartHeartbeat()
+// answerPings replies to server PINGs so NATS keeps the connection open
+func (e *NATSExporter) answerPings(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			e.connMu.Lock()
+			fmt.Fprintf(conn, "PONG\r\n")
+			e.connMu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			slog.Warn("Exporter got a NATS error", "line", line)
+		}
+	}
+}
 
-	select {} // Keep the process running
+// exportEvent publishes an event if an exporter is configured
+func (t *Trader) exportEvent(ev Event) {
+	if t.Exporter == nil {
+		return
+	}
+	ev.TraderID = t.ID
+	ev.Time = time.Now()
+	t.Exporter.Publish(ev)
 }
 
-// SendResponse sends a response back to the Seller
-func (t *Trader) SendResponse(sellerAddr string, res *Response) {
-	client, err := rpc.Dial("tcp", sellerAddr)
+// ======= HEARTBEAT HISTORY =======
+
+// HeartbeatRecord describes a single heartbeat attempt to the peer
+type HeartbeatRecord struct {
+	Time    time.Time
+	RTT     time.Duration
+	Outcome string // "ok", "dial-failed", "impostor" or "call-failed"
+	Err     string
+}
+
+// HeartbeatHistory is a fixed-size ring buffer of the most recent heartbeat attempts
+type HeartbeatHistory struct {
+	mu      sync.Mutex
+	records []HeartbeatRecord
+	next    int
+	full    bool
+}
+
+// NewHeartbeatHistory creates a history holding the last size attempts
+func NewHeartbeatHistory(size int) *HeartbeatHistory {
+	if size < 1 {
+		size = 1
+	}
+	return &HeartbeatHistory{records: make([]HeartbeatRecord, size)}
+}
+
+// Add records an attempt, overwriting the oldest one when the buffer is full
+func (h *HeartbeatHistory) Add(rec HeartbeatRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records[h.next] = rec
+	h.next = (h.next + 1) % len(h.records)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Snapshot returns the recorded attempts from oldest to newest
+func (h *HeartbeatHistory) Snapshot() []HeartbeatRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.full {
+		return append([]HeartbeatRecord(nil), h.records[:h.next]...)
+	}
+	return append(append([]HeartbeatRecord(nil), h.records[h.next:]...), h.records[:h.next]...)
+}
+
+// dumpHeartbeatHistory logs the recent heartbeat attempts as a failover post-mortem
+func (t *Trader) dumpHeartbeatHistory() {
+	records := t.HBHistory.Snapshot()
+	slog.Info("Heartbeat post-mortem", "attempts", len(records))
+	for _, rec := range records {
+		if rec.Err != "" {
+			slog.Info("Heartbeat attempt", "time", rec.Time.Format("15:04:05.000"), "outcome", rec.Outcome, "rtt", rec.RTT, "err", rec.Err)
+		} else {
+			slog.Info("Heartbeat attempt", "time", rec.Time.Format("15:04:05.000"), "outcome", rec.Outcome, "rtt", rec.RTT)
+		}
+	}
+}
+
+// ======= ROLE TRANSITIONS =======
+
+// Causes of role transitions
+const (
+	causePeerUnreachable  = "peer-unreachable"  // The peer never answered at startup
+	causePeerLeads        = "peer-leads"        // The peer already led at startup
+	causeElectionWon      = "election-won"      // Won the startup negotiation or a Bully election
+	causeElectionLost     = "election-lost"     // Another Trader won the election
+	causeHeartbeatTimeout = "heartbeat-timeout" // The failure detector suspected the leader
+	causeAdminFailover    = "admin-failover"    // An operator approved a held-back failover
+	causeHigherTerm       = "higher-term"       // Another Trader leads in a newer term
+	causeDualLeaders      = "dual-leaders"      // Both Traders led after a partition; the higher ID yields
+	causeAdminDrain       = "admin-drain"       // An operator turned drain mode on or off
+	causeShutdown         = "shutdown"          // A graceful shutdown drained and stopped the Trader
+	causeStandbyPromoted  = "standby-promoted"  // Ranked first of the standby pool when the leader failed
+	causePeerShutdown     = "peer-shutdown"     // The peer announced a graceful shutdown
+)
+
+// Transition is one change of a Trader's role: "starting", "leader", "backup", "draining"
+// or "stopped". A draining Trader keeps its leadership but refuses new requests.
+type Transition struct {
+	At     time.Time `json:"at"`
+	Trader int       `json:"trader"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Cause  string    `json:"cause"`
+	Term   int64     `json:"term"`
+	Leader bool      `json:"leader"` // Whether the Trader leads after the transition
+}
+
+// TransitionLog tracks a Trader's role and appends every change to a file as JSON lines,
+// for timeline/timeline.go to render. A nil TransitionLog records nothing.
+type TransitionLog struct {
+	trader int
+
+	mu       sync.Mutex
+	role     string // Current role (guarded by mu)
+	leader   bool   // (guarded by mu)
+	draining bool   // (guarded by mu)
+	f        *os.File
+	enc      *json.Encoder
+}
+
+// NewTransitionLog creates the log of a Trader, appending to path unless it is empty
+func NewTransitionLog(trader int, path string) (*TransitionLog, error) {
+	l := &TransitionLog{trader: trader, role: "starting"}
+	if path == "" {
+		return l, nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
 	if err != nil {
-		log.Printf("Trader %d: Failed to connect to Seller at %s: %v", t.ID, sellerAddr, err)
+		return nil, err
+	}
+	l.f, l.enc = f, json.NewEncoder(f)
+	return l, nil
+}
+
+// Leader records that the Trader leads or follows, for cause
+func (l *TransitionLog) Leader(leader bool, cause string, term int64) {
+	if l == nil {
 		return
 	}
-	defer client.Close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.leader = leader
+	l.recordLocked(cause, term)
+}
 
-	var reply string
-	err = client.Call("Seller.ReceiveResponse", res, &reply)
-	if err != nil {
-		log.Printf("Trader %d: Failed to send response to Seller at %s: %v", t.ID, sellerAddr, err)
+// Drain records that drain mode was turned on or off, for cause
+func (l *TransitionLog) Drain(draining bool, cause string, term int64) {
+	if l == nil {
 		return
 	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.draining = draining
+	l.recordLocked(cause, term)
+}
 
-	log.Printf("Trader %d: Response sent to Seller at %s", t.ID, sellerAddr)
+// Stop records that the Trader stopped and closes the file
+func (l *TransitionLog) Stop(cause string, term int64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.appendLocked("stopped", cause, term)
+	if l.f != nil {
+		if err := l.f.Close(); err != nil {
+			slog.Warn("Failed to close transitions log", "err", err)
+		}
+		l.f, l.enc = nil, nil
+	}
 }
 
-// NotifySellers informs all Sellers to communicate with the new leader
-func (t *Trader) NotifySellers(newLeaderAddr string) {
-	// Simulate a list of seller addresses (in a real system, this would be dynamically populated)
-	sellerAddresses := []string{"localhost:8003", "localhost:8004"} // Add all known Seller addresses here
+// Role returns the current role, or "" for a nil log
+func (l *TransitionLog) Role() string {
+	if l == nil {
+		return ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.role
+}
 
-	for _, sellerAddr := range sellerAddresses {
-		client, err := rpc.Dial("tcp", sellerAddr)
-		if err != nil {
-			log.Printf("Trader %d: Failed to notify Seller at %s: %v", t.ID, sellerAddr, err)
-			continue
-		}
-		defer client.Close()
+// recordLocked appends a transition if the leadership and drain flags give a new role;
+// l.mu must be held
+func (l *TransitionLog) recordLocked(cause string, term int64) {
+	role := "backup"
+	switch {
+	case l.draining:
+		role = "draining"
+	case l.leader:
+		role = "leader"
+	}
+	if role != l.role {
+		l.appendLocked(role, cause, term)
+	}
+}
 
-		var reply string
-		err = client.Call("Seller.UpdateLeader", newLeaderAddr, &reply)
-		if err != nil {
-			log.Printf("Trader %d: Failed to notify Seller at %s: %v", t.ID, sellerAddr, err)
-			continue
+// appendLocked moves to role and writes the transition; l.mu must be held
+func (l *TransitionLog) appendLocked(role, cause string, term int64) {
+	tr := Transition{At: time.Now(), Trader: l.trader, From: l.role, To: role, Cause: cause, Term: term, Leader: l.leader}
+	l.role = role
+	slog.Info("Role changed", "from", tr.From, "to", tr.To, "cause", cause, "term", term)
+	if l.enc == nil {
+		return
+	}
+	if err := l.enc.Encode(tr); err != nil {
+		slog.Warn("Failed to append role transition", "err", err)
+	}
+}
+
+// ======= FAILURE DETECTION =======
+
+// defaultHeartbeatInterval is the nominal time between heartbeats to the peer unless
+// -heartbeat-interval sets another
+const defaultHeartbeatInterval = 5 * time.Second
+
+// heartbeatInterval returns the nominal time between heartbeats to the peer
+func (t *Trader) heartbeatInterval() time.Duration {
+	t.HeartbeatMu.Lock()
+	defer t.HeartbeatMu.Unlock()
+	return t.HeartbeatInterval
+}
+
+// FailureDetector decides, from the outcome of heartbeats, whether the peer has failed.
+// Heartbeat and Miss are called from the heartbeat loop only.
+type FailureDetector interface {
+	Name() string
+	Heartbeat(at time.Time) // The peer answered a heartbeat sent at this time
+	Miss(at time.Time)      // A heartbeat sent at this time failed
+	// Suspicion reports the detector's current suspicion level (in its own unit) and
+	// whether the peer is suspected to have failed
+	Suspicion(now time.Time) (level float64, suspect bool)
+}
+
+// DetectorConfig selects and parameterises a failure detector
+type DetectorConfig struct {
+	Kind     string        // "counter", "fixed-timeout" or "phi-accrual"
+	Interval time.Duration // Wall-clock heartbeat interval
+	Misses   int           // counter: consecutive failed heartbeats before suspecting
+	Timeout  time.Duration // fixed-timeout: wall-clock time without an answer before suspecting
+	Phi      float64       // phi-accrual: suspicion threshold
+}
+
+// NewFailureDetector builds the detector named by cfg.Kind
+func NewFailureDetector(cfg DetectorConfig) (FailureDetector, error) {
+	switch cfg.Kind {
+	case "counter":
+		if cfg.Misses < 1 {
+			return nil, fmt.Errorf("counter detector needs at least 1 miss, got %d", cfg.Misses)
+		}
+		return &counterDetector{threshold: cfg.Misses}, nil
+	case "fixed-timeout":
+		if cfg.Timeout <= 0 {
+			return nil, fmt.Errorf("fixed-timeout detector needs a positive timeout, got %v", cfg.Timeout)
 		}
+		return &timeoutDetector{timeout: cfg.Timeout, last: time.Now()}, nil
+	case "phi-accrual":
+		if cfg.Phi <= 0 {
+			return nil, fmt.Errorf("phi-accrual detector needs a positive threshold, got %v", cfg.Phi)
+		}
+		return newPhiAccrualDetector(cfg.Phi, cfg.Interval), nil
+	default:
+		return nil, fmt.Errorf("unknown failure detector %q (expected counter, fixed-timeout or phi-accrual)", cfg.Kind)
+	}
+}
+
+// counterDetector suspects the peer after a number of consecutive failed heartbeats
+type counterDetector struct {
+	threshold int
+	misses    int
+}
+
+func (d *counterDetector) Name() string           { return "counter" }
+func (d *counterDetector) Heartbeat(at time.Time) { d.misses = 0 }
+func (d *counterDetector) Miss(at time.Time)      { d.misses++ }
+
+func (d *counterDetector) Suspicion(now time.Time) (float64, bool) {
+	return float64(d.misses), d.misses >= d.threshold
+}
+
+// timeoutDetector suspects the peer once it has not answered for a fixed time
+type timeoutDetector struct {
+	timeout time.Duration
+	last    time.Time // Last answered heartbeat (or start-up)
+}
+
+func (d *timeoutDetector) Name() string           { return "fixed-timeout" }
+func (d *timeoutDetector) Heartbeat(at time.Time) { d.last = at }
+func (d *timeoutDetector) Miss(at time.Time)      {}
+
+func (d *timeoutDetector) Suspicion(now time.Time) (float64, bool) {
+	silent := now.Sub(d.last)
+	return silent.Seconds(), silent > d.timeout
+}
+
+// phiAccrualDetectorWindow is the number of heartbeat inter-arrival times remembered
+const phiAccrualDetectorWindow = 100
 
-		log.Printf("Trader %d: Notified Seller at %s about new leader %s", t.ID, sellerAddr, newLeaderAddr)
+// phiAccrualDetector implements the phi accrual detector (Hayashibara et al.): phi is
+// -log10 of the probability that an answer arrives later than now, given the observed
+// distribution of inter-arrival times, so its threshold adapts to the network's jitter
+type phiAccrualDetector struct {
+	threshold float64
+	minStdDev float64   // Seconds; keeps perfectly regular heartbeats from looking infinitely certain
+	intervals []float64 // Recent inter-arrival times in seconds
+	last      time.Time
+}
+
+// newPhiAccrualDetector seeds the history with the expected heartbeat interval
+func newPhiAccrualDetector(threshold float64, interval time.Duration) *phiAccrualDetector {
+	return &phiAccrualDetector{
+		threshold: threshold,
+		minStdDev: interval.Seconds() / 10,
+		intervals: []float64{interval.Seconds()},
+		last:      time.Now(),
 	}
 }
 
-// TakeOverLeadership promotes the Trader as the leader for all posts and informs Sellers
-func (t *Trader) TakeOverLeadership() {
-	t.IsLeader = true
-	log.Printf("Trader %d: Taking over all posts as the sole leader.", t.ID)
+func (d *phiAccrualDetector) Name() string      { return "phi-accrual" }
+func (d *phiAccrualDetector) Miss(at time.Time) {}
 
-	// Notify Sellers about the new leader
-	t.NotifySellers(t.Address)
+func (d *phiAccrualDetector) Heartbeat(at time.Time) {
+	d.intervals = append(d.intervals, at.Sub(d.last).Seconds())
+	if len(d.intervals) > phiAccrualDetectorWindow {
+		d.intervals = d.intervals[1:]
+	}
+	d.last = at
 }
 
-// ReceiveRequest handles requests from Sellers
-func (t *Trader) ReceiveRequest(req *Request, res *Response) error {
-	log.Printf("Trader %d: Received request %d from Seller %d for %d %s in Post %d",
-		t.ID, req.RequestID, req.SellerID, req.Quantity, req.Item, req.Post)
+func (d *phiAccrualDetector) Suspicion(now time.Time) (float64, bool) {
+	var mean, variance float64
+	for _, iv := range d.intervals {
+		mean += iv
+	}
+	mean /= float64(len(d.intervals))
+	for _, iv := range d.intervals {
+		variance += (iv - mean) * (iv - mean)
+	}
+	stdDev := math.Max(math.Sqrt(variance/float64(len(d.intervals))), d.minStdDev)
 
-	// Simulate request processing
-	time.Sleep(2 * time.Second)
+	// Probability that the next answer arrives later than now under a normal distribution
+	y := (now.Sub(d.last).Seconds() - mean) / stdDev
+	pLater := 0.5 * math.Erfc(y/math.Sqrt2)
+	phi := -math.Log10(pLater)
+	return phi, phi >= d.threshold
+}
 
-	res.RequestID = req.RequestID
-	res.Status = "Success"
-	res.Message = fmt.Sprintf("Processed request %d: %d %s from Seller %d", req.RequestID, req.Quantity, req.Item, req.SellerID)
-	res.Processed = true
+// ======= FAILOVER POLICY =======
+
+// How a backup reacts when its failure detector suspects the leader
+const (
+	failoverTakeover = "takeover"  // Take over every post at once
+	failoverStandby  = "standby"   // Wait for an operator to approve the takeover
+	failoverReadOnly = "read-only" // Serve read-only requests until the peer returns
+)
+
+// peerFailed reacts to a suspected peer failure. A leader, or a backup with the takeover
+// policy, takes over; otherwise the backup holds back until an operator approves the
+// takeover or the peer answers again. With the Bully election, the survivor only takes
+// over the peer's post; in a standby pool, the standbys are ranked for the takeover.
+func (t *Trader) peerFailed(cause string) {
+	if t.bully() {
+		// Leadership follows the election; only the peer's post is ours to take over
+		t.setPeerUp(false)
+		t.adoptPeer()
+		return
+	}
+
+	t.HeartbeatMu.Lock()
+	holdBack := !t.IsLeader && (t.FailoverPolicy == failoverStandby || t.FailoverPolicy == failoverReadOnly)
+	wasPending := t.failoverPending
+	if holdBack {
+		t.failoverPending = true
+	}
+	t.HeartbeatMu.Unlock()
+
+	if !holdBack && t.pooled() {
+		t.failoverInPool()
+		return
+	}
+	if !holdBack {
+		t.TakeOverLeadership(cause)
+		return
+	}
+	t.setPeerUp(false)
+	if !wasPending {
+		slog.Warn("Leader failure suspected; not taking over", "failover", t.FailoverPolicy)
+		t.exportEvent(Event{Type: "failover-held", Leader: t.peerAddr()})
+	}
+}
+
+// peerRecovered ends a held-back failover once the peer answers again
+func (t *Trader) peerRecovered() {
+	t.HeartbeatMu.Lock()
+	wasPending := t.failoverPending
+	t.failoverPending = false
+	t.HeartbeatMu.Unlock()
+	if wasPending {
+		slog.Info("Peer answers again; leaving failover mode", "failover", t.FailoverPolicy)
+	}
+}
+
+// failoverRefusal returns the status and message for a request refused while a failover
+// is held back, or an empty status if the request may be served
+func (t *Trader) failoverRefusal(readOnly bool) (string, string) {
+	t.HeartbeatMu.Lock()
+	pending := t.failoverPending
+	t.HeartbeatMu.Unlock()
+	switch {
+	case !pending:
+		return "", ""
+	case t.FailoverPolicy == failoverStandby:
+		return "Standby", fmt.Sprintf("Trader %d is on standby until an operator approves the takeover from its failed peer", t.ID)
+	case !readOnly:
+		return "ReadOnly", fmt.Sprintf("Trader %d serves only read-only requests until its peer returns", t.ID)
+	}
+	return "", ""
+}
+
+// ApproveFailover lets an operator complete a failover held back by the standby or
+// read-only policy
+func (t *Trader) ApproveFailover(args *AdminArgs, reply *string) error {
+	if err := t.checkAdmin(args); err != nil {
+		return err
+	}
+
+	t.HeartbeatMu.Lock()
+	pending := t.failoverPending
+	t.failoverPending = false
+	t.HeartbeatMu.Unlock()
+	if !pending {
+		*reply = fmt.Sprintf("Trader %d has no failover awaiting approval", t.ID)
+		return nil
+	}
+
+	slog.Info("Failover approved by admin")
+	t.TakeOverLeadership(causeAdminFailover)
+	*reply = fmt.Sprintf("Trader %d took over", t.ID)
 	return nil
 }
+
+// ======= STATE TRANSFER =======
+
+// InventoryEntry is the stock of one item
+type InventoryEntry struct {
+	Item     string
+	Quantity int
+}
+
+// ChunkArgs asks for one chunk of a state snapshot
+type ChunkArgs struct {
+	SnapshotID int64 // 0 starts a new snapshot
+	Seq        int   // Sequence number of the requested chunk
+	Size       int   // Maximum entries per chunk
+}
+
+// StateChunk is one numbered piece of a state snapshot
+type StateChunk struct {
+	SnapshotID int64
+	Seq        int
+	Total      int // Total number of entries in the snapshot
+	Entries    []InventoryEntry
+	Done       bool // Set on the last chunk
+}
+
+// stateSnapshot is a frozen copy of the inventory kept so an interrupted transfer can resume
+type stateSnapshot struct {
+	entries []InventoryEntry
+	created time.Time
+}
+
+// snapshotTTL is how long a snapshot stays available for resuming a transfer
+const snapshotTTL = time.Minute
+
+// FetchStateChunk serves one chunk of an inventory snapshot. Requesting an unknown or
+// expired snapshot starts a new one from sequence 0.
+func (t *Trader) FetchStateChunk(args *ChunkArgs, reply *StateChunk) error {
+	if err := t.injectFault("FetchStateChunk"); err != nil {
+		return err
+	}
+	size := args.Size
+	if size <= 0 {
+		size = 100
+	}
+
+	t.snapshotMu.Lock()
+	defer t.snapshotMu.Unlock()
+
+	for id, snap := range t.snapshots {
+		if time.Since(snap.created) > common.Scaled(snapshotTTL) {
+			delete(t.snapshots, id)
+		}
+	}
+
+	id, seq := args.SnapshotID, args.Seq
+	snap, ok := t.snapshots[id]
+	if !ok {
+		id, seq = time.Now().UnixNano(), 0
+		snap = &stateSnapshot{created: time.Now()}
+		t.InventoryMu.Lock()
+		for item, qty := range t.Inventory {
+			snap.entries = append(snap.entries, InventoryEntry{Item: item, Quantity: qty})
+		}
+		t.InventoryMu.Unlock()
+		sort.Slice(snap.entries, func(i, j int) bool { return snap.entries[i].Item < snap.entries[j].Item })
+		t.snapshots[id] = snap
+	}
+
+	start := seq * size
+	if start > len(snap.entries) {
+		return fmt.Errorf("chunk %d is past the end of snapshot %d", seq, id)
+	}
+	end := start + size
+	if end > len(snap.entries) {
+		end = len(snap.entries)
+	}
+
+	*reply = StateChunk{
+		SnapshotID: id,
+		Seq:        seq,
+		Total:      len(snap.entries),
+		Entries:    snap.entries[start:end],
+		Done:       end == len(snap.entries),
+	}
+	if reply.Done {
+		delete(t.snapshots, id)
+	}
+	return nil
+}
+
+// PullPeerState transfers the peer's inventory chunk by chunk, resuming from the last
+// received chunk when the connection drops
+func (t *Trader) PullPeerState(maxResumes int) error {
+	var (
+		snapshotID int64
+		seq        int
+		entries    []InventoryEntry
+		lastErr    error
+	)
+
+	for resumes := 0; resumes <= maxResumes; resumes++ {
+		if resumes > 0 {
+			slog.Warn("State transfer interrupted; resuming", "snapshot", snapshotID, "chunk", seq, "err", lastErr)
+			time.Sleep(common.Scaled(time.Second))
+		}
+
+		client, err := t.dialPeer()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		for {
+			var chunk StateChunk
+			err = t.call(client, "Trader.FetchStateChunk", &ChunkArgs{SnapshotID: snapshotID, Seq: seq, Size: t.ChunkSize}, &chunk)
+			if err != nil {
+				lastErr = err
+				break
+			}
+			if chunk.SnapshotID != snapshotID || chunk.Seq != seq {
+				// The peer started a fresh snapshot (ours expired), so start over
+				entries = nil
+			}
+			snapshotID = chunk.SnapshotID
+			entries = append(entries, chunk.Entries...)
+			seq = chunk.Seq + 1
+
+			if chunk.Done {
+				client.Close()
+				t.installPeerState(entries)
+				return nil
+			}
+		}
+		client.Close()
+	}
+	return fmt.Errorf("state transfer failed after %d resumes: %v", maxResumes, lastErr)
+}
+
+// installPeerState stores a completed transfer as the replica of the peer's inventory
+func (t *Trader) installPeerState(entries []InventoryEntry) {
+	replica := make(map[string]int, len(entries))
+	for _, e := range entries {
+		replica[e.Item] = e.Quantity
+	}
+
+	t.InventoryMu.Lock()
+	t.PeerInventory = replica
+	t.InventoryMu.Unlock()
+
+	slog.Info("Pulled inventory from peer", "entries", len(entries))
+}
+
+// ======= EVENT SOURCING =======
+
+// Stock buckets a StateEvent changes
+const (
+	bucketInventory = "inventory" // Stock for our own post
+	bucketHandback  = "handback"  // Deposits accepted for the peer's post
+	bucketAdopted   = "adopted"   // Peer stock adopted at takeover
+)
+
+// StateEvent is one change to the Trader's state. The Trader's stock is the result of
+// applying its events in order, so the journal, the replication stream and recovery all
+// read from the same record.
+type StateEvent struct {
+	Seq       int64          `json:"seq"`
+	Time      time.Time      `json:"time"`
+	Kind      string         `json:"kind"` // deposit, purchase, correction, spoil, cancel, handback-in, handback-out, adopt, return, leader, accept or finish
+	Bucket    string         `json:"bucket,omitempty"`
+	Item      string         `json:"item,omitempty"`
+	Quantity  int            `json:"quantity,omitempty"` // Signed change to Bucket
+	Stock     map[string]int `json:"stock,omitempty"`    // Whole adopted inventory (adopt only)
+	Post      int            `json:"post,omitempty"`
+	SellerID  int            `json:"seller_id,omitempty"`
+	BuyerID   int            `json:"buyer_id,omitempty"`
+	RequestID int            `json:"request_id,omitempty"`
+	Price     float64        `json:"price,omitempty"`
+	Rule      string         `json:"rule,omitempty"` // Pricing rule applied (purchase only)
+	Leader    string         `json:"leader,omitempty"`
+	Term      int64          `json:"term,omitempty"`
+	Request   *Request       `json:"request,omitempty"` // Request accepted for processing (accept only)
+}
+
+// Journal is the append-only, ordered log of StateEvents. Each record is one line,
+// "<crc32c in hex> <event as JSON>", so torn and corrupted records are detected on reading.
+type Journal struct {
+	mu   sync.Mutex
+	f    *os.File
+	seq  int64
+	size int64 // Length of the journal up to its last complete record
+}
+
+// journalCRC is the checksum table of journal records
+var journalCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// JournalCorruptError reports a journal record that fails its checksum or cannot be parsed
+type JournalCorruptError struct {
+	Path   string
+	Line   int
+	Offset int64 // Byte offset of the bad record
+	Err    error
+}
+
+func (e *JournalCorruptError) Error() string {
+	return fmt.Sprintf("journal %s is corrupt at line %d (offset %d): %v", e.Path, e.Line, e.Offset, e.Err)
+}
+
+// encodeRecord frames an event as a checksummed journal line
+func encodeRecord(ev *StateEvent) ([]byte, error) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.Checksum(data, journalCRC), data)), nil
+}
+
+// decodeRecord checks and parses one journal line without its newline. Lines starting
+// with "{" were written before records were checksummed and are parsed as they are.
+func decodeRecord(line []byte) (StateEvent, error) {
+	var ev StateEvent
+	data := line
+	if !bytes.HasPrefix(line, []byte("{")) {
+		sum, rest, ok := bytes.Cut(line, []byte(" "))
+		if !ok || len(sum) != 8 {
+			return ev, errors.New("missing checksum")
+		}
+		want, err := strconv.ParseUint(string(sum), 16, 32)
+		if err != nil {
+			return ev, fmt.Errorf("bad checksum %q", sum)
+		}
+		if got := crc32.Checksum(rest, journalCRC); got != uint32(want) {
+			return ev, fmt.Errorf("checksum mismatch: record has %08x, content has %08x", want, got)
+		}
+		data = rest
+	}
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return ev, err
+	}
+	return ev, nil
+}
+
+// OpenJournal opens (or creates) a journal for appending and returns the events written by
+// an earlier run. A record cut short by a crash or a full disk is truncated away. A
+// record that fails its checksum, cannot be parsed or breaks the sequence is refused,
+// unless forceRecover is set: then the journal is truncated there, dropping it and
+// every record after it.
+func OpenJournal(path string, forceRecover bool) (*Journal, []StateEvent, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	var events []StateEvent
+	offset, line := 0, 0
+	for offset < len(data) {
+		line++
+		n := bytes.IndexByte(data[offset:], '\n')
+		if n < 0 {
+			slog.Warn("Truncating torn last record of journal", "path", path, "line", line, "bytes", len(data)-offset)
+			break
+		}
+		rec := data[offset : offset+n]
+		if len(bytes.TrimSpace(rec)) == 0 {
+			offset += n + 1
+			continue
+		}
+		ev, err := decodeRecord(rec)
+		if err == nil && len(events) > 0 && ev.Seq != events[len(events)-1].Seq+1 {
+			err = fmt.Errorf("event %d follows event %d", ev.Seq, events[len(events)-1].Seq)
+		}
+		if err != nil {
+			corrupt := &JournalCorruptError{Path: path, Line: line, Offset: int64(offset), Err: err}
+			if !forceRecover {
+				return nil, nil, corrupt
+			}
+			slog.Warn("Truncating corrupt journal (-force-recover)", "err", corrupt, "bytes", len(data)-offset)
+			break
+		}
+		events = append(events, ev)
+		offset += n + 1
+	}
+	if offset < len(data) {
+		if err := os.Truncate(path, int64(offset)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	j := &Journal{f: f, size: int64(offset)}
+	if len(events) > 0 {
+		j.seq = events[len(events)-1].Seq
+	}
+	return j, events, nil
+}
+
+// Append numbers the event and writes it, synced to disk before returning. A record
+// that could not be written whole, e.g. because the disk is full, is cut off again so
+// the next one does not follow a torn record.
+func (j *Journal) Append(ev *StateEvent) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	ev.Seq = j.seq + 1
+	rec, err := encodeRecord(ev)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(rec); err != nil {
+		j.rollback()
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		j.rollback()
+		return err
+	}
+	j.seq++
+	j.size += int64(len(rec))
+	return nil
+}
+
+// rollback truncates the journal to its last complete record
+func (j *Journal) rollback() {
+	if err := j.f.Truncate(j.size); err != nil {
+		slog.Warn("Failed to cut a partly written record off the journal", "err", err)
+	}
+}
+
+// Close syncs and closes the journal
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.f.Sync(); err != nil {
+		j.f.Close()
+		return err
+	}
+	return j.f.Close()
+}
+
+// record journals an event that does not change stock
+func (t *Trader) record(ev StateEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if t.Journal == nil {
+		return
+	}
+	if err := t.Journal.Append(&ev); err != nil {
+		slog.Warn("Failed to journal event", "kind", ev.Kind, "err", err)
+	}
+}
+
+// leaderChanged exports and journals that the Trader at addr leads in term
+func (t *Trader) leaderChanged(addr string, term int64) {
+	t.exportEvent(Event{Type: "leader", Leader: addr})
+	t.record(StateEvent{Kind: "leader", Leader: addr, Term: term})
+}
+
+// applyLocked applies a stock event, journals it and, for our own post's inventory, queues
+// it for the peer. It is the only way stock changes. InventoryMu must be held, so events
+// reach the journal and the peer in the order they were applied.
+func (t *Trader) applyLocked(ev StateEvent) {
+	ev.Time = time.Now()
+	t.mutateLocked(ev)
+	t.record(ev)
+	if ev.Bucket == bucketInventory && ev.Quantity != 0 && t.Replicator != nil {
+		t.Replicator.AppendEvent(ev)
+	}
+}
+
+// mutateLocked changes the stock as the event describes; InventoryMu must be held
+func (t *Trader) mutateLocked(ev StateEvent) {
+	switch ev.Kind {
+	case "adopt":
+		t.Adopted = make(map[string]int, len(ev.Stock))
+		for item, qty := range ev.Stock {
+			t.Adopted[item] = qty
+		}
+		return
+	case "return":
+		t.Adopted = nil
+		return
+	case "deposit", "correction":
+		t.noteSaleLocked(ev.SellerID, ev.Item, ev.Quantity)
+	}
+
+	var held map[string]int
+	switch ev.Bucket {
+	case bucketInventory:
+		held = t.Inventory
+	case bucketHandback:
+		held = t.Handback
+	case bucketAdopted:
+		if t.Adopted == nil {
+			t.Adopted = make(map[string]int)
+		}
+		held = t.Adopted
+	default:
+		return
+	}
+	held[ev.Item] += ev.Quantity
+	if held[ev.Item] == 0 {
+		delete(held, ev.Item)
+	}
+	// With a Warehouse the local stock is only a tally; the Warehouse holds the real one
+	if held[ev.Item] < 0 && t.Warehouse == "" {
+		t.alert(alertNegativeInventory, "Stock fell below zero", "bucket", ev.Bucket, "item", ev.Item, "stock", held[ev.Item],
+			"event", ev.Kind, "seller", ev.SellerID, "buyer", ev.BuyerID, "request", ev.RequestID)
+	}
+	t.trackLotsLocked(ev)
+}
+
+// journalAccepted journals a request before it is acknowledged or processed, so a
+// restarted Trader finishes it even if its Seller never resubmits it
+func (t *Trader) journalAccepted(req *Request) {
+	if t.Journal == nil || req.DryRun {
+		return
+	}
+	key := RequestKey{req.SellerID, req.RequestID}
+
+	t.RequestMu.Lock()
+	if t.walAccepted[key] {
+		t.RequestMu.Unlock()
+		return
+	}
+	t.walAccepted[key] = true
+	t.RequestMu.Unlock()
+
+	accepted := *req
+	t.record(StateEvent{Kind: "accept", Post: req.Post, SellerID: req.SellerID, RequestID: req.RequestID, Request: &accepted})
+}
+
+// journalFinished journals that an accepted request finished, whatever its outcome.
+// Requests that were never journaled are ignored.
+func (t *Trader) journalFinished(req *Request) {
+	key := RequestKey{req.SellerID, req.RequestID}
+
+	t.RequestMu.Lock()
+	accepted := t.walAccepted[key]
+	delete(t.walAccepted, key)
+	t.RequestMu.Unlock()
+	if accepted {
+		t.record(StateEvent{Kind: "finish", Post: req.Post, SellerID: req.SellerID, RequestID: req.RequestID})
+	}
+}
+
+// finishJournaled processes, in journal order, the requests an earlier run accepted but
+// never finished. Their paths show the "journal" hop. Those that commit are answered
+// from the dedup table when their Seller resubmits them, even before it registers again.
+func (t *Trader) finishJournaled(reqs []Request) {
+	slog.Info("Finishing requests accepted before the restart", "count", len(reqs))
+	for _, req := range reqs {
+		if n := len(req.Path); n > 0 && req.Path[n-1] == traderHop(t.ID) {
+			req.Path = req.Path[:n-1]
+		}
+		req.Path = append(req.Path, "journal")
+
+		var res Response
+		if err := t.handleRequest(&req, &res); err != nil {
+			slog.Warn("Failed to finish journaled request", "request", req.RequestID, "seller", req.SellerID, "err", err)
+			continue
+		}
+		slog.Info("Finished journaled request", "request", req.RequestID, "seller", req.SellerID, "status", res.Status)
+	}
+}
+
+// rebuild restores the state a journal describes by replaying its events in order, and
+// returns the requests that were accepted but never finished, in the order accepted. It
+// runs at startup, before the Trader serves anything.
+func (t *Trader) rebuild(events []StateEvent) []Request {
+	deposits := make(map[RequestKey]int)
+	accepted := make(map[RequestKey]StateEvent)
+	now := time.Now()
+
+	t.InventoryMu.Lock()
+	for _, ev := range events {
+		t.mutateLocked(ev)
+		switch ev.Kind {
+		case "deposit":
+			t.Processed++
+			deposits[RequestKey{ev.SellerID, ev.RequestID}] = ev.Quantity
+			if ev.SellerID != 0 && now.Sub(ev.Time) <= depositRetention {
+				res := Response{
+					Status:    "Success",
+					Message:   depositMessage(ev.RequestID, ev.Quantity, ev.Item, ev.SellerID),
+					RequestID: ev.RequestID,
+					Processed: true,
+					TraderID:  t.ID,
+				}
+				t.rememberDepositLocked(&Request{SellerID: ev.SellerID, RequestID: ev.RequestID}, &res, ev.Time)
+			}
+		case "cancel":
+			t.Abandoned++
+		case "spoil":
+			t.Spoiled -= ev.Quantity
+		case "correction":
+			if t.corrections == nil {
+				t.corrections = make(map[RequestKey]int)
+			}
+			key := RequestKey{ev.SellerID, ev.RequestID}
+			if _, ok := t.corrections[key]; !ok {
+				t.corrections[key] = deposits[key]
+			}
+			t.corrections[key] += ev.Quantity
+		case "purchase":
+			if now.Sub(ev.Time) > purchaseRetention {
+				continue
+			}
+			if t.purchases == nil {
+				t.purchases = make(map[RequestKey]purchase)
+			}
+			res := Response{
+				Status:    "Purchased",
+				Message:   fmt.Sprintf("Sold %d %s from Post %d to Buyer %d for %s", -ev.Quantity, ev.Item, ev.Post, ev.BuyerID, describePrice(ev.Price, ev.Rule)),
+				RequestID: ev.RequestID,
+				Processed: true,
+				TraderID:  t.ID,
+				Price:     ev.Price,
+				PriceRule: ev.Rule,
+			}
+			t.purchases[RequestKey{ev.BuyerID, ev.RequestID}] = purchase{res: res, at: ev.Time}
+			t.purchaseExpiry.push(RequestKey{ev.BuyerID, ev.RequestID}, ev.Time)
+		case "leader":
+			if ev.Leader == t.Address && ev.Term > t.Term {
+				t.Term = ev.Term
+			}
+		case "accept":
+			if ev.Request != nil {
+				accepted[RequestKey{ev.SellerID, ev.RequestID}] = ev
+			}
+		}
+		switch ev.Kind {
+		case "deposit", "cancel", "finish":
+			delete(accepted, RequestKey{ev.SellerID, ev.RequestID})
+		}
+	}
+	t.InventoryMu.Unlock()
+
+	unfinished := make([]StateEvent, 0, len(accepted))
+	for _, ev := range accepted {
+		unfinished = append(unfinished, ev)
+	}
+	sort.Slice(unfinished, func(i, j int) bool { return unfinished[i].Seq < unfinished[j].Seq })
+	reqs := make([]Request, len(unfinished))
+	for i, ev := range unfinished {
+		reqs[i] = *ev.Request
+	}
+	return reqs
+}
+
+// ======= PERISHABLE STOCK =======
+
+// stockLot is one deposit of perishable stock still held; lots of an item are kept oldest
+// first, and stock leaves them in that order
+type stockLot struct {
+	Quantity  int
+	SellerID  int // 0 for hand-backs
+	RequestID int
+	Expires   time.Time
+}
+
+// parseShelfLife parses a list such as "apples=2m,pears=30s" into shelf lives by item
+func parseShelfLife(spec string) (map[string]time.Duration, error) {
+	life := make(map[string]time.Duration)
+	if spec == "" {
+		return life, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		item, ttl, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("shelf life %q is not item=duration", part)
+		}
+		if _, known := itemPrices[item]; !known {
+			return nil, fmt.Errorf("unknown item %q", item)
+		}
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid shelf life %q for %s", ttl, item)
+		}
+		life[item] = d
+	}
+	return life, nil
+}
+
+// trackLotsLocked keeps the lots of a perishable item in step with a change to our own
+// inventory; InventoryMu must be held
+func (t *Trader) trackLotsLocked(ev StateEvent) {
+	life, perishable := t.ShelfLife[ev.Item]
+	if !perishable || ev.Bucket != bucketInventory || ev.Quantity == 0 {
+		return
+	}
+	if t.lots == nil {
+		t.lots = make(map[string][]stockLot)
+	}
+	if ev.Quantity > 0 {
+		lot := stockLot{Quantity: ev.Quantity, SellerID: ev.SellerID, RequestID: ev.RequestID, Expires: ev.Time.Add(common.Scaled(life))}
+		t.lots[ev.Item] = append(t.lots[ev.Item], lot)
+		return
+	}
+
+	take, lots := -ev.Quantity, t.lots[ev.Item]
+	for take > 0 && len(lots) > 0 {
+		if lots[0].Quantity > take {
+			lots[0].Quantity -= take
+			break
+		}
+		take -= lots[0].Quantity
+		lots = lots[1:]
+	}
+	if len(lots) == 0 {
+		delete(t.lots, ev.Item)
+	} else {
+		t.lots[ev.Item] = lots
+	}
+}
+
+// sweepSpoiled takes expired lots out of the inventory and notifies the Sellers that
+// deposited them
+func (t *Trader) sweepSpoiled() {
+	now := time.Now()
+	var spoiled []SpoilageNotice
+
+	t.InventoryMu.Lock()
+	for item := range t.lots {
+		for len(t.lots[item]) > 0 && !t.lots[item][0].Expires.After(now) {
+			lot := t.lots[item][0]
+			// The oldest lot leaves first, so the event consumes exactly this one
+			t.applyLocked(StateEvent{Kind: "spoil", Bucket: bucketInventory, Item: item, Quantity: -lot.Quantity,
+				Post: t.Post, SellerID: lot.SellerID, RequestID: lot.RequestID})
+			spoiled = append(spoiled, SpoilageNotice{TraderID: t.ID, SellerID: lot.SellerID, RequestID: lot.RequestID,
+				Item: item, Quantity: lot.Quantity, Expired: lot.Expires})
+		}
+	}
+	t.InventoryMu.Unlock()
+
+	for _, n := range spoiled {
+		slog.Info("Stock spoiled", "request", n.RequestID, "seller", n.SellerID, "item", n.Item, "quantity", n.Quantity)
+		t.RequestMu.Lock()
+		t.Spoiled += n.Quantity
+		t.RequestMu.Unlock()
+		t.exportEvent(Event{Type: "spoilage", SellerID: n.SellerID, RequestID: n.RequestID, Post: t.Post, Item: n.Item, Quantity: n.Quantity})
+		if n.SellerID != 0 {
+			go t.notifySpoilage(n)
+		}
+	}
+}
+
+// notifySpoilage tells the Seller that deposited a lot that it spoiled
+func (t *Trader) notifySpoilage(n SpoilageNotice) {
+	if t.Secret != "" {
+		n.Signature = common.SpoilageSignature(t.Secret, &n)
+	}
+	if t.streamTo(n.SellerID, StreamMessage{Kind: "spoilage", Spoilage: &n}) {
+		return
+	}
+	t.RegistryMu.Lock()
+	reg, ok := t.Registry[n.SellerID]
+	addr := ""
+	if ok {
+		addr = reg.Address
+	}
+	t.RegistryMu.Unlock()
+	if addr == "" {
+		slog.Info("Seller is not registered; cannot notify it of spoilage", "seller", n.SellerID)
+		return
+	}
+
+	var reply string
+	if err := t.notify("spoilage", addr, "Seller.Spoiled", &n, &reply); err != nil {
+		slog.Warn("Failed to notify Seller of spoilage", "seller", n.SellerID, "addr", addr, "err", err)
+	}
+}
+
+// ======= REPLICATION =======
+
+// ReplicationEntry is one committed change replicated to the peer
+type ReplicationEntry struct {
+	Seq      int64
+	Item     string
+	Quantity int
+	Marker   int64 // Snapshot marker travelling in order with the entries; marker entries carry no item
+	queued   time.Time
+
+	SellerID  int         // Seller whose request this trade commits (0 for hand-backs)
+	RequestID int         // That Seller's request ID, advancing its watermark on the peer
+	Seller    *SellerInfo // Registration change; registration entries carry no item
+	Evicted   *SellerInfo // Registration evicted while idle; the peer drops it but keeps its watermark. Eviction entries carry no item
+	Settled   *RequestKey // Logged request that finished; the peer forgets it. Settle entries carry no item
+}
+
+// ReplicationBatch carries several entries in one RPC
+type ReplicationBatch struct {
+	From    int
+	Epoch   int64 // Identifies the sender's process lifetime; sequence numbers restart with it
+	Entries []ReplicationEntry
+
+	SessionKey string // Sender's session-signing key when no cluster secret is shared
+	Signature  string `json:"-"` // See PeerSignature (empty if unsigned)
+}
+
+// Replicator batches committed changes and flushes them to the peer when the batch is
+// full or the flush interval elapses. A batch size of 1 replicates every entry individually.
+// The leader of a standby pool flushes to every standby, each at its own pace.
+type Replicator struct {
+	t             *Trader
+	BatchSize     int
+	FlushInterval time.Duration
+	mu            sync.Mutex
+	epoch         int64
+	seq           int64
+	pending       []ReplicationEntry // Entries some target has not acknowledged yet
+	acked         map[string]int64   // Highest sequence each target acknowledged, by address
+	sending       map[string]bool    // Targets a flush is running for
+	flushNow      chan struct{}
+
+	// Metrics (guarded by mu)
+	entries      int
+	rpcs         int
+	entryLatency time.Duration // Summed enqueue-to-ack latency
+	rpcLatency   time.Duration // Summed RPC round-trip latency
+}
+
+// maxPendingReplication bounds the backlog kept while the peer is unreachable
+const maxPendingReplication = 10000
+
+// NewReplicator creates a replicator; call Run to start flushing
+func NewReplicator(t *Trader, batchSize int, flushInterval time.Duration) *Replicator {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &Replicator{
+		t:             t,
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval,
+		epoch:         time.Now().UnixNano(),
+		acked:         make(map[string]int64),
+		sending:       make(map[string]bool),
+		flushNow:      make(chan struct{}, 1),
+	}
+}
+
+// Append queues a committed change, triggering a flush once the batch is full
+func (r *Replicator) Append(item string, quantity int) {
+	r.appendEntry(ReplicationEntry{Item: item, Quantity: quantity})
+}
+
+// AppendEvent queues a change to our inventory. Deposits carry their Seller and request ID
+// so the peer can keep that Seller's watermark warm.
+func (r *Replicator) AppendEvent(ev StateEvent) {
+	e := ReplicationEntry{Item: ev.Item, Quantity: ev.Quantity}
+	if ev.Kind == "deposit" {
+		e.SellerID, e.RequestID = ev.SellerID, ev.RequestID
+	}
+	r.appendEntry(e)
+}
+
+// AppendSeller queues a registration change so the peer holds a warm copy of the registry
+func (r *Replicator) AppendSeller(reg SellerInfo) {
+	reg.committedAbove = nil
+	r.appendEntry(ReplicationEntry{Seller: &reg})
+}
+
+// AppendEviction queues the eviction of an idle Seller's registration
+func (r *Replicator) AppendEviction(reg SellerInfo) {
+	reg.committedAbove = nil
+	r.appendEntry(ReplicationEntry{Evicted: &reg})
+}
+
+// appendEntry queues an entry, triggering a flush once the batch is full
+func (r *Replicator) appendEntry(e ReplicationEntry) {
+	r.mu.Lock()
+	r.seq++
+	e.Seq, e.queued = r.seq, time.Now()
+	r.pending = append(r.pending, e)
+	if len(r.pending) > maxPendingReplication {
+		slog.Warn("Replication backlog full; dropping oldest entry", "seq", r.pending[0].Seq)
+		r.pending = r.pending[1:]
+	}
+	full := len(r.pending) >= r.BatchSize
+	r.mu.Unlock()
+
+	if full {
+		select {
+		case r.flushNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// AppendSettled queues the end of a logged request, behind the trade it committed if any
+func (r *Replicator) AppendSettled(key RequestKey) {
+	r.appendEntry(ReplicationEntry{Settled: &key})
+}
+
+// AppendMarker queues a snapshot marker behind every change already queued, so the peer
+// sees it in channel order, and flushes right away
+func (r *Replicator) AppendMarker(snapshotID int64) {
+	r.mu.Lock()
+	r.seq++
+	r.pending = append(r.pending, ReplicationEntry{Seq: r.seq, Marker: snapshotID, queued: time.Now()})
+	r.mu.Unlock()
+
+	select {
+	case r.flushNow <- struct{}{}:
+	default:
+	}
+}
+
+// Run flushes batches on size or time triggers
+func (r *Replicator) Run() {
+	ticker := time.NewTicker(common.Scaled(r.FlushInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.flushNow:
+			r.flush()
+		case <-ticker.C:
+			r.flush()
+		}
+	}
+}
+
+// flush sends pending entries to every target. The peer of a pair is flushed in place;
+// each standby of a pool gets a goroutine of its own, so an unreachable one never holds
+// the others back.
+func (r *Replicator) flush() {
+	targets := r.t.replicaTargets()
+	if len(targets) == 0 {
+		// A standby of a pool forwards every request to the leader, so nothing it queues
+		// is needed anywhere
+		r.mu.Lock()
+		r.pending = nil
+		r.mu.Unlock()
+		return
+	}
+	if len(targets) == 1 {
+		r.flushTo(targets[0], targets)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, addr := range targets {
+		if !r.sending[addr] {
+			r.sending[addr] = true
+			go func(addr string) {
+				r.flushTo(addr, targets)
+				r.mu.Lock()
+				delete(r.sending, addr)
+				r.mu.Unlock()
+			}(addr)
+		}
+	}
+}
+
+// flushTo sends the entries addr has not acknowledged in batches of at most BatchSize,
+// stopping at the first failure, then drops the entries every target acknowledged. A
+// target seen for the first time starts at the oldest entry still pending.
+func (r *Replicator) flushTo(addr string, targets []string) {
+	defer r.trim(targets)
+	for {
+		r.mu.Lock()
+		next := sort.Search(len(r.pending), func(i int) bool { return r.pending[i].Seq > r.acked[addr] })
+		batch := append([]ReplicationEntry(nil), r.pending[next:min(next+r.BatchSize, len(r.pending))]...)
+		r.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+
+		start := time.Now()
+		if err := r.send(addr, batch); err != nil {
+			slog.Warn("Failed to replicate entries", "to", addr, "count", len(batch), "err", err)
+			return
+		}
+		acked := time.Now()
+
+		r.mu.Lock()
+		r.acked[addr] = batch[len(batch)-1].Seq
+		r.rpcs++
+		r.rpcLatency += acked.Sub(start)
+		for _, e := range batch {
+			r.entries++
+			r.entryLatency += acked.Sub(e.queued)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// trim drops the pending entries every target has acknowledged
+func (r *Replicator) trim(targets []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pending) == 0 {
+		return
+	}
+	low := r.seq
+	for _, addr := range targets {
+		low = min(low, max(r.acked[addr], r.pending[0].Seq-1))
+	}
+	done := sort.Search(len(r.pending), func(i int) bool { return r.pending[i].Seq > low })
+	r.pending = r.pending[done:]
+}
+
+// send delivers one batch to a target: the peer, or another standby of the pool
+func (r *Replicator) send(addr string, batch []ReplicationEntry) error {
+	var client *rpc.Client
+	var err error
+	switch {
+	case addr == r.t.peerAddr():
+		client, err = r.t.dialPeer()
+	case r.t.partitioned():
+		err = errPartitioned
+	default:
+		client, err = common.DialTimeouts(addr, r.t.Timeouts)
+	}
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	args := &ReplicationBatch{From: r.t.ID, Epoch: r.epoch, Entries: batch}
+	if r.t.Secret == "" {
+		args.SessionKey = r.t.localSessionKey
+	}
+	args.Signature = r.t.signPeerCall("Trader.ReplicateBatch", args)
+	var reply string
+	return r.t.call(client, "Trader.ReplicateBatch", args, &reply)
+}
+
+// backlog returns the number of entries waiting to be sent to the peer
+func (r *Replicator) backlog() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pending)
+}
+
+// logStats reports replication latency so per-entry and batched modes can be compared
+func (r *Replicator) logStats() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rpcs == 0 {
+		return
+	}
+	slog.Info("Replication stats", "batch", r.BatchSize, "flush", r.FlushInterval, "entries", r.entries, "rpcs", r.rpcs,
+		"entries_per_rpc", float64(r.entries)/float64(r.rpcs), "rpc_latency", r.rpcLatency/time.Duration(r.rpcs),
+		"entry_latency", r.entryLatency/time.Duration(r.entries), "pending", len(r.pending))
+}
+
+// ReplicateBatch applies a batch of the peer's committed changes to the local replica,
+// skipping entries already applied by an earlier, retried batch. Entries missing before
+// the batch, dropped from the sender's backlog or sent before we followed it, are made
+// up for by pulling the peer's whole inventory.
+func (t *Trader) ReplicateBatch(batch *ReplicationBatch, reply *string) error {
+	if err := t.injectFault("ReplicateBatch"); err != nil {
+		return err
+	}
+	if !t.peerCallSigned("Trader.ReplicateBatch", batch.Signature, batch) {
+		return t.refuseUnsignedPeerCall("Trader.ReplicateBatch", batch.From)
+	}
+	if following := t.poolID(t.peerAddr()); t.pooled() && batch.From != following {
+		return fmt.Errorf("trader %d follows trader %d, not trader %d", t.ID, following, batch.From)
+	}
+	t.InventoryMu.Lock()
+	defer t.InventoryMu.Unlock()
+
+	if t.PeerInventory == nil {
+		t.PeerInventory = make(map[string]int)
+	}
+	if t.PeerRegistry == nil {
+		t.PeerRegistry = make(map[int]*SellerInfo)
+	}
+	if t.peerEvicted == nil {
+		t.peerEvicted = make(map[int]*SellerInfo)
+	}
+	if batch.Epoch != t.replEpoch {
+		// The peer restarted with empty stock and no registrations, so its sequence numbers
+		// and our replicas of its inventory and registry start over
+		t.replEpoch = batch.Epoch
+		t.replApplied = 0
+		t.PeerInventory = make(map[string]int)
+		t.PeerRegistry = make(map[int]*SellerInfo)
+		t.peerEvicted = make(map[int]*SellerInfo)
+	}
+	t.peerSessionKey = batch.SessionKey
+	applied := 0
+	for _, e := range batch.Entries {
+		if e.Seq <= t.replApplied {
+			continue
+		}
+		if e.Seq > t.replApplied+1 {
+			slog.Warn("Replication entries missing; pulling the peer's inventory", "from", t.replApplied+1, "to", e.Seq-1)
+			go t.pullPeerStateOnce()
+		}
+		t.replApplied = e.Seq
+		if e.Marker != 0 {
+			// Recording takes RequestMu, which must not be acquired under InventoryMu. The
+			// marker is still delivered before the entries sent after it, which belong to
+			// the next snapshot rather than to this one's channel state.
+			t.InventoryMu.Unlock()
+			t.receiveMarker(e.Marker, batch.From)
+			t.InventoryMu.Lock()
+			if t.replEpoch != batch.Epoch || t.PeerInventory == nil || t.PeerRegistry == nil {
+				// The replica was adopted or dropped meanwhile, and the rest of the batch
+				// with it
+				break
+			}
+			continue
+		}
+		if e.Seller != nil {
+			t.PeerRegistry[e.Seller.ID] = e.Seller
+			delete(t.peerEvicted, e.Seller.ID)
+			continue
+		}
+		if e.Evicted != nil {
+			delete(t.PeerRegistry, e.Evicted.ID)
+			t.peerEvicted[e.Evicted.ID] = e.Evicted
+			continue
+		}
+		if e.Settled != nil {
+			delete(t.peerAccepted, *e.Settled)
+			continue
+		}
+		if reg, ok := t.PeerRegistry[e.SellerID]; ok {
+			reg.commit(e.RequestID)
+		} else if reg, ok := t.peerEvicted[e.SellerID]; ok {
+			reg.commit(e.RequestID)
+		}
+		t.PeerInventory[e.Item] += e.Quantity
+		t.recordChannel("replicate", e.Item, e.Quantity)
+		applied++
+	}
+
+	*reply = fmt.Sprintf("Applied %d of %d entries", applied, len(batch.Entries))
+	return nil
+}
+
+// ======= REQUEST LOG =======
+
+// RequestLogArgs carries a request we accepted to the peer before it is acknowledged
+type RequestLogArgs struct {
+	From      int
+	Epoch     int64 // Sender's replication epoch; the peer drops the log of an earlier lifetime
+	Term      int64 // Sender's leadership term when it accepted the request
+	Index     int64 // Position in the sender's request log
+	Request   Request
+	Signature string `json:"-"` // See PeerSignature (empty if unsigned)
+}
+
+// loggedRequest is a request the peer accepted and has not settled yet
+type loggedRequest struct {
+	Index   int64
+	Term    int64
+	Request Request
+}
+
+// logRequest stores a request for our own post on the peer before we acknowledge or
+// process it, so the peer finishes it if we fail. While the peer is down nobody could
+// take over from us, so the request is accepted unreplicated.
+func (t *Trader) logRequest(req *Request) error {
+	if !t.SyncRequests || req.DryRun || req.Post != t.Post {
+		return nil
+	}
+	key := RequestKey{req.SellerID, req.RequestID}
+
+	t.RequestMu.Lock()
+	if t.logged[key] {
+		t.RequestMu.Unlock()
+		return nil
+	}
+	t.logIndex++
+	args := &RequestLogArgs{From: t.ID, Epoch: t.Replicator.epoch, Index: t.logIndex, Request: *req}
+	t.RequestMu.Unlock()
+	args.Term = t.term()
+	args.Signature = t.signPeerCall("Trader.AppendRequest", args)
+
+	if !t.peerUp() {
+		slog.Warn("Peer is down; accepting request without replicating it", "request", req.RequestID, "seller", req.SellerID)
+		return nil
+	}
+	var reply string
+	if err := t.peerCall("Trader.AppendRequest", args, &reply); err != nil {
+		return fmt.Errorf("peer did not store request %d: %w", req.RequestID, err)
+	}
+
+	t.RequestMu.Lock()
+	t.logged[key] = true
+	t.RequestMu.Unlock()
+	return nil
+}
+
+// settleRequest tells the peer a logged request finished, so it is not finished again
+// after a takeover. Requests that were never logged are ignored.
+func (t *Trader) settleRequest(req *Request) {
+	key := RequestKey{req.SellerID, req.RequestID}
+
+	t.RequestMu.Lock()
+	logged := t.logged[key]
+	delete(t.logged, key)
+	t.RequestMu.Unlock()
+	if logged {
+		t.Replicator.AppendSettled(key)
+	}
+}
+
+// AppendRequest stores a request the peer accepted, so we can finish it if the peer fails
+// before settling it
+func (t *Trader) AppendRequest(args *RequestLogArgs, reply *string) error {
+	if err := t.injectFault("AppendRequest"); err != nil {
+		return err
+	}
+	if !t.peerCallSigned("Trader.AppendRequest", args.Signature, args) {
+		return t.refuseUnsignedPeerCall("Trader.AppendRequest", args.From)
+	}
+	if t.partitioned() {
+		return errPartitioned
+	}
+	if peerID := t.peerID(); peerID != 0 && args.From != peerID {
+		return fmt.Errorf("trader %d does not keep the request log of trader %d", t.ID, args.From)
+	}
+
+	t.InventoryMu.Lock()
+	defer t.InventoryMu.Unlock()
+	if t.peerAccepted == nil || args.Epoch != t.peerLogEpoch {
+		// The peer restarted; Sellers resend what its earlier lifetime left unfinished
+		t.peerLogEpoch = args.Epoch
+		t.peerAccepted = make(map[RequestKey]loggedRequest)
+	}
+	key := RequestKey{args.Request.SellerID, args.Request.RequestID}
+	t.peerAccepted[key] = loggedRequest{Index: args.Index, Term: args.Term, Request: args.Request}
+	*reply = fmt.Sprintf("Stored request %d from Seller %d at index %d", key.RequestID, key.SellerID, args.Index)
+	return nil
+}
+
+// finishPeerRequests processes, in log order, the requests the failed peer accepted but
+// never settled. Ones it committed before failing are recognised by the adopted Seller
+// watermarks and skipped.
+func (t *Trader) finishPeerRequests(accepted map[RequestKey]loggedRequest) {
+	entries := make([]loggedRequest, 0, len(accepted))
+	for _, e := range accepted {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Index < entries[j].Index })
+
+	slog.Info("Finishing requests the peer accepted before failing", "count", len(entries))
+	for _, e := range entries {
+		req := e.Request
+		var res Response
+		if err := t.handleRequest(&req, &res); err != nil {
+			slog.Warn("Failed to finish request", "request", req.RequestID, "seller", req.SellerID, "err", err)
+			continue
+		}
+		slog.Info("Finished request logged by the peer", "request", req.RequestID, "seller", req.SellerID, "index", e.Index, "term", e.Term, "status", res.Status)
+	}
+}
+
+// ======= RECONCILIATION =======
+
+// errPartitioned is returned for peer traffic dropped by an injected partition
+var errPartitioned = errors.New("peer traffic dropped by injected partition")
+
+// partitioned reports whether peer traffic is being dropped
+func (t *Trader) partitioned() bool {
+	t.HeartbeatMu.Lock()
+	defer t.HeartbeatMu.Unlock()
+	return t.Partitioned
+}
+
+// isLeader reports whether this Trader currently considers itself leader
+func (t *Trader) isLeader() bool {
+	t.HeartbeatMu.Lock()
+	defer t.HeartbeatMu.Unlock()
+	return t.IsLeader
+}
+
+// setLeader records whether this Trader leads, and why, in the current term; the caller
+// holds HeartbeatMu
+func (t *Trader) setLeader(leader bool, cause string) {
+	if leader != t.IsLeader {
+		t.prom.roleChanges.Inc(map[bool]string{true: "leader", false: "backup"}[leader])
+	}
+	t.IsLeader = leader
+	t.leading.Store(leader)
+	t.Transitions.Leader(leader, cause, t.Term)
+}
+
+// logRole names this Trader's role in its log records
+func (t *Trader) logRole() string {
+	if t.leading.Load() {
+		return "leader"
+	}
+	return "backup"
+}
+
+// term returns the current leadership term
+func (t *Trader) term() int64 {
+	t.HeartbeatMu.Lock()
+	defer t.HeartbeatMu.Unlock()
+	return t.Term
+}
+
+// reconcile runs after a heartbeat reaches the peer. It resolves dual leadership left
+// by a partition (the lower ID keeps leadership, under a term newer than the peer's) and
+// returns stock held for the peer.
+func (t *Trader) reconcile(client *rpc.Client) {
+	var peer NodeIdentity
+	if err := t.call(client, "Trader.Identify", 0, &peer); err != nil {
+		slog.Warn("Failed to query peer for reconciliation", "err", err)
+		return
+	}
+
+	t.HeartbeatMu.Lock()
+	// A peer restarted without a term file rejoins as backup in term 0; one that leads in
+	// a term older than it reported before would be accepted by Sellers as a stale leader
+	if peer.Leader && peer.Term < t.peerTerm {
+		t.alert(alertTermRegression, "Peer leads in a term older than it reported before", "trader", peer.ID, "peer_term", peer.Term, "last_peer_term", t.peerTerm)
+	}
+	t.peerTerm = peer.Term
+	t.peerLeader = peer.Leader
+	dualLeaders := t.IsLeader && peer.Leader
+	if t.bully() {
+		// Dual leadership is resolved by the election
+		t.HeartbeatMu.Unlock()
+	} else if dualLeaders && t.ID > peer.ID {
+		t.setLeader(false, causeDualLeaders)
+		t.voteLocked(peer.ID, peer.Term)
+		t.HeartbeatMu.Unlock()
+		slog.Warn("Both Traders are leaders after a partition; stepping down", "leader", peer.ID)
+		t.leaderChanged(t.peerAddr(), peer.Term)
+	} else if t.IsLeader && peer.Term >= t.Term {
+		// Keep our term ahead of the peer's so Sellers that followed it accept us again
+		t.startTermLocked(peer.Term)
+		term := t.Term
+		t.HeartbeatMu.Unlock()
+		slog.Info("Leading after a partition", "term", term, "peer_term", peer.Term)
+		if peer.Term > 0 {
+			// The peer led at some point, so Sellers may have followed it
+			t.NotifySellers(t.Address)
+		}
+	} else {
+		t.HeartbeatMu.Unlock()
+	}
+
+	t.InventoryMu.Lock()
+	handback := t.Handback
+	adopted := len(t.Adopted)
+	t.InventoryMu.Unlock()
+	if len(handback) == 0 && adopted == 0 {
+		return
+	}
+
+	entries := make([]InventoryEntry, 0, len(handback))
+	for item, qty := range handback {
+		entries = append(entries, InventoryEntry{Item: item, Quantity: qty})
+	}
+	args := &HandbackArgs{From: t.ID, Entries: entries}
+	args.Signature = t.signPeerCall("Trader.AcceptHandback", args)
+	var reply string
+	if err := t.call(client, "Trader.AcceptHandback", args, &reply); err != nil {
+		slog.Warn("Failed to hand back stock to peer", "err", err)
+		return
+	}
+
+	t.InventoryMu.Lock()
+	for _, e := range entries {
+		t.applyLocked(StateEvent{Kind: "handback-out", Bucket: bucketHandback, Item: e.Item, Quantity: -e.Quantity})
+	}
+	if t.Adopted != nil {
+		t.applyLocked(StateEvent{Kind: "return"})
+	}
+	t.InventoryMu.Unlock()
+	slog.Info("Returned adopted stock to peer", "items", len(entries))
+}
+
+// ======= TERM STORAGE =======
+
+// TermState is the part of the election state that must survive a restart
+type TermState struct {
+	Term     int64 `json:"term"`
+	VotedFor int   `json:"voted_for"` // Trader granted leadership in VoteTerm; 0 if none
+	VoteTerm int64 `json:"vote_term"`
+}
+
+// TermStore keeps the TermState in a file, replaced atomically on every change
+type TermStore struct {
+	path string
+}
+
+// OpenTermStore opens the store and returns the state saved by an earlier run
+func OpenTermStore(path string) (*TermStore, TermState, error) {
+	var st TermState
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &TermStore{path: path}, st, nil
+	}
+	if err != nil {
+		return nil, st, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, st, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return &TermStore{path: path}, st, nil
+}
+
+// Save writes the state to disk and syncs it before returning
+func (s *TermStore) Save(st TermState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return writeFileSynced(s.path, data)
+}
+
+// writeFileSynced replaces path with data, synced to disk before the rename
+func writeFileSynced(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// persistTermLocked saves the term and vote; HeartbeatMu must be held
+func (t *Trader) persistTermLocked() {
+	if t.TermStore == nil {
+		return
+	}
+	st := TermState{Term: t.Term, VotedFor: t.votedFor, VoteTerm: t.voteTerm}
+	if err := t.TermStore.Save(st); err != nil {
+		slog.Warn("Failed to persist term", "term", t.Term, "err", err)
+	}
+}
+
+// startTermLocked moves to the next leadership term of ours above our own, the given peer
+// term and any term we voted in, and votes for ourselves in it; HeartbeatMu must be held
+func (t *Trader) startTermLocked(peerTerm int64) {
+	next := t.Term
+	if peerTerm > next {
+		next = peerTerm
+	}
+	if t.voteTerm > next {
+		next = t.voteTerm
+	}
+	t.Term = next + 1
+	// Traders lead in disjoint terms, so Traders taking over on either side of a
+	// partition or crash never share one
+	slot, n := t.termShare()
+	t.Term += (slot - (t.Term-1)%n + n) % n
+	t.votedFor, t.voteTerm = t.ID, t.Term
+	t.persistTermLocked()
+}
+
+// termShare returns the terms this Trader may start: those with (term-1) % n == slot. A
+// member of a Bully cluster or standby pool of n Traders takes every n-th term by its rank
+// among their IDs; in a pair, odd IDs take the odd terms and even IDs the even ones.
+func (t *Trader) termShare() (slot, n int64) {
+	group := t.Members
+	if group == nil {
+		group = t.Pool
+	}
+	if group == nil {
+		return int64((t.ID - 1) % 2), 2
+	}
+	for id := range group {
+		if id < t.ID {
+			slot++
+		}
+	}
+	return slot, int64(len(group))
+}
+
+// voteLocked records that leadership in term went to another Trader. It refuses a second,
+// different vote in a term already voted in, or a vote in an older term. HeartbeatMu must
+// be held.
+func (t *Trader) voteLocked(candidate int, term int64) bool {
+	if term < t.voteTerm || (term == t.voteTerm && t.votedFor != candidate) {
+		slog.Info("Refusing vote", "candidate", candidate, "term", term, "voted_for", t.votedFor, "vote_term", t.voteTerm)
+		return false
+	}
+	t.votedFor, t.voteTerm = candidate, term
+	t.persistTermLocked()
+	return true
+}
+
+// ======= ROLE NEGOTIATION =======
+
+// Hello is exchanged by Traders at startup to agree on the initial leader
+type Hello struct {
+	ID          int
+	Leader      bool
+	Term        int64
+	LogLen      int  // Committed requests, so the Trader with more history is preferred
+	Negotiating bool // Still deciding its role
+	Post        int  // Post the Trader owns
+}
+
+// Hello reports this Trader's role and history to a starting peer
+func (t *Trader) Hello(args *Hello, reply *Hello) error {
+	if err := t.injectFault("Hello"); err != nil {
+		return err
+	}
+	if t.partitioned() {
+		return errPartitioned
+	}
+	*reply = t.hello()
+	if !t.pooled() || args.ID == t.poolID(t.peerAddr()) {
+		t.setPeerPost(args.Post) // Every standby of a pool says hello to the leader
+	}
+	slog.Info("Hello from Trader", "trader", args.ID, "term", args.Term, "committed", args.LogLen)
+	return nil
+}
+
+// hello describes this Trader for role negotiation
+func (t *Trader) hello() Hello {
+	t.RequestMu.Lock()
+	logLen := t.Processed
+	t.RequestMu.Unlock()
+
+	t.HeartbeatMu.Lock()
+	defer t.HeartbeatMu.Unlock()
+	return Hello{ID: t.ID, Leader: t.IsLeader, Term: t.Term, LogLen: logLen, Negotiating: t.negotiating, Post: t.Post}
+}
+
+// winsElection decides the initial leader between two starting Traders: the higher term,
+// then the longer history, then the lower ID. Both sides reach the same decision.
+func winsElection(self, peer Hello) bool {
+	if self.Term != peer.Term {
+		return self.Term > peer.Term
+	}
+	if self.LogLen != peer.LogLen {
+		return self.LogLen > peer.LogLen
+	}
+	return self.ID < peer.ID
+}
+
+// waitForDependencies blocks until the peer (every other member with -cluster) and the
+// Warehouse, if any, accept connections, so this Trader assumes no role against a peer
+// that has not started yet. It returns the dependencies still unreachable at the timeout.
+func (t *Trader) waitForDependencies(timeout time.Duration) []string {
+	pending := make(map[string]func() error)
+	peer := t.peerAddr()
+	if peer != "" {
+		pending["peer Trader at "+peer] = func() error {
+			client, err := t.dialPeer() // Also verifies the peer's identity
+			if err == nil {
+				client.Close()
+			}
+			return err
+		}
+	}
+	for id, addr := range t.Members {
+		if id != t.ID && addr != peer {
+			pending[fmt.Sprintf("Trader %d at %s", id, addr)] = func() error {
+				return common.Call(addr, "Trader.Ping", int64(0), new(int64), common.Scaled(t.Timeouts.Default))
+			}
+		}
+	}
+	if t.Warehouse != "" {
+		pending["Warehouse at "+t.Warehouse] = func() error {
+			conn, err := common.DialConn(t.Warehouse, common.Scaled(2*time.Second))
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}
+	}
+
+	deadline := time.Now().Add(common.Scaled(timeout))
+	for {
+		for name, check := range pending {
+			if err := check(); err == nil {
+				slog.Info("Startup dependency is reachable", "dependency", name)
+				delete(pending, name)
+			}
+		}
+		if len(pending) == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(common.Scaled(time.Second))
+	}
+
+	var missing []string
+	for name := range pending {
+		missing = append(missing, name)
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// negotiateRole settles this Trader's role before heartbeats start. A peer that already
+// leads keeps leading; otherwise the Traders elect one. If the peer never answers within
+// timeout, this Trader leads alone. An extra standby of a pool waits for the peer to
+// settle its own role and never leads: if the peer is gone, the pool's failover decides.
+func (t *Trader) negotiateRole(timeout time.Duration) {
+	deadline := time.Now().Add(common.Scaled(timeout))
+	var peer Hello
+	var err error
+	for {
+		peer, err = t.sayHello()
+		if (err == nil && !(t.Standby && peer.Negotiating)) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(common.Scaled(time.Second))
+	}
+
+	self := t.hello()
+	t.HeartbeatMu.Lock()
+	t.negotiating = false
+	switch {
+	case err != nil && t.Standby:
+		t.setLeader(false, causePeerUnreachable)
+		slog.Warn("Peer did not answer during startup; waiting as standby", "err", err)
+	case err != nil:
+		t.startTermLocked(0)
+		t.setLeader(true, causePeerUnreachable)
+		slog.Warn("Peer did not answer during startup; leading alone", "term", t.Term, "err", err)
+	case peer.Leader:
+		t.peerTerm = peer.Term
+		t.voteLocked(peer.ID, peer.Term)
+		t.setLeader(false, causePeerLeads)
+		slog.Info("Joining established cluster as backup", "leader", peer.ID, "term", peer.Term)
+	case t.Standby:
+		t.peerTerm = peer.Term
+		t.setLeader(false, causeElectionLost)
+		slog.Info("Joining as standby of a Trader that does not lead; looking for the pool's leader", "trader", peer.ID)
+	case winsElection(self, peer):
+		t.peerTerm = peer.Term
+		t.startTermLocked(peer.Term)
+		t.setLeader(true, causeElectionWon)
+		slog.Info("Elected initial leader", "term", t.Term, "peer_term", peer.Term, "peer_committed", peer.LogLen)
+	default:
+		t.setLeader(false, causeElectionLost)
+		t.peerTerm = peer.Term
+		// The peer starts its term above both of ours
+		winnerTerm := peer.Term
+		if self.Term > winnerTerm {
+			winnerTerm = self.Term
+		}
+		t.voteLocked(peer.ID, winnerTerm+1)
+		slog.Info("Peer wins the initial election; starting as backup", "leader", peer.ID)
+	}
+	leader, term := t.IsLeader, t.Term
+	t.HeartbeatMu.Unlock()
+
+	if err == nil && t.Standby && !peer.Leader && !t.followPoolLeader() {
+		slog.Warn("No member of the pool leads; forwarding through the peer", "trader", peer.ID)
+	}
+	if leader {
+		t.leaderChanged(t.Address, term)
+		if term > 1 {
+			// An earlier leader existed, so Sellers may be following another Trader
+			t.NotifySellers(t.Address)
+		}
+	}
+}
+
+// sayHello exchanges Hello messages with the peer
+func (t *Trader) sayHello() (Hello, error) {
+	var reply Hello
+	client, err := t.dialPeer()
+	if err != nil {
+		return reply, err
+	}
+	defer client.Close()
+
+	self := t.hello()
+	err = t.call(client, "Trader.Hello", &self, &reply)
+	if err == nil {
+		t.setPeerPost(reply.Post)
+	}
+	return reply, err
+}
+
+// setPeerPost records the post the peer owns, as reported in its Hello
+func (t *Trader) setPeerPost(post int) {
+	if post <= 0 {
+		return
+	}
+	t.HeartbeatMu.Lock()
+	t.peerPost = post
+	t.HeartbeatMu.Unlock()
+}
+
+// servesPost reports whether this Trader or its peer owns a post. Until the peer has said
+// which post it owns, any post is accepted, and a standby pool serves the posts of all its
+// members.
+func (t *Trader) servesPost(post int) bool {
+	if t.pooled() {
+		return true
+	}
+	t.HeartbeatMu.Lock()
+	defer t.HeartbeatMu.Unlock()
+	return post == t.Post || t.peerPost == 0 || post == t.peerPost
+}
+
+// HandbackArgs carries deposits accepted on the receiver's behalf
+type HandbackArgs struct {
+	From      int
+	Entries   []InventoryEntry
+	Signature string `json:"-"` // See PeerSignature (empty if unsigned)
+}
+
+// AcceptHandback adds stock the peer accepted for our post while we were unreachable
+func (t *Trader) AcceptHandback(args *HandbackArgs, reply *string) error {
+	if err := t.injectFault("AcceptHandback"); err != nil {
+		return err
+	}
+	if !t.peerCallSigned("Trader.AcceptHandback", args.Signature, args) {
+		return t.refuseUnsignedPeerCall("Trader.AcceptHandback", args.From)
+	}
+	if t.partitioned() {
+		return errPartitioned
+	}
+	if args.From == t.ID || !t.knownTrader(args.From) {
+		return fmt.Errorf("trader %d does not take hand-backs from trader %d", t.ID, args.From)
+	}
+
+	t.InventoryMu.Lock()
+	for _, e := range args.Entries {
+		t.applyLocked(StateEvent{Kind: "handback-in", Bucket: bucketInventory, Item: e.Item, Quantity: e.Quantity})
+		t.recordChannel("handback", e.Item, e.Quantity)
+	}
+	t.InventoryMu.Unlock()
+
+	slog.Info("Accepted hand-back", "items", len(args.Entries), "trader", args.From)
+	*reply = "Accepted"
+	return nil
+}
+
+// ======= BULLY ELECTION =======
+
+// With -cluster, leadership is settled by the Bully algorithm over every Trader of the
+// cluster instead of between the two Traders of a pair: the highest reachable ID leads.
+// The pair still forwards, replicates and takes over each other's post; only who leads,
+// and which term it leads in, comes from the election.
+
+// electionTimeout bounds each election call, and twice it bounds the wait for the
+// winner's Coordinator message before the election is restarted
+const electionTimeout = 2 * time.Second
+
+// ElectionArgs is sent by a Trader starting an election to every Trader with a higher ID
+type ElectionArgs struct {
+	From      int
+	Term      int64
+	Signature string `json:"-"` // See PeerSignature (empty if unsigned)
+}
+
+// ElectionReply tells the candidate a higher Trader is alive and takes the election over
+type ElectionReply struct {
+	ID   int
+	Term int64
+}
+
+// CoordinatorArgs announces the winner of an election to every Trader with a lower ID
+type CoordinatorArgs struct {
+	ID        int
+	Address   string
+	Term      int64
+	Signature string `json:"-"` // See PeerSignature (empty if unsigned)
+}
+
+// parseMembers parses a list such as "1=localhost:8001,2=localhost:8002" into Trader
+// addresses by ID
+func parseMembers(spec string) (map[int]string, error) {
+	members := make(map[int]string)
+	for _, entry := range strings.Split(spec, ",") {
+		id, addr, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		n, err := strconv.Atoi(id)
+		if !ok || err != nil || n <= 0 || addr == "" {
+			return nil, fmt.Errorf("invalid cluster member %q (expected id=address)", entry)
+		}
+		if _, dup := members[n]; dup {
+			return nil, fmt.Errorf("Trader %d listed twice", n)
+		}
+		members[n] = addr
+	}
+	return members, nil
+}
+
+// bully reports whether leadership is settled by the Bully election
+func (t *Trader) bully() bool {
+	return t.Members != nil
+}
+
+// membersAbove returns the IDs of the other cluster members above (or, with above unset,
+// below) this Trader, in ascending order
+func (t *Trader) membersAbove(above bool) []int {
+	var ids []int
+	for id := range t.Members {
+		if id != t.ID && (id > t.ID) == above {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// callMember makes one election call to another cluster member. An injected partition
+// drops these calls like the peer's traffic.
+func (t *Trader) callMember(id int, method string, args, reply interface{}) error {
+	if t.partitioned() {
+		return errPartitioned
+	}
+	return common.CallNode(t.Members[id], traderHop(id), method, args, reply, common.Scaled(electionTimeout))
+}
+
+// Election answers a candidate with a lower ID: we are alive, so we run the election
+// ourselves
+func (t *Trader) Election(args *ElectionArgs, reply *ElectionReply) error {
+	if err := t.injectFault("Election"); err != nil {
+		return err
+	}
+	if !t.peerCallSigned("Trader.Election", args.Signature, args) {
+		return t.refuseUnsignedPeerCall("Trader.Election", args.From)
+	}
+	if t.partitioned() {
+		return errPartitioned
+	}
+	if !t.bully() {
+		return fmt.Errorf("trader %d does not run Bully elections", t.ID)
+	}
+
+	slog.Info("Election started by a lower Trader; taking it over", "trader", args.From, "term", args.Term)
+	*reply = ElectionReply{ID: t.ID, Term: t.term()}
+	go t.runElection()
+	return nil
+}
+
+// Coordinator accepts the winner of an election as leader and relays the announcement to
+// the Sellers and Buyers registered here. A lower Trader claiming leadership while we are
+// alive is refused, and bullied with an election of our own.
+func (t *Trader) Coordinator(args *CoordinatorArgs, reply *string) error {
+	if err := t.injectFault("Coordinator"); err != nil {
+		return err
+	}
+	if !t.peerCallSigned("Trader.Coordinator", args.Signature, args) {
+		return t.refuseUnsignedPeerCall("Trader.Coordinator", args.ID)
+	}
+	if t.partitioned() {
+		return errPartitioned
+	}
+	if !t.bully() {
+		return fmt.Errorf("trader %d does not run Bully elections", t.ID)
+	}
+	if args.ID < t.ID {
+		slog.Info("Refusing Trader as leader; starting an election", "trader", args.ID)
+		go t.runElection()
+		return fmt.Errorf("trader %d outranks trader %d", t.ID, args.ID)
+	}
+
+	t.HeartbeatMu.Lock()
+	if !t.voteLocked(args.ID, args.Term) {
+		t.HeartbeatMu.Unlock()
+		return fmt.Errorf("term %d of trader %d is stale", args.Term, args.ID)
+	}
+	wasLeader := t.IsLeader
+	changed := t.leaderID != args.ID
+	cause := causeElectionLost
+	if wasLeader {
+		cause = causeHigherTerm
+	}
+	t.setLeader(false, cause)
+	t.leaderID = args.ID
+	t.HeartbeatMu.Unlock()
+
+	select {
+	case t.coordinated <- struct{}{}:
+	default:
+	}
+	if wasLeader {
+		slog.Info("Stepping down; another Trader won the election", "leader", args.ID, "term", args.Term)
+	} else if changed {
+		slog.Info("Following new leader", "leader", args.ID, "addr", args.Address, "term", args.Term)
+	}
+	if changed || wasLeader {
+		t.leaderChanged(args.Address, args.Term)
+		go t.announceLeader(args.ID, args.Address, args.Term)
+	}
+	*reply = "OK"
+	return nil
+}
+
+// runElection runs the Bully algorithm: ask every higher Trader to take over, lead if none
+// answers, and otherwise wait for the winner's Coordinator message, starting again if it
+// never comes. Only one election runs at a time.
+func (t *Trader) runElection() {
+	t.HeartbeatMu.Lock()
+	if t.electing {
+		t.HeartbeatMu.Unlock()
+		return
+	}
+	t.electing = true
+	t.HeartbeatMu.Unlock()
+	defer func() {
+		t.HeartbeatMu.Lock()
+		t.electing = false
+		t.HeartbeatMu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-t.coordinated: // Drop an announcement from before this round
+		default:
+		}
+
+		higher := t.membersAbove(true)
+		answered := make(chan int, len(higher))
+		var wg sync.WaitGroup
+		for _, id := range higher {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				args := &ElectionArgs{From: t.ID, Term: t.term()}
+				args.Signature = t.signPeerCall("Trader.Election", args)
+				var reply ElectionReply
+				if err := t.callMember(id, "Trader.Election", args, &reply); err == nil {
+					answered <- reply.ID
+				}
+			}(id)
+		}
+		wg.Wait()
+		close(answered)
+
+		var alive []int
+		for id := range answered {
+			alive = append(alive, id)
+		}
+		if len(alive) == 0 {
+			t.becomeLeader()
+			return
+		}
+		slog.Info("Higher Traders are alive; waiting for the winner", "alive", alive)
+
+		select {
+		case <-t.coordinated:
+			return
+		case <-time.After(common.Scaled(2 * electionTimeout)):
+			slog.Info("No Coordinator message after the election; starting it again")
+		}
+	}
+}
+
+// probeMembers asks every other member to identify itself, recording the post each owns,
+// and returns the identities of those that answered
+func (t *Trader) probeMembers() []NodeIdentity {
+	var mu sync.Mutex
+	var found []NodeIdentity
+	var wg sync.WaitGroup
+	for id := range t.Members {
+		if id == t.ID {
+			continue
+		}
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			var peer NodeIdentity
+			if err := t.callMember(id, "Trader.Identify", 0, &peer); err == nil && peer.ID == id {
+				mu.Lock()
+				found = append(found, peer)
+				mu.Unlock()
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	t.HeartbeatMu.Lock()
+	for _, peer := range found {
+		if peer.Post > 0 {
+			t.postOwners[peer.Post] = peer.ID
+		}
+	}
+	t.HeartbeatMu.Unlock()
+	return found
+}
+
+// clusterTerm returns the highest term reported by any reachable member, so the winner's
+// term is newer than any leader's Sellers may have followed
+func (t *Trader) clusterTerm() int64 {
+	var highest int64
+	for _, peer := range t.probeMembers() {
+		if peer.Term > highest {
+			highest = peer.Term
+		}
+	}
+	return highest
+}
+
+// postOwner returns the member a request for post must be routed to, or 0 if this Trader
+// or its peer owns the post, or no member is known to. Owners are probed for again while a
+// post is unknown.
+func (t *Trader) postOwner(post int) int {
+	if !t.bully() || post == t.Post {
+		return 0
+	}
+	t.HeartbeatMu.Lock()
+	peerPost := t.peerPost
+	owner, known := t.postOwners[post]
+	t.HeartbeatMu.Unlock()
+	if post == peerPost {
+		return 0
+	}
+	if !known {
+		t.probeMembers()
+		t.HeartbeatMu.Lock()
+		owner = t.postOwners[post]
+		t.HeartbeatMu.Unlock()
+	}
+	if owner == t.ID || t.Members[owner] == t.peerAddr() {
+		return 0
+	}
+	return owner
+}
+
+// forwardToMember routes a request for another pair's post to the member owning it
+func (t *Trader) forwardToMember(id int, req *Request) (*Response, error) {
+	if err := t.checkRoute(req); err != nil {
+		return nil, err
+	}
+	if t.partitioned() {
+		return nil, errPartitioned
+	}
+	req.Term = t.term()
+	span, fwd := t.startForward(req, traderHop(id))
+	defer span.End()
+	var res Response
+	if err := common.CallNode(t.Members[id], traderHop(id), "Trader.ReceiveRequest", fwd, &res, common.Scaled(t.Timeouts.For("Trader.ReceiveRequest"))); err != nil {
+		span.Fail(err)
+		return nil, err
+	}
+	span.Set("a4.status", res.Status)
+	slog.Info("Request routed to owner of its Post", "request", req.RequestID, "trader", id, "post", req.Post, "path", formatPath(res.Path))
+	return &res, nil
+}
+
+// becomeLeader takes leadership after winning an election, in a term above every term in
+// the cluster, and announces it to the lower Traders and to our Sellers and Buyers
+func (t *Trader) becomeLeader() {
+	highest := t.clusterTerm()
+
+	t.HeartbeatMu.Lock()
+	wasLeader := t.IsLeader
+	t.leaderID = t.ID
+	if !wasLeader || highest >= t.Term {
+		t.startTermLocked(highest)
+	}
+	t.setLeader(true, causeElectionWon)
+	term := t.Term
+	t.HeartbeatMu.Unlock()
+
+	slog.Info("Won the election", "term", term)
+	if !wasLeader {
+		t.leaderChanged(t.Address, term)
+	}
+
+	args := &CoordinatorArgs{ID: t.ID, Address: t.Address, Term: term}
+	args.Signature = t.signPeerCall("Trader.Coordinator", args)
+	var wg sync.WaitGroup
+	for _, id := range t.membersAbove(false) {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			var reply string
+			if err := t.callMember(id, "Trader.Coordinator", args, &reply); err != nil {
+				slog.Warn("Failed to announce leadership to Trader", "trader", id, "err", err)
+			}
+		}(id)
+	}
+	wg.Wait()
+	t.NotifySellers(t.Address)
+}
+
+// checkLeader runs as the leader-check job. A follower probes the leader and starts an
+// election once it is gone or no longer leads; a leader starts one when a higher Trader is
+// reachable again, so the highest surviving ID always ends up leading.
+func (t *Trader) checkLeader() error {
+	t.HeartbeatMu.Lock()
+	leader, leaderID, electing := t.IsLeader, t.leaderID, t.electing
+	t.HeartbeatMu.Unlock()
+	if electing {
+		return nil
+	}
+
+	if leader {
+		for _, id := range t.membersAbove(true) {
+			var peer NodeIdentity
+			if err := t.callMember(id, "Trader.Identify", 0, &peer); err == nil {
+				slog.Info("Higher Trader is reachable; starting an election", "trader", id)
+				go t.runElection()
+				return nil
+			}
+		}
+		return nil
+	}
+
+	var peer NodeIdentity
+	err := errors.New("no leader known")
+	if leaderID != 0 {
+		err = t.callMember(leaderID, "Trader.Identify", 0, &peer)
+		if err == nil && (!peer.Leader || peer.ID != leaderID) {
+			err = fmt.Errorf("Trader %d no longer leads", leaderID)
+		}
+	}
+	if err != nil {
+		slog.Warn("Lost leader; starting an election", "leader", leaderID, "err", err)
+		go t.runElection()
+		return err
+	}
+	return nil
+}
+
+// ======= STANDBY POOL =======
+
+// With -pool, a leader has more than one backup. The pair runs as usual, and extra
+// standbys started with -standby follow the leader as their peer: they heartbeat it and
+// forward their Sellers' requests to it. Only the leader replicates, to every member of
+// the pool. When the leader fails, the reachable standbys are ranked by -promote-by; the
+// first takes over, pairs with the next and re-points the rest at itself.
+
+// How the pool ranks standbys for promotion
+const (
+	promoteByLag = "lag" // Most replication entries applied from the leader first, then the lower ID
+	promoteByID  = "id"  // Lower ID first
+)
+
+// StandbyStatus describes a member of the pool for ranking
+type StandbyStatus struct {
+	ID        int
+	Address   string
+	Leader    bool
+	Term      int64
+	Following int   // Pool member this one follows as its peer; 0 if its peer is outside the pool
+	LeadTerm  int64 // Term of the leader it follows, as last reported by that leader
+	Epoch     int64 // Epoch of the replication stream it applies
+	Applied   int64 // Highest sequence applied from that stream
+	Lag       int64 // Entries behind the first standby in the ranking; -1 if it follows an older leader
+}
+
+// RepointArgs tells a standby which member of the pool was promoted
+type RepointArgs struct {
+	ID        int
+	Address   string
+	Term      int64
+	Signature string `json:"-"` // See PeerSignature (empty if unsigned)
+}
+
+// pooled reports whether this Trader belongs to a standby pool
+func (t *Trader) pooled() bool {
+	return t.Pool != nil
+}
+
+// poolID returns the ID of the pool member at addr, or 0 if none is there
+func (t *Trader) poolID(addr string) int {
+	for id, a := range t.Pool {
+		if a == addr {
+			return id
+		}
+	}
+	return 0
+}
+
+// peerAddr returns the address of the peer Trader
+func (t *Trader) peerAddr() string {
+	t.peerMu.Lock()
+	defer t.peerMu.Unlock()
+	return t.Peer
+}
+
+// peerID returns the expected ID of the peer Trader, 0 if it is not verified
+func (t *Trader) peerID() int {
+	t.peerMu.Lock()
+	defer t.peerMu.Unlock()
+	return t.PeerID
+}
+
+// setPeer points heartbeats, forwards and state transfers at another Trader of the pool
+func (t *Trader) setPeer(id int, addr string) {
+	t.peerMu.Lock()
+	old := t.Peer
+	t.Peer = addr
+	if t.PeerID != 0 {
+		t.PeerID = id
+	}
+	t.peerMu.Unlock()
+	if old == addr {
+		return
+	}
+	t.Conns.Drop(old, nil)
+	t.setPeerUp(false)
+	t.HeartbeatMu.Lock()
+	t.peerPost, t.peerDomain = 0, ""
+	t.HeartbeatMu.Unlock()
+	slog.Info("Re-pointed to a new peer", "trader", id, "addr", addr, "previous", old)
+}
+
+// replicaTargets returns the addresses committed changes are replicated to: the peer, or
+// in a pool every other member while this Trader leads and none otherwise
+func (t *Trader) replicaTargets() []string {
+	if !t.pooled() {
+		return []string{t.peerAddr()}
+	}
+	if !t.isLeader() {
+		return nil
+	}
+	var addrs []string
+	for id, addr := range t.Pool {
+		if id != t.ID {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// callPoolMember makes one call to another member of the pool. An injected partition
+// drops these calls like the peer's traffic.
+func (t *Trader) callPoolMember(id int, method string, args, reply interface{}) error {
+	if t.partitioned() {
+		return errPartitioned
+	}
+	return common.CallNode(t.Pool[id], traderHop(id), method, args, reply, common.Scaled(electionTimeout))
+}
+
+// standbyStatus describes this Trader for ranking
+func (t *Trader) standbyStatus() StandbyStatus {
+	st := StandbyStatus{ID: t.ID, Address: t.Address, Following: t.poolID(t.peerAddr()), Lag: -1}
+	t.HeartbeatMu.Lock()
+	st.Leader, st.Term, st.LeadTerm = t.IsLeader, t.Term, t.peerTerm
+	t.HeartbeatMu.Unlock()
+	t.InventoryMu.Lock()
+	st.Epoch, st.Applied = t.replEpoch, t.replApplied
+	t.InventoryMu.Unlock()
+	return st
+}
+
+// StandbyStatus reports this Trader's role and replication progress to a member of the
+// pool ranking standbys
+func (t *Trader) StandbyStatus(_ int, reply *StandbyStatus) error {
+	if err := t.injectFault("StandbyStatus"); err != nil {
+		return err
+	}
+	if t.partitioned() {
+		return errPartitioned
+	}
+	if !t.pooled() {
+		return fmt.Errorf("trader %d is in no standby pool", t.ID)
+	}
+	*reply = t.standbyStatus()
+	return nil
+}
+
+// rankStandbys returns the reachable members of the pool other than exclude, this Trader
+// included, in promotion order
+func (t *Trader) rankStandbys(exclude int) []StandbyStatus {
+	ranked := []StandbyStatus{t.standbyStatus()}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for id := range t.Pool {
+		if id == t.ID || id == exclude {
+			continue
+		}
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			var st StandbyStatus
+			if err := t.callPoolMember(id, "Trader.StandbyStatus", 0, &st); err == nil && st.ID == id {
+				mu.Lock()
+				ranked = append(ranked, st)
+				mu.Unlock()
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if t.PromoteBy == promoteByLag {
+			if a.LeadTerm != b.LeadTerm {
+				return a.LeadTerm > b.LeadTerm // Followers of an older leader missed the newer one's entries
+			}
+			if a.Applied != b.Applied {
+				return a.Applied > b.Applied
+			}
+		}
+		return a.ID < b.ID
+	})
+	for i := range ranked {
+		if ranked[i].LeadTerm == ranked[0].LeadTerm && ranked[i].Epoch == ranked[0].Epoch {
+			ranked[i].Lag = ranked[0].Applied - ranked[i].Applied
+		}
+	}
+	return ranked
+}
+
+// formatRanking renders a promotion order for the log, e.g. "3(lag 0) 2(lag 14)"
+func formatRanking(ranked []StandbyStatus) string {
+	parts := make([]string, len(ranked))
+	for i, st := range ranked {
+		lag := "?"
+		if st.Lag >= 0 {
+			lag = strconv.FormatInt(st.Lag, 10)
+		}
+		parts[i] = fmt.Sprintf("%d(lag %s)", st.ID, lag)
+	}
+	return strings.Join(parts, " ")
+}
+
+// failoverInPool reacts to the suspected failure of the peer. A standby follows a member
+// already promoted in its place, takes over if it ranks first, and otherwise leaves the
+// takeover to the first; the leader pairs with the first reachable standby instead.
+func (t *Trader) failoverInPool() {
+	t.setPeerUp(false)
+	failed := t.poolID(t.peerAddr())
+	ranked := t.rankStandbys(failed)
+	var others []StandbyStatus
+	for _, st := range ranked {
+		if st.ID != t.ID {
+			others = append(others, st)
+		}
+	}
+
+	if t.isLeader() {
+		if len(others) == 0 {
+			slog.Warn("Peer failed and no other standby of the pool is reachable", "peer", failed)
+			return
+		}
+		slog.Warn("Peer failed; pairing with the next standby", "peer", failed, "standby", others[0].ID, "order", formatRanking(others))
+		t.setPeer(others[0].ID, others[0].Address)
+		return
+	}
+
+	for _, st := range others {
+		if st.Leader && st.Term >= t.term() {
+			slog.Info("Another standby already took over; following it", "leader", st.ID, "term", st.Term)
+			t.follow(st.ID, st.Address, st.Term)
+			return
+		}
+	}
+	if ranked[0].ID != t.ID {
+		slog.Info("Leader failure suspected; leaving the takeover to the first standby", "leader", failed, "standby", ranked[0].ID, "by", t.PromoteBy, "order", formatRanking(ranked))
+		return
+	}
+
+	slog.Warn("Leader failure suspected; promoting this standby", "leader", failed, "by", t.PromoteBy, "order", formatRanking(ranked))
+	t.TakeOverLeadership(causeStandbyPromoted)
+	if len(others) > 0 {
+		t.setPeer(others[0].ID, others[0].Address)
+	}
+	args := &RepointArgs{ID: t.ID, Address: t.Address, Term: t.term()}
+	args.Signature = t.signPeerCall("Trader.Repoint", args)
+	var wg sync.WaitGroup
+	for _, st := range others {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			var reply string
+			if err := t.callPoolMember(id, "Trader.Repoint", args, &reply); err != nil {
+				slog.Warn("Failed to re-point standby at this leader", "trader", id, "err", err)
+			}
+		}(st.ID)
+	}
+	wg.Wait()
+}
+
+// followPoolLeader makes a standby follow the member of the pool that leads, reporting
+// whether one was found
+func (t *Trader) followPoolLeader() bool {
+	for _, st := range t.rankStandbys(0) {
+		if st.Leader && st.ID != t.ID {
+			slog.Info("Following the leader of the pool", "leader", st.ID, "term", st.Term)
+			t.follow(st.ID, st.Address, st.Term)
+			return true
+		}
+	}
+	return false
+}
+
+// follow makes a standby follow the member of the pool leading at addr. The replica of the
+// previous leader's stock is dropped, since the new leader adopted it, and the new
+// leader's stock is pulled in its place.
+func (t *Trader) follow(id int, addr string, term int64) {
+	t.HeartbeatMu.Lock()
+	t.peerTerm = term
+	t.HeartbeatMu.Unlock()
+	t.setPeer(id, addr)
+
+	t.InventoryMu.Lock()
+	t.PeerInventory, t.PeerRegistry, t.peerEvicted, t.peerAccepted = nil, nil, nil, nil
+	t.replEpoch, t.replApplied = 0, 0
+	t.InventoryMu.Unlock()
+	t.leaderChanged(addr, term)
+	go t.pullPeerStateOnce()
+}
+
+// Repoint makes this standby follow the member of the pool just promoted. A leader in an
+// older term steps down for it.
+func (t *Trader) Repoint(args *RepointArgs, reply *string) error {
+	if err := t.injectFault("Repoint"); err != nil {
+		return err
+	}
+	if !t.peerCallSigned("Trader.Repoint", args.Signature, args) {
+		return t.refuseUnsignedPeerCall("Trader.Repoint", args.ID)
+	}
+	if t.partitioned() {
+		return errPartitioned
+	}
+	if t.Pool[args.ID] != args.Address {
+		return fmt.Errorf("trader %d at %s is not in the standby pool of trader %d", args.ID, args.Address, t.ID)
+	}
+
+	t.HeartbeatMu.Lock()
+	if !t.voteLocked(args.ID, args.Term) || (t.IsLeader && t.Term >= args.Term) {
+		t.HeartbeatMu.Unlock()
+		return fmt.Errorf("term %d of trader %d is stale", args.Term, args.ID)
+	}
+	wasLeader := t.IsLeader
+	if wasLeader {
+		t.setLeader(false, causeHigherTerm)
+	}
+	t.HeartbeatMu.Unlock()
+
+	if wasLeader {
+		slog.Warn("Stepping down; a standby was promoted in a newer term", "leader", args.ID, "term", args.Term)
+	}
+	slog.Info("Following the promoted standby", "leader", args.ID, "addr", args.Address, "term", args.Term)
+	t.follow(args.ID, args.Address, args.Term)
+	*reply = "OK"
+	return nil
+}
+
+// pullPeerStateOnce transfers the peer's inventory unless a transfer is already running
+func (t *Trader) pullPeerStateOnce() {
+	if !t.pulling.CompareAndSwap(false, true) {
+		return
+	}
+	defer t.pulling.Store(false)
+	if err := t.PullPeerState(3); err != nil {
+		slog.Warn("Failed to pull the peer's inventory", "err", err)
+	}
+}
+
+// ======= PRICING =======
+
+// PricingRule is a discount applied when a purchase is settled
+type PricingRule struct {
+	Name        string  `json:"name"`
+	Kind        string  `json:"kind"`                   // "bulk" or "bundle"
+	Item        string  `json:"item,omitempty"`         // Item the rule applies to; empty for every item
+	MinQuantity int     `json:"min_quantity,omitempty"` // bulk: smallest quantity that gets the discount
+	Discount    float64 `json:"discount,omitempty"`     // bulk: fraction taken off the list price
+	Size        int     `json:"size,omitempty"`         // bundle: units sold together
+	Price       float64 `json:"price,omitempty"`        // bundle: price of a whole bundle
+}
+
+// PricingConfig is the -pricing file
+type PricingConfig struct {
+	Rules []PricingRule `json:"rules"`
+}
+
+// LoadPricing reads and checks pricing rules
+func LoadPricing(path string) (*PricingConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg PricingConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	for i, r := range cfg.Rules {
+		if r.Name == "" || names[r.Name] {
+			return nil, fmt.Errorf("rule %d: name missing or used twice", i+1)
+		}
+		names[r.Name] = true
+		if _, ok := itemPrices[r.Item]; r.Item != "" && !ok {
+			return nil, fmt.Errorf("rule %s: unknown item %q", r.Name, r.Item)
+		}
+		switch r.Kind {
+		case "bulk":
+			if r.MinQuantity < 1 || r.Discount <= 0 || r.Discount >= 1 {
+				return nil, fmt.Errorf("rule %s: bulk needs min_quantity >= 1 and a discount between 0 and 1", r.Name)
+			}
+		case "bundle":
+			if r.Item == "" || r.Size < 2 || r.Price <= 0 {
+				return nil, fmt.Errorf("rule %s: bundle needs an item, size >= 2 and a positive price", r.Name)
+			}
+		default:
+			return nil, fmt.Errorf("rule %s: unknown kind %q (expected bulk or bundle)", r.Name, r.Kind)
+		}
+	}
+	return &cfg, nil
+}
+
+// quote prices a quantity of an item at list price, or with the rule that makes it
+// cheapest. It returns the rule applied, empty for the list price. A nil config quotes
+// list prices.
+func (cfg *PricingConfig) quote(item string, quantity int) (price float64, rule string) {
+	unit := itemPrices[item]
+	price = unit * float64(quantity)
+	if cfg == nil {
+		return price, ""
+	}
+	for _, r := range cfg.Rules {
+		if r.Item != "" && r.Item != item {
+			continue
+		}
+		var p float64
+		switch r.Kind {
+		case "bulk":
+			if quantity < r.MinQuantity {
+				continue
+			}
+			p = unit * float64(quantity) * (1 - r.Discount)
+		case "bundle":
+			if quantity < r.Size {
+				continue
+			}
+			p = float64(quantity/r.Size)*r.Price + float64(quantity%r.Size)*unit
+		}
+		if p < price {
+			price, rule = p, r.Name
+		}
+	}
+	return price, rule
+}
+
+// describePrice formats a settled price together with the rule applied
+func describePrice(price float64, rule string) string {
+	if rule == "" {
+		return fmt.Sprintf("%.2f", price)
+	}
+	return fmt.Sprintf("%.2f (rule %s)", price, rule)
+}
+
+// ======= REQUEST TRACKING =======
+
+// CompletedRequest is a processed request together with its outcome
+type CompletedRequest struct {
+	Time      time.Time `json:"time"`
+	TraderID  int       `json:"trader_id"`
+	SellerID  int       `json:"seller_id,omitempty"`
+	RequestID int       `json:"request_id"`
+	Post      int       `json:"post"`
+	Item      string    `json:"item"`
+	Quantity  int       `json:"quantity"`
+	Status    string    `json:"status"`
+	Path      []string  `json:"path,omitempty"`
+
+	BuyerID int     `json:"buyer_id,omitempty"` // Set instead of SellerID for purchases
+	Price   float64 `json:"price,omitempty"`    // Amount paid for a purchase
+	Rule    string  `json:"rule,omitempty"`     // Pricing rule applied to a purchase
+}
+
+// RequestHistory is a fixed-size ring of the most recently completed requests
+type RequestHistory struct {
+	mu      sync.Mutex
+	records []CompletedRequest
+	next    int
+	full    bool
+	total   int // Completed requests ever recorded
+}
+
+// NewRequestHistory creates a history holding the last size completed requests
+func NewRequestHistory(size int) *RequestHistory {
+	if size < 1 {
+		size = 1
+	}
+	return &RequestHistory{records: make([]CompletedRequest, size)}
+}
+
+// Add records a completed request, overwriting the oldest one when the ring is full
+func (h *RequestHistory) Add(rec CompletedRequest) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records[h.next] = rec
+	h.next = (h.next + 1) % len(h.records)
+	if h.next == 0 {
+		h.full = true
+	}
+	h.total++
+}
+
+// Len returns the number of requests currently held and the number ever recorded
+func (h *RequestHistory) Len() (held, total int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.full {
+		return len(h.records), h.total
+	}
+	return h.next, h.total
+}
+
+// AuditLog appends completed requests to a file as JSON lines
+type AuditLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// OpenAuditLog opens (or creates) an audit log for appending
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Append writes one record
+func (a *AuditLog) Append(rec interface{}) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.enc.Encode(rec)
+}
+
+// Close syncs and closes the audit log
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.f.Sync(); err != nil {
+		a.f.Close()
+		return err
+	}
+	return a.f.Close()
+}
+
+// approxRequestBytes estimates the memory held by one tracked request
+func approxRequestBytes(item string) int {
+	return int(unsafe.Sizeof(CompletedRequest{})) + len(item)
+}
+
+// firstDelivery records an at-most-once request and reports whether this is the first
+// time it arrived. Requests with other semantics always count as first deliveries.
+func (t *Trader) firstDelivery(req *Request) bool {
+	if req.Delivery != deliveryAtMostOnce {
+		return true
+	}
+	key := RequestKey{req.SellerID, req.RequestID}
+	now := time.Now()
+
+	t.RequestMu.Lock()
+	defer t.RequestMu.Unlock()
+	if t.seenOnce == nil {
+		t.seenOnce = make(map[RequestKey]time.Time)
+	}
+	if _, seen := t.seenOnce[key]; seen {
+		t.DupsDropped++
+		return false
+	}
+	t.seenExpiry.expire(now, atMostOnceRetention, func(k RequestKey) {
+		if at, ok := t.seenOnce[k]; ok && now.Sub(at) > atMostOnceRetention {
+			delete(t.seenOnce, k)
+		}
+	})
+	t.seenOnce[key] = now
+	t.seenExpiry.push(key, now)
+	return true
+}
+
+// errInProgress reports a request of which a copy is already in flight
+var errInProgress = errors.New("request already in progress")
+
+// OverloadedError reports a full request queue, and how long the Seller should back off
+type OverloadedError struct {
+	Depth      int
+	RetryAfter time.Duration
+}
+
+func (e *OverloadedError) Error() string {
+	return fmt.Sprintf("%d requests queued or in flight; retry after %v", e.Depth, e.RetryAfter)
+}
+
+// trackRequest registers a request as in flight. It returns errInProgress if a copy of
+// it already is, and an *OverloadedError if bounded and the queue is full.
+func (t *Trader) trackRequest(req *Request, bounded bool) error {
+	t.RequestMu.Lock()
+	defer t.RequestMu.Unlock()
+	for _, r := range t.Requests {
+		if r.SellerID == req.SellerID && r.RequestID == req.RequestID {
+			return errInProgress
+		}
+	}
+	if bounded {
+		if err := t.checkQueueLocked(); err != nil {
+			return err
+		}
+	}
+	t.Requests = append(t.Requests, *req)
+	return nil
+}
+
+// checkQueueLocked returns an *OverloadedError if MaxQueue requests are in flight or
+// waiting for a dispatcher; RequestMu must be held
+func (t *Trader) checkQueueLocked() error {
+	depth := len(t.Requests) + len(t.acceptQueue)
+	if t.MaxQueue <= 0 || depth < t.MaxQueue {
+		return nil
+	}
+	return t.queueFull(depth)
+}
+
+// queueFull estimates when a queue of depth requests will have drained: each worker
+// slot takes one request per processing time, and unlimited workers take them all at once
+func (t *Trader) queueFull(depth int) *OverloadedError {
+	slots := t.workers.size()
+	if slots <= 0 {
+		slots = max(depth, 1)
+	}
+	rounds := max((depth+slots-1)/slots, 1)
+	return &OverloadedError{Depth: depth, RetryAfter: time.Duration(rounds) * common.Scaled(processingTime)}
+}
+
+// refuseOverloaded answers a request that found the queue full
+func (t *Trader) refuseOverloaded(req *Request, res *Response, err *OverloadedError) {
+	t.RequestMu.Lock()
+	t.Overloaded++
+	t.RequestMu.Unlock()
+	slog.Warn("Refusing request as overloaded", "request", req.RequestID, "seller", req.SellerID, "err", err)
+	res.Status = "Overloaded"
+	res.Message = fmt.Sprintf("Trader %d is overloaded (%v)", t.ID, err)
+	res.RetryAfter = err.RetryAfter
+}
+
+// isInFlight reports whether a request is currently being processed
+func (t *Trader) isInFlight(key RequestKey) bool {
+	t.RequestMu.Lock()
+	defer t.RequestMu.Unlock()
+	for _, r := range t.Requests {
+		if r.SellerID == key.SellerID && r.RequestID == key.RequestID {
+			return true
+		}
+	}
+	return false
+}
+
+// untrackRequestLocked removes a request from the in-flight list; RequestMu must be held
+func (t *Trader) untrackRequestLocked(req *Request) {
+	for i, r := range t.Requests {
+		if r.SellerID == req.SellerID && r.RequestID == req.RequestID {
+			t.Requests = append(t.Requests[:i], t.Requests[i+1:]...)
+			return
+		}
+	}
+}
+
+// completeRequest moves a request received at start from the in-flight list to the
+// bounded history and spills it to the audit log
+func (t *Trader) completeRequest(req *Request, res *Response, start time.Time) {
+	t.RequestMu.Lock()
+	t.untrackRequestLocked(req)
+	t.RequestMu.Unlock()
+	if res.Status == "Success" {
+		t.Posts.Completed(req.Post, false, start)
+	}
+
+	rec := CompletedRequest{
+		Time:      time.Now(),
+		TraderID:  t.ID,
+		SellerID:  req.SellerID,
+		RequestID: req.RequestID,
+		Post:      req.Post,
+		Item:      req.Item,
+		Quantity:  req.Quantity,
+		Status:    res.Status,
+		Path:      req.Path,
+	}
+	t.History.Add(rec)
+	t.Queries.Invalidate()
+	if t.AuditLog != nil {
+		if err := t.AuditLog.Append(rec); err != nil {
+			slog.Warn("Failed to write audit log", "err", err)
+		}
+	}
+
+	if _, total := t.History.Len(); total%100 == 0 {
+		inFlight, held, bytes := t.trackingStats()
+		slog.Info("Request tracking", "in_flight", inFlight, "history", held, "completed", total, "bytes", bytes)
+	}
+	if t.Metrics != nil {
+		if err := t.Metrics.Event(); err != nil {
+			slog.Warn("Failed to write metrics snapshot", "err", err)
+		}
+	}
+}
+
+// trackingStats reports how many requests are tracked and roughly how much memory they use
+func (t *Trader) trackingStats() (inFlight, held, bytes int) {
+	t.RequestMu.Lock()
+	inFlight = len(t.Requests)
+	for _, r := range t.Requests {
+		bytes += approxRequestBytes(r.Item)
+	}
+	t.RequestMu.Unlock()
+
+	t.History.mu.Lock()
+	for _, r := range t.History.records {
+		bytes += approxRequestBytes(r.Item)
+	}
+	t.History.mu.Unlock()
+
+	held, _ = t.History.Len()
+	return inFlight, held, bytes
+}
+
+// ======= ADMISSION CONTROL =======
+
+// Rough per-entry memory costs used by the admission estimate
+const (
+	mapEntryOverhead      = 48
+	stockEntryBytes       = mapEntryOverhead + 8
+	cancelEntryBytes      = mapEntryOverhead + int(unsafe.Sizeof(RequestKey{}))
+	replicationEntryBytes = int(unsafe.Sizeof(ReplicationEntry{}))
+)
+
+// approxMemory estimates the memory held by request tracking, cancellations, inventory and
+// the replication backlog
+func (t *Trader) approxMemory() int {
+	_, _, bytes := t.trackingStats()
+
+	t.RequestMu.Lock()
+	bytes += len(t.Cancelled) * cancelEntryBytes
+	t.RequestMu.Unlock()
+
+	t.InventoryMu.Lock()
+	for _, m := range []map[string]int{t.Inventory, t.Adopted, t.Handback, t.PeerInventory} {
+		for item := range m {
+			bytes += stockEntryBytes + len(item)
+		}
+	}
+	t.InventoryMu.Unlock()
+
+	if t.Replicator != nil {
+		t.Replicator.mu.Lock()
+		bytes += len(t.Replicator.pending) * replicationEntryBytes
+		t.Replicator.mu.Unlock()
+	}
+	return bytes
+}
+
+// admit checks whether new work fits under the memory limit
+func (t *Trader) admit() (used int, ok bool) {
+	if t.MemLimit <= 0 {
+		return 0, true
+	}
+	used = t.approxMemory()
+	return used, used < t.MemLimit
+}
+
+// rateBurst is the number of requests a Seller may send back to back before SellerRate applies
+const rateBurst = 5
+
+// tokenBucket tracks one Seller's request allowance
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allowRequest takes a token from the Seller's bucket, refilled at SellerRate per
+// (scaled) second up to rateBurst, and reports false if none was left
+func (t *Trader) allowRequest(sellerID int) bool {
+	if t.SellerRate <= 0 {
+		return true
+	}
+	now := time.Now()
+
+	t.RequestMu.Lock()
+	defer t.RequestMu.Unlock()
+	if t.buckets == nil {
+		t.buckets = make(map[int]*tokenBucket)
+	}
+	b, ok := t.buckets[sellerID]
+	if !ok {
+		b = &tokenBucket{tokens: rateBurst, last: now}
+		t.buckets[sellerID] = b
+	}
+	elapsed := float64(now.Sub(b.last)) / float64(common.Scaled(time.Second))
+	b.tokens = math.Min(rateBurst, b.tokens+elapsed*t.SellerRate)
+	b.last = now
+	if b.tokens < 1 {
+		t.RateLimited++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ======= WORK SCHEDULING =======
+
+// workSlots bounds concurrent work. A freed slot goes to the waiting request with the
+// highest priority, then the earliest deadline, then the one waiting longest.
+type workSlots struct {
+	mu      sync.Mutex
+	limit   int // 0 for unlimited
+	inUse   int
+	waiting []*slotWaiter
+	seq     uint64
+}
+
+// slotWaiter is a request waiting for a slot
+type slotWaiter struct {
+	priority int
+	deadline time.Time
+	seq      uint64
+	ready    chan struct{} // Closed when the slot is handed over
+}
+
+// newWorkSlots returns slots for at most limit concurrent requests (0 for unlimited)
+func newWorkSlots(limit int) *workSlots {
+	return &workSlots{limit: limit}
+}
+
+// before reports whether w should get a slot ahead of other
+func (w *slotWaiter) before(other *slotWaiter) bool {
+	if w.priority != other.priority {
+		return w.priority > other.priority
+	}
+	if w.deadline.IsZero() != other.deadline.IsZero() {
+		return !w.deadline.IsZero()
+	}
+	if !w.deadline.Equal(other.deadline) {
+		return w.deadline.Before(other.deadline)
+	}
+	return w.seq < other.seq
+}
+
+// acquire waits for a slot for the request, reporting false if its deadline passes first
+func (ws *workSlots) acquire(req *Request) bool {
+	ws.mu.Lock()
+	if ws.limit <= 0 || (ws.inUse < ws.limit && len(ws.waiting) == 0) {
+		ws.inUse++
+		ws.mu.Unlock()
+		return true
+	}
+	ws.seq++
+	w := &slotWaiter{priority: req.Priority, deadline: req.Deadline, seq: ws.seq, ready: make(chan struct{})}
+	ws.waiting = append(ws.waiting, w)
+	ws.mu.Unlock()
+
+	var expired <-chan time.Time
+	if !req.Deadline.IsZero() {
+		timer := time.NewTimer(time.Until(req.Deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-w.ready:
+		return true
+	case <-expired:
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for i, other := range ws.waiting {
+		if other == w {
+			ws.waiting = append(ws.waiting[:i], ws.waiting[i+1:]...)
+			return false
+		}
+	}
+	// The slot was handed over just as the deadline passed
+	return true
+}
+
+// release frees a slot, handing it straight to the first waiting request unless the
+// limit was lowered below the slots in use
+func (ws *workSlots) release() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if len(ws.waiting) == 0 || (ws.limit > 0 && ws.inUse > ws.limit) {
+		ws.inUse--
+		return
+	}
+	ws.handOver()
+}
+
+// handOver gives a slot to the first waiting request. ws.mu must be held.
+func (ws *workSlots) handOver() {
+	first := 0
+	for i, w := range ws.waiting {
+		if w.before(ws.waiting[first]) {
+			first = i
+		}
+	}
+	w := ws.waiting[first]
+	ws.waiting = append(ws.waiting[:first], ws.waiting[first+1:]...)
+	close(w.ready)
+}
+
+// setLimit changes the number of slots. New slots go straight to waiting requests;
+// removed ones are taken back as the requests holding them finish.
+func (ws *workSlots) setLimit(limit int) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.limit = limit
+	for len(ws.waiting) > 0 && (limit <= 0 || ws.inUse < limit) {
+		ws.inUse++
+		ws.handOver()
+	}
+}
+
+// load returns the number of slots in use and of requests waiting for one
+func (ws *workSlots) load() (inUse, waiting int) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.inUse, len(ws.waiting)
+}
+
+// size returns the current limit (0 for unlimited)
+func (ws *workSlots) size() int {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.limit
+}
+
+// cpuBusyThreshold is the share of the available CPUs above which the worker pool is
+// not grown, since more workers would only queue for the CPUs instead
+const cpuBusyThreshold = 0.9
+
+// workersPerCPU sets the default upper bound of the autoscaled pool. Most of a request's
+// time is spent waiting rather than computing, so a CPU can carry several.
+const workersPerCPU = 4
+
+// idleRunsToShrink is how many autoscaling runs in a row must find an idle slot and
+// nothing waiting before the pool shrinks, so a pause between bursts keeps the workers
+const idleRunsToShrink = 30
+
+// cpuBusy returns the share of the CPUs Go may use (GOMAXPROCS) that this process kept
+// busy since the last call
+func (t *Trader) cpuBusy() float64 {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	cpu := time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+	now := time.Now()
+	lastCPU, lastTime := t.lastCPU, t.lastCPUTime
+	t.lastCPU, t.lastCPUTime = cpu, now
+	if lastTime.IsZero() {
+		return 0
+	}
+	return float64(cpu-lastCPU) / (float64(now.Sub(lastTime)) * float64(runtime.GOMAXPROCS(0)))
+}
+
+// autoscaleWorkers resizes the worker pool between WorkersMin and WorkersMax. Requests
+// waiting for a slot grow it by as many as are waiting, unless the CPUs are already
+// busy; a slot idle for idleRunsToShrink runs shrinks it by one.
+func (t *Trader) autoscaleWorkers() error {
+	inUse, waiting := t.workers.load()
+	limit := t.workers.size()
+	busy := t.cpuBusy()
+
+	if waiting == 0 && inUse < limit {
+		t.idleRuns++
+	} else {
+		t.idleRuns = 0
+	}
+	target := limit
+	switch {
+	case waiting > 0 && busy < cpuBusyThreshold:
+		target = min(t.WorkersMax, limit+waiting)
+	case t.idleRuns >= idleRunsToShrink:
+		target = max(t.WorkersMin, limit-1)
+		t.idleRuns = 0
+	}
+	if target == limit {
+		return nil
+	}
+
+	t.workers.setLimit(target)
+	t.RequestMu.Lock()
+	t.WorkerScalings++
+	t.RequestMu.Unlock()
+	slog.Info("Scaled workers", "from", limit, "to", target, "processing", inUse, "waiting", waiting, "cpu_busy", fmt.Sprintf("%.0f%%", busy*100))
+	return nil
+}
+
+// errExpired reports a request whose deadline passed while it waited for a forward slot
+var errExpired = errors.New("deadline passed while waiting to forward")
+
+// expired reports whether a request's deadline has passed
+func expired(req *Request) bool {
+	return !req.Deadline.IsZero() && time.Now().After(req.Deadline)
+}
+
+// refuseExpired answers a request whose deadline passed before it could start
+func (t *Trader) refuseExpired(req *Request, res *Response) {
+	t.RequestMu.Lock()
+	t.Expired++
+	t.RequestMu.Unlock()
+	slog.Warn("Request missed its deadline", "request", req.RequestID, "seller", req.SellerID, "priority", req.Priority, "deadline", req.Deadline.Format(time.RFC3339Nano))
+	res.Status = "Expired"
+	res.Message = fmt.Sprintf("Request %d could not start before its deadline", req.RequestID)
+}
+
+// noteForwardedTerm learns the term a forwarded request was stamped with. A term from
+// the peer newer than the last one it reported is recorded, and a leader that sees a
+// term newer than its own warns that it was superseded; reconciliation resolves it.
+func (t *Trader) noteForwardedTerm(req *Request) {
+	if req.Term == 0 || len(req.Path) < 2 {
+		return
+	}
+	from := req.Path[len(req.Path)-1]
+
+	peerID := t.peerID()
+	t.HeartbeatMu.Lock()
+	defer t.HeartbeatMu.Unlock()
+	if peerID != 0 && from == traderHop(peerID) && req.Term > t.peerTerm {
+		t.peerTerm = req.Term
+	}
+	if t.IsLeader && req.Term > t.Term {
+		slog.Warn("Request was forwarded in a newer term", "request", req.RequestID, "from", from, "forward_term", req.Term, "term", t.Term)
+	}
+}
+
+// ======= SELLER REGISTRY =======
+
+// RegisterSeller records a Seller's address. A Seller re-registering under the same ID
+// (e.g. after a restart on a new port) atomically replaces its old registration, and the
+// old address stops receiving notifications.
+func (t *Trader) RegisterSeller(info *common.SellerInfo, reply *RegisterReply) error {
+	if err := t.injectFault("RegisterSeller"); err != nil {
+		return err
+	}
+	if info.ID <= 0 || info.Address == "" {
+		return fmt.Errorf("invalid registration: seller ID %d at %q", info.ID, info.Address)
+	}
+	if !t.registrationSigned(info) {
+		return fmt.Errorf("registration of seller %d: %w", info.ID, errUnsigned)
+	}
+
+	t.RegistryMu.Lock()
+	defer t.RegistryMu.Unlock()
+	*reply = t.registerLocked(info)
+	return nil
+}
+
+// RegisterSellersBulk registers many Sellers in one call, e.g. every Seller of an
+// experiment before it starts, instead of each racing the Trader's startup on its own.
+// Nothing is registered unless every entry is valid; replies follow the order of infos.
+func (t *Trader) RegisterSellersBulk(infos []common.SellerInfo, reply *[]RegisterReply) error {
+	if err := t.injectFault("RegisterSellersBulk"); err != nil {
+		return err
+	}
+	seen := make(map[int]bool, len(infos))
+	for _, info := range infos {
+		if info.ID <= 0 || info.Address == "" {
+			return fmt.Errorf("invalid registration: seller ID %d at %q", info.ID, info.Address)
+		}
+		if seen[info.ID] {
+			return fmt.Errorf("seller ID %d is listed twice", info.ID)
+		}
+		if !t.registrationSigned(&info) {
+			return fmt.Errorf("registration of seller %d: %w", info.ID, errUnsigned)
+		}
+		seen[info.ID] = true
+	}
+
+	t.RegistryMu.Lock()
+	defer t.RegistryMu.Unlock()
+	*reply = make([]RegisterReply, len(infos))
+	for i := range infos {
+		(*reply)[i] = t.registerLocked(&infos[i])
+	}
+	slog.Info("Registered Sellers in bulk", "count", len(infos))
+	return nil
+}
+
+// registrationSigned reports whether a registration carries the cluster secret's signature,
+// logging the ones that do not
+func (t *Trader) registrationSigned(info *common.SellerInfo) bool {
+	if t.signedWith(info.Signature, func(secret string) string { return common.RegistrationSignature(secret, info) }) {
+		return true
+	}
+	slog.Warn("Rejected registration with an invalid signature", "seller", info.ID, "addr", info.Address)
+	return false
+}
+
+// registerLocked records a valid registration and starts its session; RegistryMu must be held
+func (t *Trader) registerLocked(info *common.SellerInfo) RegisterReply {
+	var reply RegisterReply
+
+	// A fresh registration starts a fresh session: a restarted Seller numbers its
+	// requests from 1 again, so the old watermark must not carry over
+	reg := &SellerInfo{ID: info.ID, Address: info.Address, Post: info.Post, Registered: time.Now(), LeasedThrough: t.leases[info.ID]}
+	if old, ok := t.Registry[info.ID]; ok {
+		reg.Generation = old.Generation
+		if old.Address != info.Address {
+			reg.Generation++
+			reply.Replaced = old.Address
+			slog.Info("Seller moved; dropping the stale registration", "seller", info.ID, "old_addr", old.Address, "addr", info.Address, "generation", reg.Generation)
+		}
+	} else {
+		if old, ok := t.evicted[info.ID]; ok {
+			// The fresh session drops the evicted watermark but keeps the generation
+			reg.Generation = old.Generation
+			delete(t.evicted, info.ID)
+		}
+		slog.Info("Registered Seller", "seller", info.ID, "addr", info.Address, "post", info.Post)
+	}
+	t.Registry[info.ID] = reg
+	t.replicateSellerLocked(reg)
+
+	reply.Generation = reg.Generation
+	reply.Session = t.issueSessionLocked(reg)
+	return reply
+}
+
+// ======= SESSIONS =======
+
+// Session is the server-side context of a registered Seller, carried in a signed token
+// so the Seller can resume it on any Trader after reconnecting
+type Session struct {
+	SellerID   int    `json:"seller_id"`
+	Address    string `json:"address"`
+	Post       int    `json:"post"`
+	Generation int64  `json:"generation"`
+	Term       int64  `json:"term"`      // Leadership term of the issuing Trader
+	Watermark  int    `json:"watermark"` // Every request ID up to this one has been committed
+	IssuedAt   int64  `json:"issued_at"` // Unix nanoseconds
+
+	LeasedThrough int `json:"leased_through,omitempty"` // Highest request ID leased to the Seller
+}
+
+// sessionKey returns the key session tokens are signed with. Without a cluster secret,
+// tokens can only be resumed on the Trader that issued them.
+func (t *Trader) sessionKey() string {
+	if t.Secret != "" {
+		return t.Secret
+	}
+	return t.localSessionKey
+}
+
+// issueSessionLocked encodes a registration as a signed session token; RegistryMu must be held
+func (t *Trader) issueSessionLocked(reg *SellerInfo) string {
+	sess := Session{
+		SellerID:   reg.ID,
+		Address:    reg.Address,
+		Post:       reg.Post,
+		Generation: reg.Generation,
+		Term:       t.term(),
+		Watermark:  reg.Watermark,
+		IssuedAt:   time.Now().UnixNano(),
+
+		LeasedThrough: reg.LeasedThrough,
+	}
+	payload, _ := json.Marshal(sess)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + common.Sign(t.sessionKey(), "session", encoded)
+}
+
+// decodeSession verifies a session token and returns its contents
+func (t *Trader) decodeSession(token string) (Session, error) {
+	var sess Session
+	dot := strings.LastIndexByte(token, '.')
+	if dot < 0 {
+		return sess, fmt.Errorf("malformed session token")
+	}
+	encoded, mac := token[:dot], token[dot+1:]
+	if !hmac.Equal([]byte(mac), []byte(common.Sign(t.sessionKey(), "session", encoded))) {
+		t.InventoryMu.Lock()
+		peerKey := t.peerSessionKey
+		t.InventoryMu.Unlock()
+		if peerKey == "" || !hmac.Equal([]byte(mac), []byte(common.Sign(peerKey, "session", encoded))) {
+			return sess, fmt.Errorf("session token signature mismatch")
+		}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return sess, fmt.Errorf("malformed session token: %v", err)
+	}
+	if err := json.Unmarshal(payload, &sess); err != nil {
+		return sess, fmt.Errorf("malformed session token: %v", err)
+	}
+	return sess, nil
+}
+
+// ResumeSession restores a Seller's registration and dedup watermark from a session token,
+// without replaying its history. The Seller may have moved to a new address since.
+func (t *Trader) ResumeSession(args *ResumeArgs, reply *RegisterReply) error {
+	if err := t.injectFault("ResumeSession"); err != nil {
+		return err
+	}
+	if !t.signedWith(args.Signature, func(secret string) string { return common.ResumeSignature(secret, args) }) {
+		slog.Warn("Rejected session resumption with an invalid signature", "addr", args.Address)
+		return fmt.Errorf("session resumption: %w", errUnsigned)
+	}
+	sess, err := t.decodeSession(args.Token)
+	if err != nil {
+		slog.Warn("Rejected session resumption", "err", err)
+		return err
+	}
+	addr := args.Address
+	if addr == "" {
+		addr = sess.Address
+	}
+
+	t.RegistryMu.Lock()
+	defer t.RegistryMu.Unlock()
+
+	reg, ok := t.Registry[sess.SellerID]
+	if !ok {
+		// An evicted Seller comes back with its watermark
+		if reg, ok = t.evicted[sess.SellerID]; ok {
+			delete(t.evicted, sess.SellerID)
+			t.Registry[sess.SellerID] = reg
+		}
+	}
+	switch {
+	case !ok:
+		reg = &SellerInfo{ID: sess.SellerID, Post: sess.Post, Generation: sess.Generation, Watermark: sess.Watermark}
+		t.Registry[sess.SellerID] = reg
+	case reg.Generation > sess.Generation:
+		return fmt.Errorf("session of Seller %d is from generation %d, registration is at %d", sess.SellerID, sess.Generation, reg.Generation)
+	case sess.Watermark > reg.Watermark:
+		reg.raiseWatermark(sess.Watermark)
+	}
+	if err := t.raiseLeaseLocked(sess.SellerID, sess.LeasedThrough); err != nil {
+		slog.Warn("Failed to persist the lease carried by a Seller's session", "seller", sess.SellerID, "err", err)
+	}
+	if reg.Address != "" && reg.Address != addr {
+		reply.Replaced = reg.Address
+	}
+	reg.Address = addr
+	reg.Registered = time.Now()
+	t.replicateSellerLocked(reg)
+
+	slog.Info("Resumed Seller session", "seller", sess.SellerID, "addr", addr, "watermark", reg.Watermark, "issued_term", sess.Term)
+	reply.Generation = reg.Generation
+	reply.Session = t.issueSessionLocked(reg)
+	return nil
+}
+
+// depositRetention is how long a Trader remembers the outcome of committed Seller
+// requests for retries. Older retries fall back to the Seller's watermark.
+const depositRetention = 10 * time.Minute
+
+// expiryQueue lists the keys of a dedup table in the order they were added, so expired
+// entries are dropped from the front instead of by scanning the whole table on every
+// commit while RequestMu is held
+type expiryQueue struct {
+	keys []RequestKey
+	at   []time.Time
+	head int
+}
+
+// push records that key was added at at; a key pushed out of time order only expires late
+func (q *expiryQueue) push(key RequestKey, at time.Time) {
+	q.keys = append(q.keys, key)
+	q.at = append(q.at, at)
+}
+
+// expire pops the keys added more than retention before now and calls drop with each. A
+// key added again since is popped for its first addition too, so drop checks its time.
+func (q *expiryQueue) expire(now time.Time, retention time.Duration, drop func(RequestKey)) {
+	for q.head < len(q.keys) && now.Sub(q.at[q.head]) > retention {
+		drop(q.keys[q.head])
+		q.head++
+	}
+	if q.head > 0 && q.head >= len(q.keys)/2 {
+		q.keys = append(q.keys[:0], q.keys[q.head:]...)
+		q.at = append(q.at[:0], q.at[q.head:]...)
+		q.head = 0
+	}
+}
+
+// depositMessage describes a committed Seller request
+func depositMessage(requestID, quantity int, item string, sellerID int) string {
+	return fmt.Sprintf("Processed request %d: %d %s from Seller %d", requestID, quantity, item, sellerID)
+}
+
+// rememberDepositLocked records the outcome of a committed Seller request in the dedup
+// table, so a retry is answered with it; RequestMu must be held
+func (t *Trader) rememberDepositLocked(req *Request, res *Response, at time.Time) {
+	if t.deposits == nil {
+		t.deposits = make(map[RequestKey]purchase)
+	}
+	t.depositExpiry.expire(at, depositRetention, func(k RequestKey) {
+		if d, ok := t.deposits[k]; ok && at.Sub(d.at) > depositRetention {
+			delete(t.deposits, k)
+		}
+	})
+	key := RequestKey{req.SellerID, req.RequestID}
+	t.deposits[key] = purchase{res: *res, at: at}
+	t.depositExpiry.push(key, at)
+}
+
+// committedResponse returns the recorded outcome of a Seller request that was already
+// committed, counting the retry it answers
+func (t *Trader) committedResponse(req *Request) (Response, bool) {
+	t.RequestMu.Lock()
+	defer t.RequestMu.Unlock()
+	done, ok := t.deposits[RequestKey{req.SellerID, req.RequestID}]
+	if !ok || time.Since(done.at) > depositRetention {
+		return Response{}, false
+	}
+	t.Repeated++
+	return done.res, true
+}
+
+// isDuplicate reports whether a request is at or below its Seller's committed watermark,
+// or was committed above it
+func (t *Trader) isDuplicate(req *Request) bool {
+	t.RegistryMu.Lock()
+	defer t.RegistryMu.Unlock()
+	reg, ok := t.watermarkLocked(req.SellerID)
+	return ok && (req.RequestID <= reg.Watermark || reg.committedAbove[req.RequestID])
+}
+
+// watermarkLocked returns the registration holding a Seller's watermark, evicted or not;
+// RegistryMu must be held
+func (t *Trader) watermarkLocked(sellerID int) (*SellerInfo, bool) {
+	if reg, ok := t.Registry[sellerID]; ok {
+		return reg, true
+	}
+	reg, ok := t.evicted[sellerID]
+	return reg, ok
+}
+
+// noteCommitted advances the Seller's watermark past every contiguously committed request
+func (t *Trader) noteCommitted(req *Request) {
+	t.RegistryMu.Lock()
+	defer t.RegistryMu.Unlock()
+	if reg, ok := t.watermarkLocked(req.SellerID); ok {
+		reg.commit(req.RequestID)
+		reg.LastCommit = time.Now()
+	}
+}
+
+// commit records a committed request and advances the watermark past every contiguously
+// committed one
+func (reg *SellerInfo) commit(requestID int) {
+	if requestID <= reg.Watermark {
+		return
+	}
+	if reg.committedAbove == nil {
+		reg.committedAbove = make(map[int]bool)
+	}
+	reg.committedAbove[requestID] = true
+	for reg.committedAbove[reg.Watermark+1] {
+		delete(reg.committedAbove, reg.Watermark+1)
+		reg.Watermark++
+	}
+}
+
+// raiseWatermark moves the watermark up to w, forgetting the commits it now covers
+func (reg *SellerInfo) raiseWatermark(w int) {
+	if w <= reg.Watermark {
+		return
+	}
+	reg.Watermark = w
+	for id := range reg.committedAbove {
+		if id <= w {
+			delete(reg.committedAbove, id)
+		}
+	}
+	for reg.committedAbove[reg.Watermark+1] {
+		delete(reg.committedAbove, reg.Watermark+1)
+		reg.Watermark++
+	}
+}
+
+// replicateSellerLocked queues a registration for the peer; RegistryMu must be held
+func (t *Trader) replicateSellerLocked(reg *SellerInfo) {
+	if t.Replicator != nil {
+		t.Replicator.AppendSeller(*reg)
+	}
+}
+
+// replicateRegistry queues every registration, e.g. when the peer (re)appears
+func (t *Trader) replicateRegistry() {
+	t.RegistryMu.Lock()
+	defer t.RegistryMu.Unlock()
+	for _, reg := range t.Registry {
+		t.replicateSellerLocked(reg)
+	}
+	if t.Replicator != nil {
+		for _, reg := range t.evicted {
+			t.Replicator.AppendEviction(*reg)
+		}
+	}
+}
+
+// adoptRegistry merges the warm copy of the failed peer's registry into our own, so its
+// Sellers are notified and authenticated without re-registering. Our own registrations win
+// unless the peer saw a newer generation of the Seller. The peer's evicted Sellers are
+// merged into ours for their watermarks.
+func (t *Trader) adoptRegistry(peer, evicted map[int]*SellerInfo) {
+	if len(peer) == 0 && len(evicted) == 0 {
+		return
+	}
+	t.RegistryMu.Lock()
+	defer t.RegistryMu.Unlock()
+
+	for id, reg := range evicted {
+		if _, ok := t.Registry[id]; ok {
+			continue
+		}
+		if own, ok := t.evicted[id]; ok && own.Generation >= reg.Generation {
+			continue
+		}
+		if t.evicted == nil {
+			t.evicted = make(map[int]*SellerInfo)
+		}
+		t.evicted[id] = reg
+	}
+
+	adopted := 0
+	for id, reg := range peer {
+		// IDs the peer leased stay taken whichever registration wins
+		if err := t.raiseLeaseLocked(id, reg.LeasedThrough); err != nil {
+			slog.Warn("Failed to persist the peer's lease", "seller", id, "err", err)
+		}
+		if own, ok := t.Registry[id]; ok && own.Generation >= reg.Generation {
+			continue
+		}
+		reg.LeasedThrough = t.leases[id]
+		t.Registry[id] = reg
+		delete(t.evicted, id)
+		adopted++
+	}
+	slog.Info("Adopted registrations from the peer's registry", "adopted", adopted, "total", len(peer))
+}
+
+// refreshSession returns a current session token for a registered Seller, or ""
+func (t *Trader) refreshSession(sellerID int) string {
+	t.RegistryMu.Lock()
+	defer t.RegistryMu.Unlock()
+	reg, ok := t.Registry[sellerID]
+	if !ok {
+		return ""
+	}
+	return t.issueSessionLocked(reg)
+}
+
+// notifyTarget is one address to inform about a leader change
+type notifyTarget struct {
+	addr       string
+	sellerID   int
+	generation int64
+}
+
+// notifyTargets lists the registered Sellers
+func (t *Trader) notifyTargets() []notifyTarget {
+	t.RegistryMu.Lock()
+	defer t.RegistryMu.Unlock()
+
+	var targets []notifyTarget
+	for _, reg := range t.Registry {
+		targets = append(targets, notifyTarget{addr: reg.Address, sellerID: reg.ID, generation: reg.Generation})
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].addr < targets[j].addr })
+	return targets
+}
+
+// stillCurrent reports whether a notification target has not been superseded by a handover
+func (t *Trader) stillCurrent(target notifyTarget) bool {
+	t.RegistryMu.Lock()
+	defer t.RegistryMu.Unlock()
+
+	reg, ok := t.Registry[target.sellerID]
+	return ok && reg.Generation == target.generation && reg.Address == target.addr
+}
+
+// ======= REQUEST ID LEASES =======
+
+// maxLeaseBlock bounds how many request IDs a single lease may reserve
+const maxLeaseBlock = 10000
+
+// LeaseStore keeps the highest request ID leased to each Seller in a file, replaced
+// atomically on every lease
+type LeaseStore struct {
+	path string
+}
+
+// OpenLeaseStore opens the store and returns the leases saved by an earlier run
+func OpenLeaseStore(path string) (*LeaseStore, map[int]int, error) {
+	leases := make(map[int]int)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &LeaseStore{path: path}, leases, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return nil, nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return &LeaseStore{path: path}, leases, nil
+}
+
+// Save writes the leases to disk and syncs them before returning
+func (s *LeaseStore) Save(leases map[int]int) error {
+	data, err := json.Marshal(leases)
+	if err != nil {
+		return err
+	}
+	return writeFileSynced(s.path, data)
+}
+
+// raiseLeaseLocked records that request IDs up to through are taken by a Seller, persisting
+// the change before it is used; RegistryMu must be held
+func (t *Trader) raiseLeaseLocked(sellerID, through int) error {
+	prev := t.leases[sellerID]
+	if through <= prev {
+		return nil
+	}
+	t.leases[sellerID] = through
+	if t.LeaseStore != nil {
+		if err := t.LeaseStore.Save(t.leases); err != nil {
+			t.leases[sellerID] = prev
+			return err
+		}
+	}
+	if reg, ok := t.Registry[sellerID]; ok {
+		reg.LeasedThrough = through
+	}
+	return nil
+}
+
+// LeaseRequestIDs reserves the next block of request IDs for a Seller. Blocks never
+// overlap, across Seller restarts and across Traders: the lease is persisted before it is
+// granted, replicated with the registration and carried in the session token. The
+// Seller's floor lets the watermark skip IDs it will never send.
+func (t *Trader) LeaseRequestIDs(args *LeaseArgs, reply *LeaseReply) error {
+	if err := t.injectFault("LeaseRequestIDs"); err != nil {
+		return err
+	}
+	if args.SellerID <= 0 || args.Count < 1 || args.Count > maxLeaseBlock {
+		return fmt.Errorf("invalid lease of %d request IDs for Seller %d (1 to %d allowed)", args.Count, args.SellerID, maxLeaseBlock)
+	}
+	if !t.signedWith(args.Signature, func(secret string) string { return common.LeaseSignature(secret, args) }) {
+		slog.Warn("Rejected request ID lease with an invalid signature", "seller", args.SellerID)
+		return fmt.Errorf("lease for Seller %d: %w", args.SellerID, errUnsigned)
+	}
+
+	t.RegistryMu.Lock()
+	defer t.RegistryMu.Unlock()
+
+	first := t.leases[args.SellerID] + 1
+	if args.Above >= first {
+		first = args.Above + 1
+	}
+	last := first + args.Count - 1
+	if err := t.raiseLeaseLocked(args.SellerID, last); err != nil {
+		slog.Warn("Failed to persist lease for Seller", "seller", args.SellerID, "err", err)
+		return fmt.Errorf("could not persist lease: %v", err)
+	}
+
+	if reg, ok := t.Registry[args.SellerID]; ok {
+		if args.Floor > first {
+			args.Floor = first // IDs of the new block cannot have been resolved yet
+		}
+		reg.raiseWatermark(args.Floor - 1)
+		t.replicateSellerLocked(reg)
+		reply.Session = t.issueSessionLocked(reg)
+	}
+	reply.First, reply.Last = first, last
+	slog.Info("Leased request IDs", "seller", args.SellerID, "first", first, "last", last)
+	return nil
+}
+
+// ======= DISTRIBUTED SNAPSHOT =======
+//
+// Chandy–Lamport snapshots: the initiator records its state and sends a marker to the peer
+// behind every replication entry already queued, then records the peer's replication
+// stream until the peer's marker comes back. A Trader receiving a marker first records
+// its state, sends its own marker and finishes at once, since nothing on the channel
+// preceded the marker. Each Trader also sends the marker to its registered Sellers, which
+// record their pending requests. Every node writes its part to SnapshotDir.
+//
+// Hand-backs are direct RPCs outside the replication stream, so one racing a snapshot
+// may be recorded on the channel even though the sender already counted it.
+
+// ChannelMessage is a message from the peer recorded as in flight during a snapshot
+type ChannelMessage struct {
+	Kind     string `json:"kind"` // "replicate" or "handback"
+	Item     string `json:"item"`
+	Quantity int    `json:"quantity"`
+}
+
+// LocalSnapshot is a Trader's part of a global snapshot
+type LocalSnapshot struct {
+	SnapshotID    int64            `json:"snapshot_id"`
+	Role          string           `json:"role"`
+	ID            int              `json:"id"`
+	Post          int              `json:"post"`
+	RecordedAt    time.Time        `json:"recorded_at"`
+	Leader        bool             `json:"leader"`
+	Term          int64            `json:"term"`
+	Inventory     map[string]int   `json:"inventory"`
+	Adopted       map[string]int   `json:"adopted"`
+	Handback      map[string]int   `json:"handback"`
+	PeerInventory map[string]int   `json:"peer_inventory"`
+	InFlight      []Request        `json:"in_flight"`      // Received from Sellers but not yet committed
+	ReplPending   int              `json:"repl_pending"`   // Replication entries not yet sent to the peer
+	Channel       []ChannelMessage `json:"channel"`        // Received from the peer after recording, before its marker
+	ChannelClosed bool             `json:"channel_closed"` // False if the peer's marker never arrived
+}
+
+// snapshotMarkerWait bounds how long the peer channel is recorded, and how old a marker
+// may be and still start a recording
+const snapshotMarkerWait = 10 * time.Second
+
+// StartSnapshot begins a global snapshot on an admin's request and returns its ID
+func (t *Trader) StartSnapshot(args *AdminArgs, reply *int64) error {
+	if err := t.checkAdmin(args); err != nil {
+		return err
+	}
+
+	id := time.Now().UnixNano()
+	if !t.recordSnapshot(id) {
+		return fmt.Errorf("Trader %d is already recording a snapshot", t.ID)
+	}
+	slog.Info("Started global snapshot", "snapshot", id)
+	*reply = id
+	return nil
+}
+
+// ReceiveMarker accepts a marker sent directly when replication is disabled
+func (t *Trader) ReceiveMarker(marker *Marker, reply *string) error {
+	if err := t.injectFault("ReceiveMarker"); err != nil {
+		return err
+	}
+	if t.partitioned() {
+		return errPartitioned
+	}
+	t.receiveMarker(marker.SnapshotID, marker.From)
+	*reply = "OK"
+	return nil
+}
+
+// receiveMarker records on the first marker of a snapshot, and closes the peer channel
+// on the marker that answers ours
+func (t *Trader) receiveMarker(id int64, from int) {
+	t.globalSnapMu.Lock()
+	answering := t.recording != nil && t.recording.SnapshotID == id
+	seen := id <= t.lastSnapshotID
+	t.globalSnapMu.Unlock()
+
+	if answering {
+		t.finishSnapshot(id, true)
+		return
+	}
+	if seen || time.Since(time.Unix(0, id)) > common.Scaled(snapshotMarkerWait) {
+		return
+	}
+
+	slog.Info("Received snapshot marker", "snapshot", id, "trader", from)
+	if t.recordSnapshot(id) {
+		// The marker was the first message on the peer channel, so its state is empty
+		t.finishSnapshot(id, true)
+	}
+}
+
+// recordSnapshot records local state and sends markers to the peer and registered Sellers.
+// It reports false if another snapshot is still being recorded.
+func (t *Trader) recordSnapshot(id int64) bool {
+	t.HeartbeatMu.Lock()
+	snap := &LocalSnapshot{
+		SnapshotID: id,
+		Role:       "trader",
+		ID:         t.ID,
+		Post:       t.Post,
+		Leader:     t.IsLeader,
+		Term:       t.Term,
+	}
+	t.HeartbeatMu.Unlock()
+
+	// In-flight requests and stock are captured together, so a request that commits
+	// concurrently is counted exactly once
+	t.RequestMu.Lock()
+	t.InventoryMu.Lock()
+	t.globalSnapMu.Lock()
+	busy := t.recording != nil
+	if !busy {
+		snap.RecordedAt = time.Now()
+		snap.Inventory = copyStock(t.Inventory)
+		snap.Adopted = copyStock(t.Adopted)
+		snap.Handback = copyStock(t.Handback)
+		snap.PeerInventory = copyStock(t.PeerInventory)
+		snap.InFlight = append([]Request(nil), t.Requests...)
+		t.recording = snap
+		t.lastSnapshotID = id
+	}
+	t.globalSnapMu.Unlock()
+	t.InventoryMu.Unlock()
+	t.RequestMu.Unlock()
+	if busy {
+		return false
+	}
+
+	if t.Replicator != nil {
+		t.Replicator.mu.Lock()
+		snap.ReplPending = len(t.Replicator.pending)
+		t.Replicator.mu.Unlock()
+		t.Replicator.AppendMarker(id)
+	} else {
+		go t.sendMarker(id)
+	}
+	go t.markSellers(id)
+
+	time.AfterFunc(common.Scaled(snapshotMarkerWait), func() { t.finishSnapshot(id, false) })
+	return true
+}
+
+// recordChannel notes a message from the peer while its channel is being recorded;
+// InventoryMu must be held so the message is ordered against recordSnapshot
+func (t *Trader) recordChannel(kind, item string, quantity int) {
+	t.globalSnapMu.Lock()
+	defer t.globalSnapMu.Unlock()
+	if t.recording != nil {
+		t.recording.Channel = append(t.recording.Channel, ChannelMessage{Kind: kind, Item: item, Quantity: quantity})
+	}
+}
+
+// sendMarker delivers a marker to the peer directly when there is no replication stream
+func (t *Trader) sendMarker(id int64) {
+	client, err := t.dialPeer()
+	if err != nil {
+		slog.Warn("Failed to send marker for snapshot to peer", "snapshot", id, "err", err)
+		return
+	}
+	defer client.Close()
+
+	var reply string
+	if err := t.call(client, "Trader.ReceiveMarker", &Marker{SnapshotID: id, From: t.ID}, &reply); err != nil {
+		slog.Warn("Failed to send marker for snapshot to peer", "snapshot", id, "err", err)
+	}
+}
+
+// markSellers sends the marker to every registered Seller, over the response stream for
+// client-only Sellers
+func (t *Trader) markSellers(id int64) {
+	t.RegistryMu.Lock()
+	addrs := make([]string, 0, len(t.Registry))
+	var streamed []int
+	for _, reg := range t.Registry {
+		if common.IsStreamAddress(reg.Address) {
+			streamed = append(streamed, reg.ID)
+		} else {
+			addrs = append(addrs, reg.Address)
+		}
+	}
+	t.RegistryMu.Unlock()
+
+	for _, sellerID := range streamed {
+		t.streamTo(sellerID, StreamMessage{Kind: "marker", Marker: &Marker{SnapshotID: id, From: t.ID}})
+	}
+	for _, addr := range addrs {
+		var reply string
+		if err := t.callNode(addr, "Seller.Snapshot", &Marker{SnapshotID: id, From: t.ID}, &reply); err != nil {
+			slog.Warn("Failed to send marker for snapshot to Seller", "snapshot", id, "addr", addr, "err", err)
+		}
+	}
+}
+
+// finishSnapshot stops recording and writes the local part of the snapshot
+func (t *Trader) finishSnapshot(id int64, channelClosed bool) {
+	t.globalSnapMu.Lock()
+	snap := t.recording
+	if snap == nil || snap.SnapshotID != id {
+		t.globalSnapMu.Unlock()
+		return
+	}
+	t.recording = nil
+	t.globalSnapMu.Unlock()
+
+	snap.ChannelClosed = channelClosed
+	if !channelClosed {
+		slog.Warn("Peer marker never arrived; channel state may be incomplete", "snapshot", id)
+	}
+
+	path, err := writeSnapshotPart(t.SnapshotDir, fmt.Sprintf("snapshot-%d-trader-%d.json", id, t.ID), snap)
+	if err != nil {
+		slog.Warn("Failed to write snapshot", "snapshot", id, "err", err)
+		return
+	}
+	slog.Info("Wrote snapshot", "snapshot", id, "path", path, "channel_messages", len(snap.Channel))
+}
+
+// writeSnapshotPart writes one node's part of a snapshot as indented JSON
+func writeSnapshotPart(dir, name string, part interface{}) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(part, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	return path, os.WriteFile(path, data, 0644)
+}
+
+// ======= LOAD SHARING =======
+
+// ReadOnlyReply is a read-only request answered by the backup from its replica
+type ReadOnlyReply struct {
+	Response   Response
+	ReplicaSeq int64 // Replication sequence of the leader reflected by the replica
+}
+
+// ServeReadOnly answers a dry run delegated by the leader, using the replica of the
+// leader's inventory. Only read-only requests are accepted.
+func (t *Trader) ServeReadOnly(req *Request, reply *ReadOnlyReply) error {
+	if err := t.injectFault("ServeReadOnly"); err != nil {
+		return err
+	}
+	if t.partitioned() {
+		return errPartitioned
+	}
+	if !req.DryRun {
+		return fmt.Errorf("Trader %d only serves read-only requests for its peer", t.ID)
+	}
+
+	reply.Response.RequestID = req.RequestID
+	reply.ReplicaSeq = t.replicaRead(req, &reply.Response)
+	return nil
+}
+
+// replicaRead answers a dry run from the replica of the peer's inventory and returns the
+// replication sequence the replica reflects
+func (t *Trader) replicaRead(req *Request, res *Response) int64 {
+	t.InventoryMu.Lock()
+	stock := t.PeerInventory[req.Item]
+	seq := t.replApplied
+	t.InventoryMu.Unlock()
+
+	t.reportDryRun(req, res, stock)
+	res.Message += fmt.Sprintf(" (served by Trader %d from replica at sequence %d)", t.ID, seq)
+	return seq
+}
+
+// servesReplicaReads reports whether a split read for post can be answered from the
+// replica of the peer's inventory, which this Trader keeps with -replicate
+func (t *Trader) servesReplicaReads(post int) bool {
+	if t.Replicator == nil || post == t.Post {
+		return false
+	}
+	t.HeartbeatMu.Lock()
+	defer t.HeartbeatMu.Unlock()
+	return post == t.peerPost
+}
+
+// overloaded reports whether this leader should delegate read-only work to the backup
+func (t *Trader) overloaded() bool {
+	if t.OffloadAbove <= 0 || t.Replicator == nil || !t.isLeader() || !t.peerUp() {
+		return false
+	}
+	t.RequestMu.Lock()
+	defer t.RequestMu.Unlock()
+	return len(t.Requests) >= t.OffloadAbove
+}
+
+// offload delegates a read-only request to the backup, reporting false if the backup
+// could not serve it
+func (t *Trader) offload(req *Request, res *Response) bool {
+	var reply ReadOnlyReply
+	if err := t.peerCall("Trader.ServeReadOnly", req, &reply); err != nil {
+		slog.Warn("Backup could not serve read-only request", "request", req.RequestID, "err", err)
+		return false
+	}
+	*res = reply.Response
+
+	t.RequestMu.Lock()
+	t.Offloaded++
+	offloaded, local := t.Offloaded, t.ReadOnlyLocal
+	t.RequestMu.Unlock()
+	if offloaded%100 == 1 {
+		slog.Info("Load sharing", "offloaded", offloaded, "local", local)
+	}
+	return true
+}
+
+// ======= MARKET SUMMARY =======
+
+// SubscribeMarket adds or removes a market summary subscriber
+func (t *Trader) SubscribeMarket(args *SubscribeArgs, reply *string) error {
+	if args.Address == "" || args.Service == "" {
+		return fmt.Errorf("invalid subscription: service %q at %q", args.Service, args.Address)
+	}
+	if common.IsStreamAddress(args.Address) {
+		return fmt.Errorf("client-only node at %s cannot receive market summaries", args.Address)
+	}
+
+	t.marketMu.Lock()
+	defer t.marketMu.Unlock()
+	if args.Unsubscribe {
+		delete(t.marketSubs, args.Address)
+		slog.Info("Unsubscribed from market summaries", "service", args.Service, "addr", args.Address)
+		*reply = "Unsubscribed"
+		return nil
+	}
+	if _, ok := t.marketSubs[args.Address]; !ok {
+		slog.Info("Subscribed to market summaries", "service", args.Service, "addr", args.Address)
+	}
+	t.marketSubs[args.Address] = args.Service
+	*reply = "Subscribed"
+	return nil
+}
+
+// Market returns the most recent market summary, e.g. for a dashboard
+func (t *Trader) Market(args int, reply *MarketSummary) error {
+	t.marketMu.Lock()
+	defer t.marketMu.Unlock()
+	if t.lastMarket == nil {
+		return fmt.Errorf("no market summary computed yet")
+	}
+	*reply = *t.lastMarket
+	return nil
+}
+
+// noteTradeLocked counts a committed trade towards the current interval's volume;
+// InventoryMu must be held
+func (t *Trader) noteTradeLocked(item string, quantity int) {
+	if t.marketVolume == nil {
+		t.marketVolume = make(map[string]int)
+	}
+	t.marketVolume[item] += quantity
+	t.marketTrades++
+}
+
+// noteSaleLocked adds a Seller's deposit, or a correction of one, to its cumulative sales;
+// InventoryMu must be held
+func (t *Trader) noteSaleLocked(sellerID int, item string, quantity int) {
+	if sellerID == 0 || quantity == 0 {
+		return
+	}
+	if t.sales == nil {
+		t.sales = make(map[int]map[string]int)
+	}
+	if t.sales[sellerID] == nil {
+		t.sales[sellerID] = make(map[string]int)
+	}
+	t.sales[sellerID][item] += quantity
+}
+
+// leaderboardLocked ranks items and the top Sellers (0 for all) by cumulative sales;
+// InventoryMu must be held
+func (t *Trader) leaderboardLocked(top int) *Leaderboard {
+	lb := &Leaderboard{TraderID: t.ID, Time: time.Now()}
+	items := make(map[string]*ItemSales)
+	for id, sold := range t.sales {
+		seller := SellerSales{SellerID: id, Items: make(map[string]int, len(sold))}
+		for item, qty := range sold {
+			seller.Items[item] = qty
+			seller.Quantity += qty
+			is := items[item]
+			if is == nil {
+				is = &ItemSales{Item: item}
+				items[item] = is
+			}
+			is.Quantity += qty
+			if best := t.sales[is.Leader][item]; is.Leader == 0 || qty > best || (qty == best && id < is.Leader) {
+				is.Leader = id
+			}
+		}
+		lb.Total += seller.Quantity
+		lb.Sellers = append(lb.Sellers, seller)
+	}
+	for _, is := range items {
+		if is.Quantity > 0 {
+			is.Share = float64(t.sales[is.Leader][is.Item]) / float64(is.Quantity)
+		}
+		lb.Items = append(lb.Items, *is)
+	}
+	for i := range lb.Sellers {
+		if lb.Total > 0 {
+			lb.Sellers[i].Share = float64(lb.Sellers[i].Quantity) / float64(lb.Total)
+		}
+	}
+
+	sort.Slice(lb.Items, func(i, j int) bool {
+		if lb.Items[i].Quantity != lb.Items[j].Quantity {
+			return lb.Items[i].Quantity > lb.Items[j].Quantity
+		}
+		return lb.Items[i].Item < lb.Items[j].Item
+	})
+	sort.Slice(lb.Sellers, func(i, j int) bool {
+		if lb.Sellers[i].Quantity != lb.Sellers[j].Quantity {
+			return lb.Sellers[i].Quantity > lb.Sellers[j].Quantity
+		}
+		return lb.Sellers[i].SellerID < lb.Sellers[j].SellerID
+	})
+	if top > 0 && len(lb.Sellers) > top {
+		lb.Sellers = lb.Sellers[:top]
+	}
+	return lb
+}
+
+// GetLeaderboard returns the current sales ranking, limited to the top Sellers (0 for all)
+func (t *Trader) GetLeaderboard(top int, reply *Leaderboard) error {
+	t.InventoryMu.Lock()
+	lb := t.leaderboardLocked(top)
+	t.InventoryMu.Unlock()
+	*reply = *lb
+	return nil
+}
+
+// marketSummary computes the summary for the interval that just ended and starts a new one
+func (t *Trader) marketSummary(interval time.Duration) *MarketSummary {
+	sum := &MarketSummary{
+		TraderID: t.ID,
+		Time:     time.Now(),
+		Interval: interval,
+		Stock:    make(map[string]int),
+		Prices:   make(map[string]float64),
+	}
+	for item, price := range itemPrices {
+		sum.Prices[item] = price
+	}
+
+	t.InventoryMu.Lock()
+	for _, held := range []map[string]int{t.Inventory, t.Adopted, t.Handback} {
+		for item, qty := range held {
+			sum.Stock[item] += qty
+		}
+	}
+	if t.PeerInventory != nil {
+		for item, qty := range t.PeerInventory {
+			sum.Stock[item] += qty
+		}
+		sum.IncludesPeer = true
+	}
+	sum.Volume, sum.Trades = t.marketVolume, t.marketTrades
+	t.marketVolume, t.marketTrades = make(map[string]int), 0
+	sum.Leaderboard = t.leaderboardLocked(0)
+	t.InventoryMu.Unlock()
+
+	if sum.Volume == nil {
+		sum.Volume = make(map[string]int)
+	}
+	for item, qty := range sum.Stock {
+		sum.Value += float64(qty) * itemPrices[item]
+	}
+	return sum
+}
+
+// broadcastMarket computes a market summary over the last window and sends it to subscribers
+func (t *Trader) broadcastMarket(window time.Duration) {
+	sum := t.marketSummary(window)
+	t.marketMu.Lock()
+	t.lastMarket = sum
+	subs := make(map[string]string, len(t.marketSubs))
+	for addr, service := range t.marketSubs {
+		subs[addr] = service
+	}
+	t.marketMu.Unlock()
+
+	slog.Info("Market summary", "stock", sum.Stock, "volume", sum.Volume, "trades", sum.Trades, "value", fmt.Sprintf("%.2f", sum.Value), "subscribers", len(subs))
+	if lb := sum.Leaderboard; len(lb.Sellers) > 0 {
+		slog.Info("Sales leaderboard", "total", lb.Total, "top_item", lb.Items[0].Item, "top_seller", lb.Sellers[0].SellerID,
+			"share", fmt.Sprintf("%.2f", lb.Sellers[0].Share))
+	}
+	for addr, service := range subs {
+		go t.sendMarketSummary(addr, service, sum)
+	}
+}
+
+// sendMarketSummary delivers a summary to one subscriber, dropping subscribers that are gone
+func (t *Trader) sendMarketSummary(addr, service string, sum *MarketSummary) {
+	var reply string
+	if err := t.callNode(addr, service+".MarketSummary", sum, &reply); err != nil {
+		slog.Warn("Dropping market subscriber", "service", service, "addr", addr, "err", err)
+		t.marketMu.Lock()
+		delete(t.marketSubs, addr)
+		t.marketMu.Unlock()
+	}
+}
+
+// ======= SCHEDULED JOBS =======
+
+// Job is a periodic task of the Trader, also runnable on demand through Trader.RunJob
+type Job struct {
+	Name     string
+	Interval time.Duration // Nominal time between runs; 0 runs the job only on demand
+	Run      func() error
+	trigger  chan struct{}
+	retime   chan struct{} // Signalled when Interval changes
+
+	// Metrics (guarded by Scheduler.mu)
+	runs      int
+	failures  int
+	running   bool
+	lastStart time.Time
+	lastTook  time.Duration
+	totalTook time.Duration
+	lastErr   string
+	nextRun   time.Time
+}
+
+// JobStatus reports one scheduled job to an admin
+type JobStatus struct {
+	Name      string
+	Interval  time.Duration // Nominal interval; 0 if the job only runs on demand
+	Runs      int
+	Failures  int
+	Running   bool
+	LastStart time.Time
+	LastTook  time.Duration
+	AvgTook   time.Duration
+	LastError string
+	NextRun   time.Time // Zero if the job only runs on demand
+}
+
+// Scheduler runs the Trader's periodic jobs, each in its own goroutine so a slow job
+// never delays another. A job never overlaps itself: a tick or trigger that arrives
+// while it runs is served once it finishes.
+type Scheduler struct {
+	t    *Trader
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// NewScheduler creates an empty scheduler; add jobs, then call Start
+func NewScheduler(t *Trader) *Scheduler {
+	return &Scheduler{t: t, jobs: make(map[string]*Job)}
+}
+
+// Add registers a job
+func (s *Scheduler) Add(name string, interval time.Duration, run func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[name] = &Job{Name: name, Interval: interval, Run: run, trigger: make(chan struct{}, 1), retime: make(chan struct{}, 1)}
+}
+
+// Start launches every registered job
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		go s.loop(job)
+	}
+}
+
+// loop runs a job on its interval and whenever it is triggered
+func (s *Scheduler) loop(job *Job) {
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	// retime restarts the ticker on the job's current interval
+	retime := func() {
+		if ticker != nil {
+			ticker.Stop()
+			ticker, tick = nil, nil
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		job.nextRun = time.Time{}
+		if job.Interval > 0 {
+			ticker = time.NewTicker(common.Scaled(job.Interval))
+			tick = ticker.C
+			job.nextRun = time.Now().Add(common.Scaled(job.Interval))
+		}
+	}
+	retime()
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-tick:
+		case <-job.trigger:
+		case <-job.retime:
+			retime()
+			continue
+		}
+		s.runOnce(job)
+	}
+}
+
+// runOnce runs a job and records its metrics
+func (s *Scheduler) runOnce(job *Job) {
+	start := time.Now()
+	s.mu.Lock()
+	job.running = true
+	job.lastStart = start
+	s.mu.Unlock()
+
+	err := job.Run()
+	took := time.Since(start)
+
+	s.mu.Lock()
+	job.running = false
+	job.runs++
+	job.lastTook = took
+	job.totalTook += took
+	job.lastErr = ""
+	if err != nil {
+		job.failures++
+		job.lastErr = err.Error()
+	}
+	if job.Interval > 0 {
+		job.nextRun = start.Add(common.Scaled(job.Interval))
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		slog.Warn("Job failed", "job", job.Name, "took", took, "err", err)
+	}
+}
+
+// SetInterval changes a job's interval; its next run is one new interval from now. A
+// job not added (yet) is left alone.
+func (s *Scheduler) SetInterval(name string, interval time.Duration) {
+	s.mu.Lock()
+	job, ok := s.jobs[name]
+	if ok {
+		job.Interval = interval
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case job.retime <- struct{}{}:
+	default:
+	}
+}
+
+// Trigger asks for a job to run now. A trigger already waiting absorbs this one.
+func (s *Scheduler) Trigger(name string) error {
+	s.mu.Lock()
+	job, ok := s.jobs[name]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no job named %q on Trader %d", name, s.t.ID)
+	}
+	select {
+	case job.trigger <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// status reports every job, sorted by name
+func (s *Scheduler) status() []JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []JobStatus
+	for _, job := range s.jobs {
+		st := JobStatus{
+			Name:      job.Name,
+			Interval:  job.Interval,
+			Runs:      job.runs,
+			Failures:  job.failures,
+			Running:   job.running,
+			LastStart: job.lastStart,
+			LastTook:  job.lastTook,
+			LastError: job.lastErr,
+			NextRun:   job.nextRun,
+		}
+		if job.runs > 0 {
+			st.AvgTook = job.totalTook / time.Duration(job.runs)
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// JobArgs names a job for Trader.RunJob
+type JobArgs struct {
+	Token string
+	Name  string
+}
+
+// Jobs reports the Trader's scheduled jobs and their metrics
+func (t *Trader) Jobs(args *AdminArgs, reply *[]JobStatus) error {
+	if err := t.checkAdmin(args); err != nil {
+		return err
+	}
+	if t.Scheduler == nil {
+		return fmt.Errorf("Trader %d runs no scheduled jobs", t.ID)
+	}
+	*reply = t.Scheduler.status()
+	return nil
+}
+
+// RunJob triggers a scheduled job now; it runs in the background
+func (t *Trader) RunJob(args *JobArgs, reply *string) error {
+	if err := t.checkAdmin(&AdminArgs{Token: args.Token}); err != nil {
+		return err
+	}
+	if t.Scheduler == nil {
+		return fmt.Errorf("Trader %d runs no scheduled jobs", t.ID)
+	}
+	if err := t.Scheduler.Trigger(args.Name); err != nil {
+		return err
+	}
+	slog.Info("Job triggered by admin", "job", args.Name)
+	*reply = fmt.Sprintf("Trader %d: job %s triggered", t.ID, args.Name)
+	return nil
+}
+
+// checkpoint records a global snapshot, as an admin's StartSnapshot would. Only the
+// leader starts one; its marker brings the backup into the same snapshot.
+func (t *Trader) checkpoint() error {
+	if !t.isLeader() {
+		slog.Info("Skipping checkpoint; the leader takes them")
+		return nil
+	}
+	id := time.Now().UnixNano()
+	if !t.recordSnapshot(id) {
+		return fmt.Errorf("snapshot still being recorded")
+	}
+	slog.Info("Started checkpoint snapshot", "snapshot", id)
+	return nil
+}
+
+// evictIdleSellers drops the registrations of Sellers with no request committed or
+// registration made for longer than ttl. Their addresses stop receiving notifications,
+// but their watermarks are kept, here and on the peer, so a late retry is still caught
+// as a duplicate once the response cache has forgotten it.
+func (t *Trader) evictIdleSellers(ttl time.Duration) error {
+	cutoff := time.Now().Add(-common.Scaled(ttl))
+	t.RegistryMu.Lock()
+	defer t.RegistryMu.Unlock()
+	for id, reg := range t.Registry {
+		if reg.Registered.After(cutoff) || reg.LastCommit.After(cutoff) {
+			continue
+		}
+		delete(t.Registry, id)
+		if t.evicted == nil {
+			t.evicted = make(map[int]*SellerInfo)
+		}
+		t.evicted[id] = reg
+		if t.Replicator != nil {
+			t.Replicator.AppendEviction(*reg)
+		}
+		slog.Info("Evicted idle Seller", "seller", id, "addr", reg.Address, "ttl", ttl, "watermark", reg.Watermark)
+	}
+	return nil
+}
+
+// ======= ADMIN API =======
+
+// AdminArgs carries the admin credential for privileged operations.
+// It is deliberately separate from anything a Seller sends, so a seller
+// credential can never authorize an admin action.
+type AdminArgs struct {
+	Token  string
+	Enable bool // Used by toggle operations such as Drain
+}
+
+// checkAdmin verifies the admin token in constant time
+func (t *Trader) checkAdmin(args *AdminArgs) error {
+	if t.AdminToken == "" {
+		return fmt.Errorf("admin API disabled on Trader %d (no -admin-token configured)", t.ID)
+	}
+	if subtle.ConstantTimeCompare([]byte(args.Token), []byte(t.AdminToken)) != 1 {
+		slog.Warn("Rejected admin call with invalid token")
+		return fmt.Errorf("admin authentication failed")
+	}
+	return nil
+}
+
+// Drain toggles drain mode, in which the Trader stops accepting new requests
+func (t *Trader) Drain(args *AdminArgs, reply *string) error {
+	if err := t.checkAdmin(args); err != nil {
+		return err
+	}
+
+	t.RequestMu.Lock()
+	t.Draining = args.Enable
+	t.RequestMu.Unlock()
+	t.Transitions.Drain(args.Enable, causeAdminDrain, t.term())
+
+	slog.Info("Drain mode set by admin", "enable", args.Enable)
+	*reply = fmt.Sprintf("Trader %d draining=%v", t.ID, args.Enable)
+	return nil
+}
+
+// Partition injects (Enable) or heals a network partition between this Trader and its peer
+func (t *Trader) Partition(args *AdminArgs, reply *string) error {
+	if err := t.checkAdmin(args); err != nil {
+		return err
+	}
+
+	t.HeartbeatMu.Lock()
+	t.Partitioned = args.Enable
+	t.HeartbeatMu.Unlock()
+	if args.Enable {
+		t.Conns.Drop(t.peerAddr(), nil)
+	}
+
+	slog.Info("Partition from peer set by admin", "enable", args.Enable)
+	*reply = fmt.Sprintf("Trader %d partitioned=%v", t.ID, args.Enable)
+	return nil
+}
+
+// Fault is injected into every call of one RPC method
+type Fault struct {
+	Delay    time.Duration // Added before the method runs (nominal time, see common.Scaled)
+	Jitter   time.Duration // Up to this much extra delay, chosen at random per call
+	DropProb float64       // Probability of failing the call without running it
+}
+
+// FaultArgs sets or clears (zero Fault) the fault injected into an RPC method
+type FaultArgs struct {
+	Token  string
+	Method string // Method name without the "Trader." prefix, e.g. "ReplicateBatch"
+	Fault  Fault
+}
+
+// errInjectedDrop is returned for calls dropped by fault injection
+var errInjectedDrop = errors.New("call dropped by injected fault")
+
+// InjectFault delays or drops calls to one RPC method, so a single protocol step can be
+// slowed down in isolation
+func (t *Trader) InjectFault(args *FaultArgs, reply *string) error {
+	if err := t.checkAdmin(&AdminArgs{Token: args.Token}); err != nil {
+		return err
+	}
+	if args.Fault.DropProb < 0 || args.Fault.DropProb > 1 {
+		return fmt.Errorf("drop probability %v outside [0, 1]", args.Fault.DropProb)
+	}
+
+	t.faultMu.Lock()
+	if args.Fault == (Fault{}) {
+		delete(t.faults, args.Method)
+	} else {
+		t.faults[args.Method] = args.Fault
+	}
+	t.faultMu.Unlock()
+
+	slog.Info("Fault set by admin", "method", args.Method, "delay", args.Fault.Delay, "jitter", args.Fault.Jitter, "drop", fmt.Sprintf("%.0f%%", args.Fault.DropProb*100))
+	*reply = fmt.Sprintf("Trader %d fault on %s: %+v", t.ID, args.Method, args.Fault)
+	return nil
+}
+
+// injectFault applies the fault configured for an RPC method, if any
+func (t *Trader) injectFault(method string) error {
+	t.faultMu.Lock()
+	f, ok := t.faults[method]
+	t.faultMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	delay := f.Delay
+	if f.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(f.Jitter)))
+	}
+	time.Sleep(common.Scaled(delay))
+	if f.DropProb > 0 && rand.Float64() < f.DropProb {
+		return errInjectedDrop
+	}
+	return nil
+}
+
+// Shutdown timing: replies go out before the process exits, and a graceful shutdown waits
+// at most shutdownGrace (nominal time) for in-flight requests
+const (
+	shutdownReplyDelay = 100 * time.Millisecond
+	shutdownGrace      = 30 * time.Second
+)
+
+// Shutdown stops the Trader. A graceful shutdown drains new requests, waits for in-flight
+// ones, flushes replication, hands leadership to the peer, closes the listener and then
+// the audit log and exporter; an immediate one exits right after replying. SIGINT and
+// SIGTERM start a graceful shutdown too.
+func (t *Trader) Shutdown(args *ShutdownArgs, reply *string) error {
+	if err := t.checkAdmin(&AdminArgs{Token: args.Token}); err != nil {
+		return err
+	}
+
+	switch args.Mode {
+	case "immediate":
+		slog.Info("Immediate shutdown requested by admin")
+		time.AfterFunc(shutdownReplyDelay, func() { os.Exit(0) })
+	case "", "graceful":
+		slog.Info("Graceful shutdown requested by admin")
+		go t.shutdownGracefully()
+	default:
+		return fmt.Errorf("unknown shutdown mode %q (want graceful or immediate)", args.Mode)
+	}
+	*reply = fmt.Sprintf("Trader %d shutting down (%s)", t.ID, args.Mode)
+	return nil
+}
+
+// shutdownGracefully finishes outstanding work, hands leadership to the peer and exits
+func (t *Trader) shutdownGracefully() {
+	if !t.shuttingDown.CompareAndSwap(false, true) {
+		return
+	}
+	t.RequestMu.Lock()
+	t.Draining = true
+	t.RequestMu.Unlock()
+	t.Transitions.Drain(true, causeShutdown, t.term())
+
+	deadline := time.Now().Add(common.Scaled(shutdownGrace))
+	for {
+		inFlight, _, _ := t.trackingStats()
+		queued := len(t.acceptQueue)
+		if inFlight == 0 && queued == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			slog.Info("Shutting down", "in_flight", inFlight, "queued", queued)
+			break
+		}
+		time.Sleep(common.Scaled(100 * time.Millisecond))
+	}
+
+	if t.Replicator != nil {
+		t.Replicator.flush()
+	}
+	if t.Cache != nil {
+		t.Cache.flush()
+	}
+	t.leave()
+	if t.server != nil {
+		// Wait at least long enough for the reply to an admin's Shutdown call to go out
+		if cut := t.server.Shutdown(max(time.Until(deadline), common.Scaled(shutdownReplyDelay))); cut > 0 {
+			slog.Warn("Closed connections with calls still in progress", "calls", cut)
+		}
+	}
+	if t.AuditLog != nil {
+		if err := t.AuditLog.Close(); err != nil {
+			slog.Warn("Failed to close audit log", "err", err)
+		}
+	}
+	if t.Journal != nil {
+		if err := t.Journal.Close(); err != nil {
+			slog.Warn("Failed to close journal", "err", err)
+		}
+	}
+	if t.Exporter != nil {
+		t.Exporter.Close()
+	}
+	t.Tracer.Close()
+	if t.Metrics != nil {
+		if err := t.Metrics.Close(); err != nil {
+			slog.Warn("Failed to close metrics file", "err", err)
+		}
+	}
+
+	t.logFairness()
+	t.Transitions.Stop(causeShutdown, t.term())
+	slog.Info("Shut down gracefully")
+	time.Sleep(shutdownReplyDelay)
+	os.Exit(0)
+}
+
+// LeavingArgs announces that a Trader is shutting down gracefully
+type LeavingArgs struct {
+	ID        int
+	Term      int64
+	Signature string `json:"-"` // See PeerSignature (empty if unsigned)
+}
+
+// leave steps down and tells the peer, or every member of a standby pool, that this
+// Trader is shutting down, so the peer takes over now instead of waiting for its failure
+// detector. Heartbeats are refused from then on, so the peer does not mistake the Trader
+// for alive while its connections close.
+func (t *Trader) leave() {
+	t.HeartbeatMu.Lock()
+	t.Leaving = true
+	if t.IsLeader {
+		t.setLeader(false, causeShutdown)
+	}
+	args := &LeavingArgs{ID: t.ID, Term: t.Term}
+	t.HeartbeatMu.Unlock()
+	args.Signature = t.signPeerCall("Trader.PeerLeaving", args)
+
+	var reply string
+	if t.pooled() {
+		for id := range t.Pool {
+			if id == t.ID {
+				continue
+			}
+			if err := t.callPoolMember(id, "Trader.PeerLeaving", args, &reply); err != nil {
+				slog.Warn("Failed to tell a member of the pool about the shutdown", "trader", id, "err", err)
+			}
+		}
+		return
+	}
+	if t.peerAddr() == "" {
+		return
+	}
+	client, err := t.dialPeer()
+	if err == nil {
+		err = t.call(client, "Trader.PeerLeaving", args, &reply)
+		client.Close()
+	}
+	if err != nil {
+		slog.Warn("Failed to tell the peer about the shutdown", "err", err)
+		return
+	}
+	slog.Info("Told the peer about the shutdown", "peer", t.peerAddr())
+}
+
+// PeerLeaving takes over from the peer when it shuts down gracefully, as if the failure
+// detector had suspected it. Members of a standby pool that do not follow the sender
+// ignore it.
+func (t *Trader) PeerLeaving(args *LeavingArgs, reply *string) error {
+	if err := t.injectFault("PeerLeaving"); err != nil {
+		return err
+	}
+	if !t.peerCallSigned("Trader.PeerLeaving", args.Signature, args) {
+		return t.refuseUnsignedPeerCall("Trader.PeerLeaving", args.ID)
+	}
+	if t.partitioned() {
+		return errPartitioned
+	}
+	peerID := t.peerID()
+	if t.pooled() {
+		peerID = t.poolID(t.peerAddr())
+	}
+	if peerID != 0 && args.ID != peerID {
+		*reply = fmt.Sprintf("Trader %d does not follow trader %d", t.ID, args.ID)
+		return nil
+	}
+
+	t.HeartbeatMu.Lock()
+	if args.Term > t.peerTerm {
+		t.peerTerm = args.Term
+	}
+	t.HeartbeatMu.Unlock()
+	slog.Warn("Peer is shutting down; taking over now", "trader", args.ID, "term", args.Term)
+	go t.peerFailed(causePeerShutdown)
+	*reply = "OK"
+	return nil
+}
+
+// TraderState is a point-in-time view of a Trader for admin tools and scenarios
+type TraderState struct {
+	ID        int
+	IsLeader  bool
+	PeerUp    bool
+	Inventory map[string]int
+	Adopted   map[string]int
+	Handback  map[string]int
+	Processed int
+	Abandoned int
+
+	InFlight      int // Requests currently being processed
+	HistoryLen    int // Completed requests kept in the history ring
+	TrackingBytes int // Approximate memory used for request tracking
+	MemoryBytes   int // Approximate memory counted by admission control
+	MemoryLimit   int // Admission limit in bytes (0 if unlimited)
+
+	Faults map[string]Fault // Injected faults by RPC method
+
+	QueryHits   int    // History queries answered from the query cache
+	QueryMisses int    // History queries that scanned the history
+	QuerySeq    uint64 // Sequence number of the history, bumped by every change
+
+	Offloaded     int // Read-only requests delegated to the backup
+	ReplicaReads  int // Split reads for the peer's post answered from the replica
+	ReadOnlyLocal int // Read-only requests served locally
+
+	DupsDropped int // Repeated at-most-once requests dropped without processing
+	Repeated    int // Retries of committed Seller requests answered with their recorded outcome
+
+	FailoverPolicy  string // Reaction to leader failure
+	FailoverPending bool   // Whether a takeover is held back by the policy
+
+	RateLimited int // Requests refused by the per-Seller rate limit
+	Overloaded  int // Requests refused because the request queue was full
+	Summaries   int // Summary deposits committed, netting deposits Sellers recorded locally during overload
+	Summarized  int // Deposits netted into those summaries
+	Federated   int // Purchases we could not fill that another cluster filled through the federation gateway
+	TimedOut    int // Outgoing RPCs abandoned at their deadline
+
+	Alerts     map[string]int // Anomalies detected by kind; every one is a correctness violation to investigate
+	StaleConns int            // Pooled peer connections found dead by a ping and replaced
+
+	Pool common.PoolStats // Pooled connections to the peer, Sellers and Buyers
+
+	Fairness FairnessReport // Trades, rate and latency by post, and the fairness index across posts
+
+	Spoiled int // Perishable stock removed after its shelf life
+
+	Term      int64 // Current leadership term
+	Draining  bool  // Whether new requests are refused
+	ReplQueue int   // Replication entries waiting to be sent to the peer
+	Forwards  int   // Requests forwarded to the peer and not yet answered
+	PollQueue int   // Poll-mode outcomes not yet fetched by Sellers
+	Streams   int   // Sellers reading their response stream
+
+	AcceptQueue  int // Accepted push, poll and stream requests waiting for a dispatcher
+	AsyncWorkers int // Dispatchers processing accepted requests; 0 for a goroutine each
+
+	Members  int // Traders in the Bully election cluster (0 without -cluster)
+	LeaderID int // Leader elected in the Bully election, as far as this Trader knows (0 if unknown)
+
+	PeerAccepted int // Requests the peer accepted and has not settled, kept in case it fails
+
+	ForwardsWaiting int // Requests waiting for a forward slot
+	Working         int // Requests holding a processing slot
+	WorkWaiting     int // Requests waiting for a processing slot (always 0 without -workers)
+	Expired         int // Requests refused because their deadline passed before they could start
+
+	WorkerLimit    int // Current size of the worker pool (0 for unlimited)
+	WorkerScalings int // Times the autoscaler resized the worker pool
+
+	CachePending  int // Cached Warehouse transactions not yet written back
+	CacheWritten  int // Cached Warehouse transactions written back
+	CacheRefused  int // Cached purchases the Warehouse refused at write-back
+	CacheOversold int // Quantity sold from the cache that the Warehouse refused
+}
+
+// NodeStatus is one node of the cluster as seen by the reporting Trader
+type NodeStatus struct {
+	Role    string // "trader" or "seller"
+	ID      int    // 0 if unknown
+	Address string
+	Post    int
+	Leader  bool
+	Term    int64
+	Domain  string
+	Health  string // "up", "down", "draining" or "unknown"
+	Self    bool   // Whether this is the reporting Trader's own entry
+}
+
+// LinkStatus is a connection between two nodes, identified by address
+type LinkStatus struct {
+	From, To string
+	Kind     string // "peer" (heartbeats, forwarding and replication) or "registered" (Seller to Trader)
+	Up       bool
+	Note     string // e.g. "partitioned"
+}
+
+// ClusterStatus is a Trader's view of the cluster topology
+type ClusterStatus struct {
+	Reporter int
+	Time     time.Time
+	Nodes    []NodeStatus
+	Links    []LinkStatus
+}
+
+// ClusterStatus reports this Trader, its peer and its registered Sellers, and the links
+// between them, for topology diagrams
+func (t *Trader) ClusterStatus(args *AdminArgs, reply *ClusterStatus) error {
+	if err := t.checkAdmin(args); err != nil {
+		return err
+	}
+	reply.Reporter = t.ID
+	reply.Time = time.Now()
+
+	self := NodeStatus{Role: "trader", ID: t.ID, Address: t.Address, Post: t.Post, Domain: t.Domain, Health: "up", Self: true}
+	peerAddr, peerID := t.peerAddr(), t.peerID()
+	peer := NodeStatus{Role: "trader", ID: peerID, Address: peerAddr, Health: "down"}
+	link := LinkStatus{From: t.Address, To: peerAddr, Kind: "peer"}
+
+	t.HeartbeatMu.Lock()
+	self.Leader, self.Term = t.IsLeader, t.Term
+	peer.Domain = t.peerDomain
+	peer.Term = t.peerTerm
+	if t.PeerUp {
+		peer.Health = "up"
+		peer.Leader = t.peerLeader
+		link.Up = true
+	}
+	if t.Partitioned {
+		link.Up = false
+		link.Note = "partitioned"
+	}
+	t.HeartbeatMu.Unlock()
+
+	t.RequestMu.Lock()
+	if t.Draining {
+		self.Health = "draining"
+	}
+	t.RequestMu.Unlock()
+	reply.Nodes = append(reply.Nodes, self, peer)
+	reply.Links = append(reply.Links, link)
+
+	t.RegistryMu.Lock()
+	for _, reg := range t.Registry {
+		reply.Nodes = append(reply.Nodes, NodeStatus{Role: "seller", ID: reg.ID, Address: reg.Address, Post: reg.Post, Health: "unknown"})
+		reply.Links = append(reply.Links, LinkStatus{From: reg.Address, To: t.Address, Kind: "registered", Up: true})
+	}
+	t.RegistryMu.Unlock()
+	return nil
+}
+
+// State reports the Trader's role and stock
+func (t *Trader) State(args *AdminArgs, reply *TraderState) error {
+	if err := t.checkAdmin(args); err != nil {
+		return err
+	}
+	t.state(reply)
+	return nil
+}
+
+// state fills in the Trader's state report
+func (t *Trader) state(reply *TraderState) {
+	t.HeartbeatMu.Lock()
+	reply.ID = t.ID
+	reply.StaleConns = t.StaleConns
+	reply.IsLeader = t.IsLeader
+	reply.PeerUp = t.PeerUp
+	reply.FailoverPending = t.failoverPending
+	reply.LeaderID = t.leaderID
+	t.HeartbeatMu.Unlock()
+	reply.FailoverPolicy = t.FailoverPolicy
+	reply.Members = len(t.Members)
+	reply.Term = t.term()
+
+	t.InventoryMu.Lock()
+	reply.Inventory = copyStock(t.Inventory)
+	reply.Adopted = copyStock(t.Adopted)
+	reply.Handback = copyStock(t.Handback)
+	reply.PeerAccepted = len(t.peerAccepted)
+	t.InventoryMu.Unlock()
+
+	t.RequestMu.Lock()
+	reply.Processed = t.Processed
+	reply.Abandoned = t.Abandoned
+	reply.Offloaded = t.Offloaded
+	reply.ReplicaReads = t.ReplicaReads
+	reply.ReadOnlyLocal = t.ReadOnlyLocal
+	reply.DupsDropped = t.DupsDropped
+	reply.Repeated = t.Repeated
+	reply.RateLimited = t.RateLimited
+	reply.Overloaded = t.Overloaded
+	reply.Summaries, reply.Summarized = t.Summaries, t.Summarized
+	reply.Federated = t.Federated
+	t.timeoutMu.Lock()
+	reply.TimedOut = t.TimedOut
+	t.timeoutMu.Unlock()
+	t.alertMu.Lock()
+	reply.Alerts = make(map[string]int, len(t.Alerts))
+	for kind, n := range t.Alerts {
+		reply.Alerts[kind] = n
+	}
+	t.alertMu.Unlock()
+	reply.Expired = t.Expired
+	reply.WorkerScalings = t.WorkerScalings
+	reply.Spoiled = t.Spoiled
+	reply.Draining = t.Draining
+	for _, ready := range t.readyResponses {
+		reply.PollQueue += len(ready)
+	}
+	t.RequestMu.Unlock()
+
+	reply.InFlight, reply.HistoryLen, reply.TrackingBytes = t.trackingStats()
+	reply.QueryHits, reply.QueryMisses, reply.QuerySeq = t.Queries.Stats()
+	reply.Fairness = t.Posts.Report()
+	reply.Pool = t.Conns.Stats()
+	reply.MemoryBytes = t.approxMemory()
+	reply.MemoryLimit = t.MemLimit
+	reply.Forwards, reply.ForwardsWaiting = t.forwardSlots.load()
+	reply.Working, reply.WorkWaiting = t.workers.load()
+	reply.WorkerLimit = t.workers.size()
+	reply.Streams = t.openStreams()
+	reply.AcceptQueue = len(t.acceptQueue)
+	reply.AsyncWorkers = t.AsyncWorkers
+	if t.Replicator != nil {
+		reply.ReplQueue = t.Replicator.backlog()
+	}
+	if t.Cache != nil {
+		reply.CachePending, reply.CacheWritten, reply.CacheRefused, reply.CacheOversold = t.Cache.stats()
+	}
+
+	t.faultMu.Lock()
+	reply.Faults = make(map[string]Fault, len(t.faults))
+	for method, f := range t.faults {
+		reply.Faults[method] = f
+	}
+	t.faultMu.Unlock()
+}
+
+// copyStock returns a copy of a stock map
+func copyStock(m map[string]int) map[string]int {
+	out := make(map[string]int, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// ======= BUYERS =======
+
+// purchase is a completed purchase or Seller request, remembered so a retry gets the
+// same answer
+type purchase struct {
+	res Response
+	at  time.Time
+}
+
+// purchaseRetention is how long a Trader remembers completed purchases for retries
+const purchaseRetention = 10 * time.Minute
+
+// RegisterBuyer records a Buyer's address so it is notified when leadership changes
+func (t *Trader) RegisterBuyer(info *BuyerInfo, reply *string) error {
+	if err := t.injectFault("RegisterBuyer"); err != nil {
+		return err
+	}
+	if info.ID <= 0 || info.Address == "" {
+		return fmt.Errorf("invalid registration: buyer ID %d at %q", info.ID, info.Address)
+	}
+	if !t.signedWith(info.Signature, func(secret string) string { return common.BuyerRegistrationSignature(secret, info) }) {
+		slog.Warn("Rejected Buyer registration with an invalid signature", "buyer", info.ID, "addr", info.Address)
+		return fmt.Errorf("registration of buyer %d: %w", info.ID, errUnsigned)
+	}
+	t.RegistryMu.Lock()
+	if t.buyers == nil {
+		t.buyers = make(map[int]string)
+	}
+	if _, known := t.buyers[info.ID]; !known {
+		slog.Info("Registered Buyer", "buyer", info.ID, "addr", info.Address)
+	}
+	t.buyers[info.ID] = info.Address
+	t.RegistryMu.Unlock()
+	*reply = "Registered"
+	return nil
+}
+
+// Buy handles a Buyer's purchase and signs the response
+func (t *Trader) Buy(req *BuyRequest, res *Response) error {
+	if err := t.injectFault("Buy"); err != nil {
+		return err
+	}
+	var err error
+	if !t.signedWith(req.Signature, func(secret string) string { return common.BuyRequestSignature(secret, req) }) {
+		slog.Warn("Rejected purchase with an invalid signature", "request", req.RequestID, "buyer", req.BuyerID, "path", formatPath(req.Path))
+		res.RequestID = req.RequestID
+		res.Status = "Invalid"
+		res.Message = fmt.Sprintf("Trader %d rejected purchase %d: missing or invalid signature", t.ID, req.RequestID)
+	} else {
+		err = t.handleBuy(req, res)
+	}
+	t.prom.purchases.Inc(res.Status)
+	t.sealResponse(res)
+	return err
+}
+
+// handleBuy forwards a purchase to the Trader owning its post or takes the stock here.
+// Purchases of the peer's post are served from adopted stock while the peer is down.
+func (t *Trader) handleBuy(req *BuyRequest, res *Response) error {
+	start := time.Now()
+	req.Path = append(req.Path, traderHop(t.ID))
+	res.Path = req.Path
+	res.RequestID = req.RequestID
+
+	slog.Info("Received purchase", "request", req.RequestID, "buyer", req.BuyerID, "quantity", req.Quantity, "item", req.Item, "post", req.Post, "path", formatPath(req.Path))
+
+	t.RequestMu.Lock()
+	draining := t.Draining
+	t.RequestMu.Unlock()
+	if draining {
+		res.Status = "Draining"
+		res.Message = fmt.Sprintf("Trader %d is draining and not accepting new requests", t.ID)
+		return nil
+	}
+	if status, msg := t.failoverRefusal(false); status != "" {
+		res.Status, res.Message = status, msg
+		return nil
+	}
+
+	if err := validateRequest(&Request{Item: req.Item, Quantity: req.Quantity, Post: req.Post}); err != nil {
+		slog.Info("Rejected purchase", "request", req.RequestID, "buyer", req.BuyerID, "err", err)
+		res.Status = "Invalid"
+		res.Message = err.Error()
+		return nil
+	}
+
+	if req.Post != t.Post && t.peerUp() {
+		err := t.checkRoute(&Request{RequestID: req.RequestID, Path: req.Path})
+		if err == nil {
+			var fwd Response
+			if err = t.peerCall("Trader.Buy", req, &fwd); err == nil {
+				*res = fwd
+				return nil
+			}
+		}
+		var routeErr *RoutingError
+		if errors.As(err, &routeErr) {
+			res.Status = "RoutingError"
+			res.Message = routeErr.Error()
+			return nil
+		}
+		slog.Warn("Serving purchase locally after forwarding failed", "request", req.RequestID, "post", req.Post, "err", err)
+	}
+
+	key := RequestKey{req.BuyerID, req.RequestID}
+	t.RequestMu.Lock()
+	done, ok := t.purchases[key]
+	t.RequestMu.Unlock()
+	if ok {
+		slog.Info("Purchase was already completed; repeating its outcome", "request", req.RequestID, "buyer", req.BuyerID)
+		path := res.Path
+		*res = done.res
+		res.Path = path
+		return nil
+	}
+
+	// Simulate request processing
+	t.Posts.Received(req.Post)
+	time.Sleep(common.Scaled(processingTime))
+
+	// The Warehouse, when there is one, decides whether the stock is there
+	if t.Warehouse != "" {
+		wr, err := t.warehouseTxn("Buy", WarehouseTxn{ClientID: req.BuyerID, RequestID: req.RequestID, Post: req.Post, Item: req.Item, Quantity: req.Quantity})
+		if err != nil {
+			slog.Warn("Warehouse did not complete purchase", "request", req.RequestID, "buyer", req.BuyerID, "err", err)
+			res.Status = "WarehouseUnavailable"
+			res.Message = fmt.Sprintf("Trader %d could not reach the warehouse: %v", t.ID, err)
+			return nil
+		}
+		if wr.Status != "Success" {
+			res.Status = wr.Status
+			res.Message = wr.Message
+			slog.Info("Purchase refused", "request", req.RequestID, "buyer", req.BuyerID, "status", res.Status, "reason", res.Message)
+			if wr.Status == "OutOfStock" {
+				t.federate(req, res)
+			}
+			return nil
+		}
+	}
+
+	now := time.Now()
+	t.RequestMu.Lock()
+	t.InventoryMu.Lock()
+	ownPost := req.Post == t.Post
+	held := t.Adopted
+	if ownPost {
+		held = t.Inventory
+	}
+	if done, dup := t.purchases[key]; dup {
+		// A concurrent retry completed it while this one was processing
+		t.InventoryMu.Unlock()
+		t.RequestMu.Unlock()
+		path := res.Path
+		*res = done.res
+		res.Path = path
+		return nil
+	}
+	if t.Warehouse == "" && held[req.Item] < req.Quantity {
+		stock := held[req.Item]
+		t.InventoryMu.Unlock()
+		t.RequestMu.Unlock()
+		res.Status = "OutOfStock"
+		res.Message = fmt.Sprintf("Only %d %s in stock for Post %d, %d requested", stock, req.Item, req.Post, req.Quantity)
+		slog.Info("Purchase refused", "request", req.RequestID, "buyer", req.BuyerID, "status", res.Status, "reason", res.Message)
+		t.federate(req, res)
+		return nil
+	}
+	bucket := bucketAdopted
+	if ownPost {
+		bucket = bucketInventory
+	}
+	price, rule := t.Pricing.quote(req.Item, req.Quantity)
+	t.applyLocked(StateEvent{Kind: "purchase", Bucket: bucket, Item: req.Item, Quantity: -req.Quantity,
+		Post: req.Post, BuyerID: req.BuyerID, RequestID: req.RequestID, Price: price, Rule: rule})
+	t.noteTradeLocked(req.Item, req.Quantity)
+	t.InventoryMu.Unlock()
+
+	res.Status = "Purchased"
+	res.Message = fmt.Sprintf("Sold %d %s from Post %d to Buyer %d for %s", req.Quantity, req.Item, req.Post, req.BuyerID, describePrice(price, rule))
+	res.Processed = true
+	res.Price = price
+	res.PriceRule = rule
+	if t.purchases == nil {
+		t.purchases = make(map[RequestKey]purchase)
+	}
+	t.purchaseExpiry.expire(now, purchaseRetention, func(k RequestKey) {
+		if p, ok := t.purchases[k]; ok && now.Sub(p.at) > purchaseRetention {
+			delete(t.purchases, k)
+		}
+	})
+	t.purchases[key] = purchase{res: *res, at: now}
+	t.purchaseExpiry.push(key, now)
+	t.RequestMu.Unlock()
+	t.Posts.Completed(req.Post, true, start)
+
+	slog.Info(res.Message, "request", req.RequestID, "buyer", req.BuyerID)
+
+	t.recordPurchase(CompletedRequest{
+		Time:      now,
+		TraderID:  t.ID,
+		BuyerID:   req.BuyerID,
+		RequestID: req.RequestID,
+		Post:      req.Post,
+		Item:      req.Item,
+		Quantity:  req.Quantity,
+		Status:    res.Status,
+		Path:      req.Path,
+		Price:     price,
+		Rule:      rule,
+	})
+	return nil
+}
+
+// recordPurchase writes a completed purchase to the history and audit log and exports it
+func (t *Trader) recordPurchase(rec CompletedRequest) {
+	t.History.Add(rec)
+	t.Queries.Invalidate()
+	if t.AuditLog != nil {
+		if err := t.AuditLog.Append(rec); err != nil {
+			slog.Warn("Failed to write audit log", "err", err)
+		}
+	}
+	t.exportEvent(Event{
+		Type:      "purchase",
+		RequestID: rec.RequestID,
+		Post:      rec.Post,
+		Item:      rec.Item,
+		Quantity:  rec.Quantity,
+	})
+}
+
+// ======= DIRECT TRADES =======
+
+// directRule is the pricing rule recorded for a trade a Seller and a Buyer made directly
+const directRule = "direct"
+
+// DirectSellers lists the registered Sellers a Buyer may trade with directly once no
+// Trader is reachable. The Buyer identifies itself with its signed registration.
+func (t *Trader) DirectSellers(info *BuyerInfo, reply *[]SellerContact) error {
+	if err := t.injectFault("DirectSellers"); err != nil {
+		return err
+	}
+	if !t.signedWith(info.Signature, func(secret string) string { return common.BuyerRegistrationSignature(secret, info) }) {
+		slog.Warn("Rejected Seller directory request with an invalid signature", "buyer", info.ID, "addr", info.Address)
+		return fmt.Errorf("seller directory for buyer %d: %w", info.ID, errUnsigned)
+	}
+	t.RegistryMu.Lock()
+	for _, reg := range t.Registry {
+		// Client-only Sellers cannot be dialed
+		if !common.IsStreamAddress(reg.Address) {
+			*reply = append(*reply, SellerContact{ID: reg.ID, Address: reg.Address, Post: reg.Post})
+		}
+	}
+	t.RegistryMu.Unlock()
+	sort.Slice(*reply, func(i, j int) bool { return (*reply)[i].ID < (*reply)[j].ID })
+	return nil
+}
+
+// ReconcileDirect books the trades a Seller made directly with Buyers while no Trader was
+// reachable. The Seller sends them once its deferred deposits are flushed, so the stock
+// they sold has reached the Trader; each trade takes it out again as a purchase at the
+// agreed price. Trades for the peer's post go to the peer while it is alive, and a trade
+// already booked, such as one resent after a lost reply, is skipped.
+func (t *Trader) ReconcileDirect(report *DirectReport, reply *string) error {
+	if err := t.injectFault("ReconcileDirect"); err != nil {
+		return err
+	}
+	if !t.signedWith(report.Signature, func(secret string) string { return common.DirectReportSignature(secret, report) }) {
+		slog.Warn("Rejected direct trade report with an invalid signature", "seller", report.SellerID, "trades", len(report.Trades))
+		return fmt.Errorf("direct trades of seller %d: %w", report.SellerID, errUnsigned)
+	}
+
+	var forward []DirectTrade
+	booked, skipped := 0, 0
+	for _, trade := range report.Trades {
+		if trade.SellerID != report.SellerID {
+			return fmt.Errorf("report of seller %d carries a trade of seller %d", report.SellerID, trade.SellerID)
+		}
+		if trade.Post != t.Post && t.peerUp() {
+			forward = append(forward, trade)
+			continue
+		}
+		if t.bookDirect(&trade) {
+			booked++
+		} else {
+			skipped++
+		}
+	}
+	if len(forward) > 0 {
+		fwd := &DirectReport{SellerID: report.SellerID, Trades: forward}
+		if t.Secret != "" {
+			fwd.Signature = common.DirectReportSignature(t.Secret, fwd)
+		}
+		var peerReply string
+		if err := t.peerCall("Trader.ReconcileDirect", fwd, &peerReply); err != nil {
+			return fmt.Errorf("peer did not reconcile %d direct trades: %w", len(forward), err)
+		}
+	}
+	*reply = fmt.Sprintf("Reconciled %d direct trades of Seller %d (%d already booked, %d sent to the peer)", booked, report.SellerID, skipped, len(forward))
+	return nil
+}
+
+// bookDirect takes the stock of one direct trade out of the inventory and records it as a
+// purchase. It reports false if the trade was already booked.
+func (t *Trader) bookDirect(trade *DirectTrade) bool {
+	key := RequestKey{trade.BuyerID, trade.RequestID}
+	now := time.Now()
+	t.RequestMu.Lock()
+	if _, dup := t.purchases[key]; dup {
+		t.RequestMu.Unlock()
+		return false
+	}
+	t.InventoryMu.Lock()
+	bucket, held := bucketAdopted, t.Adopted
+	if trade.Post == t.Post {
+		bucket, held = bucketInventory, t.Inventory
+	}
+	taken := min(trade.Quantity, held[trade.Item])
+	if taken < trade.Quantity {
+		// The Buyer already has the goods; the stock was sold again through a Trader
+		// before the Seller's deposits arrived
+		slog.Warn("Direct trade exceeds the stock; booking the shortfall", "request", trade.RequestID, "buyer", trade.BuyerID,
+			"seller", trade.SellerID, "item", trade.Item, "quantity", trade.Quantity, "stock", taken)
+	}
+	if taken > 0 {
+		t.applyLocked(StateEvent{Kind: "purchase", Bucket: bucket, Item: trade.Item, Quantity: -taken,
+			Post: trade.Post, BuyerID: trade.BuyerID, RequestID: trade.RequestID, Price: trade.Price, Rule: directRule})
+	}
+	t.noteTradeLocked(trade.Item, trade.Quantity)
+	t.InventoryMu.Unlock()
+
+	res := Response{
+		Status:    "Purchased",
+		Message:   fmt.Sprintf("Seller %d sold %d %s from Post %d to Buyer %d directly for %.2f", trade.SellerID, trade.Quantity, trade.Item, trade.Post, trade.BuyerID, trade.Price),
+		RequestID: trade.RequestID,
+		Processed: true,
+		TraderID:  t.ID,
+		Price:     trade.Price,
+		PriceRule: directRule,
+	}
+	if t.purchases == nil {
+		t.purchases = make(map[RequestKey]purchase)
+	}
+	t.purchases[key] = purchase{res: res, at: now}
+	t.purchaseExpiry.push(key, now)
+	t.RequestMu.Unlock()
+
+	slog.Info(res.Message, "request", trade.RequestID, "buyer", trade.BuyerID, "seller", trade.SellerID)
+	t.recordPurchase(CompletedRequest{
+		Time:      trade.At,
+		TraderID:  t.ID,
+		BuyerID:   trade.BuyerID,
+		RequestID: trade.RequestID,
+		Post:      trade.Post,
+		Item:      trade.Item,
+		Quantity:  trade.Quantity,
+		Status:    res.Status,
+		Path:      []string{fmt.Sprintf("buyer-%d", trade.BuyerID), fmt.Sprintf("seller-%d", trade.SellerID), traderHop(t.ID)},
+		Price:     trade.Price,
+		Rule:      directRule,
+	})
+	return true
+}
+
+// notifyBuyers tells registered Buyers that Trader id leads at newLeaderAddr in term
+func (t *Trader) notifyBuyers(id int, newLeaderAddr string, term int64) {
+	t.RegistryMu.Lock()
+	addrs := make([]string, 0, len(t.buyers))
+	for _, addr := range t.buyers {
+		addrs = append(addrs, addr)
+	}
+	t.RegistryMu.Unlock()
+	sort.Strings(addrs)
+
+	for _, addr := range addrs {
+		update := LeaderUpdate{Address: newLeaderAddr, TraderID: id, Term: term, IssuedAt: time.Now().UnixNano()}
+		if t.Secret != "" {
+			update.Signature = common.LeaderUpdateSignature(t.Secret, &update)
+		}
+		var reply string
+		if err := t.notify("leader update", addr, "Buyer.UpdateLeader", &update, &reply); err != nil {
+			slog.Warn("Failed to notify Buyer", "addr", addr, "err", err)
+			continue
+		}
+		slog.Info("Notified Buyer about new leader", "addr", addr, "leader_addr", newLeaderAddr)
+	}
+}
+
+// ======= WAREHOUSE =======
+
+// WarehouseTxn is a stock movement routed through the Warehouse
+type WarehouseTxn struct {
+	TraderID  int
+	ClientID  int // Seller (Sell) or Buyer (Buy) the transaction is for
+	RequestID int // That client's request ID; the Warehouse applies each one once
+	Post      int
+	Item      string
+	Quantity  int
+}
+
+// WarehouseReply is the Warehouse's outcome of a transaction
+type WarehouseReply struct {
+	Status  string // "Success" or "OutOfStock"
+	Message string
+	Stock   int  // Stock of the item at the post afterwards
+	Repeat  bool // The transaction had already been applied
+}
+
+// WarehouseQuery selects the stock the Warehouse reports; an empty Item selects every item
+type WarehouseQuery struct {
+	Post int
+	Item string
+}
+
+// WarehouseQueryReply is the stock the Warehouse holds for a post
+type WarehouseQueryReply struct {
+	Stock map[string]int
+}
+
+// warehouseTxn routes a transaction through the Warehouse, or through the cache when there
+// is one; kind is "Sell" or "Buy"
+func (t *Trader) warehouseTxn(kind string, txn WarehouseTxn) (WarehouseReply, error) {
+	var reply WarehouseReply
+	txn.TraderID = t.ID
+	if t.Cache != nil {
+		return t.Cache.apply(kind, txn)
+	}
+	conn, err := common.DialConn(t.Warehouse, common.Scaled(2*time.Second))
+	if err != nil {
+		return reply, err
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	err = t.call(client, "Warehouse."+kind, &txn, &reply)
+	return reply, err
+}
+
+// cachedTxn is a transaction applied to the cache and not yet written back
+type cachedTxn struct {
+	kind string
+	txn  WarehouseTxn
+}
+
+// WarehouseCache serves Warehouse transactions from a local copy of the stock and writes
+// them back in batches. Purchases the cache allowed but the Warehouse refuses at write-back
+// were over-sold: another Trader sold the same stock in the meantime.
+type WarehouseCache struct {
+	t             *Trader
+	BatchSize     int
+	FlushInterval time.Duration
+	mu            sync.Mutex
+	stock         map[int]map[string]int // Warehouse stock by post plus unflushed changes (guarded by mu)
+	pending       []cachedTxn            // Applied locally, not yet written back (guarded by mu)
+	flushNow      chan struct{}
+	flushMu       sync.Mutex // Serializes write-backs
+
+	// Metrics (guarded by mu)
+	written  int // Transactions written back
+	oversold int // Quantity sold from the cache that the Warehouse refused
+	refused  int // Purchases refused at write-back
+}
+
+// NewWarehouseCache creates a cache; call Run to start writing back
+func NewWarehouseCache(t *Trader, batchSize int, flushInterval time.Duration) *WarehouseCache {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &WarehouseCache{
+		t:             t,
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval,
+		stock:         make(map[int]map[string]int),
+		flushNow:      make(chan struct{}, 1),
+	}
+}
+
+// apply serves a transaction from the cache, loading the post's stock from the Warehouse
+// the first time it is used, and queues it for write-back
+func (c *WarehouseCache) apply(kind string, txn WarehouseTxn) (WarehouseReply, error) {
+	var reply WarehouseReply
+	c.mu.Lock()
+	_, loaded := c.stock[txn.Post]
+	c.mu.Unlock()
+	if !loaded {
+		if err := c.refresh(txn.Post); err != nil {
+			return reply, err
+		}
+	}
+
+	c.mu.Lock()
+	stock := c.stock[txn.Post]
+	if kind == "Buy" && stock[txn.Item] < txn.Quantity {
+		c.mu.Unlock()
+		reply.Status = "OutOfStock"
+		reply.Stock = stock[txn.Item]
+		reply.Message = fmt.Sprintf("Only %d %s in stock for Post %d, %d requested", stock[txn.Item], txn.Item, txn.Post, txn.Quantity)
+		return reply, nil
+	}
+	if kind == "Buy" {
+		stock[txn.Item] -= txn.Quantity
+	} else {
+		stock[txn.Item] += txn.Quantity
+	}
+	reply.Status = "Success"
+	reply.Stock = stock[txn.Item]
+	c.pending = append(c.pending, cachedTxn{kind, txn})
+	full := len(c.pending) >= c.BatchSize
+	c.mu.Unlock()
+
+	if full {
+		select {
+		case c.flushNow <- struct{}{}:
+		default:
+		}
+	}
+	return reply, nil
+}
+
+// refresh replaces the cached stock of a post with the Warehouse's, replaying the
+// transactions not yet written back on top
+func (c *WarehouseCache) refresh(post int) error {
+	conn, err := common.DialConn(c.t.Warehouse, common.Scaled(2*time.Second))
+	if err != nil {
+		return err
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	var q WarehouseQueryReply
+	if err := c.t.call(client, "Warehouse.Query", &WarehouseQuery{Post: post}, &q); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stock := q.Stock
+	if stock == nil {
+		stock = make(map[string]int)
+	}
+	for _, p := range c.pending {
+		if p.txn.Post != post {
+			continue
+		}
+		if p.kind == "Buy" {
+			stock[p.txn.Item] -= p.txn.Quantity
+		} else {
+			stock[p.txn.Item] += p.txn.Quantity
+		}
+	}
+	c.stock[post] = stock
+	return nil
+}
+
+// Run writes back when a batch is full or the flush interval elapses
+func (c *WarehouseCache) Run() {
+	ticker := time.NewTicker(common.Scaled(c.FlushInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.flushNow:
+		case <-ticker.C:
+		}
+		c.flush()
+	}
+}
+
+// flush writes pending transactions back in order, stopping at the first failure, then
+// refreshes the cached posts so sales by other Traders show up
+func (c *WarehouseCache) flush() {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	batch := append([]cachedTxn(nil), c.pending...)
+	posts := make([]int, 0, len(c.stock))
+	for post := range c.stock {
+		posts = append(posts, post)
+	}
+	c.mu.Unlock()
+
+	if len(batch) > 0 {
+		conn, err := common.DialConn(c.t.Warehouse, common.Scaled(2*time.Second))
+		if err != nil {
+			slog.Warn("Failed to write back cached transactions", "count", len(batch), "err", err)
+			return
+		}
+		client := rpc.NewClient(conn)
+		sent := 0
+		for _, p := range batch {
+			var reply WarehouseReply
+			if err := c.t.call(client, "Warehouse."+p.kind, &p.txn, &reply); err != nil {
+				slog.Warn("Write-back stopped early", "sent", sent, "count", len(batch), "err", err)
+				break
+			}
+			sent++
+			if reply.Status != "Success" {
+				c.mu.Lock()
+				c.refused++
+				c.oversold += p.txn.Quantity
+				c.mu.Unlock()
+				slog.Warn("Warehouse refused cached purchase; stock over-sold", "request", p.txn.RequestID, "buyer", p.txn.ClientID, "reason", reply.Message, "quantity", p.txn.Quantity, "item", p.txn.Item)
+			}
+		}
+		client.Close()
+
+		c.mu.Lock()
+		c.pending = c.pending[sent:]
+		c.written += sent
+		c.mu.Unlock()
+		if sent < len(batch) {
+			return
+		}
+	}
+
+	for _, post := range posts {
+		if err := c.refresh(post); err != nil {
+			slog.Warn("Failed to refresh cached stock of Post", "post", post, "err", err)
+			return
+		}
+	}
+}
+
+// stats reports the cache's write-back counters
+func (c *WarehouseCache) stats() (pending, written, refused, oversold int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending), c.written, c.refused, c.oversold
+}
+
+// ======= FEDERATION =======
+
+// FederatedBuy is a purchase offered to the federation gateway (Gateway.Buy)
+type FederatedBuy struct {
+	Cluster string // This cluster; the gateway never routes the purchase back here
+	Request BuyRequest
+}
+
+// federate offers a purchase we cannot fill to the federation gateway, which tries the
+// other clusters. res keeps our refusal unless one of them fills the purchase.
+func (t *Trader) federate(req *BuyRequest, res *Response) {
+	if t.Gateway == "" || req.Federated {
+		return
+	}
+	var fwd Response
+	if err := t.callNode(t.Gateway, "Gateway.Buy", &FederatedBuy{Cluster: t.ClusterName, Request: *req}, &fwd); err != nil {
+		slog.Warn("Federation gateway did not complete purchase", "request", req.RequestID, "buyer", req.BuyerID, "err", err)
+		return
+	}
+	if fwd.Status != "Purchased" {
+		slog.Info("No federated cluster filled purchase", "request", req.RequestID, "buyer", req.BuyerID, "status", fwd.Status, "reason", fwd.Message)
+		return
+	}
+	*res = fwd
+
+	// Remember it, so a retry is not filled a second time from stock that arrived since
+	t.RequestMu.Lock()
+	t.Federated++
+	if t.purchases == nil {
+		t.purchases = make(map[RequestKey]purchase)
+	}
+	key := RequestKey{req.BuyerID, req.RequestID}
+	now := time.Now()
+	t.purchases[key] = purchase{res: *res, at: now}
+	t.purchaseExpiry.push(key, now)
+	t.RequestMu.Unlock()
+	slog.Info(res.Message, "request", req.RequestID, "buyer", req.BuyerID, "path", formatPath(res.Path))
+}
+
+// ======= TRADE CORRECTIONS =======
+
+// CorrectionArgs asks an admin to void or adjust a recorded trade
+type CorrectionArgs struct {
+	Token       string
+	SellerID    int
+	RequestID   int
+	Action      string // "void" or "adjust"
+	NewQuantity int    // Corrected quantity for "adjust"
+	Reason      string
+}
+
+// Find returns the most recent successful trade for a Seller's request still in the ring
+func (h *RequestHistory) Find(sellerID, requestID int) (CompletedRequest, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.next
+	if h.full {
+		n = len(h.records)
+	}
+	for i := 0; i < n; i++ {
+		rec := h.records[(h.next-1-i+len(h.records))%len(h.records)]
+		if rec.SellerID == sellerID && rec.RequestID == requestID && rec.Status == "Success" {
+			return rec, true
+		}
+	}
+	return CompletedRequest{}, false
+}
+
+// Find scans the audit log for a successful trade that has left the in-memory history
+func (a *AuditLog) Find(sellerID, requestID int) (CompletedRequest, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.Open(a.f.Name())
+	if err != nil {
+		return CompletedRequest{}, false
+	}
+	defer f.Close()
+
+	var found CompletedRequest
+	ok := false
+	dec := json.NewDecoder(f)
+	for {
+		var line struct {
+			Type string `json:"type"`
+			CompletedRequest
+		}
+		if err := dec.Decode(&line); err != nil {
+			break
+		}
+		if line.Type == "" && line.SellerID == sellerID && line.RequestID == requestID && line.Status == "Success" {
+			found, ok = line.CompletedRequest, true
+		}
+	}
+	return found, ok
+}
+
+// CorrectTrade voids or adjusts a recorded trade: the stock held for it changes by the
+// difference, the change is replicated, a signed correction is appended to the audit log
+// and the Seller is notified. A trade can be corrected repeatedly; each correction
+// starts from the quantity left by the previous one.
+func (t *Trader) CorrectTrade(args *CorrectionArgs, reply *Correction) error {
+	if err := t.checkAdmin(&AdminArgs{Token: args.Token}); err != nil {
+		return err
+	}
+	newQty := 0
+	switch args.Action {
+	case "void":
+	case "adjust":
+		if args.NewQuantity < 0 {
+			return fmt.Errorf("corrected quantity must not be negative, got %d", args.NewQuantity)
+		}
+		newQty = args.NewQuantity
+	default:
+		return fmt.Errorf("unknown correction action %q (want void or adjust)", args.Action)
+	}
+
+	rec, ok := t.History.Find(args.SellerID, args.RequestID)
+	if !ok && t.AuditLog != nil {
+		rec, ok = t.AuditLog.Find(args.SellerID, args.RequestID)
+	}
+	if !ok {
+		return fmt.Errorf("no recorded trade for request %d of Seller %d on Trader %d (forwarded trades are corrected on the peer)", args.RequestID, args.SellerID, t.ID)
+	}
+
+	key := RequestKey{args.SellerID, args.RequestID}
+	t.RequestMu.Lock()
+	oldQty, corrected := t.corrections[key]
+	if !corrected {
+		oldQty = rec.Quantity
+	}
+	delta := newQty - oldQty
+
+	t.InventoryMu.Lock()
+	held := t.Handback
+	if rec.Post == t.Post {
+		held = t.Inventory
+	}
+	if held[rec.Item]+delta < 0 {
+		stock := held[rec.Item]
+		t.InventoryMu.Unlock()
+		t.RequestMu.Unlock()
+		return fmt.Errorf("cannot take %d %s back: only %d held for Post %d", -delta, rec.Item, stock, rec.Post)
+	}
+	bucket := bucketHandback
+	if rec.Post == t.Post {
+		bucket = bucketInventory
+	}
+	t.applyLocked(StateEvent{Kind: "correction", Bucket: bucket, Item: rec.Item, Quantity: delta,
+		Post: rec.Post, SellerID: rec.SellerID, RequestID: rec.RequestID})
+	t.InventoryMu.Unlock()
+
+	if t.corrections == nil {
+		t.corrections = make(map[RequestKey]int)
+	}
+	t.corrections[key] = newQty
+	t.RequestMu.Unlock()
+	t.Queries.Invalidate()
+
+	c := Correction{
+		Type:        "correction",
+		Time:        time.Now(),
+		TraderID:    t.ID,
+		SellerID:    args.SellerID,
+		RequestID:   args.RequestID,
+		Post:        rec.Post,
+		Item:        rec.Item,
+		OldQuantity: oldQty,
+		NewQuantity: newQty,
+		Reason:      args.Reason,
+	}
+	c.Signature = common.CorrectionSignature(t.sessionKey(), &c)
+	slog.Info("Corrected request", "request", c.RequestID, "seller", c.SellerID, "item", c.Item, "old_quantity", oldQty, "quantity", newQty, "reason", c.Reason)
+
+	if t.AuditLog != nil {
+		if err := t.AuditLog.Append(c); err != nil {
+			slog.Warn("Failed to write correction to audit log", "err", err)
+		}
+	}
+	t.exportEvent(Event{
+		Type:      "correction",
+		SellerID:  c.SellerID,
+		RequestID: c.RequestID,
+		Post:      c.Post,
+		Item:      c.Item,
+		Quantity:  delta,
+	})
+	go t.notifyCorrection(c)
+
+	*reply = c
+	return nil
+}
+
+// notifyCorrection tells the Seller that made a trade that it was corrected
+func (t *Trader) notifyCorrection(c Correction) {
+	if t.streamTo(c.SellerID, StreamMessage{Kind: "correction", Correction: &c}) {
+		slog.Info("Notified Seller of the correction over its stream", "seller", c.SellerID, "request", c.RequestID)
+		return
+	}
+	t.RegistryMu.Lock()
+	reg, ok := t.Registry[c.SellerID]
+	addr := ""
+	if ok {
+		addr = reg.Address
+	}
+	t.RegistryMu.Unlock()
+	if addr == "" {
+		slog.Info("Seller is not registered; cannot notify it of the correction", "seller", c.SellerID)
+		return
+	}
+
+	var reply string
+	if err := t.notify("correction", addr, "Seller.TradeCorrected", &c, &reply); err != nil {
+		slog.Warn("Failed to notify Seller of the correction", "seller", c.SellerID, "addr", addr, "err", err)
+		return
+	}
+	slog.Info("Notified Seller of the correction", "seller", c.SellerID, "request", c.RequestID)
+}
+
+// ======= ANOMALY ALERTS =======
+
+// Kinds of anomaly raised as alerts. None of them happens in a correct run.
+const (
+	alertDuplicateProcessing = "duplicate-processing"   // A request was committed a second time
+	alertTermRegression      = "term-regression"        // The peer leads in a term older than one it reported before
+	alertNegativeInventory   = "negative-inventory"     // Stock of an item fell below zero
+	alertNotifyExhausted     = "notification-exhausted" // A notification was given up after its last attempt
+)
+
+// alert reports an anomaly as an ERROR record whose message starts with ALERT, so a long
+// run's logs can be searched for them, and counts it in the state report and metrics
+func (t *Trader) alert(kind, msg string, args ...any) {
+	t.alertMu.Lock()
+	if t.Alerts == nil {
+		t.Alerts = make(map[string]int)
+	}
+	t.Alerts[kind]++
+	t.alertMu.Unlock()
+	t.prom.alerts.Inc(kind)
+	slog.Error("ALERT: "+msg, append([]any{"alert", kind}, args...)...)
+}
+
+// notify delivers a notification to a Seller or Buyer, retrying with backoff. A
+// notification still undelivered after the last attempt raises an alert, once per node
+// until a notification reaches it again; one the node refused is returned at once.
+func (t *Trader) notify(what, addr, method string, args, reply interface{}) error {
+	t.alertMu.Lock()
+	attempts, backoff := max(t.NotifyAttempts, 1), t.NotifyBackoff
+	t.alertMu.Unlock()
+	retry := common.Retry{Attempts: attempts, Backoff: common.Scaled(backoff), MaxBackoff: common.Scaled(8 * backoff)}
+	err := retry.Do(func() error {
+		return t.callNode(addr, method, args, reply)
+	})
+	var refused rpc.ServerError
+	lost := err != nil && !errors.As(err, &refused)
+
+	t.alertMu.Lock()
+	alerted := t.unreachable[addr]
+	if !lost {
+		delete(t.unreachable, addr)
+	} else if !alerted {
+		if t.unreachable == nil {
+			t.unreachable = make(map[string]bool)
+		}
+		t.unreachable[addr] = true
+	}
+	t.alertMu.Unlock()
+	if lost && !alerted {
+		t.alert(alertNotifyExhausted, "Notification lost after every attempt", "notification", what, "addr", addr, "attempts", attempts, "err", err)
+	}
+	return err
+}
+
+// ======= PROMETHEUS METRICS =======
+
+// traderMetrics are the Trader's counters and histograms exposed on /metrics. They are
+// registered before the Trader starts serving and never replaced.
+type traderMetrics struct {
+	requests    *metrics.Counter   // Seller requests by outcome
+	purchases   *metrics.Counter   // Buyer purchases by outcome
+	heartbeats  *metrics.Counter   // Heartbeats sent to the peer by outcome
+	takeovers   *metrics.Counter   // Failovers to this Trader after the peer failed
+	roleChanges *metrics.Counter   // Role transitions by the new role
+	rpcLatency  *metrics.Histogram // Outgoing RPCs by method
+	rpcTimeouts *metrics.Counter   // Outgoing RPCs abandoned at their deadline by method
+	alerts      *metrics.Counter   // Anomalies detected by kind
+}
+
+// registerMetrics creates the Trader's metrics in reg. Gauges are set from the Trader's
+// state report on every scrape.
+func (t *Trader) registerMetrics(reg *metrics.Registry) {
+	t.prom = traderMetrics{
+		requests:    reg.Counter("a4_trader_requests_total", "Seller requests by the outcome this Trader gave them", "status"),
+		purchases:   reg.Counter("a4_trader_purchases_total", "Buyer purchases by the outcome this Trader gave them", "status"),
+		heartbeats:  reg.Counter("a4_trader_heartbeats_total", "Heartbeats sent to the peer by outcome; anything but ok is a failure", "outcome"),
+		takeovers:   reg.Counter("a4_trader_takeovers_total", "Failovers in which this Trader took over the failed peer's post"),
+		roleChanges: reg.Counter("a4_trader_role_changes_total", "Role transitions by the new role", "role"),
+		rpcLatency:  reg.Histogram("a4_rpc_duration_seconds", "Latency of outgoing RPCs by method", metrics.DefaultBuckets, "method"),
+		rpcTimeouts: reg.Counter("a4_rpc_timeouts_total", "Outgoing RPCs abandoned at their deadline by method", "method"),
+		alerts:      reg.Counter("a4_trader_alerts_total", "Anomalies detected by kind; any increase is a correctness violation", "kind"),
+	}
+
+	leader := reg.Gauge("a4_trader_leader", "1 while this Trader leads, 0 as backup")
+	term := reg.Gauge("a4_trader_term", "Current leadership term")
+	peerUp := reg.Gauge("a4_trader_peer_up", "1 while the peer answers heartbeats")
+	inFlight := reg.Gauge("a4_trader_inflight_requests", "Requests being processed")
+	queues := reg.Gauge("a4_trader_queue_depth", "Entries waiting in each queue", "queue")
+	processed := reg.Gauge("a4_trader_processed", "Requests committed since the Trader started")
+	reg.OnScrape(func() {
+		var st TraderState
+		t.state(&st)
+		leader.Set(boolValue(st.IsLeader))
+		term.Set(float64(st.Term))
+		peerUp.Set(boolValue(st.PeerUp))
+		inFlight.Set(float64(st.InFlight))
+		processed.Set(float64(st.Processed))
+		queues.Set(float64(st.AcceptQueue), "accept")
+		queues.Set(float64(st.ReplQueue), "replication")
+		queues.Set(float64(st.PollQueue), "poll")
+		queues.Set(float64(st.Forwards), "forwarded")
+		queues.Set(float64(st.ForwardsWaiting), "forward-wait")
+		queues.Set(float64(st.WorkWaiting), "work-wait")
+		queues.Set(float64(st.CachePending), "warehouse-cache")
+	})
+}
+
+// boolValue is 1 for true and 0 for false
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ======= HTTP STATUS =======
+
+// HealthStatus is the Trader's answer to GET /status, for external health checks
+type HealthStatus struct {
+	Node          string     `json:"node"` // Always "trader"
+	ID            int        `json:"id"`
+	Address       string     `json:"address"`
+	Post          int        `json:"post"`
+	Role          string     `json:"role"` // "starting", "leader", "backup", "draining" or "stopped"
+	Leader        bool       `json:"leader"`
+	Term          int64      `json:"term"`
+	LeaderID      int        `json:"leader_id,omitempty"` // Leader of the Bully election, if known
+	Peer          string     `json:"peer,omitempty"`
+	PeerUp        bool       `json:"peer_up"`
+	LastHeartbeat *time.Time `json:"last_heartbeat"` // Last heartbeat exchanged with the peer either way; null if none yet
+	Healthy       bool       `json:"healthy"`        // Serving as leader or backup, not starting or draining
+}
+
+// healthStatus reports the Trader's role and its link to the peer
+func (t *Trader) healthStatus() HealthStatus {
+	st := HealthStatus{Node: "trader", ID: t.ID, Address: t.Address, Post: t.Post, Peer: t.peerAddr()}
+	t.HeartbeatMu.Lock()
+	st.Leader, st.Term, st.LeaderID, st.PeerUp = t.IsLeader, t.Term, t.leaderID, t.PeerUp
+	last := t.heartbeatSent
+	if t.heartbeatReceived.After(last) {
+		last = t.heartbeatReceived
+	}
+	t.HeartbeatMu.Unlock()
+	if !last.IsZero() {
+		st.LastHeartbeat = &last
+	}
+
+	st.Role = t.Transitions.Role()
+	if st.Role == "" {
+		st.Role = t.logRole()
+	}
+	st.Healthy = st.Role == "leader" || st.Role == "backup"
+	return st
+}
+
+// serveStatus answers GET /status with the HealthStatus as JSON, with status 503 while the
+// Trader is starting, draining or stopping
+func (t *Trader) serveStatus(w http.ResponseWriter, _ *http.Request) {
+	st := t.healthStatus()
+	w.Header().Set("Content-Type", "application/json")
+	if !st.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(st)
+}
+
+// ======= POST FAIRNESS =======
+
+// PostStats is the service one post got from this Trader
+type PostStats struct {
+	Post       int
+	Received   int           // Deposits and purchases of the post this Trader started processing
+	Deposits   int           // Deposits committed
+	Purchases  int           // Purchases completed
+	Rate       float64       // Completed trades per second since the first request of any post
+	AvgLatency time.Duration // Mean time from receiving a completed trade to finishing it
+	MaxLatency time.Duration
+}
+
+// FairnessReport compares the posts one Trader serves, e.g. its own and the adopted one
+// after a takeover, so multi-post experiments show whether one post starves another
+type FairnessReport struct {
+	Posts    []PostStats // By post number
+	Fairness float64     // Jain's index of the per-post trade rates: 1 when every post gets the same service, 1/n when one of n gets all of it (1 with fewer than two posts)
+}
+
+// PostTracker counts trades and their latency by post; a nil tracker counts nothing
+type PostTracker struct {
+	mu    sync.Mutex
+	start time.Time // First request of any post
+	posts map[int]*PostStats
+}
+
+// NewPostTracker creates an empty tracker
+func NewPostTracker() *PostTracker {
+	return &PostTracker{posts: make(map[int]*PostStats)}
+}
+
+// post returns the stats of a post, creating them; p.mu must be held
+func (p *PostTracker) post(post int) *PostStats {
+	ps, ok := p.posts[post]
+	if !ok {
+		ps = &PostStats{Post: post}
+		p.posts[post] = ps
+	}
+	return ps
+}
+
+// Received counts a request of the post that this Trader processes itself
+func (p *PostTracker) Received(post int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.start.IsZero() {
+		p.start = time.Now()
+	}
+	p.post(post).Received++
+}
+
+// Completed counts a committed deposit or a completed purchase received at start
+func (p *PostTracker) Completed(post int, purchase bool, start time.Time) {
+	if p == nil {
+		return
+	}
+	latency := time.Since(start)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ps := p.post(post)
+	if purchase {
+		ps.Purchases++
+	} else {
+		ps.Deposits++
+	}
+	trades := ps.Deposits + ps.Purchases
+	ps.AvgLatency += (latency - ps.AvgLatency) / time.Duration(trades)
+	ps.MaxLatency = max(ps.MaxLatency, latency)
+}
+
+// Report returns the per-post stats and their fairness index
+func (p *PostTracker) Report() FairnessReport {
+	report := FairnessReport{Fairness: 1}
+	if p == nil {
+		return report
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elapsed := time.Since(p.start).Seconds()
+	var sum, sumSq float64
+	for _, ps := range p.posts {
+		st := *ps
+		if elapsed > 0 {
+			st.Rate = float64(st.Deposits+st.Purchases) / elapsed
+		}
+		sum += st.Rate
+		sumSq += st.Rate * st.Rate
+		report.Posts = append(report.Posts, st)
+	}
+	sort.Slice(report.Posts, func(i, j int) bool { return report.Posts[i].Post < report.Posts[j].Post })
+	if n := len(report.Posts); n > 1 && sumSq > 0 {
+		report.Fairness = sum * sum / (float64(n) * sumSq)
+	}
+	return report
+}
+
+// logFairness logs the service each post got and the fairness index, as part of the
+// periodic and final run summary; it logs nothing before the first trade
+func (t *Trader) logFairness() {
+	report := t.Posts.Report()
+	if len(report.Posts) == 0 {
+		return
+	}
+	for _, ps := range report.Posts {
+		slog.Info("Post service", "post", ps.Post, "received", ps.Received, "deposits", ps.Deposits, "purchases", ps.Purchases,
+			"rate", fmt.Sprintf("%.2f/s", ps.Rate), "avg_latency", ps.AvgLatency.Round(time.Microsecond), "max_latency", ps.MaxLatency.Round(time.Microsecond))
+	}
+	slog.Info("Post fairness", "posts", len(report.Posts), "fairness", fmt.Sprintf("%.3f", report.Fairness))
+}
+
+// ======= QUERY CACHE =======
+
+// QueryCache memoizes the replies of read RPCs that scan the request history. Every
+// change to what they read bumps a sequence number; a cached reply computed at an older
+// sequence is stale and recomputed, so polling dashboards and CLIs cost one scan per
+// change instead of one per poll.
+type QueryCache struct {
+	mu      sync.Mutex
+	seq     uint64                // Bumped by every change to the history or its corrections
+	entries map[string]queryEntry // Replies by method and query
+	size    int                   // Most replies kept
+	hits    int
+	misses  int
+}
+
+// queryEntry is a cached reply and the sequence number it was computed at
+type queryEntry struct {
+	seq   uint64
+	reply interface{}
+}
+
+// NewQueryCache creates a cache holding up to size replies; a nil cache caches nothing
+func NewQueryCache(size int) *QueryCache {
+	if size < 1 {
+		return nil
+	}
+	return &QueryCache{entries: make(map[string]queryEntry), size: size}
+}
+
+// Invalidate bumps the sequence number, making every cached reply stale
+func (c *QueryCache) Invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.seq++
+	c.mu.Unlock()
+}
+
+// Get returns the cached reply for key, or computes and caches it. compute runs without
+// the cache lock, with the sequence number it reads at; a reply whose sequence moved on
+// meanwhile is returned but not cached.
+func (c *QueryCache) Get(key string, compute func(seq uint64) interface{}) (reply interface{}, cached bool) {
+	if c == nil {
+		return compute(0), false
+	}
+	c.mu.Lock()
+	seq := c.seq
+	if e, ok := c.entries[key]; ok && e.seq == seq {
+		c.hits++
+		c.mu.Unlock()
+		return e.reply, true
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	reply = compute(seq)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seq != seq {
+		return reply, false
+	}
+	if len(c.entries) >= c.size {
+		for k, e := range c.entries {
+			if e.seq != seq {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) >= c.size {
+		c.entries = make(map[string]queryEntry)
+	}
+	c.entries[key] = queryEntry{seq: seq, reply: reply}
+	return reply, false
+}
+
+// Stats returns the hit and miss counts and the current sequence number
+func (c *QueryCache) Stats() (hits, misses int, seq uint64) {
+	if c == nil {
+		return 0, 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.seq
+}
+
+// Records returns the completed requests held, newest first
+func (h *RequestHistory) Records() []CompletedRequest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.next
+	if h.full {
+		n = len(h.records)
+	}
+	out := make([]CompletedRequest, 0, n)
+	for i := 0; i < n; i++ {
+		out = append(out, h.records[(h.next-1-i+len(h.records))%len(h.records)])
+	}
+	return out
+}
+
+// TransactionQuery selects completed requests from the history; zero fields match all
+type TransactionQuery struct {
+	Token    string
+	SellerID int
+	BuyerID  int
+	Item     string
+	Status   string
+	Limit    int // Most records returned, newest first (0 for all held)
+}
+
+// TransactionList answers a TransactionQuery
+type TransactionList struct {
+	Records []CompletedRequest
+	Seq     uint64 // Sequence number of the history the list reflects
+	Cached  bool   // Whether the reply came from the query cache
+}
+
+// Transactions lists completed requests, newest first, with trade corrections applied
+func (t *Trader) Transactions(args *TransactionQuery, reply *TransactionList) error {
+	if err := t.checkAdmin(&AdminArgs{Token: args.Token}); err != nil {
+		return err
+	}
+	q := *args
+	q.Token = ""
+	v, cached := t.Queries.Get(fmt.Sprintf("Transactions %+v", q), func(seq uint64) interface{} {
+		return TransactionList{Records: t.transactions(q), Seq: seq}
+	})
+	*reply = v.(TransactionList)
+	reply.Cached = cached
+	return nil
+}
+
+// transactions scans the history for the records matching q
+func (t *Trader) transactions(q TransactionQuery) []CompletedRequest {
+	records := t.History.Records()
+	t.RequestMu.Lock()
+	defer t.RequestMu.Unlock()
+	var out []CompletedRequest
+	for _, rec := range records {
+		if (q.SellerID != 0 && rec.SellerID != q.SellerID) || (q.BuyerID != 0 && rec.BuyerID != q.BuyerID) ||
+			(q.Item != "" && rec.Item != q.Item) || (q.Status != "" && rec.Status != q.Status) {
+			continue
+		}
+		if qty, ok := t.corrections[RequestKey{rec.SellerID, rec.RequestID}]; ok && rec.SellerID != 0 && rec.Status == "Success" {
+			rec.Quantity = qty
+		}
+		out = append(out, rec)
+		if q.Limit > 0 && len(out) == q.Limit {
+			break
+		}
+	}
+	return out
+}
+
+// PriceQuery selects the purchases of one item a price history covers
+type PriceQuery struct {
+	Token string
+	Item  string
+	Limit int // Most purchases covered, newest first (0 for all held)
+}
+
+// PricePoint is one purchase in a price history
+type PricePoint struct {
+	Time      time.Time
+	BuyerID   int
+	Quantity  int
+	Price     float64 // Amount paid
+	UnitPrice float64
+	Rule      string // Pricing rule applied, if any
+}
+
+// PriceHistory is what Buyers recently paid for an item
+type PriceHistory struct {
+	Item      string
+	ListPrice float64
+	Points    []PricePoint // Newest first
+	Min       float64      // Lowest unit price paid
+	Avg       float64      // Average unit price, weighted by quantity
+	Max       float64      // Highest unit price paid
+	Seq       uint64       // Sequence number of the history the prices reflect
+	Cached    bool         // Whether the reply came from the query cache
+}
+
+// PriceHistory summarises the prices paid in the successful purchases of an item
+func (t *Trader) PriceHistory(args *PriceQuery, reply *PriceHistory) error {
+	if err := t.checkAdmin(&AdminArgs{Token: args.Token}); err != nil {
+		return err
+	}
+	if _, ok := itemPrices[args.Item]; !ok {
+		return fmt.Errorf("unknown item %q", args.Item)
+	}
+	q := *args
+	q.Token = ""
+	v, cached := t.Queries.Get(fmt.Sprintf("PriceHistory %+v", q), func(seq uint64) interface{} {
+		hist := t.priceHistory(q)
+		hist.Seq = seq
+		return hist
+	})
+	*reply = v.(PriceHistory)
+	reply.Cached = cached
+	return nil
+}
+
+// priceHistory scans the history for the purchases of q.Item
+func (t *Trader) priceHistory(q PriceQuery) PriceHistory {
+	hist := PriceHistory{Item: q.Item, ListPrice: itemPrices[q.Item]}
+	var paid float64
+	var units int
+	for _, rec := range t.History.Records() {
+		if rec.BuyerID == 0 || rec.Item != q.Item || rec.Status != "Purchased" || rec.Quantity == 0 {
+			continue
+		}
+		unit := rec.Price / float64(rec.Quantity)
+		hist.Points = append(hist.Points, PricePoint{Time: rec.Time, BuyerID: rec.BuyerID, Quantity: rec.Quantity,
+			Price: rec.Price, UnitPrice: unit, Rule: rec.Rule})
+		if len(hist.Points) == 1 || unit < hist.Min {
+			hist.Min = unit
+		}
+		hist.Max = max(hist.Max, unit)
+		paid += rec.Price
+		units += rec.Quantity
+		if q.Limit > 0 && len(hist.Points) == q.Limit {
+			break
+		}
+	}
+	if units > 0 {
+		hist.Avg = paid / float64(units)
+	}
+	return hist
+}
+
+// ======= NODE IDENTITY =======
+
+// Identify reports who is answering at this address, so callers can reject impostors
+func (t *Trader) Identify(_ int, reply *NodeIdentity) error {
+	if err := t.injectFault("Identify"); err != nil {
+		return err
+	}
+	*reply = NodeIdentity{Role: "trader", ID: t.ID, Address: t.Address, Domain: t.Domain, Time: time.Now(), Leader: t.isLeader(), Term: t.term(), Post: t.Post}
+	return nil
+}
+
+// Ping echoes its argument. It is the cheapest RPC, used to check that a pooled
+// connection still reaches a live peer.
+func (t *Trader) Ping(args int64, reply *int64) error {
+	if err := t.injectFault("Ping"); err != nil {
+		return err
+	}
+	*reply = args
+	return nil
+}
+
+// errImpostor is returned when the node at the peer address is not the expected Trader
+type errImpostor struct {
+	addr     string
+	expected int
+	got      NodeIdentity
+}
+
+func (e *errImpostor) Error() string {
+	return fmt.Sprintf("node at %s identifies as %s %d, expected trader %d", e.addr, e.got.Role, e.got.ID, e.expected)
+}
+
+// dialPeer connects to the peer Trader and, if a peer ID is configured, verifies its identity
+func (t *Trader) dialPeer() (*rpc.Client, error) {
+	if t.partitioned() {
+		return nil, errPartitioned
+	}
+	addr, peerID := t.peerAddr(), t.peerID()
+	var client *rpc.Client
+	var err error
+	if peerID != 0 {
+		// Over TLS, the peer's certificate must also name it
+		client, err = common.DialNode(addr, traderHop(peerID), common.Scaled(t.Timeouts.Default))
+	} else {
+		client, err = common.DialTimeouts(addr, t.Timeouts)
+	}
+	if err != nil {
+		if errors.Is(err, common.ErrWrongNode) {
+			slog.Warn("Rejected impostor at the peer address", "err", err)
+		}
+		return nil, err
+	}
+	if peerID == 0 && t.Domain == "" {
+		return client, nil
+	}
+
+	var id NodeIdentity
+	if err := t.call(client, "Trader.Identify", 0, &id); err != nil {
+		client.Close()
+		return nil, err
+	}
+	if peerID != 0 && (id.Role != "trader" || id.ID != peerID) {
+		client.Close()
+		return nil, &errImpostor{addr: addr, expected: peerID, got: id}
+	}
+	t.checkPeerDomain(id)
+	return client, nil
+}
+
+// peerMethods are the RPCs only another Trader of the pair, standby pool or cluster makes
+var peerMethods = map[string]bool{
+	"Trader.ReceiveHeartbeat": true,
+	"Trader.ReplicateBatch":   true,
+	"Trader.AppendRequest":    true,
+	"Trader.FetchStateChunk":  true,
+	"Trader.Hello":            true,
+	"Trader.AcceptHandback":   true,
+	"Trader.Election":         true,
+	"Trader.Coordinator":      true,
+	"Trader.StandbyStatus":    true,
+	"Trader.Repoint":          true,
+	"Trader.PeerLeaving":      true,
+	"Trader.ReceiveMarker":    true,
+}
+
+// checkPeerCaller admits a peer-only RPC over mutual TLS only from a client certificate
+// naming a Trader this one works with, so a Seller's or Buyer's certificate cannot pose
+// as the peer. Calls without a verified certificate are left to the TLS configuration.
+func (t *Trader) checkPeerCaller(call *rpcserver.Call) (func(string, time.Duration), error) {
+	if call.Cert == nil || !peerMethods[call.Method] {
+		return nil, nil
+	}
+	names := common.CertNames(call.Cert)
+	for _, name := range names {
+		var id int
+		if _, err := fmt.Sscanf(name, "trader-%d", &id); err == nil && traderHop(id) == name && t.knownTrader(id) {
+			return nil, nil
+		}
+	}
+	slog.Warn("Rejected peer call from a certificate not naming a known Trader", "method", call.Method, "from", call.Remote, "cert", strings.Join(names, ", "))
+	return nil, fmt.Errorf("%s is only served to the Traders of this cluster", call.Method)
+}
+
+// knownTrader reports whether id is the peer or a member of the standby pool or Bully
+// cluster. Without a configured peer ID, pool or cluster, any Trader is.
+func (t *Trader) knownTrader(id int) bool {
+	peerID := t.peerID()
+	if peerID == 0 && t.Pool == nil && t.Members == nil {
+		return true
+	}
+	_, inPool := t.Pool[id]
+	_, member := t.Members[id]
+	return id == peerID || inPool || member
+}
+
+// checkPeerDomain warns when the backup shares the leader's failure domain, since a
+// single machine or rack failure would then take out both Traders
+func (t *Trader) checkPeerDomain(peer NodeIdentity) {
+	t.HeartbeatMu.Lock()
+	changed := peer.Domain != t.peerDomain
+	t.peerDomain = peer.Domain
+	t.HeartbeatMu.Unlock()
+
+	if !changed || t.Domain == "" {
+		return
+	}
+	if peer.Domain == t.Domain {
+		slog.Warn("Peer shares this Trader's failure domain; a single failure there takes out both leader and backup. Place the backup in a different domain.", "trader", peer.ID, "domain", t.Domain)
+	} else if peer.Domain != "" {
+		slog.Info("Peer is in a different failure domain", "trader", peer.ID, "peer_domain", peer.Domain, "domain", t.Domain)
+	}
+}
+
+// dialNode connects to a node for the connection pool, verifying the peer's identity
+func (t *Trader) dialNode(addr string) (*rpc.Client, error) {
+	if addr == t.peerAddr() {
+		return t.dialPeer()
+	}
+	return common.DialTimeouts(addr, t.Timeouts)
+}
+
+// callNode makes an RPC on the node at addr over the pooled connection to it
+func (t *Trader) callNode(addr, method string, args, reply interface{}) error {
+	return t.Conns.Do(addr, func(client *rpc.Client) error {
+		return t.call(client, method, args, reply)
+	})
+}
+
+// peerCall makes an RPC on the peer over the pooled connection to it
+func (t *Trader) peerCall(method string, args, reply interface{}) error {
+	if t.partitioned() {
+		return errPartitioned
+	}
+	return t.callNode(t.peerAddr(), method, args, reply)
+}
+
+// pingPeerConn checks the pooled peer connection with a ping. A connection the peer no
+// longer answers on, e.g. because it rebooted and the old TCP connection is half dead, is
+// replaced now rather than by the first forward that fails on it.
+func (t *Trader) pingPeerConn() error {
+	peer := t.peerAddr()
+	held := t.Conns.Get(peer)
+	if held == nil {
+		return nil // Nothing pooled; the next forward dials
+	}
+
+	var reply int64
+	err := t.peerCall("Trader.Ping", time.Now().UnixNano(), &reply)
+	if t.Conns.Get(peer) == held {
+		return nil // The peer answered on this connection, even if with an error
+	}
+	t.HeartbeatMu.Lock()
+	t.StaleConns++
+	t.HeartbeatMu.Unlock()
+	if err == nil {
+		slog.Info("Pooled connection to the peer was stale; replaced it")
+		return nil
+	}
+	slog.Warn("Pooled connection to the peer is stale; reconnecting", "err", err)
+	if err := t.peerCall("Trader.Ping", time.Now().UnixNano(), &reply); err != nil {
+		return fmt.Errorf("reconnecting to the peer: %w", err)
+	}
+	return nil
+}
+
+// RoutingError reports a request that could not be forwarded without looping
+type RoutingError struct {
+	RequestID int
+	Path      []string
+	Reason    string
+}
+
+func (e *RoutingError) Error() string {
+	return fmt.Sprintf("cannot route request %d (path %s): %s", e.RequestID, formatPath(e.Path), e.Reason)
+}
+
+// checkRoute refuses to forward a request that already visited the peer or has used up
+// its hop limit, so a misconfigured routing table cannot bounce it around forever
+func (t *Trader) checkRoute(req *Request) error {
+	hops := 0
+	for _, hop := range req.Path {
+		if strings.HasPrefix(hop, "trader-") {
+			hops++
+		}
+		if peerID := t.peerID(); peerID != 0 && hop == traderHop(peerID) {
+			return &RoutingError{req.RequestID, req.Path, fmt.Sprintf("already visited Trader %d", peerID)}
+		}
+	}
+	if hops >= t.MaxHops {
+		return &RoutingError{req.RequestID, req.Path, fmt.Sprintf("hop limit of %d Traders reached", t.MaxHops)}
+	}
+	return nil
+}
+
+// ForwardRequest forwards the request to the peer Trader over a persistent connection.
+// Concurrent forwards are pipelined on that connection, up to ForwardInflight at a time.
+func (t *Trader) ForwardRequest(req *Request) (*Response, error) {
+	if err := t.checkRoute(req); err != nil {
+		slog.Info("Not forwarding request", "request", req.RequestID, "err", err)
+		return nil, err
+	}
+
+	if !t.forwardSlots.acquire(req) {
+		return nil, errExpired
+	}
+	defer t.forwardSlots.release()
+	req.Term = t.term()
+	span, fwd := t.startForward(req, "peer")
+	defer span.End()
+
+	var res Response
+	if err := t.peerCall("Trader.ReceiveRequest", fwd, &res); err != nil {
+		span.Fail(err)
+		slog.Warn("Failed to forward request to peer", "err", err)
+		return nil, err
+	}
+	span.Set("a4.status", res.Status)
+	slog.Info("Request forwarded to peer", "request", req.RequestID, "path", formatPath(res.Path))
+	return &res, nil
+}
+
+// startForward opens the client span of sending req on to another Trader and returns the
+// copy to send, which carries the span so the receiver's span becomes its child
+func (t *Trader) startForward(req *Request, to string) (*tracing.Span, *Request) {
+	span := t.Tracer.Start("Trader.ReceiveRequest", tracing.Client, req.Trace)
+	span.Set("a4.request", req.RequestID)
+	span.Set("a4.to", to)
+	fwd := *req
+	fwd.Trace = span.Context()
+	return span, &fwd
+}
+
+// ReceiveHeartbeat handles heartbeat messages from the peer Trader
+func (t *Trader) ReceiveHeartbeat(req int, reply *string) error {
+	if err := t.injectFault("ReceiveHeartbeat"); err != nil {
+		return err
+	}
+	if t.partitioned() {
+		return errPartitioned
+	}
+	if peerID := t.peerID(); peerID != 0 && req != peerID && t.Pool[req] == "" {
+		slog.Warn("Rejected heartbeat from unexpected Trader", "trader", req)
+		return fmt.Errorf("trader %d does not accept heartbeats from trader %d", t.ID, req)
+	}
+
+	t.HeartbeatMu.Lock()
+	if t.Leaving {
+		t.HeartbeatMu.Unlock()
+		return fmt.Errorf("trader %d is shutting down", t.ID)
+	}
+	t.Heartbeat = true
+	t.heartbeatReceived = time.Now()
+	t.HeartbeatMu.Unlock()
+
+	slog.Debug("Received heartbeat", "trader", req)
+	*reply = "Alive"
+	return nil
+}
+
+// recordHeartbeat keeps a heartbeat attempt for the post-mortem and counts its outcome
+func (t *Trader) recordHeartbeat(rec HeartbeatRecord) {
+	t.HBHistory.Add(rec)
+	t.prom.heartbeats.Inc(rec.Outcome)
+	if rec.Outcome == "ok" {
+		t.HeartbeatMu.Lock()
+		t.heartbeatSent = rec.Time.Add(rec.RTT)
+		t.HeartbeatMu.Unlock()
+	}
+}
+
+// SendHeartbeat sends heartbeat messages to the peer Trader
+func (t *Trader) SendHeartbeat() {
+	start := time.Now()
+	client, err := t.dialPeer()
+	if impostor, ok := err.(*errImpostor); ok {
+		t.recordHeartbeat(HeartbeatRecord{Time: start, RTT: time.Since(start), Outcome: "impostor", Err: err.Error()})
+		slog.Warn("Rejecting impostor at peer address. Assuming failure.", "err", impostor)
+		t.peerFailed(causeHeartbeatTimeout)
+		return
+	} else if err != nil {
+		t.recordHeartbeat(HeartbeatRecord{Time: start, RTT: time.Since(start), Outcome: "dial-failed", Err: err.Error()})
+		slog.Warn("Failed to connect to peer")
+		t.heartbeatMissed(start)
+		return
+	}
+	defer client.Close()
+
+	var reply string
+	err = t.call(client, "Trader.ReceiveHeartbeat", t.ID, &reply)
+	if err != nil {
+		t.recordHeartbeat(HeartbeatRecord{Time: start, RTT: time.Since(start), Outcome: "call-failed", Err: err.Error()})
+		slog.Warn("Failed to send heartbeat", "err", err)
+		t.heartbeatMissed(start)
+		return
+	}
+	t.recordHeartbeat(HeartbeatRecord{Time: start, RTT: time.Since(start), Outcome: "ok"})
+	if _, suspected := t.Detector.Suspicion(time.Now()); suspected {
+		slog.Info("Failure detector no longer suspects the peer", "detector", t.Detector.Name())
+	}
+	t.Detector.Heartbeat(start)
+	if !t.peerUp() && t.Replicator != nil {
+		// The peer may have restarted without our registrations
+		t.replicateRegistry()
+	}
+	t.setPeerUp(true)
+	t.peerRecovered()
+
+	slog.Debug("Heartbeat acknowledged by peer")
+	t.reconcile(client)
+}
+
+// heartbeatMissed feeds a failed heartbeat to the failure detector and takes over
+// leadership once the detector suspects the peer
+func (t *Trader) heartbeatMissed(at time.Time) {
+	t.Detector.Miss(at)
+	level, suspect := t.Detector.Suspicion(time.Now())
+	if !suspect {
+		slog.Info("Failure detector not suspecting the peer yet", "detector", t.Detector.Name(), "level", fmt.Sprintf("%.2f", level))
+		return
+	}
+	slog.Warn("Failure detector suspects the peer. Assuming failure.", "detector", t.Detector.Name(), "level", fmt.Sprintf("%.2f", level))
+	t.peerFailed(causeHeartbeatTimeout)
+}
+
+// setPeerUp records whether the peer is reachable
+func (t *Trader) setPeerUp(up bool) {
+	t.HeartbeatMu.Lock()
+	t.PeerUp = up
+	t.HeartbeatMu.Unlock()
+}
+
+// peerUp reports whether the peer answered the last heartbeat
+func (t *Trader) peerUp() bool {
+	t.HeartbeatMu.Lock()
+	defer t.HeartbeatMu.Unlock()
+	return t.PeerUp
+}
+
+// StartHeartbeat sends periodic heartbeat messages to the peer Trader, following
+// changes of the interval from one heartbeat to the next
+func (t *Trader) StartHeartbeat() {
+	interval := t.heartbeatInterval()
+	ticker := time.NewTicker(common.Scaled(interval))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.HeartbeatMu.Lock()
+		leaving := t.Leaving
+		t.HeartbeatMu.Unlock()
+		if leaving {
+			return
+		}
+		t.SendHeartbeat()
+		if next := t.heartbeatInterval(); next != interval {
+			interval = next
+			ticker.Reset(common.Scaled(interval))
+		}
+	}
+}
+
+// StartRPCServer starts the Trader's RPC server, returning once it listens
+func StartRPCServer(t *Trader) {
+	srv := rpcserver.New(rpcserver.Options{
+		Name:    fmt.Sprintf("Trader %d", t.ID),
+		Address: t.Address,
+		DevMode: t.DevMode,
+		TLS:     t.TLS,
+
+		Interceptors: []rpcserver.Interceptor{t.checkPeerCaller},
+	})
+	if err := srv.Register(t); err != nil {
+		common.Fatal("Error registering Trader service", "err", err)
+	}
+
+	addr, err := srv.Listen()
+	if err != nil {
+		common.Fatal("Error starting RPC server", "addr", t.Address, "err", err)
+	}
+	t.Address = addr
+	t.server = srv
+
+	slog.Info("RPC server started", "addr", t.Address)
+	go srv.Serve()
+}
+
+// ======= PREFLIGHT =======
+
+// preflightConfig holds the settings checked by -preflight
+type preflightConfig struct {
+	ID, PeerID, Post         int
+	Address, Peer, ExportURL string
+	ChunkSize, ReplBatch     int
+	HBHistory                int
+	ReplFlush                time.Duration
+}
+
+// maxClockSkew is the largest tolerated difference between our clock and the peer's
+const maxClockSkew = time.Second
+
+// runPreflight checks that a Trader could start and run correctly, printing one line
+// per check. It returns false if any check failed.
+func runPreflight(cfg preflightConfig) bool {
+	ok := true
+	report := func(passed bool, format string, args ...interface{}) {
+		status := " OK "
+		if !passed {
+			status = "FAIL"
+			ok = false
+		}
+		fmt.Printf("[%s] %s\n", status, fmt.Sprintf(format, args...))
+	}
+	warn := func(format string, args ...interface{}) {
+		fmt.Printf("[WARN] %s\n", fmt.Sprintf(format, args...))
+	}
+
+	fmt.Printf("Preflight for Trader %d at %s\n", cfg.ID, cfg.Address)
+
+	// Configuration
+	report(cfg.ID > 0, "id is positive (got %d)", cfg.ID)
+	report(cfg.Post > 0, "post is positive (got %d)", cfg.Post)
+	report(cfg.Address != "", "address is set")
+	report(cfg.Peer != "", "peer is set")
+	report(cfg.Peer != cfg.Address, "peer differs from own address")
+	report(cfg.ChunkSize > 0, "chunk-size is positive (got %d)", cfg.ChunkSize)
+	report(cfg.ReplBatch > 0, "repl-batch is positive (got %d)", cfg.ReplBatch)
+	report(cfg.ReplFlush > 0, "repl-flush is positive (got %v)", cfg.ReplFlush)
+	report(cfg.HBHistory > 0, "heartbeat-history is positive (got %d)", cfg.HBHistory)
+
+	// Listen address
+	if cfg.Address != "" {
+		listener, err := net.Listen("tcp", cfg.Address)
+		report(err == nil, "address %s can be bound%s", cfg.Address, errSuffix(err))
+		if err == nil {
+			listener.Close()
+		}
+	}
+
+	// Peer reachability, identity and clock
+	if cfg.Peer != "" && cfg.Peer != cfg.Address {
+		conn, err := common.DialConn(cfg.Peer, 2*time.Second)
+		if err != nil {
+			warn("peer %s is not reachable yet%s; fine if it starts later", cfg.Peer, errSuffix(err))
+		} else {
+			client := rpc.NewClient(conn)
+			var id NodeIdentity
+			sent := time.Now()
+			err = common.CallTimeout(client, "Trader.Identify", 0, &id, 2*time.Second)
+			rtt := time.Since(sent)
+			client.Close()
+
+			report(err == nil, "peer %s answers Identify%s", cfg.Peer, errSuffix(err))
+			if err == nil {
+				if cfg.PeerID != 0 {
+					report(id.Role == "trader" && id.ID == cfg.PeerID, "peer identifies as trader %d (got %s %d)", cfg.PeerID, id.Role, id.ID)
+				}
+				report(id.ID != cfg.ID, "peer has a different ID than ours")
+				skew := time.Until(id.Time.Add(rtt / 2))
+				if skew < 0 {
+					skew = -skew
+				}
+				report(skew <= maxClockSkew, "clock skew with peer is %v (limit %v)", skew.Round(time.Millisecond), maxClockSkew)
+			}
+		}
+	}
+
+	// Local clock sanity
+	now := time.Now()
+	report(now.Year() >= 2020, "local clock looks sane (%s)", now.Format(time.RFC3339))
+
+	// Event export backend
+	if cfg.ExportURL != "" {
+		if strings.HasPrefix(cfg.ExportURL, "nats://") {
+			conn, err := net.DialTimeout("tcp", strings.TrimPrefix(cfg.ExportURL, "nats://"), 2*time.Second)
+			report(err == nil, "export backend %s is reachable%s", cfg.ExportURL, errSuffix(err))
+			if err == nil {
+				conn.Close()
+			}
+		} else {
+			_, err := NewExporter(cfg.ExportURL, "")
+			report(false, "export URL is supported%s", errSuffix(err))
+		}
+	}
+
+	// Storage
+	f, err := os.CreateTemp(".", ".preflight-*")
+	report(err == nil, "working directory is writable%s", errSuffix(err))
+	if err == nil {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	if ok {
+		fmt.Println("Preflight passed")
+	} else {
+		fmt.Println("Preflight FAILED")
+	}
+	return ok
+}
+
+// errSuffix formats an optional error for report lines
+func errSuffix(err error) string {
+	if err == nil {
+		return ""
+	}
+	return ": " + err.Error()
+}
+
+func main() {
+	id := flag.Int("id", 0, "Trader ID")
+	address := flag.String("address", "", "Trader Address")
+	peer := flag.String("peer", "", "Peer Trader Address")
+	post := flag.Int("post", 0, "Post ID")
+	exportURL := flag.String("export", "", "Event export URL, e.g. nats://localhost:4222 (disabled if empty)")
+	exportSubject := flag.String("export-subject", "a4.events", "Subject to publish exported events on")
+	spans := flag.String("spans", "", "OpenTelemetry span export: an OTLP/HTTP collector URL such as http://localhost:4318, or a file to append OTLP JSON lines to (disabled if empty)")
+	adminToken := flag.String("admin-token", "", "Token required for admin operations (admin API disabled if empty)")
+	hbHistory := flag.Int("heartbeat-history", 20, "Number of recent heartbeat attempts kept for failover post-mortems")
+	stateSync := flag.Duration("state-sync", 0, "Interval for pulling the peer's inventory for takeover, e.g. 10s (0 pulls only when the state-sync job is run on demand)")
+	chunkSize := flag.Int("chunk-size", 100, "Inventory entries per state transfer chunk")
+	replicate := flag.Bool("replicate", false, "Push committed trades to the peer Trader")
+	replBatch := flag.Int("repl-batch", 16, "Maximum replication entries per RPC (1 replicates each entry individually)")
+	replFlush := flag.Duration("repl-flush", 200*time.Millisecond, "Maximum time a replication entry waits before being flushed")
+	forwardInflight := flag.Int("forward-inflight", 32, "Maximum forwarded requests in flight to the peer at once")
+	syncRequests := flag.Bool("sync-requests", false, "Store each accepted request on the peer before acknowledging it, so the peer finishes it if this Trader fails (requires -replicate)")
+	metricsDir := flag.String("metrics-dir", "", "Directory to append local JSON metrics snapshots to, one file per node (disabled if empty)")
+	metricsInterval := flag.Duration("metrics-interval", 10*time.Second, "Interval between metrics snapshots (0 writes only count-based snapshots)")
+	metricsEvery := flag.Int("metrics-every", 0, "Also write a metrics snapshot after every N completed requests (0 disables)")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on at /metrics (disabled if empty)")
+	statusAddr := flag.String("status-addr", "", "Address to serve the JSON health status on at /status; may equal -metrics-addr (disabled if empty)")
+	pprofAddr := flag.String("pprof-addr", "", "Debug address to serve net/http/pprof profiles on at /debug/pprof/; may equal -metrics-addr (disabled if empty)")
+	workers := flag.Int("workers", 0, "Maximum requests processed at once, serving higher priorities and earlier deadlines first (0 for unlimited; the starting size with -autoscale-workers)")
+	autoscale := flag.Bool("autoscale-workers", false, "Resize the worker pool between -workers-min and -workers-max from the queue depth and CPU use")
+	workersMin := flag.Int("workers-min", 1, "Smallest autoscaled worker pool")
+	workersMax := flag.Int("workers-max", 0, "Largest autoscaled worker pool (0 for 4 per CPU Go may use, see GOMAXPROCS)")
+	cacheWarehouse := flag.Bool("warehouse-cache", false, "Serve Warehouse transactions from a local cache and write them back in batches (requires -warehouse)")
+	cacheBatch := flag.Int("cache-batch", 16, "Cached Warehouse transactions written back at once")
+	cacheFlush := flag.Duration("cache-flush", time.Second, "Longest time a cached Warehouse transaction waits before it is written back")
+	shelfLife := flag.String("shelf-life", "", "Shelf life of perishable items, e.g. apples=2m,pears=30s; expired stock is removed (nothing expires if empty)")
+	sweepInterval := flag.Duration("sweep-interval", 5*time.Second, "Interval between sweeps for expired perishable stock")
+	checkpointInterval := flag.Duration("checkpoint-interval", 0, "Interval between global snapshots taken as checkpoints (0 takes them only when the checkpoint job is run on demand)")
+	sellerTTL := flag.Duration("seller-ttl", 0, "Evict the registrations of Sellers with no request committed for this long (0 never evicts)")
+	sellerRate := flag.Float64("seller-rate", 0, "Requests per second each Seller may send, with bursts of 5 (0 disables rate limiting)")
+	warehouse := flag.String("warehouse", "", "Address of the Warehouse to route deposits and purchases through (stock kept locally if empty)")
+	gateway := flag.String("gateway", "", "Address of the federation gateway to offer purchases this cluster cannot fill (federation disabled if empty)")
+	clusterName := flag.String("cluster-name", "", "Name of this cluster in the federation gateway's routing table (required with -gateway)")
+	failoverPolicy := flag.String("failover", failoverTakeover, "Backup's reaction to leader failure: takeover, standby (wait for Trader.ApproveFailover) or read-only (serve dry runs until the peer returns)")
+	responseMode := flag.String("response-mode", responseSync, "How Sellers receive outcomes: sync (reply), push (Seller.ReceiveResponse), poll (GetPending) or stream (Stream); Sellers must use the same mode")
+	asyncWorkers := flag.Int("async-workers", 0, "Dispatchers processing accepted push, poll and stream requests (0 for a goroutine per request)")
+	asyncQueue := flag.Int("async-queue", 256, "Accepted requests queued for the dispatchers before new ones are refused")
+	marketInterval := flag.Duration("market-interval", 30*time.Second, "Interval between market summary broadcasts to subscribers (0 disables)")
+	detector := flag.String("failure-detector", "counter", "Failure detector: counter, fixed-timeout or phi-accrual")
+	fdMisses := flag.Int("fd-misses", 1, "Consecutive failed heartbeats before the counter detector suspects the peer")
+	heartbeatInterval := flag.Duration("heartbeat-interval", defaultHeartbeatInterval, "Nominal time between heartbeats to the peer; also the leader check interval with -cluster")
+	fdTimeout := flag.Duration("fd-timeout", 12*time.Second, "Time without a heartbeat answer before the fixed-timeout detector suspects the peer")
+	fdPhi := flag.Float64("fd-phi", 8, "Suspicion threshold of the phi-accrual detector")
+	maxHops := flag.Int("max-hops", 2, "Most Traders a request may visit; forwarding beyond this returns a RoutingError")
+	domain := flag.String("domain", "", "Failure domain label (e.g. machine or rack) used to warn about co-located leader and backup")
+	devMode := flag.Bool("dev", false, "Development mode: listen on a free port if -address is taken")
+	peerID := flag.Int("peer-id", 0, "Expected ID of the peer Trader; nodes answering with another identity are rejected (0 disables)")
+	flag.Float64Var(&common.TimeScale, "time-scale", 1.0, "Speed factor applied to all delays, tickers and timeouts (e.g. 10 runs 10x faster)")
+	historySize := flag.Int("history", 1000, "Number of completed requests kept in memory")
+	queryCache := flag.Int("query-cache", 64, "Replies of history queries (transactions, price history) cached until the history changes (0 disables)")
+	auditPath := flag.String("audit", "", "File to append completed requests to as JSON lines (disabled if empty)")
+	transitionsPath := flag.String("transitions", "", "File to append role transitions and their causes to as JSON lines, for timeline/timeline.go (disabled if empty)")
+	pricingPath := flag.String("pricing", "", "JSON file of bulk and bundle discounts applied when purchases are settled (list prices if empty)")
+	journalPath := flag.String("journal", "", "File to journal state events to, replayed on startup (disabled if empty)")
+	forceRecover := flag.Bool("force-recover", false, "Start even if the journal has a corrupt record, truncating it there and losing the events from there on")
+	memLimit := flag.Int("mem-limit", 0, "Approximate memory limit in bytes above which new requests are refused with CapacityExceeded (0 disables)")
+	maxQueue := flag.Int("max-queue", 0, "Requests queued or in flight above which new ones are refused as Overloaded with a retry-after hint (0 for unbounded)")
+	maxConns := flag.Int("max-conns", 64, "Most pooled connections to the peer, Sellers and Buyers; the least recently used idle one is closed to make room (0 for no limit)")
+	connIdle := flag.Duration("conn-idle", time.Minute, "Close pooled connections unused this long (0 keeps them)")
+	pingInterval := flag.Duration("ping-interval", 5*time.Second, "Interval between pings of the persistent peer connection, which is replaced if the peer stopped answering on it (0 pings only on demand)")
+	rpcTimeout := flag.Duration("rpc-timeout", 5*time.Second, "Deadline for dialing and for RPCs without their own timeout (0 waits indefinitely)")
+	rpcTimeouts := flag.String("rpc-timeouts", "", "Per-RPC deadlines overriding the defaults, as method=duration pairs keyed by Service.Method or Service, e.g. Trader.ReceiveRequest=30s,Warehouse=2s")
+	secret := flag.String("secret", "", "Cluster secret for signing responses and leader notifications and for refusing unsigned or forged requests (unsigned and unchecked if empty)")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate served to Traders, Sellers and Buyers over TLS and presented to nodes running -mtls (plaintext if empty; needs -tls-key and -ca)")
+	tlsKey := flag.String("tls-key", "", "PEM private key of -tls-cert")
+	caFile := flag.String("ca", "", "PEM certificate of the cluster CA; connections to other nodes use TLS and trust only it")
+	mtls := flag.Bool("mtls", false, "Refuse any Trader, Seller, Buyer or tool connecting without a certificate signed by -ca (needs -tls-cert)")
+	notifyAttempts := flag.Int("notify-attempts", 3, "Attempts at each notification to a Seller or Buyer (leader updates, pushed responses, corrections, spoilage) before it is given up with an alert")
+	notifyBackoff := flag.Duration("notify-backoff", 250*time.Millisecond, "Wait after the first failed notification attempt, doubling after each further one up to 8 times this")
+	offloadAbove := flag.Int("offload-above", 0, "As leader with -replicate, delegate dry runs to the backup while this many requests are in flight (0 disables)")
+	leaseFile := flag.String("lease-file", "", "File the request IDs leased to Sellers are persisted to, so a restart never leases them again (in memory only if empty)")
+	termFile := flag.String("term-file", "", "File the current term and last vote are persisted to, so a restart cannot regress them (in memory only if empty)")
+	negotiateTimeout := flag.Duration("negotiate-timeout", 5*time.Second, "How long to wait for the peer when electing the initial leader at startup")
+	waitForPeer := flag.Duration("wait-for-peer", 0, "Before assuming any role, wait this long for the peer (every member with -cluster) and the Warehouse to be reachable, and exit if they are not (0 starts right away)")
+	cluster := flag.String("cluster", "", "Every Trader of the cluster as id=address pairs, e.g. 1=localhost:8001,2=localhost:8002,3=localhost:8005; leadership is then settled by a Bully election and -peer is optional (two-Trader election if empty)")
+	poolSpec := flag.String("pool", "", "Every Trader of a standby pool as id=address pairs, e.g. 1=localhost:8001,2=localhost:8002,3=localhost:8005; the leader replicates to all of them and the most up-to-date standby is promoted when it fails (requires -replicate)")
+	promoteBy := flag.String("promote-by", promoteByLag, "How the pool picks the standby to promote: lag (most replicated changes first) or id (lowest ID first)")
+	standby := flag.Bool("standby", false, "Join the -pool as an extra standby of the leader at -peer instead of negotiating leadership")
+	snapshotDir := flag.String("snapshot-dir", "snapshots", "Directory global snapshots are written to")
+	configPath := flag.String("config", "", "Cluster config file (.yaml, .yml or .toml) setting the flags not given here; A4_<FLAG> environment variables override it")
+	logLevel := flag.String("log-level", "info", "Lowest level logged: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log record format: text (key=value) or json")
+	preflight := flag.Bool("preflight", false, "Check configuration, peer, export backend, storage and clock, print a report and exit")
+	flag.Parse()
+	if err := config.Apply(flag.CommandLine, *configPath, "trader"); err != nil {
+		log.Fatal(err)
+	}
+
+	// Every record names this Trader, its peer and its current role, so logs of many
+	// nodes can be merged and filtered
+	var trader *Trader
+	parsed, err := common.ParseLogLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	level := new(slog.LevelVar) // Changed by a configuration reload
+	level.Set(parsed)
+	attrs := []any{"node", "trader", "id", *id}
+	if *peer != "" {
+		attrs = append(attrs, "peer", *peer)
+	}
+	logger, err := common.NewLogger(os.Stderr, *logFormat, level, func() string {
+		if trader == nil {
+			return "starting"
+		}
+		return trader.logRole()
+	}, attrs...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	if common.TimeScale <= 0 {
+		common.Fatal("-time-scale must be positive", "time_scale", common.TimeScale)
+	}
+	serverTLS, clientTLS, err := common.LoadTLS(*tlsCert, *tlsKey, *caFile, *mtls)
+	if err != nil {
+		common.Fatal("Error loading TLS configuration", "err", err)
+	}
+	common.UseTLS(clientTLS)
+
+	if *preflight {
+		cfg := preflightConfig{
+			ID: *id, Address: *address, Peer: *peer, PeerID: *peerID, Post: *post,
+			ExportURL: *exportURL, ChunkSize: *chunkSize, ReplBatch: *replBatch,
+			ReplFlush: *replFlush, HBHistory: *hbHistory,
+		}
+		if !runPreflight(cfg) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	var members map[int]string
+	if *cluster != "" {
+		var err error
+		if members, err = parseMembers(*cluster); err != nil {
+			common.Fatal("Error parsing -cluster", "err", err)
+		}
+		if addr, ok := members[*id]; !ok || addr != *address {
+			common.Fatal("-cluster must list this Trader", "id", *id, "address", *address)
+		}
+		if *failoverPolicy != failoverTakeover {
+			common.Fatal("-failover cannot be combined with -cluster; the Bully election decides when the leader has failed", "failover", *failoverPolicy)
+		}
+	}
+
+	var pool map[int]string
+	if *poolSpec != "" {
+		var err error
+		if pool, err = parseMembers(*poolSpec); err != nil {
+			common.Fatal("Error parsing -pool", "err", err)
+		}
+		if addr, ok := pool[*id]; !ok || addr != *address {
+			common.Fatal("-pool must list this Trader", "id", *id, "address", *address)
+		}
+		if members != nil {
+			common.Fatal("-pool cannot be combined with -cluster; the Bully election already picks among every member")
+		}
+		if !*replicate {
+			common.Fatal("-pool requires -replicate; standbys are only promotable with the leader's changes")
+		}
+		inPool := false
+		for _, addr := range pool {
+			inPool = inPool || addr == *peer
+		}
+		if !inPool {
+			common.Fatal("-pool must list the -peer", "peer", *peer)
+		}
+	}
+	if *standby && pool == nil {
+		common.Fatal("-standby requires -pool")
+	}
+	if *promoteBy != promoteByLag && *promoteBy != promoteByID {
+		common.Fatal("Unknown -promote-by (expected lag or id)", "promote-by", *promoteBy)
+	}
+
+	if *id == 0 || *address == "" || (*peer == "" && members == nil) || *post == 0 {
+		common.Fatal("Usage: trader -id=<id> -address=<address> -peer=<peer> -post=<post> (-peer is optional with -cluster)")
+	}
+	if *peer == *address {
+		common.Fatal("-peer is this Trader's own address; it must point at the other Trader (e.g. -address=localhost:8001 -peer=localhost:8002)", "peer", *peer)
+	}
+
+	if members == nil && pool == nil && *peerID != 0 && *peerID%2 == *id%2 {
+		// A cluster or pool shares the terms out by rank instead
+		common.Fatal("Trader IDs have the same parity; the Traders of a pair lead in odd or even terms by ID, so use one odd and one even ID", "id", *id, "peer_id", *peerID)
+	}
+	timeouts, err := common.ParseTimeouts(*rpcTimeout, *rpcTimeouts)
+	if err != nil {
+		common.Fatal("Error parsing -rpc-timeouts", "err", err)
+	}
+
+	trader = &Trader{
+		ID:         *id,
+		Address:    *address,
+		Peer:       *peer,
+		Post:       *post,
+		AdminToken: *adminToken,
+		Inventory:  make(map[string]int),
+		Cancelled:  make(map[RequestKey]bool),
+		HBHistory:  NewHeartbeatHistory(*hbHistory),
+		PeerID:     *peerID,
+		DevMode:    *devMode,
+		ChunkSize:  *chunkSize,
+		snapshots:  make(map[int64]*stateSnapshot),
+		Domain:     *domain,
+		Handback:   make(map[string]int),
+		Secret:     *secret,
+		TLS:        serverTLS,
+		History:    NewRequestHistory(*historySize),
+		Queries:    NewQueryCache(*queryCache),
+		Posts:      NewPostTracker(),
+		MemLimit:   *memLimit,
+		MaxQueue:   *maxQueue,
+		Timeouts:   timeouts,
+		Registry:   make(map[int]*SellerInfo),
+
+		NotifyAttempts: *notifyAttempts,
+		NotifyBackoff:  *notifyBackoff,
+		leases:         make(map[int]int),
+
+		SnapshotDir: *snapshotDir,
+		negotiating: true,
+		faults:      make(map[string]Fault),
+
+		OffloadAbove: *offloadAbove,
+		marketSubs:   make(map[string]string),
+
+		ResponseMode:   *responseMode,
+		readyResponses: make(map[int][]Response),
+
+		FailoverPolicy: *failoverPolicy,
+		Warehouse:      *warehouse,
+		SellerRate:     *sellerRate,
+
+		Gateway:     *gateway,
+		ClusterName: *clusterName,
+
+		Members:     members,
+		coordinated: make(chan struct{}, 1),
+		postOwners:  make(map[int]int),
+		logged:      make(map[RequestKey]bool),
+		walAccepted: make(map[RequestKey]bool),
+
+		HeartbeatInterval: *heartbeatInterval,
+
+		Pool:      pool,
+		PromoteBy: *promoteBy,
+		Standby:   *standby,
+	}
+	sessionKey := make([]byte, 32)
+	if _, err := cryptorand.Read(sessionKey); err != nil {
+		common.Fatal("Error generating session key", "err", err)
+	}
+	trader.localSessionKey = hex.EncodeToString(sessionKey)
+	trader.Conns = &common.Pool{Dial: trader.dialNode, MaxConns: *maxConns, IdleTimeout: common.Scaled(*connIdle)}
+	if *forwardInflight < 1 {
+		*forwardInflight = 1
+	}
+	trader.forwardSlots = newWorkSlots(*forwardInflight)
+	if *workers < 0 {
+		common.Fatal("-workers must not be negative")
+	}
+	if *notifyAttempts < 1 || *notifyBackoff <= 0 {
+		common.Fatal("-notify-attempts must be at least 1 and -notify-backoff positive")
+	}
+	if *heartbeatInterval <= 0 {
+		common.Fatal("-heartbeat-interval must be positive", "heartbeat_interval", *heartbeatInterval)
+	}
+	if *gateway != "" && *clusterName == "" {
+		common.Fatal("-gateway requires -cluster-name")
+	}
+	if *autoscale {
+		if *workersMax == 0 {
+			*workersMax = workersPerCPU * runtime.GOMAXPROCS(0)
+		}
+		if *workersMin < 1 || *workersMax < *workersMin {
+			common.Fatal("-workers-min must be at least 1 and at most -workers-max")
+		}
+		trader.WorkersMin, trader.WorkersMax = *workersMin, *workersMax
+		*workers = min(max(*workers, *workersMin), *workersMax)
+	}
+	trader.workers = newWorkSlots(*workers)
+	if *syncRequests && !*replicate {
+		common.Fatal("-sync-requests requires -replicate")
+	}
+	trader.SyncRequests = *syncRequests
+	trader.MaxHops = *maxHops
+	if *failoverPolicy != failoverTakeover && *failoverPolicy != failoverStandby && *failoverPolicy != failoverReadOnly {
+		common.Fatal("Unknown -failover (expected takeover, standby or read-only)", "failover", *failoverPolicy)
+	}
+	life, err := parseShelfLife(*shelfLife)
+	if err != nil {
+		common.Fatal("Error parsing -shelf-life", "err", err)
+	}
+	trader.ShelfLife = life
+	if *responseMode != responseSync && *responseMode != responsePush && *responseMode != responsePoll && *responseMode != responseStream {
+		common.Fatal("Unknown -response-mode (expected sync, push, poll or stream)", "response_mode", *responseMode)
+	}
+	if *asyncWorkers < 0 || *asyncQueue < 1 {
+		common.Fatal("-async-workers must not be negative and -async-queue must be positive")
+	}
+	if *asyncWorkers > 0 && *responseMode != responseSync {
+		trader.AsyncWorkers = *asyncWorkers
+		trader.acceptQueue = make(chan Request, *asyncQueue)
+		for i := 0; i < *asyncWorkers; i++ {
+			go trader.runDispatcher()
+		}
+	}
+	fd, err := NewFailureDetector(DetectorConfig{
+		Kind:     *detector,
+		Interval: common.Scaled(*heartbeatInterval),
+		Misses:   *fdMisses,
+		Timeout:  common.Scaled(*fdTimeout),
+		Phi:      *fdPhi,
+	})
+	if err != nil {
+		common.Fatal("Error configuring failure detector", "err", err)
+	}
+	trader.Detector = fd
+
+	if *termFile != "" {
+		store, st, err := OpenTermStore(*termFile)
+		if err != nil {
+			common.Fatal("Error opening term file", "err", err)
+		}
+		trader.TermStore = store
+		trader.Term, trader.votedFor, trader.voteTerm = st.Term, st.VotedFor, st.VoteTerm
+		slog.Info("Restored term", "term", st.Term, "voted_for", st.VotedFor, "vote_term", st.VoteTerm, "file", *termFile)
+	}
+
+	if *leaseFile != "" {
+		store, leases, err := OpenLeaseStore(*leaseFile)
+		if err != nil {
+			common.Fatal("Error opening lease file", "err", err)
+		}
+		trader.LeaseStore, trader.leases = store, leases
+		slog.Info("Restored request ID leases", "sellers", len(leases), "file", *leaseFile)
+	}
+
+	var unfinished []Request
+	if *journalPath != "" {
+		journal, events, err := OpenJournal(*journalPath, *forceRecover)
+		var corrupt *JournalCorruptError
+		if errors.As(err, &corrupt) {
+			common.Fatal("Error opening journal. Restore it from a backup, or start with -force-recover to truncate it at the bad record, losing the events from there on", "err", err)
+		} else if err != nil {
+			common.Fatal("Error opening journal", "err", err)
+		}
+		trader.Journal = journal
+		unfinished = trader.rebuild(events)
+		slog.Info("Rebuilt state from journal", "events", len(events), "file", *journalPath, "stock", trader.Inventory, "committed", trader.Processed, "unfinished", len(unfinished))
+	}
+
+	trader.Transitions, err = NewTransitionLog(trader.ID, *transitionsPath)
+	if err != nil {
+		common.Fatal("Error opening transitions log", "err", err)
+	}
+
+	if *auditPath != "" {
+		audit, err := OpenAuditLog(*auditPath)
+		if err != nil {
+			common.Fatal("Error opening audit log", "err", err)
+		}
+		trader.AuditLog = audit
+	}
+
+	if *pricingPath != "" {
+		pricing, err := LoadPricing(*pricingPath)
+		if err != nil {
+			common.Fatal("Error loading pricing rules", "err", err)
+		}
+		trader.Pricing = pricing
+		slog.Info("Loaded pricing rules", "rules", len(pricing.Rules), "file", *pricingPath)
+	}
+
+	if *exportURL != "" {
+		exporter, err := NewExporter(*exportURL, *exportSubject)
+		if err != nil {
+			common.Fatal("Error configuring event export", "err", err)
+		}
+		trader.Exporter = exporter
+		slog.Info("Exporting events", "url", *exportURL, "subject", *exportSubject)
+	}
+
+	if *spans != "" {
+		tracer, err := tracing.New(*spans, "trader", traderHop(trader.ID))
+		if err != nil {
+			common.Fatal("Error configuring span export", "err", err)
+		}
+		trader.Tracer = tracer
+		slog.Info("Exporting spans", "endpoint", *spans)
+	}
+
+	endpoints := make(metrics.Endpoints)
+	if *metricsAddr != "" {
+		reg := metrics.NewRegistry()
+		trader.registerMetrics(reg)
+		endpoints.Handle(*metricsAddr, "/metrics", reg)
+	}
+	endpoints.Handle(*statusAddr, "/status", http.HandlerFunc(trader.serveStatus))
+	endpoints.Handle(*pprofAddr, "/debug/pprof/", metrics.Profiles())
+	if err := endpoints.Serve(); err != nil {
+		common.Fatal("Error starting HTTP server", "err", err)
+	}
+	for _, ep := range []struct{ name, addr string }{{"Prometheus metrics", *metricsAddr}, {"health status", *statusAddr}, {"pprof profiles", *pprofAddr}} {
+		if ep.addr != "" {
+			slog.Info("Serving "+ep.name, "addr", ep.addr)
+		}
+	}
+
+	if *cacheWarehouse {
+		if trader.Warehouse == "" {
+			common.Fatal("-warehouse-cache requires -warehouse")
+		}
+		trader.Cache = NewWarehouseCache(trader, *cacheBatch, *cacheFlush)
+		go trader.Cache.Run()
+	}
+
+	sched := NewScheduler(trader)
+
+	// Reload the settings that can change while running on SIGHUP
+	appliedWorkers := *workers
+	go config.Watch(flag.CommandLine, *configPath, "trader", []string{"log-level", "heartbeat-interval", "workers", "notify-attempts", "notify-backoff"}, func() error {
+		parsed, err := common.ParseLogLevel(*logLevel)
+		if err != nil {
+			return err
+		}
+		switch {
+		case *heartbeatInterval <= 0:
+			return fmt.Errorf("-heartbeat-interval must be positive, got %v", *heartbeatInterval)
+		case *workers < 0:
+			return fmt.Errorf("-workers must not be negative, got %d", *workers)
+		case *notifyAttempts < 1:
+			return fmt.Errorf("-notify-attempts must be at least 1, got %d", *notifyAttempts)
+		case *notifyBackoff <= 0:
+			return fmt.Errorf("-notify-backoff must be positive, got %v", *notifyBackoff)
+		}
+		level.Set(parsed)
+		trader.HeartbeatMu.Lock()
+		trader.HeartbeatInterval = *heartbeatInterval
+		trader.HeartbeatMu.Unlock()
+		sched.SetInterval("leader-check", *heartbeatInterval) // Only run with -cluster
+		trader.alertMu.Lock()
+		trader.NotifyAttempts, trader.NotifyBackoff = *notifyAttempts, *notifyBackoff
+		trader.alertMu.Unlock()
+		if *workers != appliedWorkers { // Otherwise the pool keeps any size the autoscaler gave it
+			if trader.WorkersMax > 0 {
+				*workers = min(max(*workers, trader.WorkersMin), trader.WorkersMax) // The autoscaler carries on from here
+			}
+			trader.workers.setLimit(*workers)
+			appliedWorkers = *workers
+		}
+		return nil
+	})
+	trader.Scheduler = sched
+	if *metricsDir != "" {
+		writer, err := metrics.Open(*metricsDir, traderHop(trader.ID), *metricsEvery, func() any {
+			var st TraderState
+			trader.state(&st)
+			return &st
+		})
+		if err != nil {
+			common.Fatal("Error opening metrics file", "err", err)
+		}
+		trader.Metrics = writer
+		sched.Add("metrics", *metricsInterval, func() error { return writer.Write("interval") })
+		slog.Info("Writing metrics snapshots", "dir", *metricsDir)
+	}
+	sched.Add("state-sync", *stateSync, func() error { return trader.PullPeerState(3) })
+	sched.Add("checkpoint", *checkpointInterval, trader.checkpoint)
+	if trader.peerAddr() != "" {
+		sched.Add("ping-peer", *pingInterval, trader.pingPeerConn)
+	}
+	if *connIdle > 0 {
+		sched.Add("reap-conns", *connIdle/2, func() error {
+			if n := trader.Conns.Reap(); n > 0 {
+				slog.Info("Closed idle pooled connections", "count", n)
+			}
+			return nil
+		})
+	}
+	if trader.WorkersMax > 0 {
+		sched.Add("autoscale-workers", time.Second, trader.autoscaleWorkers)
+		slog.Info("Autoscaling workers", "min", trader.WorkersMin, "max", trader.WorkersMax, "start", *workers)
+	}
+	if *marketInterval > 0 {
+		sched.Add("market", *marketInterval, func() error {
+			trader.broadcastMarket(*marketInterval)
+			return nil
+		})
+	}
+	if len(trader.ShelfLife) > 0 {
+		sched.Add("spoilage", *sweepInterval, func() error {
+			trader.sweepSpoiled()
+			return nil
+		})
+	}
+	sched.Add("post-fairness", 30*time.Second, func() error {
+		trader.logFairness()
+		return nil
+	})
+	if *sellerTTL > 0 {
+		sched.Add("evict-sellers", *sellerTTL/2, func() error { return trader.evictIdleSellers(*sellerTTL) })
+	}
+
+	StartRPCServer(trader)
+	common.OnTerminate(trader.shutdownGracefully)
+	if *replicate {
+		trader.Replicator = NewReplicator(trader, *replBatch, *replFlush)
+		go trader.Replicator.Run()
+		sched.Add("repl-stats", 30*time.Second, func() error {
+			trader.Replicator.logStats()
+			return nil
+		})
+	}
+
+	if *waitForPeer > 0 {
+		slog.Info("Waiting for the peer and the Warehouse before assuming a role", "timeout", *waitForPeer)
+		if missing := trader.waitForDependencies(*waitForPeer); len(missing) > 0 {
+			common.Fatal("Startup dependencies still unreachable after -wait-for-peer", "timeout", *waitForPeer, "unreachable", strings.Join(missing, ", "))
+		}
+	}
+	if trader.bully() {
+		trader.HeartbeatMu.Lock()
+		trader.negotiating = false
+		trader.HeartbeatMu.Unlock()
+		if trader.peerAddr() != "" {
+			trader.sayHello() // Learn the peer's post; leadership comes from the election
+		}
+		trader.runElection()
+		sched.Add("leader-check", trader.heartbeatInterval(), trader.checkLeader)
+	} else {
+		trader.negotiateRole(*negotiateTimeout)
+	}
+	if trader.peerAddr() != "" {
+		go trader.StartHeartbeat()
+	}
+	sched.Start()
+	if len(unfinished) > 0 {
+		go trader.finishJournaled(unfinished) // Once the role is settled, so they go where they belong
+	}
+
+	select {} // Keep the process running
+}
+
+// ======= RESPONSE DELIVERY =======
+
+// dispatch hands an accepted request to a dispatcher, reporting false if the queue is
+// full. Without a queue, each request gets a goroutine of its own.
+func (t *Trader) dispatch(req Request) bool {
+	if t.acceptQueue == nil {
+		go t.respondLater(req)
+		return true
+	}
+	select {
+	case t.acceptQueue <- req:
+		return true
+	default:
+		return false
+	}
+}
+
+// runDispatcher processes queued requests one at a time and delivers their outcomes
+func (t *Trader) runDispatcher() {
+	for req := range t.acceptQueue {
+		t.respondLater(req)
+	}
+}
+
+// respondLater processes an accepted push, poll or stream request and delivers its outcome
+func (t *Trader) respondLater(req Request) {
+	span := t.Tracer.Start("Trader.respondLater", tracing.Internal, req.Trace)
+	defer span.End()
+	req.Trace = span.Context()
+	var res Response
+	if err := t.handleRequest(&req, &res); err != nil {
+		span.Fail(err)
+		res.RequestID = req.RequestID
+		res.Status = "Error"
+		res.Message = err.Error()
+	}
+	span.Set("a4.request", req.RequestID)
+	span.Set("a4.status", res.Status)
+	span.Set("a4.response_mode", req.ResponseMode)
+	res.Trace = span.Context()
+	// Logged and journaled on acceptance; settle and finish it even if handling stopped
+	// before processing
+	t.settleRequest(&req)
+	t.journalFinished(&req)
+	t.signResponse(req.SellerID, &res)
+
+	if req.ResponseMode == responsePoll {
+		t.RequestMu.Lock()
+		ready := append(t.readyResponses[req.SellerID], res)
+		if len(ready) > maxReadyResponses {
+			ready = ready[len(ready)-maxReadyResponses:]
+		}
+		t.readyResponses[req.SellerID] = ready
+		t.RequestMu.Unlock()
+		return
+	}
+	if req.ResponseMode == responseStream {
+		// Queued even if the stream is not open yet; the Seller reads it on connecting
+		t.streamMu.Lock()
+		t.enqueueStreamLocked(t.streamLocked(req.SellerID), StreamMessage{Kind: "response", Response: &res})
+		t.streamMu.Unlock()
+		return
+	}
+
+	t.RegistryMu.Lock()
+	reg, ok := t.Registry[req.SellerID]
+	addr := ""
+	if ok {
+		addr = reg.Address
+	}
+	t.RegistryMu.Unlock()
+	if addr == "" {
+		slog.Warn("Seller is not registered; dropping the response", "seller", req.SellerID, "request", req.RequestID)
+		return
+	}
+	t.SendResponse(addr, &res)
+}
+
+// GetPending returns and forgets the poll-mode responses ready for the Seller holding
+// the session token
+func (t *Trader) GetPending(args *PendingArgs, reply *[]Response) error {
+	if err := t.injectFault("GetPending"); err != nil {
+		return err
+	}
+	sess, err := t.decodeSession(args.Session)
+	if err != nil {
+		return err
+	}
+	t.RequestMu.Lock()
+	*reply = t.readyResponses[sess.SellerID]
+	delete(t.readyResponses, sess.SellerID)
+	t.RequestMu.Unlock()
+	return nil
+}
+
+// SendResponse sends a response back to the Seller
+func (t *Trader) SendResponse(sellerAddr string, res *Response) {
+	span := t.Tracer.Start("Seller.ReceiveResponse", tracing.Client, res.Trace)
+	defer span.End()
+	span.Set("a4.request", res.RequestID)
+	span.Set("a4.to", sellerAddr)
+	res.Trace = span.Context()
+	var reply string
+	if err := t.notify("response", sellerAddr, "Seller.ReceiveResponse", res, &reply); err != nil {
+		span.Fail(err)
+		slog.Warn("Failed to send response to Seller", "addr", sellerAddr, "err", err)
+		return
+	}
+
+	slog.Info("Response sent to Seller", "request", res.RequestID, "addr", sellerAddr)
+}
+
+// ======= RESPONSE STREAMS =======
+
+// streamWait is how long a Stream call waits for a message before returning empty
+const streamWait = 10 * time.Second
+
+// sellerStream holds the messages queued for one Seller until it acknowledges them
+type sellerStream struct {
+	queue    []StreamMessage
+	seq      int64
+	wake     chan struct{} // Closed and replaced whenever a message is queued
+	waiting  int           // Stream calls currently blocked
+	lastCall time.Time
+}
+
+// streamLocked returns the Seller's stream, creating it if needed; streamMu must be held
+func (t *Trader) streamLocked(sellerID int) *sellerStream {
+	if t.streams == nil {
+		t.streams = make(map[int]*sellerStream)
+	}
+	st, ok := t.streams[sellerID]
+	if !ok {
+		st = &sellerStream{wake: make(chan struct{})}
+		t.streams[sellerID] = st
+	}
+	return st
+}
+
+// enqueueStreamLocked queues a message for the Seller and wakes a waiting Stream call;
+// streamMu must be held
+func (t *Trader) enqueueStreamLocked(st *sellerStream, msg StreamMessage) {
+	st.seq++
+	msg.Seq = st.seq
+	st.queue = append(st.queue, msg)
+	if len(st.queue) > maxReadyResponses {
+		st.queue = st.queue[len(st.queue)-maxReadyResponses:]
+	}
+	close(st.wake)
+	st.wake = make(chan struct{})
+}
+
+// streamOpenLocked reports whether the Seller is reading its stream; streamMu must be held
+func (t *Trader) streamOpenLocked(st *sellerStream) bool {
+	return st.waiting > 0 || time.Since(st.lastCall) < common.Scaled(streamWait)
+}
+
+// streamTo sends a notification down the Seller's response stream if it has one open,
+// and reports whether it did; otherwise the caller dials the Seller as before. A
+// client-only Seller cannot be dialed, so its messages are always queued, and it reads
+// them once it reconnects.
+func (t *Trader) streamTo(sellerID int, msg StreamMessage) bool {
+	clientOnly := t.clientOnly(sellerID)
+	t.streamMu.Lock()
+	defer t.streamMu.Unlock()
+	st, ok := t.streams[sellerID]
+	if (!ok || !t.streamOpenLocked(st)) && !clientOnly {
+		return false
+	}
+	t.enqueueStreamLocked(t.streamLocked(sellerID), msg)
+	return true
+}
+
+// clientOnly reports whether a registered Seller runs without a listener
+func (t *Trader) clientOnly(sellerID int) bool {
+	t.RegistryMu.Lock()
+	defer t.RegistryMu.Unlock()
+	reg, ok := t.Registry[sellerID]
+	return ok && common.IsStreamAddress(reg.Address)
+}
+
+// Stream returns the messages queued for the Seller holding the session token, waiting
+// up to streamWait for one if none are. The Seller calls it in a loop over one
+// connection it opened, so the Trader never dials it.
+func (t *Trader) Stream(args *StreamArgs, reply *[]StreamMessage) error {
+	if err := t.injectFault("Stream"); err != nil {
+		return err
+	}
+	sess, err := t.decodeSession(args.Session)
+	if err != nil {
+		return err
+	}
+
+	t.streamMu.Lock()
+	defer t.streamMu.Unlock()
+	st := t.streamLocked(sess.SellerID)
+	unacked := st.queue[:0]
+	for _, msg := range st.queue {
+		if msg.Seq > args.Ack {
+			unacked = append(unacked, msg)
+		}
+	}
+	st.queue = unacked
+
+	if len(st.queue) == 0 {
+		wake := st.wake
+		st.waiting++
+		t.streamMu.Unlock()
+		select {
+		case <-wake:
+		case <-time.After(common.Scaled(streamWait)):
+		}
+		t.streamMu.Lock()
+		st.waiting--
+	}
+	st.lastCall = time.Now()
+	*reply = append([]StreamMessage(nil), st.queue...)
+	return nil
+}
+
+// openStreams counts the Sellers currently reading their response stream
+func (t *Trader) openStreams() int {
+	t.streamMu.Lock()
+	defer t.streamMu.Unlock()
+	n := 0
+	for _, st := range t.streams {
+		if t.streamOpenLocked(st) {
+			n++
+		}
+	}
+	return n
+}
+
+// NotifySellers informs all Sellers, and any registered Buyers, to communicate with the new leader
+func (t *Trader) NotifySellers(newLeaderAddr string) {
+	t.announceLeader(t.ID, newLeaderAddr, t.term())
+}
+
+// announceLeader tells every Seller and Buyer known here that Trader id leads at addr in
+// term. Bully election followers relay the winner's announcement this way, reaching
+// Sellers that never registered with the winner.
+func (t *Trader) announceLeader(id int, addr string, term int64) {
+	for _, target := range t.notifyTargets() {
+		sellerAddr := target.addr
+		if !t.stillCurrent(target) {
+			slog.Info("Skipping notification to stale Seller address", "addr", sellerAddr)
+			continue
+		}
+
+		update := LeaderUpdate{Address: addr, TraderID: id, Term: term, IssuedAt: time.Now().UnixNano()}
+		if t.Secret != "" {
+			update.Signature = common.LeaderUpdateSignature(t.Secret, &update)
+		}
+		if t.streamTo(target.sellerID, StreamMessage{Kind: "leader", Leader: &update}) {
+			slog.Info("Notified Seller about new leader over its stream", "seller", target.sellerID, "leader_addr", addr)
+			continue
+		}
+
+		var reply string
+		if err := t.notify("leader update", sellerAddr, "Seller.UpdateLeader", &update, &reply); err != nil {
+			slog.Warn("Failed to notify Seller", "addr", sellerAddr, "err", err)
+			continue
+		}
+
+		slog.Info("Notified Seller about new leader", "addr", sellerAddr, "leader_addr", addr)
+	}
+	t.notifyBuyers(id, addr, term)
+}
+
+// TakeOverLeadership promotes the Trader as the leader for all posts and informs Sellers
+func (t *Trader) TakeOverLeadership(cause string) {
+	t.setPeerUp(false)
+	t.HeartbeatMu.Lock()
+	wasLeader := t.IsLeader
+	if !wasLeader {
+		// Start a term newer than any the failed peer could have used
+		t.startTermLocked(t.peerTerm)
+	}
+	t.setLeader(true, cause)
+	t.HeartbeatMu.Unlock()
+	slog.Info("Taking over all posts as the sole leader")
+	t.prom.takeovers.Inc()
+
+	if !wasLeader {
+		t.dumpHeartbeatHistory()
+		t.leaderChanged(t.Address, t.term())
+	}
+	t.adoptPeer()
+
+	// Notify Sellers about the new leader
+	t.NotifySellers(t.Address)
+}
+
+// adoptPeer takes over the failed peer's post: the stock last replicated from it, which
+// stays separate from our own inventory so it can be returned when the peer comes back,
+// and its Seller registrations
+func (t *Trader) adoptPeer() {
+	t.InventoryMu.Lock()
+	if t.PeerInventory != nil {
+		t.applyLocked(StateEvent{Kind: "adopt", Stock: t.PeerInventory})
+		slog.Info("Adopted the peer's inventory", "items", len(t.PeerInventory))
+		t.PeerInventory = nil
+	}
+	peerRegistry, peerEvicted := t.PeerRegistry, t.peerEvicted
+	t.PeerRegistry, t.peerEvicted = nil, nil
+	accepted := t.peerAccepted
+	t.peerAccepted = nil
+	t.InventoryMu.Unlock()
+	t.adoptRegistry(peerRegistry, peerEvicted)
+	if len(accepted) > 0 {
+		go t.finishPeerRequests(accepted)
+	}
+}
+
+// ReceiveRequest handles requests from Sellers and signs the response. Requests from a
+// Seller must use this Trader's response mode; in push, poll and stream mode the outcome
+// follows separately. Forwarded requests are always answered synchronously.
+func (t *Trader) ReceiveRequest(req *Request, res *Response) error {
+	if err := t.injectFault("ReceiveRequest"); err != nil {
+		return err
+	}
+	span := t.Tracer.Start("Trader.ReceiveRequest", tracing.Server, req.Trace)
+	defer span.End()
+	req.Trace = span.Context()
+	fromSeller := len(req.Path) <= 1
+	mode := req.ResponseMode
+	if mode == "" {
+		mode = responseSync
+	}
+
+	var err error
+	handled := false
+	forged := !t.requestSigned(req)
+	switch {
+	case forged:
+		slog.Warn("Rejected request with an invalid signature", "request", req.RequestID, "seller", req.SellerID, "path", formatPath(req.Path))
+		res.RequestID = req.RequestID
+		res.Status = "Invalid"
+		res.Message = fmt.Sprintf("Trader %d rejected request %d: missing or invalid signature", t.ID, req.RequestID)
+	case fromSeller && mode != t.ResponseMode:
+		slog.Warn("Rejected request in the wrong response mode", "request", req.RequestID, "seller", req.SellerID, "mode", mode, "response_mode", t.ResponseMode)
+		res.RequestID = req.RequestID
+		res.Status = "Invalid"
+		res.Message = fmt.Sprintf("Trader %d delivers responses in %s mode, request asked for %s", t.ID, t.ResponseMode, mode)
+	case fromSeller && mode != responseSync:
+		res.RequestID = req.RequestID
+		t.RequestMu.Lock()
+		err := t.checkQueueLocked()
+		t.RequestMu.Unlock()
+		if err != nil {
+			t.refuseOverloaded(req, res, err.(*OverloadedError))
+			break
+		}
+		t.journalAccepted(req)
+		if err := t.logRequest(req); err != nil {
+			t.journalFinished(req)
+			slog.Warn("Failed to replicate request to the peer", "request", req.RequestID, "seller", req.SellerID, "err", err)
+			res.Status = "Unavailable"
+			res.Message = fmt.Sprintf("Trader %d could not replicate request %d to its peer", t.ID, req.RequestID)
+			break
+		}
+		if !t.dispatch(*req) {
+			t.settleRequest(req)
+			t.journalFinished(req)
+			t.refuseOverloaded(req, res, t.queueFull(cap(t.acceptQueue)))
+			break
+		}
+		res.Status = "Accepted"
+		res.Message = fmt.Sprintf("Request %d accepted; the outcome follows by %s", req.RequestID, mode)
+	default:
+		handled = true
+		err = t.handleRequest(req, res)
+	}
+	if !handled && res.Status != "Accepted" {
+		t.prom.requests.Inc(res.Status) // Refused here; handleRequest counts its own outcomes
+	}
+	if forged {
+		t.sealResponse(res) // A forger gets no session token for the Seller it named
+	} else {
+		t.signResponse(req.SellerID, res)
+	}
+	res.Trace = span.Context()
+	span.Set("a4.request", req.RequestID)
+	span.Set("a4.seller", req.SellerID)
+	span.Set("a4.item", req.Item)
+	span.Set("a4.quantity", req.Quantity)
+	span.Set("a4.post", req.Post)
+	span.Set("a4.status", res.Status)
+	if len(res.Path) > 0 {
+		span.Set("a4.path", formatPath(res.Path))
+	}
+	span.Fail(err)
+	return err
+}
+
+// signedWith reports whether sig is the signature sign computes with the cluster secret;
+// without a secret every call passes
+func (t *Trader) signedWith(sig string, sign func(secret string) string) bool {
+	return t.Secret == "" || hmac.Equal([]byte(sign(t.Secret)), []byte(sig))
+}
+
+// requestSigned reports whether a request carries the cluster secret's signature
+func (t *Trader) requestSigned(req *Request) bool {
+	return t.signedWith(req.Signature, func(secret string) string { return common.RequestSignature(secret, req) })
+}
+
+// signPeerCall returns the signature of the arguments of a call to another Trader, or ""
+// without a cluster secret
+func (t *Trader) signPeerCall(method string, args interface{}) string {
+	if t.Secret == "" {
+		return ""
+	}
+	return common.PeerSignature(t.Secret, method, args)
+}
+
+// peerCallSigned reports whether the arguments of a call from another Trader carry the
+// cluster secret's signature
+func (t *Trader) peerCallSigned(method, sig string, args interface{}) bool {
+	return t.signedWith(sig, func(secret string) string { return common.PeerSignature(secret, method, args) })
+}
+
+// refuseUnsignedPeerCall logs and returns the error for a peer call with a bad signature
+func (t *Trader) refuseUnsignedPeerCall(method string, from int) error {
+	slog.Warn("Rejected peer call with an invalid signature", "method", method, "trader", from)
+	return fmt.Errorf("%s from trader %d: %w", method, from, errUnsigned)
+}
+
+// errUnsigned refuses a call that is not signed with the cluster secret
+var errUnsigned = errors.New("missing or invalid signature")
+
+// signResponse attaches the Trader's identity, a fresh session token and the signature
+func (t *Trader) signResponse(sellerID int, res *Response) {
+	res.Session = t.refreshSession(sellerID)
+	t.sealResponse(res)
+}
+
+// sealResponse attaches the Trader's identity and the signature, without a session
+func (t *Trader) sealResponse(res *Response) {
+	res.TraderID = t.ID
+	res.Signature = ""
+	if t.Secret != "" {
+		res.Signature = common.ResponseSignature(t.Secret, res)
+	}
+}
+
+// handleRequest validates, forwards or processes a request
+func (t *Trader) handleRequest(req *Request, res *Response) error {
+	start := time.Now()
+	defer func() { t.prom.requests.Inc(res.Status) }()
+	fromSeller := len(req.Path) <= 1
+	for _, hop := range req.Path {
+		if hop == traderHop(t.ID) {
+			slog.Warn("Request was forwarded back to this Trader", "request", req.RequestID, "seller", req.SellerID, "path", formatPath(req.Path))
+			break
+		}
+	}
+	t.noteForwardedTerm(req)
+	req.Path = append(req.Path, traderHop(t.ID))
+	res.Path = req.Path
+
+	slog.Info("Received request", "request", req.RequestID, "seller", req.SellerID, "quantity", req.Quantity, "item", req.Item, "post", req.Post, "path", formatPath(req.Path))
+
+	t.RequestMu.Lock()
+	draining := t.Draining
+	t.RequestMu.Unlock()
+	if draining {
+		res.RequestID = req.RequestID
+		res.Status = "Draining"
+		res.Message = fmt.Sprintf("Trader %d is draining and not accepting new requests", t.ID)
+		return nil
+	}
+	if status, msg := t.failoverRefusal(req.DryRun); status != "" {
+		res.RequestID = req.RequestID
+		res.Status, res.Message = status, msg
+		return nil
+	}
+
+	res.RequestID = req.RequestID
+	// A summary stands for deposits the Seller held back instead of sending, so the rate
+	// limit that made it hold them back does not apply
+	if fromSeller && req.Summarizes == 0 && !t.allowRequest(req.SellerID) {
+		slog.Warn("Rate limited request", "request", req.RequestID, "seller", req.SellerID)
+		res.Status = "RateLimited"
+		res.Message = fmt.Sprintf("Seller %d exceeded %.2f requests per second", req.SellerID, t.SellerRate)
+		return nil
+	}
+	if err := validateRequest(req); err != nil {
+		slog.Info("Rejected request", "request", req.RequestID, "seller", req.SellerID, "err", err)
+		res.Status = "Invalid"
+		res.Message = err.Error()
+		return nil
+	}
+	if expired(req) {
+		t.refuseExpired(req, res)
+		return nil
+	}
+	// With the Bully election, requests for posts outside our pair go to the member owning them
+	if owner := t.postOwner(req.Post); owner != 0 {
+		fwd, err := t.forwardToMember(owner, req)
+		if err == nil {
+			*res = *fwd
+			return nil
+		}
+		var routeErr *RoutingError
+		if errors.As(err, &routeErr) {
+			res.Status = "RoutingError"
+			res.Message = routeErr.Error()
+			return nil
+		}
+		slog.Warn("Failed to route request to the owner of its Post", "request", req.RequestID, "trader", owner, "post", req.Post, "err", err)
+		res.Status = "Unavailable"
+		res.Message = fmt.Sprintf("Trader %d owning Post %d is unreachable", owner, req.Post)
+		return nil
+	}
+	if !t.servesPost(req.Post) {
+		slog.Warn("Rejected request for a Post no Trader owns", "request", req.RequestID, "seller", req.SellerID, "post", req.Post)
+		res.Status = "Invalid"
+		res.Message = fmt.Sprintf("no Trader owns Post %d", req.Post)
+		return nil
+	}
+
+	// Split reads for the peer's post are answered from the replica instead of
+	// burdening the peer
+	if req.DryRun && req.ReadReplica && t.servesReplicaReads(req.Post) && t.peerUp() {
+		t.RequestMu.Lock()
+		t.ReplicaReads++
+		t.RequestMu.Unlock()
+		t.replicaRead(req, res)
+		slog.Info(res.Message, "request", req.RequestID, "seller", req.SellerID)
+		return nil
+	}
+
+	// Requests for the peer's post go to the peer while it is alive
+	if req.Post != t.Post && t.peerUp() {
+		fwd, err := t.ForwardRequest(req)
+		if err == nil {
+			*res = *fwd
+			return nil
+		}
+		if err == errExpired {
+			t.refuseExpired(req, res)
+			return nil
+		}
+		var routeErr *RoutingError
+		if errors.As(err, &routeErr) {
+			res.Status = "RoutingError"
+			res.Message = routeErr.Error()
+			return nil
+		}
+		slog.Warn("Serving request locally after forwarding failed", "request", req.RequestID, "post", req.Post)
+	}
+
+	if req.DryRun {
+		if t.overloaded() && t.offload(req, res) {
+			return nil
+		}
+		t.RequestMu.Lock()
+		t.ReadOnlyLocal++
+		t.RequestMu.Unlock()
+		t.dryRun(req, res)
+		return nil
+	}
+
+	if used, ok := t.admit(); !ok {
+		slog.Warn("Refusing request over the memory limit", "request", req.RequestID, "seller", req.SellerID, "bytes", used, "limit", t.MemLimit)
+		res.Status = "CapacityExceeded"
+		res.Message = fmt.Sprintf("Trader %d is at capacity (~%d of %d bytes)", t.ID, used, t.MemLimit)
+		return nil
+	}
+
+	if done, ok := t.committedResponse(req); ok {
+		slog.Info("Request was already committed; repeating its outcome", "request", req.RequestID, "seller", req.SellerID)
+		path := res.Path
+		*res = done
+		res.Path = path
+		return nil
+	}
+	if t.isDuplicate(req) {
+		slog.Info("Request was already committed; not processing it again", "request", req.RequestID, "seller", req.SellerID)
+		res.Status = "Success"
+		res.Message = fmt.Sprintf("Request %d from Seller %d was already processed", req.RequestID, req.SellerID)
+		res.Processed = true
+		return nil
+	}
+
+	if !t.firstDelivery(req) {
+		slog.Info("Dropping repeated at-most-once request", "request", req.RequestID, "seller", req.SellerID)
+		res.Status = "Duplicate"
+		res.Message = fmt.Sprintf("At-most-once request %d from Seller %d was already received; not processing it again", req.RequestID, req.SellerID)
+		return nil
+	}
+
+	// Push, poll and stream requests passed the queue bound when they were accepted
+	accepted := fromSeller && req.ResponseMode != "" && req.ResponseMode != responseSync
+	if err := t.trackRequest(req, !accepted); err != nil {
+		var overloaded *OverloadedError
+		if errors.As(err, &overloaded) {
+			t.refuseOverloaded(req, res, overloaded)
+			return nil
+		}
+		slog.Info("Request is already being processed; not processing a second copy", "request", req.RequestID, "seller", req.SellerID)
+		res.Status = "InProgress"
+		res.Message = fmt.Sprintf("Request %d from Seller %d is already being processed", req.RequestID, req.SellerID)
+		return nil
+	}
+	t.Posts.Received(req.Post)
+	defer t.completeRequest(req, res, start)
+
+	t.journalAccepted(req)
+	defer t.journalFinished(req)
+
+	if err := t.logRequest(req); err != nil {
+		slog.Warn("Failed to replicate request to the peer", "request", req.RequestID, "seller", req.SellerID, "err", err)
+		res.Status = "Unavailable"
+		res.Message = fmt.Sprintf("Trader %d could not replicate request %d to its peer", t.ID, req.RequestID)
+		return nil
+	}
+	defer t.settleRequest(req)
+
+	if !t.workers.acquire(req) {
+		t.refuseExpired(req, res)
+		return nil
+	}
+	defer t.workers.release()
+
+	// Simulate request processing
+	time.Sleep(common.Scaled(processingTime))
+
+	if t.takeCancelled(req) {
+		slog.Info("Request abandoned before processing", "request", req.RequestID, "seller", req.SellerID)
+		res.Status = "Abandoned"
+		res.Message = fmt.Sprintf("Request %d was cancelled by Seller %d", req.RequestID, req.SellerID)
+		return nil
+	}
+
+	if t.Warehouse != "" {
+		if _, err := t.warehouseTxn("Sell", WarehouseTxn{ClientID: req.SellerID, RequestID: req.RequestID, Post: req.Post, Item: req.Item, Quantity: req.Quantity}); err != nil {
+			slog.Warn("Warehouse did not store request", "request", req.RequestID, "seller", req.SellerID, "err", err)
+			res.Status = "WarehouseUnavailable"
+			res.Message = fmt.Sprintf("Trader %d could not reach the warehouse: %v", t.ID, err)
+			return nil
+		}
+	}
+
+	// Stock belongs to the Trader owning the post; deposits for the peer's post are held
+	// for hand-back when we could not forward them. The request leaves the in-flight list
+	// in the same step, so a snapshot never counts it twice.
+	t.RequestMu.Lock()
+	if _, dup := t.deposits[RequestKey{req.SellerID, req.RequestID}]; dup {
+		t.alert(alertDuplicateProcessing, "Committing a request that was already committed", "seller", req.SellerID, "request", req.RequestID,
+			"quantity", req.Quantity, "item", req.Item, "path", formatPath(req.Path))
+	}
+	t.Processed++
+	if req.Summarizes > 0 {
+		t.Summaries++
+		t.Summarized += req.Summarizes
+	}
+	t.untrackRequestLocked(req)
+	t.InventoryMu.Lock()
+	bucket := bucketHandback
+	if req.Post == t.Post {
+		bucket = bucketInventory
+	}
+	t.applyLocked(StateEvent{Kind: "deposit", Bucket: bucket, Item: req.Item, Quantity: req.Quantity,
+		Post: req.Post, SellerID: req.SellerID, RequestID: req.RequestID})
+	t.noteTradeLocked(req.Item, req.Quantity)
+	t.InventoryMu.Unlock()
+	res.Status = "Success"
+	res.Message = depositMessage(req.RequestID, req.Quantity, req.Item, req.SellerID)
+	res.Processed = true
+	t.rememberDepositLocked(req, res, time.Now())
+	t.RequestMu.Unlock()
+
+	t.noteCommitted(req)
+
+	t.exportEvent(Event{
+		Type:      "trade",
+		SellerID:  req.SellerID,
+		RequestID: req.RequestID,
+		Post:      req.Post,
+		Item:      req.Item,
+		Quantity:  req.Quantity,
+	})
+	return nil
+}
+
+// dryRun reports what processing a request would do without mutating any state
+func (t *Trader) dryRun(req *Request, res *Response) {
+	t.InventoryMu.Lock()
+	stock := t.Inventory[req.Item] + t.Adopted[req.Item] + t.Handback[req.Item]
+	t.InventoryMu.Unlock()
+
+	t.reportDryRun(req, res, stock)
+	slog.Info(res.Message, "request", req.RequestID, "seller", req.SellerID)
+}
+
+// reportDryRun fills in a dry-run report for the given stock, quoting the price a
+// purchase of the quantity would be settled at
+func (t *Trader) reportDryRun(req *Request, res *Response, stock int) {
+	res.Status = "DryRun"
+	res.Price, res.PriceRule = t.Pricing.quote(req.Item, req.Quantity)
+	res.Stock = stock
+	res.ETA = common.Scaled(processingTime)
+	res.Message = fmt.Sprintf("Dry run of request %d: %d %s at %s, %d in stock, ETA %v",
+		req.RequestID, req.Quantity, req.Item, describePrice(res.Price, res.PriceRule), res.Stock, res.ETA)
+}
+
+// CancelRequest records that a sender abandoned a request, so it is skipped instead of committed
+func (t *Trader) CancelRequest(args *CancelArgs, reply *string) error {
+	if err := t.injectFault("CancelRequest"); err != nil {
+		return err
+	}
+	if !t.signedWith(args.Signature, func(secret string) string { return common.CancelSignature(secret, args) }) {
+		slog.Warn("Rejected cancellation with an invalid signature", "seller", args.SellerID, "request", args.RequestID)
+		return fmt.Errorf("cancellation of request %d: %w", args.RequestID, errUnsigned)
+	}
+	key := RequestKey{args.SellerID, args.RequestID}
+	if !t.isInFlight(key) {
+		// Nothing to cancel; do not leave an entry behind that is never consumed
+		*reply = "Not in flight"
+		return nil
+	}
+
+	t.RequestMu.Lock()
+	t.Cancelled[RequestKey{args.SellerID, args.RequestID}] = true
+	t.RequestMu.Unlock()
+
+	slog.Info("Seller cancelled request", "seller", args.SellerID, "request", args.RequestID)
+	*reply = "Cancelled"
+	return nil
+}
+
+// takeCancelled reports whether a request was cancelled and, if so, counts it as abandoned
+func (t *Trader) takeCancelled(req *Request) bool {
+	key := RequestKey{req.SellerID, req.RequestID}
+
+	t.RequestMu.Lock()
+	defer t.RequestMu.Unlock()
+	if !t.Cancelled[key] {
+		return false
+	}
+	delete(t.Cancelled, key)
+	t.Abandoned++
+	t.record(StateEvent{Kind: "cancel", Post: req.Post, SellerID: req.SellerID, RequestID: req.RequestID})
+	slog.Info("Abandonment stats", "abandoned", t.Abandoned, "processed", t.Processed)
+	return true
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime/metrics"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"a4/common"
+)
+
+// Benchmarks of the Trader's hot paths
+
+// quiet discards log records until the test or benchmark ends
+func quiet(tb testing.TB) {
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	tb.Cleanup(func() { slog.SetDefault(logger) })
+}
+
+// skipDelays makes simulated delays, such as the processing time of a request, vanish
+// until the benchmark ends, so it measures the code
+func skipDelays(b *testing.B) {
+	scale := common.TimeScale
+	common.TimeScale = 1e9
+	b.Cleanup(func() { common.TimeScale = scale })
+}
+
+// newBenchTrader returns a standalone Trader with no peer, exporter or persistence
+func newBenchTrader() *Trader {
+	return &Trader{
+		ID:           1,
+		Post:         1,
+		Peer:         "localhost:0",
+		Inventory:    make(map[string]int),
+		Cancelled:    make(map[RequestKey]bool),
+		HBHistory:    NewHeartbeatHistory(20),
+		Handback:     make(map[string]int),
+		History:      NewRequestHistory(1000),
+		Registry:     make(map[int]*SellerInfo),
+		leases:       make(map[int]int),
+		faults:       make(map[string]Fault),
+		snapshots:    make(map[int64]*stateSnapshot),
+		forwardSlots: newWorkSlots(1),
+		workers:      newWorkSlots(0),
+		ResponseMode: responseSync,
+		Conns:        &common.Pool{},
+	}
+}
+
+func BenchmarkHandleRequest(b *testing.B) {
+	quiet(b)
+	skipDelays(b)
+	b.ReportAllocs()
+	t := newBenchTrader()
+	items := []string{"apples", "oranges", "pears"}
+	for i := 0; i < b.N; i++ {
+		req := Request{SellerID: i % 16, Post: 1, Item: items[i%len(items)], Quantity: 10, RequestID: i}
+		var res Response
+		t.handleRequest(&req, &res)
+	}
+}
+
+// mutexWait returns the total time goroutines have spent blocked on a sync.Mutex
+func mutexWait() float64 {
+	sample := []metrics.Sample{{Name: "/sync/mutex/wait/total:seconds"}}
+	metrics.Read(sample)
+	return sample[0].Value.Float64()
+}
+
+// BenchmarkHandleRequestContention commits deposits from many goroutines at once, with
+// the processing delay removed so they collide on the Trader's locks as often as they
+// can, for one hot item and for every item the market trades. It reports the time spent
+// waiting for a mutex per request next to ns/op: striping the inventory by item would
+// only pay off if that wait were a sizable share of a request, and if the spread-out
+// case waited much less than the hot one.
+func BenchmarkHandleRequestContention(b *testing.B) {
+	for _, names := range [][]string{{"apples"}, {"apples", "oranges", "pears"}} {
+		b.Run(fmt.Sprintf("items=%d", len(names)), func(b *testing.B) {
+			quiet(b)
+			skipDelays(b)
+			b.ReportAllocs()
+			t := newBenchTrader()
+			var next atomic.Int64
+			b.SetParallelism(16)
+			wait := mutexWait()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					n := int(next.Add(1))
+					req := Request{SellerID: n % 16, Post: 1, Item: names[n%len(names)], Quantity: 1, RequestID: n}
+					var res Response
+					t.handleRequest(&req, &res)
+				}
+			})
+			b.ReportMetric((mutexWait()-wait)*1e9/float64(b.N), "mutex-wait-ns/op")
+			if t.Processed != b.N {
+				b.Fatalf("committed %d of %d deposits", t.Processed, b.N)
+			}
+		})
+	}
+}
+
+func BenchmarkReplicateBatchApply(b *testing.B) {
+	quiet(b)
+	b.ReportAllocs()
+	t := newBenchTrader()
+	batch := &ReplicationBatch{From: 2, Epoch: 1, Entries: make([]ReplicationEntry, 16)}
+	for i := 0; i < b.N; i++ {
+		for j := range batch.Entries {
+			batch.Entries[j] = ReplicationEntry{Seq: int64(i*16 + j + 1), Item: "apples", Quantity: 1}
+		}
+		var reply string
+		t.ReplicateBatch(batch, &reply)
+	}
+}
+
+func BenchmarkReplicationGobRoundTrip(b *testing.B) {
+	b.ReportAllocs()
+	batch := &ReplicationBatch{From: 1, Epoch: 1}
+	for j := 0; j < 16; j++ {
+		batch.Entries = append(batch.Entries, ReplicationEntry{Seq: int64(j + 1), Item: "oranges", Quantity: 5})
+	}
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(batch); err != nil {
+			b.Fatal(err)
+		}
+		var out ReplicationBatch
+		if err := gob.NewDecoder(&buf).Decode(&out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReplicatorAppend(b *testing.B) {
+	quiet(b)
+	b.ReportAllocs()
+	r := NewReplicator(newBenchTrader(), 16, time.Second)
+	for i := 0; i < b.N; i++ {
+		r.Append("pears", 1)
+		if i%maxPendingReplication == 0 {
+			r.mu.Lock()
+			r.pending = r.pending[:0]
+			r.mu.Unlock()
+		}
+	}
+}
+
+func BenchmarkHistoryAdd(b *testing.B) {
+	b.ReportAllocs()
+	h := NewRequestHistory(1000)
+	for i := 0; i < b.N; i++ {
+		h.Add(CompletedRequest{RequestID: i, Item: "apples", Quantity: 1, Status: "Success"})
+	}
+}
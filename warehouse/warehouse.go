@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"a4/common"
+	"a4/config"
+	"a4/metrics"
+	"a4/rpcserver"
+)
+
+// ======= STRUCTS =======
+
+// Txn is one stock movement a Trader routes through the Warehouse. Sell adds Quantity of
+// Item to Post's stock, Buy takes it out.
+type Txn struct {
+	TraderID  int    // Trader routing the transaction
+	ClientID  int    // Seller (Sell) or Buyer (Buy) the transaction is for
+	RequestID int    // That client's request ID; retries reuse it
+	Post      int    // Post whose stock changes
+	Item      string // Item traded
+	Quantity  int    // Positive quantity moved
+}
+
+// TxnReply is the Warehouse's outcome of a transaction
+type TxnReply struct {
+	Status  string // "Success" or "OutOfStock"
+	Message string
+	Stock   int  // Stock of the item at the post after the transaction
+	Repeat  bool // The transaction was already applied; this is its recorded outcome
+}
+
+// QueryArgs selects the stock to report; an empty Item reports every item of the post
+type QueryArgs struct {
+	Post int
+	Item string
+}
+
+// QueryReply is the stock held for a post
+type QueryReply struct {
+	Stock map[string]int
+}
+
+// WarehouseState is what the Warehouse keeps on disk
+type WarehouseState struct {
+	Stock   map[int]map[string]int `json:"stock"`   // By post, then item
+	Applied map[string]TxnReply    `json:"applied"` // Outcomes of recent transactions by txnKey
+	Order   []string               `json:"order"`   // Keys of Applied, oldest first
+}
+
+// Warehouse holds the authoritative stock of every post
+type Warehouse struct {
+	Address string
+	Path    string // File the state is persisted to
+	DevMode bool
+	mu      sync.Mutex
+	state   WarehouseState // (guarded by mu)
+
+	txns *metrics.Counter // Prometheus count of transactions by kind and outcome; nil records nothing
+}
+
+// maxApplied bounds the transaction outcomes kept for answering retries
+const maxApplied = 10000
+
+// shutdownGrace bounds how long a graceful shutdown waits for transactions in progress
+const shutdownGrace = 30 * time.Second
+
+// ======= PERSISTENCE =======
+
+// load restores the state saved by an earlier run, if any
+func (w *Warehouse) load() error {
+	w.state = WarehouseState{Stock: make(map[int]map[string]int), Applied: make(map[string]TxnReply)}
+	data, err := os.ReadFile(w.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &w.state); err != nil {
+		return fmt.Errorf("parsing %s: %v", w.Path, err)
+	}
+	if w.state.Stock == nil {
+		w.state.Stock = make(map[int]map[string]int)
+	}
+	if w.state.Applied == nil {
+		w.state.Applied = make(map[string]TxnReply)
+	}
+	return nil
+}
+
+// saveLocked writes the state to disk, synced before the rename; mu must be held
+func (w *Warehouse) saveLocked() error {
+	data, err := json.Marshal(&w.state)
+	if err != nil {
+		return err
+	}
+	tmp := w.Path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.Path)
+}
+
+// ======= TRANSACTIONS =======
+
+// txnKey identifies a transaction across retries
+func txnKey(kind string, txn *Txn) string {
+	return fmt.Sprintf("%s/%d/%d", kind, txn.ClientID, txn.RequestID)
+}
+
+// apply moves stock for a transaction exactly once and persists the outcome before
+// answering. A retry of an applied transaction gets its recorded outcome back.
+func (w *Warehouse) apply(kind string, txn *Txn, reply *TxnReply) error {
+	if txn.Quantity <= 0 || txn.Item == "" || txn.Post <= 0 {
+		return fmt.Errorf("invalid transaction: %d %q for post %d", txn.Quantity, txn.Item, txn.Post)
+	}
+	key := txnKey(kind, txn)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if done, ok := w.state.Applied[key]; ok {
+		*reply = done
+		reply.Repeat = true
+		return nil
+	}
+
+	stock := w.state.Stock[txn.Post]
+	if kind == "buy" && stock[txn.Item] < txn.Quantity {
+		// Refusals are not recorded, so the Buyer may retry once stock arrives
+		reply.Status = "OutOfStock"
+		reply.Stock = stock[txn.Item]
+		reply.Message = fmt.Sprintf("Only %d %s in stock for Post %d, %d requested", stock[txn.Item], txn.Item, txn.Post, txn.Quantity)
+		return nil
+	}
+
+	if stock == nil {
+		stock = make(map[string]int)
+		w.state.Stock[txn.Post] = stock
+	}
+	delta := txn.Quantity
+	if kind == "buy" {
+		delta = -delta
+	}
+	stock[txn.Item] += delta
+	if stock[txn.Item] == 0 {
+		delete(stock, txn.Item)
+	}
+	reply.Status = "Success"
+	reply.Stock = stock[txn.Item]
+	reply.Message = fmt.Sprintf("%s of %d %s for Post %d applied", kind, txn.Quantity, txn.Item, txn.Post)
+
+	w.state.Applied[key] = *reply
+	w.state.Order = append(w.state.Order, key)
+	if err := w.saveLocked(); err != nil {
+		// Undo, so the caller's retry applies it again instead of it being lost on restart
+		stock[txn.Item] -= delta
+		if stock[txn.Item] == 0 {
+			delete(stock, txn.Item)
+		}
+		delete(w.state.Applied, key)
+		w.state.Order = w.state.Order[:len(w.state.Order)-1]
+		slog.Warn("Failed to persist transaction", "key", key, "err", err)
+		return fmt.Errorf("warehouse could not persist the transaction: %v", err)
+	}
+	if len(w.state.Order) > maxApplied {
+		delete(w.state.Applied, w.state.Order[0])
+		w.state.Order = w.state.Order[1:]
+	}
+
+	slog.Info("Applied transaction", "kind", kind, "quantity", txn.Quantity, "item", txn.Item, "post", txn.Post,
+		"client", txn.ClientID, "request", txn.RequestID, "trader", txn.TraderID, "stock", reply.Stock)
+	return nil
+}
+
+// Sell adds a Seller's deposit to the post's stock
+func (w *Warehouse) Sell(txn *Txn, reply *TxnReply) error {
+	return w.count("sell", reply, w.apply("sell", txn, reply))
+}
+
+// Buy takes a Buyer's purchase out of the post's stock, refusing it if too little is held
+func (w *Warehouse) Buy(txn *Txn, reply *TxnReply) error {
+	return w.count("buy", reply, w.apply("buy", txn, reply))
+}
+
+// count records a transaction's outcome in the Prometheus metrics and passes err through
+func (w *Warehouse) count(kind string, reply *TxnReply, err error) error {
+	switch {
+	case err != nil:
+		w.txns.Inc(kind, "Error")
+	case reply.Repeat:
+		w.txns.Inc(kind, "Repeat")
+	default:
+		w.txns.Inc(kind, reply.Status)
+	}
+	return err
+}
+
+// Query reports the stock held for a post
+func (w *Warehouse) Query(args *QueryArgs, reply *QueryReply) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	reply.Stock = make(map[string]int)
+	for item, qty := range w.state.Stock[args.Post] {
+		if args.Item == "" || item == args.Item {
+			reply.Stock[item] = qty
+		}
+	}
+	return nil
+}
+
+func main() {
+	address := flag.String("address", "localhost:8006", "Warehouse Address")
+	path := flag.String("file", "warehouse.json", "File the stock is persisted to")
+	devMode := flag.Bool("dev", false, "Development mode: listen on a free port if -address is taken")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate served to Traders over TLS and presented to nodes running -mtls (plaintext if empty; needs -tls-key and -ca)")
+	tlsKey := flag.String("tls-key", "", "PEM private key of -tls-cert")
+	caFile := flag.String("ca", "", "PEM certificate of the cluster CA")
+	mtls := flag.Bool("mtls", false, "Refuse any Trader connecting without a certificate signed by -ca (needs -tls-cert)")
+	configPath := flag.String("config", "", "Cluster config file (.yaml, .yml or .toml) setting the flags not given here; A4_<FLAG> environment variables override it")
+	logLevel := flag.String("log-level", "info", "Lowest level logged: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log record format: text (key=value) or json")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on at /metrics (disabled if empty)")
+	pprofAddr := flag.String("pprof-addr", "", "Debug address to serve net/http/pprof profiles on at /debug/pprof/; may equal -metrics-addr (disabled if empty)")
+	flag.Parse()
+	if err := config.Apply(flag.CommandLine, *configPath, "warehouse"); err != nil {
+		log.Fatal(err)
+	}
+
+	parsed, err := common.ParseLogLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	level := new(slog.LevelVar) // Changed by a configuration reload
+	level.Set(parsed)
+	logger, err := common.NewLogger(os.Stderr, *logFormat, level, nil, "node", "warehouse")
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+	go config.Watch(flag.CommandLine, *configPath, "warehouse", []string{"log-level"}, func() error {
+		parsed, err := common.ParseLogLevel(*logLevel)
+		if err != nil {
+			return err
+		}
+		level.Set(parsed)
+		return nil
+	})
+
+	serverTLS, _, err := common.LoadTLS(*tlsCert, *tlsKey, *caFile, *mtls)
+	if err != nil {
+		common.Fatal("Error loading TLS configuration", "err", err)
+	}
+
+	w := &Warehouse{Address: *address, Path: *path, DevMode: *devMode}
+	if err := w.load(); err != nil {
+		common.Fatal("Error loading warehouse state", "err", err)
+	}
+	slog.Info("Loaded stock", "posts", len(w.state.Stock), "file", w.Path)
+
+	endpoints := make(metrics.Endpoints)
+	if *metricsAddr != "" {
+		reg := metrics.NewRegistry()
+		w.txns = reg.Counter("a4_warehouse_transactions_total", "Transactions by kind and outcome", "kind", "status")
+		stock := reg.Gauge("a4_warehouse_stock", "Stock held by post and item", "post", "item")
+		reg.OnScrape(func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			stock.Reset()
+			for post, items := range w.state.Stock {
+				for item, qty := range items {
+					stock.Set(float64(qty), strconv.Itoa(post), item)
+				}
+			}
+		})
+		endpoints.Handle(*metricsAddr, "/metrics", reg)
+	}
+	endpoints.Handle(*pprofAddr, "/debug/pprof/", metrics.Profiles())
+	if err := endpoints.Serve(); err != nil {
+		common.Fatal("Error starting HTTP server", "err", err)
+	}
+	if *metricsAddr != "" {
+		slog.Info("Serving Prometheus metrics", "addr", *metricsAddr)
+	}
+	if *pprofAddr != "" {
+		slog.Info("Serving pprof profiles", "addr", *pprofAddr)
+	}
+
+	srv := rpcserver.New(rpcserver.Options{
+		Name:    "Warehouse",
+		Address: w.Address,
+		DevMode: w.DevMode,
+		TLS:     serverTLS,
+	})
+	if err := srv.Register(w); err != nil {
+		common.Fatal("Error registering Warehouse service", "err", err)
+	}
+	addr, err := srv.Listen()
+	if err != nil {
+		common.Fatal("Error starting RPC server", "addr", w.Address, "err", err)
+	}
+	w.Address = addr
+
+	slog.Info("RPC server started", "addr", w.Address)
+
+	// On SIGINT or SIGTERM, stop accepting connections, let the transactions in progress
+	// finish and exit with the state file written
+	common.OnTerminate(func() {
+		if cut := srv.Shutdown(shutdownGrace); cut > 0 {
+			slog.Warn("Closed connections with calls still in progress", "calls", cut)
+		}
+		w.mu.Lock() // Held until exit, so no transaction is half saved
+		slog.Info("Shut down gracefully", "applied", len(w.state.Applied))
+		os.Exit(0)
+	})
+	srv.Serve()
+	select {} // Serve returns on shutdown, which exits once calls are answered
+}